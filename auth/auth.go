@@ -0,0 +1,176 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"escrow-service/utils"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Role is the kind of caller a credential belongs to
+type Role string
+
+const (
+	RoleAdmin       Role = "admin"
+	RoleMerchant    Role = "merchant"
+	RoleParticipant Role = "participant"
+	RoleArbitrator  Role = "arbitrator"
+)
+
+// Identity is the authenticated caller of a request
+type Identity struct {
+	ID         string `json:"id"`
+	Role       Role   `json:"role"`
+	Name       string `json:"name,omitempty"`
+	MerchantID string `json:"merchant_id,omitempty"`
+	PubKey     string `json:"pubkey,omitempty"`
+}
+
+// HasPubKey reports whether the identity is bound to the given public key
+func (i *Identity) HasPubKey(pubKey string) bool {
+	return i.PubKey != "" && strings.EqualFold(i.PubKey, pubKey)
+}
+
+// In-memory credential store for demo purposes, keyed by the hash of the API key
+var (
+	credentialsMutex sync.RWMutex
+	credentials      = make(map[string]*Identity)
+)
+
+// RegisterAPIKey registers a known API key, e.g. the bootstrap admin key
+func RegisterAPIKey(key string, identity *Identity) {
+	credentialsMutex.Lock()
+	defer credentialsMutex.Unlock()
+
+	credentials[utils.HashToken(key)] = identity
+}
+
+// IssueAPIKey creates a new random API key for the identity
+// The key is returned once; only its hash is stored
+func IssueAPIKey(identity *Identity) (string, error) {
+	id, err := utils.NewID("cred")
+	if err != nil {
+		return "", err
+	}
+
+	key, hash, err := utils.NewAccessToken()
+	if err != nil {
+		return "", err
+	}
+
+	identity.ID = id
+	if identity.Role == RoleMerchant && identity.MerchantID == "" {
+		identity.MerchantID = id
+	}
+
+	credentialsMutex.Lock()
+	credentials[hash] = identity
+	credentialsMutex.Unlock()
+
+	return key, nil
+}
+
+// RevokeAPIKey removes the credential with the given identity ID
+func RevokeAPIKey(id string) bool {
+	credentialsMutex.Lock()
+	defer credentialsMutex.Unlock()
+
+	for hash, identity := range credentials {
+		if identity.ID == id {
+			delete(credentials, hash)
+			return true
+		}
+	}
+
+	return false
+}
+
+// lookupAPIKey finds the identity for an API key
+func lookupAPIKey(key string) (*Identity, bool) {
+	credentialsMutex.RLock()
+	defer credentialsMutex.RUnlock()
+
+	identity, exists := credentials[utils.HashToken(key)]
+	return identity, exists
+}
+
+type contextKey struct{}
+
+// WithIdentity returns a context carrying the authenticated identity
+func WithIdentity(ctx context.Context, identity *Identity) context.Context {
+	return context.WithValue(ctx, contextKey{}, identity)
+}
+
+// FromContext returns the authenticated identity, if any
+func FromContext(ctx context.Context) (*Identity, bool) {
+	identity, ok := ctx.Value(contextKey{}).(*Identity)
+	return identity, ok
+}
+
+// CallerID returns the ID of the request's authenticated identity, or "" for anonymous requests
+func CallerID(r *http.Request) string {
+	if identity, ok := FromContext(r.Context()); ok {
+		return identity.ID
+	}
+	return ""
+}
+
+// credentialFromRequest extracts the API key or session token from the Authorization or X-API-Key header
+func credentialFromRequest(r *http.Request) string {
+	if header := r.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+	}
+
+	return r.Header.Get("X-API-Key")
+}
+
+// Middleware resolves the caller's identity from an API key or session token and stores it in the request context
+// Requests without credentials pass through anonymously, invalid credentials are rejected
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := credentialFromRequest(r)
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		identity, exists := lookupAPIKey(key)
+		if !exists {
+			identity, exists = lookupSession(key)
+		}
+		if !exists {
+			utils.WriteErrorResponse(w, http.StatusUnauthorized, errors.New("invalid credentials"),
+				"The API key or session token is not valid or has expired")
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(WithIdentity(r.Context(), identity)))
+	})
+}
+
+// RequireAuth rejects anonymous requests
+func RequireAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := FromContext(r.Context()); !ok {
+			utils.WriteErrorResponse(w, http.StatusUnauthorized, errors.New("authentication required"),
+				"Provide an API key or session token in the Authorization header")
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// RequireAdmin rejects requests that are not made with an admin credential
+func RequireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return RequireAuth(func(w http.ResponseWriter, r *http.Request) {
+		if identity, _ := FromContext(r.Context()); identity.Role != RoleAdmin {
+			utils.WriteErrorResponse(w, http.StatusForbidden, errors.New("forbidden"), "Admin credentials are required")
+			return
+		}
+
+		next(w, r)
+	})
+}
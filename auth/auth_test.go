@@ -0,0 +1,60 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// serve runs handler behind the middleware with the given Authorization header and returns the status code
+func serve(handler http.HandlerFunc, authorization string) int {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	if authorization != "" {
+		r.Header.Set("Authorization", authorization)
+	}
+	w := httptest.NewRecorder()
+	Middleware(handler).ServeHTTP(w, r)
+	return w.Code
+}
+
+func TestAPIKeyRoles(t *testing.T) {
+	ok := func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) }
+
+	adminKey := "test-admin-key"
+	RegisterAPIKey(adminKey, &Identity{ID: "test-admin", Role: RoleAdmin})
+	participantKey, err := IssueAPIKey(&Identity{Role: RoleParticipant, PubKey: "02aa"})
+	if err != nil {
+		t.Fatalf("failed to issue a key: %v", err)
+	}
+	merchant := &Identity{Role: RoleMerchant}
+	if _, err := IssueAPIKey(merchant); err != nil || merchant.MerchantID != merchant.ID {
+		t.Errorf("expected a merchant to be its own merchant ID, got %q for %q", merchant.MerchantID, merchant.ID)
+	}
+
+	for _, c := range []struct {
+		name          string
+		handler       http.HandlerFunc
+		authorization string
+		code          int
+	}{
+		{"anonymous open route", ok, "", http.StatusOK},
+		{"anonymous", RequireAuth(ok), "", http.StatusUnauthorized},
+		{"invalid key", RequireAuth(ok), "Bearer wrong", http.StatusUnauthorized},
+		{"participant", RequireAuth(ok), "Bearer " + participantKey, http.StatusOK},
+		{"participant on admin route", RequireAdmin(ok), "Bearer " + participantKey, http.StatusForbidden},
+		{"admin", RequireAdmin(ok), "Bearer " + adminKey, http.StatusOK},
+	} {
+		if code := serve(c.handler, c.authorization); code != c.code {
+			t.Errorf("%s: expected %d, got %d", c.name, c.code, code)
+		}
+	}
+
+	// A revoked key is no longer accepted
+	identity, _ := lookupAPIKey(participantKey)
+	if !RevokeAPIKey(identity.ID) {
+		t.Fatalf("expected the key to be revoked")
+	}
+	if code := serve(RequireAuth(ok), "Bearer "+participantKey); code != http.StatusUnauthorized {
+		t.Errorf("expected a revoked key to be refused, got %d", code)
+	}
+}
@@ -0,0 +1,86 @@
+package auth
+
+import (
+	"errors"
+	"escrow-service/utils"
+	"log"
+	"net/http"
+)
+
+// CredentialRequest represents a request to issue an API key
+type CredentialRequest struct {
+	Role       Role   `json:"role"` // "admin", "merchant", "participant", or "arbitrator"
+	Name       string `json:"name,omitempty"`
+	MerchantID string `json:"merchant_id,omitempty"`
+	PubKey     string `json:"pubkey,omitempty"` // required for participants
+}
+
+// IssueCredential issues a new API key (admin only)
+func IssueCredential(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		utils.WriteErrorResponse(w, http.StatusMethodNotAllowed, errors.New("method not allowed"), "Only POST method is allowed")
+		return
+	}
+
+	var req CredentialRequest
+	if err := utils.DecodeJSONBody(r, &req); err != nil {
+		utils.WriteErrorResponse(w, http.StatusBadRequest, err, "Invalid request payload")
+		return
+	}
+
+	// Validate request
+	if req.Role != RoleAdmin && req.Role != RoleMerchant && req.Role != RoleParticipant && req.Role != RoleArbitrator {
+		utils.WriteErrorResponse(w, http.StatusBadRequest, errors.New("invalid role"),
+			"Role must be one of: admin, merchant, participant, or arbitrator")
+		return
+	}
+
+	if req.Role == RoleParticipant && req.PubKey == "" {
+		utils.WriteErrorResponse(w, http.StatusBadRequest, errors.New("missing required fields"),
+			"Participants must be bound to a public key")
+		return
+	}
+
+	identity := &Identity{
+		Role:       req.Role,
+		Name:       req.Name,
+		MerchantID: req.MerchantID,
+		PubKey:     req.PubKey,
+	}
+
+	key, err := IssueAPIKey(identity)
+	if err != nil {
+		utils.WriteErrorResponse(w, http.StatusInternalServerError, err, "Failed to issue API key")
+		return
+	}
+
+	log.Printf("Issued %s credential with ID: %s", identity.Role, identity.ID)
+	utils.WriteJSONResponse(w, http.StatusCreated, map[string]interface{}{
+		"identity": identity,
+		"api_key":  key, // only returned once
+	})
+}
+
+// RevokeCredential revokes an API key by its credential ID (admin only)
+func RevokeCredential(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		utils.WriteErrorResponse(w, http.StatusMethodNotAllowed, errors.New("method not allowed"), "Only POST method is allowed")
+		return
+	}
+
+	var req struct {
+		ID string `json:"id"`
+	}
+	if err := utils.DecodeJSONBody(r, &req); err != nil {
+		utils.WriteErrorResponse(w, http.StatusBadRequest, err, "Invalid request payload")
+		return
+	}
+
+	if !RevokeAPIKey(req.ID) {
+		utils.WriteErrorResponse(w, http.StatusNotFound, errors.New("credential not found"), "Credential with the specified ID does not exist")
+		return
+	}
+
+	log.Printf("Revoked credential with ID: %s", req.ID)
+	utils.WriteJSONResponse(w, http.StatusOK, map[string]string{"id": req.ID, "status": "revoked"})
+}
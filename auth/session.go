@@ -0,0 +1,234 @@
+package auth
+
+import (
+	"errors"
+	"escrow-service/utils"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// challengeTTL is how long a login nonce may be answered
+	challengeTTL = 5 * time.Minute
+	// sessionTTL is how long a session token issued for a proven key stays valid
+	sessionTTL = 15 * time.Minute
+	// maxChallengesPerKey and maxChallenges cap the outstanding nonces, since anyone may request them
+	maxChallengesPerKey = 5
+	maxChallenges       = 10000
+)
+
+// challenge is an outstanding login nonce bound to a public key
+type challenge struct {
+	pubKey    string
+	expiresAt time.Time
+}
+
+// session is a short-lived token bound to a proven public key
+type session struct {
+	identity  *Identity
+	expiresAt time.Time
+}
+
+// In-memory challenge and session stores for demo purposes
+var (
+	sessionsMutex   sync.Mutex
+	challenges      = make(map[string]*challenge) // keyed by nonce
+	challengesByKey = make(map[string]int)        // outstanding nonces of each public key
+	sessions        = make(map[string]*session)   // keyed by token hash
+)
+
+// ChallengeRequest represents a request for a login nonce
+type ChallengeRequest struct {
+	PubKey string `json:"pubkey"`
+}
+
+// VerifyChallengeRequest represents a signed answer to a login challenge
+type VerifyChallengeRequest struct {
+	PubKey        string `json:"pubkey"`
+	Nonce         string `json:"nonce"`
+	Signature     string `json:"signature"`                // base64 signmessage or BIP322 signature
+	SignatureType string `json:"signature_type,omitempty"` // "legacy" or "bip322", detected if empty
+}
+
+// lookupSession finds the identity for a session token, dropping it if expired
+func lookupSession(token string) (*Identity, bool) {
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+
+	hash := utils.HashToken(token)
+	s, exists := sessions[hash]
+	if !exists {
+		return nil, false
+	}
+
+	if time.Now().After(s.expiresAt) {
+		delete(sessions, hash)
+		return nil, false
+	}
+
+	return s.identity, true
+}
+
+// takeChallenge removes a challenge, returning it if it was outstanding; callers must hold sessionsMutex
+func takeChallenge(nonce string) (*challenge, bool) {
+	c, exists := challenges[nonce]
+	if !exists {
+		return nil, false
+	}
+
+	delete(challenges, nonce)
+	if challengesByKey[c.pubKey]--; challengesByKey[c.pubKey] <= 0 {
+		delete(challengesByKey, c.pubKey)
+	}
+	return c, true
+}
+
+// evictExpiredSessions drops expired challenges and sessions
+func evictExpiredSessions(now time.Time) {
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+
+	for nonce, c := range challenges {
+		if now.After(c.expiresAt) {
+			takeChallenge(nonce)
+		}
+	}
+
+	for hash, s := range sessions {
+		if now.After(s.expiresAt) {
+			delete(sessions, hash)
+		}
+	}
+}
+
+// StartSessionJanitor drops expired challenges and sessions every interval in the background
+func StartSessionJanitor(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for now := range ticker.C {
+			evictExpiredSessions(now)
+		}
+	}()
+}
+
+// IssueChallenge issues a one-time nonce for a public key to sign
+func IssueChallenge(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		utils.WriteErrorResponse(w, http.StatusMethodNotAllowed, errors.New("method not allowed"), "Only POST method is allowed")
+		return
+	}
+
+	var req ChallengeRequest
+	if err := utils.DecodeJSONBody(r, &req); err != nil {
+		utils.WriteErrorResponse(w, http.StatusBadRequest, err, "Invalid request payload")
+		return
+	}
+
+	if req.PubKey == "" {
+		utils.WriteErrorResponse(w, http.StatusBadRequest, errors.New("missing required fields"), "Public key is required")
+		return
+	}
+
+	if err := utils.ValidatePublicKey(req.PubKey); err != nil {
+		utils.WriteErrorResponse(w, http.StatusBadRequest, err, "Public key must be a hex-encoded secp256k1 key")
+		return
+	}
+
+	nonce, _, err := utils.NewAccessToken()
+	if err != nil {
+		utils.WriteErrorResponse(w, http.StatusInternalServerError, err, "Failed to generate nonce")
+		return
+	}
+
+	pubKey := strings.ToLower(req.PubKey)
+	expiresAt := time.Now().Add(challengeTTL)
+
+	sessionsMutex.Lock()
+	if len(challenges) >= maxChallenges || challengesByKey[pubKey] >= maxChallengesPerKey {
+		sessionsMutex.Unlock()
+		utils.WriteErrorResponse(w, http.StatusTooManyRequests, errors.New("too many challenges"),
+			"Too many outstanding challenges, answer or let one expire before requesting another")
+		return
+	}
+	challenges[nonce] = &challenge{pubKey: pubKey, expiresAt: expiresAt}
+	challengesByKey[pubKey]++
+	sessionsMutex.Unlock()
+
+	utils.WriteJSONResponse(w, http.StatusCreated, map[string]interface{}{
+		"pubkey":     pubKey,
+		"nonce":      nonce,
+		"message":    utils.LoginMessage(pubKey, nonce),
+		"expires_at": expiresAt,
+	})
+}
+
+// VerifyChallenge checks a signed challenge and returns a session token bound to the public key
+func VerifyChallenge(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		utils.WriteErrorResponse(w, http.StatusMethodNotAllowed, errors.New("method not allowed"), "Only POST method is allowed")
+		return
+	}
+
+	var req VerifyChallengeRequest
+	if err := utils.DecodeJSONBody(r, &req); err != nil {
+		utils.WriteErrorResponse(w, http.StatusBadRequest, err, "Invalid request payload")
+		return
+	}
+
+	if req.PubKey == "" || req.Nonce == "" || req.Signature == "" {
+		utils.WriteErrorResponse(w, http.StatusBadRequest, errors.New("missing required fields"),
+			"Public key, nonce, and signature are required")
+		return
+	}
+
+	pubKey := strings.ToLower(req.PubKey)
+
+	// Nonces are single use, so consume it before verifying
+	sessionsMutex.Lock()
+	c, exists := takeChallenge(req.Nonce)
+	sessionsMutex.Unlock()
+
+	if !exists || time.Now().After(c.expiresAt) || c.pubKey != pubKey {
+		utils.WriteErrorResponse(w, http.StatusUnauthorized, errors.New("invalid challenge"),
+			"The nonce is unknown, expired, or was issued for a different public key")
+		return
+	}
+
+	message := utils.LoginMessage(pubKey, req.Nonce)
+	if err := utils.VerifySignedMessage(pubKey, message, req.Signature, req.SignatureType); err != nil {
+		utils.WriteErrorResponse(w, http.StatusUnauthorized, err, "Signature does not prove control of the public key")
+		return
+	}
+
+	token, hash, err := utils.NewAccessToken()
+	if err != nil {
+		utils.WriteErrorResponse(w, http.StatusInternalServerError, err, "Failed to issue session token")
+		return
+	}
+
+	sessionID, err := utils.NewID("session")
+	if err != nil {
+		utils.WriteErrorResponse(w, http.StatusInternalServerError, err, "Failed to issue session token")
+		return
+	}
+
+	identity := &Identity{ID: sessionID, Role: RoleParticipant, PubKey: pubKey}
+	expiresAt := time.Now().Add(sessionTTL)
+
+	sessionsMutex.Lock()
+	sessions[hash] = &session{identity: identity, expiresAt: expiresAt}
+	sessionsMutex.Unlock()
+
+	log.Printf("Issued session %s for public key %s", sessionID, pubKey)
+	utils.WriteJSONResponse(w, http.StatusOK, map[string]interface{}{
+		"token":      token,
+		"token_type": "Bearer",
+		"identity":   identity,
+		"expires_at": expiresAt,
+	})
+}
@@ -0,0 +1,86 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"escrow-service/utils"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/ecdsa"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// postJSON sends body as JSON to handler and decodes the JSON response
+func postJSON(t *testing.T, handler http.HandlerFunc, body interface{}) (int, map[string]interface{}) {
+	t.Helper()
+
+	payload, _ := json.Marshal(body)
+	r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(payload))
+	w := httptest.NewRecorder()
+	handler(w, r)
+
+	var response map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("invalid response %q: %v", w.Body.String(), err)
+	}
+	return w.Code, response
+}
+
+// signMessage signs message with key as Bitcoin Core's signmessage does
+func signMessage(key *btcec.PrivateKey, message string) string {
+	var buf bytes.Buffer
+	wire.WriteVarString(&buf, 0, "Bitcoin Signed Message:\n")
+	wire.WriteVarString(&buf, 0, message)
+	sig, _ := ecdsa.SignCompact(key, chainhash.DoubleHashB(buf.Bytes()), true)
+	return base64.StdEncoding.EncodeToString(sig)
+}
+
+func TestChallengeLimits(t *testing.T) {
+	key, _ := btcec.NewPrivateKey()
+	pubKey := hex.EncodeToString(key.PubKey().SerializeCompressed())
+
+	if code, _ := postJSON(t, IssueChallenge, ChallengeRequest{PubKey: "not-a-key"}); code != http.StatusBadRequest {
+		t.Errorf("expected an invalid key to be refused with 400, got %d", code)
+	}
+
+	var nonces []string
+	for i := 0; i < maxChallengesPerKey; i++ {
+		code, response := postJSON(t, IssueChallenge, ChallengeRequest{PubKey: pubKey})
+		if code != http.StatusCreated {
+			t.Fatalf("expected challenge %d to be issued, got %d: %v", i+1, code, response)
+		}
+		nonces = append(nonces, response["nonce"].(string))
+	}
+	if code, _ := postJSON(t, IssueChallenge, ChallengeRequest{PubKey: pubKey}); code != http.StatusTooManyRequests {
+		t.Fatalf("expected the challenges of a key to be capped with 429, got %d", code)
+	}
+
+	// Answering a challenge frees its slot
+	code, response := postJSON(t, VerifyChallenge, VerifyChallengeRequest{
+		PubKey:    pubKey,
+		Nonce:     nonces[0],
+		Signature: signMessage(key, utils.LoginMessage(pubKey, nonces[0])),
+	})
+	if code != http.StatusOK || response["token"] == "" {
+		t.Fatalf("expected a session for the signed challenge, got %d: %v", code, response)
+	}
+	if code, _ := postJSON(t, IssueChallenge, ChallengeRequest{PubKey: pubKey}); code != http.StatusCreated {
+		t.Errorf("expected a challenge once one was answered, got %d", code)
+	}
+
+	// Expired challenges are dropped by the janitor, freeing theirs
+	evictExpiredSessions(time.Now().Add(challengeTTL + time.Second))
+	sessionsMutex.Lock()
+	outstanding := challengesByKey[pubKey]
+	sessionsMutex.Unlock()
+	if outstanding != 0 {
+		t.Errorf("expected no outstanding challenge after eviction, got %d", outstanding)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"escrow-service/escrow"
+	"escrow-service/utils"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// signerd is a standalone signing daemon that holds the escrow service key
+// so the public API process never needs access to it
+
+// Bearer token authentication middleware
+func authMiddleware(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		provided := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+			utils.WriteErrorResponse(w, http.StatusUnauthorized, errors.New("unauthorized"), "Invalid signer token")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Define signer routes
+func setupRoutes(signer escrow.Signer) *http.ServeMux {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/sign", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			utils.WriteErrorResponse(w, http.StatusMethodNotAllowed, errors.New("method not allowed"), "Only POST method is allowed")
+			return
+		}
+
+		var req escrow.SignRequest
+		if err := utils.DecodeJSONBody(r, &req); err != nil {
+			utils.WriteErrorResponse(w, http.StatusBadRequest, err, "Invalid request payload")
+			return
+		}
+
+		if req.PSBT == "" {
+			utils.WriteErrorResponse(w, http.StatusBadRequest, errors.New("missing required fields"), "PSBT is required")
+			return
+		}
+
+		signed, err := signer.SignPSBTInput(req.PSBT, req.InputIndex)
+		if err != nil {
+			utils.WriteErrorResponse(w, http.StatusBadRequest, err, "Failed to sign PSBT input")
+			return
+		}
+
+		log.Printf("Signed PSBT input %d", req.InputIndex)
+		utils.WriteJSONResponse(w, http.StatusOK, escrow.SignResponse{PSBT: signed})
+	})
+
+	mux.HandleFunc("/pubkey", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			utils.WriteErrorResponse(w, http.StatusMethodNotAllowed, errors.New("method not allowed"), "Only GET method is allowed")
+			return
+		}
+
+		pubKey, err := signer.PublicKey()
+		if err != nil {
+			utils.WriteErrorResponse(w, http.StatusInternalServerError, err, "Failed to derive public key")
+			return
+		}
+
+		utils.WriteJSONResponse(w, http.StatusOK, escrow.PublicKeyResponse{PublicKey: pubKey})
+	})
+
+	return mux
+}
+
+func main() {
+	privateKey := os.Getenv("SIGNER_PRIVATE_KEY")
+	if privateKey == "" {
+		log.Fatal("SIGNER_PRIVATE_KEY must be set to the escrow service WIF private key")
+	}
+
+	token := os.Getenv("SIGNER_TOKEN")
+	if token == "" {
+		log.Fatal("SIGNER_TOKEN must be set to the shared API token")
+	}
+
+	signer := escrow.NewLocalSigner(privateKey)
+	if _, err := signer.PublicKey(); err != nil {
+		log.Fatalf("Invalid signer private key: %v", err)
+	}
+
+	// Get port from environment variable or use default
+	port := os.Getenv("SIGNER_PORT")
+	if port == "" {
+		port = "8081"
+	}
+
+	log.Printf("Starting signer daemon on port %s...", port)
+	if err := http.ListenAndServe(":"+port, authMiddleware(token, setupRoutes(signer))); err != nil {
+		log.Fatalf("Failed to start signer daemon: %v", err)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"escrow-service/escrow"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const (
+	testPrivateKey = "cTbvZEpbBYM4T9WbzoiyQcZfqBg8YwdwUm1gUMTXQWCeTs2K6HPo"
+	testPublicKey  = "03b26e6806273fa2cb19a7af87c6d522c2efcd86bc352b6e25b0ec9a014af0c9ce"
+	testToken      = "signer-token"
+)
+
+// startDaemon serves the signer daemon's routes for testPrivateKey and counts the requests it receives by path
+func startDaemon(t *testing.T) (*httptest.Server, func(path string) int) {
+	t.Helper()
+
+	var mu sync.Mutex
+	requests := make(map[string]int)
+	handler := authMiddleware(testToken, setupRoutes(escrow.NewLocalSigner(testPrivateKey)))
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests[r.URL.Path]++
+		mu.Unlock()
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	return server, func(path string) int {
+		mu.Lock()
+		defer mu.Unlock()
+		return requests[path]
+	}
+}
+
+func TestRemoteSigner(t *testing.T) {
+	server, requests := startDaemon(t)
+	signer := escrow.NewRemoteSigner(server.URL+"/", testToken)
+
+	// The public key is fetched once and cached
+	for i := 0; i < 3; i++ {
+		pubKey, err := signer.PublicKey()
+		if err != nil {
+			t.Fatalf("failed to get the public key: %v", err)
+		}
+		if pubKey != testPublicKey {
+			t.Errorf("expected public key %s, got %s", testPublicKey, pubKey)
+		}
+	}
+	if got := requests("/pubkey"); got != 1 {
+		t.Errorf("expected the public key to be fetched once, got %d requests", got)
+	}
+
+	signed, err := signer.SignPSBTInput("70736274ff", 0)
+	if err != nil {
+		t.Fatalf("failed to sign: %v", err)
+	}
+	if signed != "signed_70736274ff" {
+		t.Errorf("expected the daemon's signature, got %q", signed)
+	}
+
+	// Errors reported by the daemon reach the caller
+	if _, err := signer.SignPSBTInput("", 0); err == nil || !strings.Contains(err.Error(), "status 400") {
+		t.Errorf("expected an empty PSBT to be refused with 400, got %v", err)
+	}
+	if _, err := signer.SignPSBTInput("70736274ff", -1); err == nil || !strings.Contains(err.Error(), "invalid input index") {
+		t.Errorf("expected a negative input index to be refused, got %v", err)
+	}
+}
+
+func TestRemoteSignerToken(t *testing.T) {
+	server, requests := startDaemon(t)
+	signer := escrow.NewRemoteSigner(server.URL, "wrong-token")
+
+	if _, err := signer.PublicKey(); err == nil || !strings.Contains(err.Error(), "status 401") {
+		t.Errorf("expected a wrong token to be refused with 401, got %v", err)
+	}
+	if _, err := signer.SignPSBTInput("70736274ff", 0); err == nil || !strings.Contains(err.Error(), "status 401") {
+		t.Errorf("expected a wrong token to be refused with 401, got %v", err)
+	}
+
+	// A failed fetch is not cached, the next call asks the daemon again
+	if _, err := signer.PublicKey(); err == nil {
+		t.Errorf("expected a wrong token to be refused again")
+	}
+	if got := requests("/pubkey"); got != 2 {
+		t.Errorf("expected 2 public key requests, got %d", got)
+	}
+}
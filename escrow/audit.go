@@ -0,0 +1,205 @@
+package escrow
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"escrow-service/auth"
+	"escrow-service/utils"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// AuditEvent records one change to an escrow. Each event holds the hash of the one before it,
+// so altering, removing or reordering any event breaks the chain from that point on
+type AuditEvent struct {
+	Sequence   int64            `json:"sequence"` // position in the escrow's chain, from 1
+	EscrowID   string           `json:"escrow_id"`
+	Timestamp  time.Time        `json:"timestamp"`
+	Actor      string           `json:"actor"` // party, role or "system"
+	Action     string           `json:"action"`
+	FromStatus Status           `json:"from_status,omitempty"`
+	ToStatus   Status           `json:"to_status"`
+	Detail     string           `json:"detail,omitempty"`
+	Request    *RequestMetadata `json:"request,omitempty"` // the API request that caused the event, if any
+	PrevHash   string           `json:"prev_hash"`
+	Hash       string           `json:"hash"`
+}
+
+// RequestMetadata identifies the API request behind an audit event
+type RequestMetadata struct {
+	Method         string `json:"method"`
+	Path           string `json:"path"`
+	IdentityID     string `json:"identity_id,omitempty"`
+	Role           string `json:"role,omitempty"`
+	RemoteAddr     string `json:"remote_addr,omitempty"`
+	UserAgent      string `json:"user_agent,omitempty"`
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+}
+
+// The audit log is append-only: events are never changed or removed once recorded
+// An escrow's lock is taken before auditMutex, never after
+var (
+	auditMutex sync.Mutex
+	auditLog   = make(map[string][]AuditEvent) // events by escrow ID, in order
+)
+
+// hashEvent returns the hex SHA-256 of the event's JSON encoding without its own hash
+func hashEvent(event AuditEvent) string {
+	event.Hash = ""
+	encoded, _ := json.Marshal(event)
+	sum := sha256.Sum256(encoded)
+	return hex.EncodeToString(sum[:])
+}
+
+// requestMetadata captures the parts of r worth keeping in the audit log
+func requestMetadata(r *http.Request) *RequestMetadata {
+	metadata := &RequestMetadata{
+		Method:         r.Method,
+		Path:           r.URL.Path,
+		RemoteAddr:     r.RemoteAddr,
+		UserAgent:      r.UserAgent(),
+		IdempotencyKey: r.Header.Get(utils.IdempotencyKeyHeader),
+	}
+	if identity, ok := auth.FromContext(r.Context()); ok {
+		metadata.IdentityID, metadata.Role = identity.ID, string(identity.Role)
+	}
+	return metadata
+}
+
+// appendEvent adds an event for an action that moved the escrow from the given status to its current one
+// Callers hold the escrow's lock and record the event once the change can no longer fail
+func (e *Escrow) appendEvent(now time.Time, actor, action string, from Status, detail string, request *RequestMetadata) {
+	auditMutex.Lock()
+	defer auditMutex.Unlock()
+
+	events := auditLog[e.ID]
+	var previous Status
+	if len(events) > 0 {
+		previous = events[len(events)-1].ToStatus
+	}
+	event := AuditEvent{
+		Sequence:   int64(len(events)) + 1,
+		EscrowID:   e.ID,
+		Timestamp:  now,
+		Actor:      actor,
+		Action:     action,
+		FromStatus: from,
+		ToStatus:   e.Status,
+		Detail:     detail,
+		Request:    request,
+	}
+	if len(events) > 0 {
+		event.PrevHash = events[len(events)-1].Hash
+	}
+	event.Hash = hashEvent(event)
+
+	auditLog[e.ID] = append(events, event)
+	e.publishEvent(event, previous)
+}
+
+// recordHistory records an action taken by the service itself, such as the scheduler
+func (e *Escrow) recordHistory(now time.Time, actor, action string, from Status, detail string) {
+	e.appendEvent(now, actor, action, from, detail, nil)
+}
+
+// recordRequest records an action taken through an API request by actor, a party or role
+func (e *Escrow) recordRequest(r *http.Request, actor, action string, from Status, detail string) {
+	e.appendEvent(time.Now(), actor, action, from, detail, requestMetadata(r))
+}
+
+// requestActor returns the role of the caller of r, for actions not taken as a party
+func requestActor(r *http.Request) string {
+	if identity, ok := auth.FromContext(r.Context()); ok {
+		return string(identity.Role)
+	}
+	return "anonymous"
+}
+
+// escrowEvents returns a copy of the escrow's audit events
+func escrowEvents(escrowID string) []AuditEvent {
+	auditMutex.Lock()
+	defer auditMutex.Unlock()
+
+	return append([]AuditEvent{}, auditLog[escrowID]...)
+}
+
+// visibleEvents returns the events as the caller of r may see them
+// The request metadata identifies callers and where they connect from, so only admins see it
+func visibleEvents(r *http.Request, events []AuditEvent) []AuditEvent {
+	if identity, ok := auth.FromContext(r.Context()); ok && identity.Role == auth.RoleAdmin {
+		return events
+	}
+
+	redacted := make([]AuditEvent, len(events))
+	for i, event := range events {
+		event.Request = nil
+		redacted[i] = event
+	}
+	return redacted
+}
+
+// verifyEvents checks the hash chain of an escrow's events, returning the sequence of the first broken event
+func verifyEvents(events []AuditEvent) (int64, error) {
+	prevHash := ""
+	for i, event := range events {
+		switch {
+		case event.Sequence != int64(i)+1:
+			return event.Sequence, fmt.Errorf("event %d is out of sequence", i+1)
+		case event.PrevHash != prevHash:
+			return event.Sequence, fmt.Errorf("event %d does not follow the previous event's hash", event.Sequence)
+		case event.Hash != hashEvent(event):
+			return event.Sequence, fmt.Errorf("event %d does not match its hash", event.Sequence)
+		}
+		prevHash = event.Hash
+	}
+	return 0, nil
+}
+
+// GetHistory returns the audit events of an escrow, and whether their hash chain is intact
+func GetHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		utils.WriteErrorResponse(w, http.StatusMethodNotAllowed, errors.New("method not allowed"), "Only GET method is allowed")
+		return
+	}
+
+	escrowID := r.URL.Query().Get("id")
+	if escrowID == "" {
+		utils.WriteErrorResponse(w, http.StatusBadRequest, errors.New("missing required fields"), "Escrow ID is required")
+		return
+	}
+
+	var events []AuditEvent
+	err := viewEscrow(escrowID, func(escrow *Escrow) error {
+		if err := authorizeRead(r, escrow); err != nil {
+			return err
+		}
+		events = escrowEvents(escrow.ID)
+		return nil
+	})
+	if err != nil {
+		writeUpdateError(w, err)
+		return
+	}
+
+	// The chain is checked on the full events, the hashes cover the request metadata
+	response := map[string]interface{}{
+		"escrow_id":   escrowID,
+		"events":      visibleEvents(r, events),
+		"count":       len(events),
+		"chain_valid": true,
+	}
+	if len(events) > 0 {
+		response["head_hash"] = events[len(events)-1].Hash
+	}
+	if sequence, err := verifyEvents(events); err != nil {
+		response["chain_valid"] = false
+		response["broken_at"] = sequence
+		response["chain_error"] = err.Error()
+	}
+
+	utils.WriteJSONResponse(w, http.StatusOK, response)
+}
@@ -0,0 +1,89 @@
+package escrow
+
+import (
+	"encoding/json"
+	"escrow-service/auth"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// getAs calls a GET handler with query as identity and decodes the JSON response
+func getAs(t *testing.T, handler http.HandlerFunc, identity *auth.Identity, query string) map[string]interface{} {
+	t.Helper()
+
+	r := httptest.NewRequest(http.MethodGet, "/?"+query, nil)
+	r = r.WithContext(auth.WithIdentity(r.Context(), identity))
+	w := httptest.NewRecorder()
+	handler(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var response map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("invalid response: %v", err)
+	}
+	return response
+}
+
+// requestsShown counts the events carrying request metadata
+func requestsShown(events interface{}) int {
+	shown := 0
+	for _, event := range events.([]interface{}) {
+		if _, ok := event.(map[string]interface{})["request"]; ok {
+			shown++
+		}
+	}
+	return shown
+}
+
+func TestRequestMetadataShownToAdminsOnly(t *testing.T) {
+	id, _ := fundTestEscrow(t, 60000)
+
+	history := getAs(t, GetHistory, testAdmin, "id="+id)
+	if requestsShown(history["events"]) == 0 {
+		t.Fatalf("expected admins to see the request metadata")
+	}
+
+	history = getAs(t, GetHistory, testBuyer, "id="+id)
+	if shown := requestsShown(history["events"]); shown != 0 {
+		t.Errorf("expected no request metadata for the buyer, got %d events with it", shown)
+	}
+	if history["chain_valid"] != true {
+		t.Errorf("expected the chain to be valid, got %v", history["chain_error"])
+	}
+
+	details := getAs(t, GetEscrow, testBuyer, "id="+id)
+	if shown := requestsShown(details["history"]); shown != 0 {
+		t.Errorf("expected no request metadata in the buyer's escrow details, got %d events with it", shown)
+	}
+}
+
+func TestHistoryEventsCarryStatuses(t *testing.T) {
+	id, _ := fundTestEscrow(t, 60000)
+	for _, party := range []string{"buyer", "seller"} {
+		identity, privateKey, publicKey := testBuyer, testBuyerPrivKey, testBuyerPubKey
+		if party == "seller" {
+			identity, privateKey, publicKey = testSeller, testSellerPrivKey, testSellerPubKey
+		}
+		mustCall(t, ReleaseEscrow, identity, ReleaseRequest{
+			EscrowID:   id,
+			PrivateKey: privateKey,
+			Signature:  "signature",
+			Party:      party,
+			PublicKey:  publicKey,
+		}, http.StatusOK)
+	}
+
+	// Only the creation has no status before it
+	for _, event := range escrowEvents(id) {
+		if event.ToStatus == "" || (event.FromStatus == "" && event.Action != "created") {
+			t.Errorf("expected %s to record the status before and after, got %q -> %q",
+				event.Action, event.FromStatus, event.ToStatus)
+		}
+	}
+	if !containsAction(id, "payout_created") {
+		t.Errorf("expected payout_created in the history, got %v", historyActions(id))
+	}
+}
@@ -0,0 +1,227 @@
+package escrow
+
+import (
+	"errors"
+	"escrow-service/auth"
+	"escrow-service/utils"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// partyPubKey returns the public key registered on the escrow for a party
+func partyPubKey(escrow *Escrow, party string) string {
+	switch party {
+	case "buyer":
+		return escrow.BuyerPubKey
+	case "seller":
+		return escrow.SellerPubKey
+	case "escrow":
+		return escrow.EscrowPubKey
+	}
+	return ""
+}
+
+// callerIdentity returns the authenticated identity or an unauthorized error
+func callerIdentity(r *http.Request) (*auth.Identity, error) {
+	identity, ok := auth.FromContext(r.Context())
+	if !ok {
+		return nil, &requestError{http.StatusUnauthorized, errors.New("authentication required"),
+			"Provide an API key or session token in the Authorization header"}
+	}
+	return identity, nil
+}
+
+// authorizeParty checks that the caller may act as the given party on the escrow
+// Participants must hold the party's registered key; the escrow party is the service, so admins act for it
+func authorizeParty(r *http.Request, escrow *Escrow, party string) error {
+	identity, err := callerIdentity(r)
+	if err != nil {
+		return err
+	}
+
+	if party == "escrow" && identity.Role == auth.RoleAdmin {
+		return nil
+	}
+
+	if identity.HasPubKey(partyPubKey(escrow, party)) {
+		return nil
+	}
+
+	return &requestError{http.StatusForbidden, errors.New("forbidden"),
+		fmt.Sprintf("Caller is not authorized to act as %s on this escrow", party)}
+}
+
+// authorizeAccess checks that the caller is a party to the escrow, its merchant, an admin,
+// or an arbitrator once the escrow is disputed
+func authorizeAccess(r *http.Request, escrow *Escrow) error {
+	identity, err := callerIdentity(r)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case identity.Role == auth.RoleAdmin:
+		return nil
+	case identity.Role == auth.RoleArbitrator && escrow.Dispute != nil:
+		return nil
+	case identity.Role == auth.RoleMerchant && escrow.MerchantID != "" && identity.MerchantID == escrow.MerchantID:
+		return nil
+	case identity.HasPubKey(escrow.BuyerPubKey), identity.HasPubKey(escrow.SellerPubKey), identity.HasPubKey(escrow.EscrowPubKey):
+		return nil
+	}
+
+	return &requestError{http.StatusForbidden, errors.New("forbidden"), "Caller is not a party to this escrow"}
+}
+
+// authorizeArbitrator checks that the caller may decide disputes
+func authorizeArbitrator(r *http.Request) (*auth.Identity, error) {
+	identity, err := callerIdentity(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if identity.Role != auth.RoleArbitrator && identity.Role != auth.RoleAdmin {
+		return nil, &requestError{http.StatusForbidden, errors.New("forbidden"),
+			"Only arbitrators and admins can decide disputes"}
+	}
+
+	return identity, nil
+}
+
+// authorizeRead checks that the caller may read the escrow
+// Escrows created with require_access_token accept the token in the X-Escrow-Token header or
+// access_token query parameter; otherwise the caller must be an authenticated party
+func authorizeRead(r *http.Request, escrow *Escrow) error {
+	token := r.Header.Get("X-Escrow-Token")
+	if token == "" {
+		token = r.URL.Query().Get("access_token")
+	}
+
+	if escrow.accessTokenHash != "" && token != "" {
+		if !utils.TokenMatches(token, escrow.accessTokenHash) {
+			return &requestError{http.StatusForbidden, errors.New("invalid access token"),
+				"The access token is not valid for this escrow"}
+		}
+		return nil
+	}
+
+	return authorizeAccess(r, escrow)
+}
+
+// authorizeCreate checks that the caller may open an escrow with these parties
+// Participants may only create escrows they are the buyer or seller of
+func authorizeCreate(identity *auth.Identity, req EscrowRequest) error {
+	if identity.Role != auth.RoleParticipant {
+		return nil
+	}
+
+	if identity.HasPubKey(req.BuyerPubKey) || identity.HasPubKey(req.SellerPubKey) {
+		return nil
+	}
+
+	return &requestError{http.StatusForbidden, errors.New("forbidden"),
+		"Participants can only create escrows they are the buyer or seller of"}
+}
+
+// resolvePublicKey fills in the request's public key from a key-bound session when it is omitted
+func resolvePublicKey(r *http.Request, pubKey string) string {
+	if pubKey != "" {
+		return pubKey
+	}
+
+	if identity, ok := auth.FromContext(r.Context()); ok {
+		return identity.PubKey
+	}
+
+	return ""
+}
+
+// checkPartyKey verifies that the public key in a request is the one registered for the party
+func checkPartyKey(escrow *Escrow, party, pubKey string) error {
+	if !strings.EqualFold(partyPubKey(escrow, party), pubKey) {
+		return &requestError{http.StatusBadRequest, errors.New("public key mismatch"),
+			fmt.Sprintf("Public key does not match the %s key registered on this escrow", party)}
+	}
+	return nil
+}
+
+// signingParties are the parties whose signatures count towards a 2-of-3 payout
+var signingParties = []string{"buyer", "seller", "escrow"}
+
+// signingParty is the party a request acts as, parsed before the escrow is locked
+type signingParty struct {
+	party     string
+	publicKey string
+	signer    Signer
+}
+
+// parseSigningParty checks the party and public key of a request acting as one of parties
+// A session obtained by proving control of a key stands in for the public_key field
+func parseSigningParty(r *http.Request, party, publicKey string, parties ...string) (*signingParty, error) {
+	publicKey = resolvePublicKey(r, publicKey)
+	if party == "" || publicKey == "" {
+		return nil, &requestError{http.StatusBadRequest, errors.New("missing required fields"),
+			"Party type and public key (or a key-bound session) are required"}
+	}
+
+	for _, allowed := range parties {
+		if party == allowed {
+			return &signingParty{party: party, publicKey: publicKey}, nil
+		}
+	}
+
+	last := len(parties) - 1
+	list := strings.Join(parties[:last], ", ") + " or " + parties[last]
+	if last > 1 {
+		list = strings.Join(parties[:last], ", ") + ", or " + parties[last]
+	}
+	return nil, &requestError{http.StatusBadRequest, errors.New("invalid party type"), "Party must be one of: " + list}
+}
+
+// parsePayoutSigner parses the party of a request signing a payout and picks its signer
+// The escrow service signs through its configured signer, other parties send the signed payout
+func parsePayoutSigner(r *http.Request, party, publicKey, psbt, privateKey string) (*signingParty, error) {
+	p, err := parseSigningParty(r, party, publicKey, signingParties...)
+	if err != nil {
+		return nil, err
+	}
+
+	p.signer, err = signerForParty(p.party, psbt, privateKey, p.publicKey)
+	if err != nil {
+		return nil, &requestError{http.StatusBadRequest, err,
+			"A signed PSBT or private key is required unless the escrow service signer is configured"}
+	}
+	return p, nil
+}
+
+// check verifies under the escrow's lock that the caller may act as the party with its key
+func (p *signingParty) check(r *http.Request, escrow *Escrow) error {
+	// Only the identity registered for a party may sign as that party
+	if err := authorizeParty(r, escrow, p.party); err != nil {
+		return err
+	}
+
+	if err := checkPartyKey(escrow, p.party, p.publicKey); err != nil {
+		return err
+	}
+
+	// Make sure the service signer actually holds the escrow key
+	if p.signer != nil && p.signer == serviceSigner {
+		if err := checkSignerKey(p.signer, escrow.EscrowPubKey); err != nil {
+			return &requestError{http.StatusBadGateway, err, "Escrow service signer cannot sign for this escrow"}
+		}
+	}
+	return nil
+}
+
+// signature returns the record of the party's signature
+func (p *signingParty) signature(signature string) PartySignature {
+	return PartySignature{
+		Party:     p.party,
+		Signature: signature,
+		Timestamp: time.Now(),
+		PublicKey: p.publicKey,
+	}
+}
@@ -0,0 +1,681 @@
+package escrow
+
+import (
+	"errors"
+	"escrow-service/utils"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// BatchStatus represents the lifecycle state of a batched payout
+type BatchStatus string
+
+const (
+	BatchSigning   BatchStatus = "signing"   // collecting the input signatures of each escrow
+	BatchSigned    BatchStatus = "signed"    // every escrow's inputs signed, the PSBT is ready for the parties to broadcast
+	BatchAbandoned BatchStatus = "abandoned" // no escrow's inputs were signed in time, all were requeued
+)
+
+// BatchEntry is one escrow's part of a batched payout
+type BatchEntry struct {
+	EscrowID     string               `json:"escrow_id"`
+	Inputs       []utils.TxInput      `json:"inputs"`
+	InputIndexes []int                `json:"input_indexes"` // positions of the inputs in the batch transaction
+	Outputs      []utils.PayoutOutput `json:"outputs"`
+	Fee          *FeeQuote            `json:"fee"`               // the escrow's share of the miner fee
+	Signers      []string             `json:"signers,omitempty"` // parties that signed every input
+	Included     bool                 `json:"included"`          // paid out by the signed transaction
+}
+
+// Batch is a transaction paying out several escrows queued for release at once
+type Batch struct {
+	ID          string            `json:"id"`
+	Status      BatchStatus       `json:"status"`
+	CreatedAt   time.Time         `json:"created_at"`
+	FeeRate     float64           `json:"fee_rate"`
+	Transaction utils.Transaction `json:"transaction"` // unsigned transaction spending every entry
+	PSBT        string            `json:"psbt"`        // the transaction with the input signatures collected so far
+	Entries     []BatchEntry      `json:"entries"`
+	TxID        string            `json:"txid,omitempty"`         // transaction of the signed PSBT
+	CompletedAt *time.Time        `json:"completed_at,omitempty"` // when every input was found signed
+}
+
+// Batches are kept in memory like escrows. An escrow's lock is taken before batchesMutex, never after
+var (
+	batchesMutex sync.Mutex
+	batches      = make(map[string]*Batch)
+)
+
+// BatchSignRequest represents a party signing its escrow's inputs of a batched payout
+type BatchSignRequest struct {
+	EscrowID   string `json:"escrow_id"`
+	PrivateKey string `json:"private_key,omitempty"` // deprecated, send the signed psbt instead
+	PSBT       string `json:"psbt,omitempty"`        // the batch PSBT with the party's inputs signed
+	Party      string `json:"party"`                 // "buyer", "seller", or "escrow"
+	PublicKey  string `json:"public_key,omitempty"`  // optional when authenticated with a key-bound session
+}
+
+// batchQueued reports whether the escrow has its release signatures and waits for the next batch
+func (e *Escrow) batchQueued() bool {
+	return e.BatchRelease && e.BatchQueuedAt != nil && e.BatchID == "" && e.Status == StatusReleasing
+}
+
+// newBatchEntry builds the escrow's part of a batch paying feeRate, with an even share
+// of the transaction's fixed overhead
+func newBatchEntry(escrow *Escrow, feeRate float64, overhead int64, now time.Time) (BatchEntry, error) {
+	inputs := escrow.payoutInputs()
+	if len(inputs) == 0 {
+		return BatchEntry{}, errors.New("escrow has no unspent outputs")
+	}
+
+	addresses := outputAddresses(payoutOutputs(escrow, releaseOutputs(escrow)))
+	vsize := utils.EstimatePartVsize(escrow.spendPath(), 2, len(inputs), addresses) + overhead
+	quote := &FeeQuote{
+		FeeRate:    feeRate,
+		Vsize:      vsize,
+		Fee:        utils.FeeForVsize(vsize, feeRate),
+		ConfTarget: feePolicy.ConfTarget,
+		QuotedAt:   now,
+	}
+
+	quote, outputs, err := quotePayout(escrow, quote, releaseOutputs(escrow))
+	if err != nil {
+		return BatchEntry{}, err
+	}
+
+	return BatchEntry{
+		EscrowID: escrow.ID,
+		Inputs:   inputs,
+		Outputs:  payoutOutputs(escrow, outputs),
+		Fee:      quote,
+	}, nil
+}
+
+// signBatchInputs signs the inputs at indexes of the batch's PSBT with signer, returning the signed PSBT
+func signBatchInputs(psbt string, indexes []int, signer Signer) (string, error) {
+	for _, index := range indexes {
+		var err error
+		if psbt, err = signer.SignPSBTInput(psbt, index); err != nil {
+			return "", fmt.Errorf("failed to sign input %d: %v", index, err)
+		}
+	}
+
+	return psbt, nil
+}
+
+// sameInputs reports whether two lists spend the same outpoints in the same order
+func sameInputs(a, b []utils.TxInput) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].TxID != b[i].TxID || a[i].Vout != b[i].Vout {
+			return false
+		}
+	}
+	return true
+}
+
+// signedBy reports whether the party has signed the entry's inputs
+func (e *BatchEntry) signedBy(party string) bool {
+	for _, signer := range e.Signers {
+		if signer == party {
+			return true
+		}
+	}
+	return false
+}
+
+// signatures counts the distinct parties that signed the entry's inputs
+func (e *BatchEntry) signatures() int {
+	parties := make(map[string]bool, len(e.Signers))
+	for _, signer := range e.Signers {
+		parties[signer] = true
+	}
+	return len(parties)
+}
+
+// ProcessBatches finalizes the batches collecting signatures, then opens a new batch for the escrows
+// queued since, including any left out of the batches just finalized
+func ProcessBatches(now time.Time) {
+	batchesMutex.Lock()
+	var open []*Batch
+	for _, batch := range batches {
+		if batch.Status == BatchSigning {
+			open = append(open, batch)
+		}
+	}
+	batchesMutex.Unlock()
+
+	sort.Slice(open, func(i, j int) bool { return open[i].CreatedAt.Before(open[j].CreatedAt) })
+	for _, batch := range open {
+		signServiceEntries(batch, finalizeBatch(batch, now))
+	}
+	openBatch(now)
+}
+
+// finalizeBatch completes the batch once every escrow's inputs are signed and marks the escrows released
+// Escrows missing input signatures, or that left releasing in the meantime, are left out rather than holding
+// up the rest. The transaction the others signed also spends their inputs, so the batch is rebuilt without
+// them and stays open until the remaining inputs are signed again. It returns the escrows of a rebuilt batch
+// the escrow service signs for
+func finalizeBatch(batch *Batch, now time.Time) []string {
+	batchesMutex.Lock()
+	ids := make([]string, 0, len(batch.Entries))
+	for _, entry := range batch.Entries {
+		ids = append(ids, entry.EscrowID)
+	}
+	batchesMutex.Unlock()
+
+	// With every escrow of the batch locked, no signature can be added while it is finalized
+	locked, unlock := lockEscrows(ids)
+	defer unlock()
+
+	batchesMutex.Lock()
+	defer batchesMutex.Unlock()
+
+	byID := make(map[string]*Escrow, len(locked))
+	for _, escrow := range locked {
+		byID[escrow.ID] = escrow
+	}
+
+	var kept []*Escrow
+	for i := range batch.Entries {
+		entry := &batch.Entries[i]
+		escrow := byID[entry.EscrowID]
+		entry.Included = escrow != nil && escrow.Status == StatusReleasing && escrow.BatchID == batch.ID &&
+			entry.signatures() >= 2 && sameInputs(escrow.payoutInputs(), entry.Inputs)
+		if entry.Included {
+			kept = append(kept, escrow)
+		}
+	}
+
+	if len(kept) == len(batch.Entries) {
+		releaseBatch(batch, byID, now)
+		return nil
+	}
+
+	for _, entry := range batch.Entries {
+		escrow := byID[entry.EscrowID]
+		if entry.Included || escrow == nil || escrow.BatchID != batch.ID {
+			continue
+		}
+
+		detail := fmt.Sprintf("Left out of batch %s with %d of 2 input signatures, queued for the next batch",
+			batch.ID, entry.signatures())
+		if escrow.Status != StatusReleasing {
+			detail = fmt.Sprintf("Left out of batch %s, escrow status is %s", batch.ID, escrow.Status)
+		}
+		leaveBatch(escrow, batch, now, detail)
+	}
+
+	var entries []BatchEntry
+	var batched []*Escrow
+	var tx utils.Transaction
+	if len(kept) > 0 {
+		var err error
+		if entries, batched, tx, err = buildBatch(batch.ID, kept, batch.FeeRate, now); err != nil {
+			log.Printf("Failed to rebuild batch %s: %v", batch.ID, err)
+			batched = nil
+		}
+	}
+
+	rebuilt := make(map[string]bool, len(batched))
+	for _, escrow := range batched {
+		rebuilt[escrow.ID] = true
+	}
+	for _, escrow := range kept {
+		if !rebuilt[escrow.ID] {
+			leaveBatch(escrow, batch, now,
+				fmt.Sprintf("Left out of batch %s, which could not be rebuilt, queued for the next batch", batch.ID))
+			continue
+		}
+		escrow.Version++
+		escrow.recordHistory(now, "system", "batch_rebuilt", escrow.Status,
+			fmt.Sprintf("Batch %s rebuilt without the escrows left out, waiting for input signatures again", batch.ID))
+	}
+
+	if len(batched) == 0 {
+		batch.Status = BatchAbandoned
+		log.Printf("Abandoned batch %s, no escrow was signed", batch.ID)
+		return nil
+	}
+
+	batch.Entries, batch.Transaction, batch.PSBT = entries, tx, tx.RawTx
+	log.Printf("Rebuilt batch %s with %d escrows", batch.ID, len(batched))
+	return serviceSignable(batched)
+}
+
+// releaseBatch completes the batch with its signed PSBT, the payout of every escrow of the batch
+// Callers hold the escrows' locks and batchesMutex
+func releaseBatch(batch *Batch, byID map[string]*Escrow, now time.Time) {
+	tx := batch.Transaction
+	for _, entry := range batch.Entries {
+		escrow := byID[entry.EscrowID]
+
+		from := escrow.Status
+		if err := escrow.transition(StatusReleased); err != nil {
+			log.Printf("Failed to release escrow ID: %s in batch %s: %v", escrow.ID, batch.ID, err)
+			continue
+		}
+		escrow.ReleaseTxID = tx.TxID
+		escrow.ReleaseFee = entry.Fee
+
+		// The escrow's payout is its own part of the signed batch transaction
+		escrow.recordPayout(&utils.Transaction{
+			TxID:     tx.TxID,
+			RawTx:    batch.PSBT,
+			Fee:      entry.Fee.Fee,
+			Inputs:   entry.Inputs,
+			Outputs:  entry.Outputs,
+			Sequence: tx.Sequence,
+		})
+		escrow.Version++
+		escrow.recordHistory(now, "system", "batch_released", from,
+			fmt.Sprintf("Released by batch %s, TxID: %s", batch.ID, tx.TxID))
+		log.Printf("Released escrow ID: %s in batch %s, TxID: %s", escrow.ID, batch.ID, tx.TxID)
+	}
+
+	batch.Status, batch.TxID, batch.CompletedAt = BatchSigned, tx.TxID, &now
+	log.Printf("Completed batch %s, TxID: %s", batch.ID, tx.TxID)
+}
+
+// leaveBatch takes the escrow out of the batch, queuing it for the next batch if it is still releasing
+func leaveBatch(escrow *Escrow, batch *Batch, now time.Time, detail string) {
+	escrow.BatchID = ""
+	if escrow.Status != StatusReleasing {
+		escrow.BatchQueuedAt = nil
+	}
+	escrow.Version++
+	escrow.recordHistory(now, "system", "batch_left_out", escrow.Status, detail)
+	log.Printf("Left escrow ID: %s out of batch %s", escrow.ID, batch.ID)
+}
+
+// buildBatch builds the entries of the escrows paid out by a batch and the transaction spending them
+// Escrows whose part cannot be built are skipped. Callers hold the escrows' locks
+func buildBatch(batchID string, escrows []*Escrow, feeRate float64, now time.Time) ([]BatchEntry, []*Escrow, utils.Transaction, error) {
+	// The fixed overhead is shared evenly between the escrows
+	overhead := utils.EstimateOverheadVsize(len(escrows), len(escrows))
+	overhead = (overhead + int64(len(escrows)) - 1) / int64(len(escrows))
+
+	var entries []BatchEntry
+	var inputs []utils.TxInput
+	var outputs []utils.PayoutOutput
+	var fee int64
+	var batched []*Escrow
+	for _, escrow := range escrows {
+		entry, err := newBatchEntry(escrow, feeRate, overhead, now)
+		if err != nil {
+			log.Printf("Left escrow ID: %s out of batch %s: %v", escrow.ID, batchID, err)
+			continue
+		}
+
+		for i := range entry.Inputs {
+			entry.InputIndexes = append(entry.InputIndexes, len(inputs)+i)
+		}
+		inputs = append(inputs, entry.Inputs...)
+		outputs = append(outputs, entry.Outputs...)
+		fee += entry.Fee.Fee
+
+		entries = append(entries, entry)
+		batched = append(batched, escrow)
+	}
+	if len(batched) == 0 {
+		return nil, nil, utils.Transaction{}, nil
+	}
+
+	tx, err := utils.CreatePayoutTransaction(inputs, outputs, fee)
+	if err != nil {
+		return nil, nil, utils.Transaction{}, err
+	}
+	return entries, batched, tx, nil
+}
+
+// serviceSignable returns the escrows whose key the escrow service signer holds
+func serviceSignable(escrows []*Escrow) []string {
+	var ids []string
+	for _, escrow := range escrows {
+		if serviceSigner != nil && checkSignerKey(serviceSigner, escrow.EscrowPubKey) == nil {
+			ids = append(ids, escrow.ID)
+		}
+	}
+	return ids
+}
+
+// openBatch builds a batch transaction spending the outputs of every queued escrow to its payees
+// The escrow service signs the inputs of the escrows whose key its signer holds, the other
+// parties sign theirs through SignBatch before the next round
+func openBatch(now time.Time) {
+	var queued []string
+	for _, escrow := range listEscrows() {
+		viewEscrow(escrow.ID, func(escrow *Escrow) error {
+			if escrow.batchQueued() {
+				queued = append(queued, escrow.ID)
+			}
+			return nil
+		})
+	}
+	if len(queued) == 0 {
+		return
+	}
+
+	feeRate, err := currentFeeRate()
+	if err != nil {
+		log.Printf("Failed to open a batch: %v", err)
+		return
+	}
+
+	batchID, err := utils.NewID("batch")
+	if err != nil {
+		log.Printf("Failed to open a batch: %v", err)
+		return
+	}
+
+	locked, unlock := lockEscrows(queued)
+
+	var candidates []*Escrow
+	for _, escrow := range locked {
+		if escrow.batchQueued() {
+			candidates = append(candidates, escrow)
+		}
+	}
+
+	batch := &Batch{ID: batchID, Status: BatchSigning, CreatedAt: now, FeeRate: feeRate}
+	var batched []*Escrow
+	if len(candidates) > 0 {
+		var tx utils.Transaction
+		batch.Entries, batched, tx, err = buildBatch(batchID, candidates, feeRate, now)
+		if err != nil {
+			unlock()
+			log.Printf("Failed to create the transaction for batch %s: %v", batchID, err)
+			return
+		}
+		batch.Transaction, batch.PSBT = tx, tx.RawTx
+	}
+	if len(batched) == 0 {
+		unlock()
+		return
+	}
+
+	signable := serviceSignable(batched)
+	for _, escrow := range batched {
+		escrow.BatchID = batch.ID
+		escrow.Version++
+		escrow.recordHistory(now, "system", "batch_opened", escrow.Status,
+			fmt.Sprintf("Added to batch %s, waiting for input signatures", batch.ID))
+	}
+
+	batchesMutex.Lock()
+	batches[batch.ID] = batch
+	batchesMutex.Unlock()
+	unlock()
+
+	log.Printf("Opened batch %s with %d escrows", batch.ID, len(batched))
+	signServiceEntries(batch, signable)
+}
+
+// signServiceEntries signs the inputs of the escrows with the escrow service signer
+// It is called once no lock is held, since the signer may be a remote daemon
+func signServiceEntries(batch *Batch, ids []string) {
+	for _, id := range ids {
+		if err := signServiceEntry(batch, id); err != nil {
+			log.Printf("Failed to sign escrow ID: %s in batch %s: %v", id, batch.ID, err)
+		}
+	}
+}
+
+// signServiceEntry signs the escrow's inputs with the escrow service signer, without holding batchesMutex
+// while signing. A PSBT another party signed meanwhile is signed again, a few times at most
+func signServiceEntry(batch *Batch, escrowID string) error {
+	// entry finds the escrow's entry while the batch takes signatures and the escrow service
+	// has not signed it, as it may through SignBatch meanwhile. Callers hold batchesMutex
+	entry := func() *BatchEntry {
+		if batch.Status != BatchSigning {
+			return nil
+		}
+		for i := range batch.Entries {
+			if batch.Entries[i].EscrowID == escrowID && !batch.Entries[i].signedBy("escrow") {
+				return &batch.Entries[i]
+			}
+		}
+		return nil
+	}
+
+	for attempt := 0; attempt < 3; attempt++ {
+		batchesMutex.Lock()
+		current := entry()
+		if current == nil {
+			batchesMutex.Unlock()
+			return errors.New("escrow is no longer signed in the batch, or already signed by the escrow service")
+		}
+		unsigned, indexes := batch.PSBT, append([]int{}, current.InputIndexes...)
+		batchesMutex.Unlock()
+
+		signed, err := signBatchInputs(unsigned, indexes, serviceSigner)
+		if err != nil {
+			return err
+		}
+
+		batchesMutex.Lock()
+		if current := entry(); current != nil && batch.PSBT == unsigned {
+			batch.PSBT = signed
+			current.Signers = append(current.Signers, "escrow")
+			batchesMutex.Unlock()
+			return nil
+		}
+		batchesMutex.Unlock()
+	}
+
+	return errors.New("batch kept changing while it was being signed")
+}
+
+// batchEntry returns the batch the escrow is part of and its entry. Callers hold batchesMutex
+func batchEntry(escrow *Escrow) (*Batch, *BatchEntry, error) {
+	batch := batches[escrow.BatchID]
+	if batch == nil {
+		if escrow.batchQueued() {
+			return nil, nil, &requestError{http.StatusConflict, errors.New("batch not open"),
+				"Release is queued, the escrow joins the next batch"}
+		}
+		return nil, nil, &requestError{http.StatusBadRequest, errors.New("not batched"),
+			"Escrow is not queued for a batched release"}
+	}
+
+	for i := range batch.Entries {
+		if batch.Entries[i].EscrowID == escrow.ID {
+			return batch, &batch.Entries[i], nil
+		}
+	}
+	return nil, nil, &requestError{http.StatusInternalServerError, errors.New("batch entry not found"),
+		"Escrow is missing from its batch"}
+}
+
+// batchResponse describes the escrow's part of its batch
+func batchResponse(batch *Batch, entry *BatchEntry) map[string]interface{} {
+	response := map[string]interface{}{
+		"escrow_id":         entry.EscrowID,
+		"batch_id":          batch.ID,
+		"batch_status":      batch.Status,
+		"created_at":        batch.CreatedAt,
+		"fee_rate":          batch.FeeRate,
+		"escrows":           len(batch.Entries),
+		"psbt":              batch.PSBT,
+		"input_indexes":     entry.InputIndexes,
+		"inputs":            entry.Inputs,
+		"outputs":           entry.Outputs,
+		"fee":               entry.Fee,
+		"signers":           entry.Signers,
+		"signatures_needed": 2,
+	}
+
+	if batch.Status != BatchSigning {
+		response["included"] = entry.Included
+	}
+	if batch.TxID != "" {
+		response["txid"] = batch.TxID
+	}
+	return response
+}
+
+// GetBatch shows the batch an escrow queued for a batched release is part of,
+// with the PSBT and the input indexes its parties sign
+func GetBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		utils.WriteErrorResponse(w, http.StatusMethodNotAllowed, errors.New("method not allowed"), "Only GET method is allowed")
+		return
+	}
+
+	escrowID := r.URL.Query().Get("escrow_id")
+	if escrowID == "" {
+		utils.WriteErrorResponse(w, http.StatusBadRequest, errors.New("missing required fields"), "Escrow ID is required")
+		return
+	}
+
+	var response map[string]interface{}
+	err := viewEscrow(escrowID, func(escrow *Escrow) error {
+		if err := authorizeRead(r, escrow); err != nil {
+			return err
+		}
+
+		batchesMutex.Lock()
+		defer batchesMutex.Unlock()
+
+		batch, entry, err := batchEntry(escrow)
+		if err != nil {
+			return err
+		}
+		response = batchResponse(batch, entry)
+		return nil
+	})
+	if err != nil {
+		writeUpdateError(w, err)
+		return
+	}
+
+	utils.WriteJSONResponse(w, http.StatusOK, response)
+}
+
+// SignBatch signs every input of an escrow in the open batch on behalf of one party
+// An escrow is paid out by the batch once two parties have signed its inputs
+func SignBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		utils.WriteErrorResponse(w, http.StatusMethodNotAllowed, errors.New("method not allowed"), "Only POST method is allowed")
+		return
+	}
+
+	var req BatchSignRequest
+	if err := utils.DecodeJSONBody(r, &req); err != nil {
+		utils.WriteErrorResponse(w, http.StatusBadRequest, err, "Invalid request payload")
+		return
+	}
+
+	// Validate request
+	if req.EscrowID == "" {
+		utils.WriteErrorResponse(w, http.StatusBadRequest, errors.New("missing required fields"), "Escrow ID is required")
+		return
+	}
+
+	party, err := parsePayoutSigner(r, req.Party, req.PublicKey, req.PSBT, req.PrivateKey)
+	if err != nil {
+		writeUpdateError(w, err)
+		return
+	}
+
+	// checkEntry finds the escrow's entry of the open batch, if the party may still sign it
+	checkEntry := func(escrow *Escrow) (*Batch, *BatchEntry, error) {
+		if err := party.check(r, escrow); err != nil {
+			return nil, nil, err
+		}
+
+		batch, entry, err := batchEntry(escrow)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if batch.Status != BatchSigning {
+			return nil, nil, &requestError{http.StatusConflict, errors.New("batch closed"),
+				fmt.Sprintf("Batch %s is %s and no longer takes signatures", batch.ID, batch.Status)}
+		}
+
+		if entry.signedBy(req.Party) {
+			return nil, nil, &requestError{http.StatusBadRequest, errors.New("duplicate signature"),
+				fmt.Sprintf("A signature from %s has already been provided", req.Party)}
+		}
+		return batch, entry, nil
+	}
+
+	// The inputs are signed without holding any lock, since the signer may be a remote daemon
+	var unsigned string
+	var indexes []int
+	err = viewEscrow(req.EscrowID, func(escrow *Escrow) error {
+		batchesMutex.Lock()
+		defer batchesMutex.Unlock()
+
+		batch, entry, err := checkEntry(escrow)
+		if err != nil {
+			return err
+		}
+		unsigned, indexes = batch.PSBT, append([]int{}, entry.InputIndexes...)
+		return nil
+	})
+	if err != nil {
+		writeUpdateError(w, err)
+		return
+	}
+
+	signed, err := signBatchInputs(unsigned, indexes, party.signer)
+	if err != nil {
+		writeUpdateError(w, signingFailed(party.signer, err, "Failed to sign batch inputs"))
+		return
+	}
+
+	// Signing only touches the batch, the escrow's lock keeps it from being finalized meanwhile
+	var response map[string]interface{}
+	err = viewEscrow(req.EscrowID, func(escrow *Escrow) error {
+		batchesMutex.Lock()
+		defer batchesMutex.Unlock()
+
+		batch, entry, err := checkEntry(escrow)
+		if err != nil {
+			return err
+		}
+
+		// Another signature added meanwhile is not part of this one's PSBT
+		if batch.PSBT != unsigned {
+			return &requestError{http.StatusConflict, errors.New("batch changed"),
+				"Batch changed while the inputs were being signed, retry the request"}
+		}
+
+		batch.PSBT = signed
+		entry.Signers = append(entry.Signers, req.Party)
+
+		escrow.recordRequest(r, req.Party, "batch_signed", escrow.Status,
+			fmt.Sprintf("Batch %s inputs signature %d of 2", batch.ID, len(entry.Signers)))
+		log.Printf("Added batch signature for escrow ID: %s in batch %s from %s", escrow.ID, batch.ID, req.Party)
+		response = batchResponse(batch, entry)
+		return nil
+	})
+	if err != nil {
+		writeUpdateError(w, err)
+		return
+	}
+
+	utils.WriteJSONResponse(w, http.StatusOK, response)
+}
+
+// StartBatcher processes batched payouts every interval in the background
+// A queued escrow joins the next batch and is paid out at the round after, once every input of the batch is signed
+func StartBatcher(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for now := range ticker.C {
+			ProcessBatches(now)
+		}
+	}()
+}
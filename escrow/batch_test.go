@@ -0,0 +1,161 @@
+package escrow
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// queueBatchedEscrow funds an escrow paid out in batches and has both parties sign its release, queuing it
+func queueBatchedEscrow(t *testing.T, amount int64) string {
+	t.Helper()
+
+	response := mustCall(t, CreateEscrow, testAdmin, EscrowRequest{
+		BuyerPubKey:  testBuyerPubKey,
+		SellerPubKey: testSellerPubKey,
+		EscrowPubKey: testEscrowPubKey,
+		Amount:       amount,
+		BatchRelease: true,
+	}, http.StatusCreated)
+	id := response["id"].(string)
+	depositTestFunds(t, id, amount, 1)
+	mustCall(t, VerifyPayment, testAdmin, map[string]string{"escrow_id": id}, http.StatusOK)
+
+	mustCall(t, ReleaseEscrow, testBuyer, ReleaseRequest{
+		EscrowID:   id,
+		PrivateKey: testBuyerPrivKey,
+		Signature:  "signature",
+		Party:      "buyer",
+		PublicKey:  testBuyerPubKey,
+	}, http.StatusOK)
+	mustCall(t, ReleaseEscrow, testSeller, ReleaseRequest{
+		EscrowID:   id,
+		PrivateKey: testSellerPrivKey,
+		Signature:  "signature",
+		Party:      "seller",
+		PublicKey:  testSellerPubKey,
+	}, http.StatusOK)
+	return id
+}
+
+// signBatchAs signs the escrow's inputs of its batch as the buyer or the seller
+func signBatchAs(t *testing.T, id, party string) {
+	t.Helper()
+
+	identity, privateKey, publicKey := testBuyer, testBuyerPrivKey, testBuyerPubKey
+	if party == "seller" {
+		identity, privateKey, publicKey = testSeller, testSellerPrivKey, testSellerPubKey
+	}
+	mustCall(t, SignBatch, identity, BatchSignRequest{
+		EscrowID:   id,
+		PrivateKey: privateKey,
+		Party:      party,
+		PublicKey:  publicKey,
+	}, http.StatusOK)
+}
+
+func TestBatchPaysOutSignedPSBT(t *testing.T) {
+	defer SetServiceSigner(serviceSigner)
+	SetServiceSigner(nil)
+
+	signed := queueBatchedEscrow(t, 80000)
+	unsigned := queueBatchedEscrow(t, 90000)
+
+	now := time.Now()
+	ProcessBatches(now)
+	opened := getAs(t, GetBatch, testBuyer, "escrow_id="+signed)
+
+	// Only one escrow's inputs are signed, so the transaction both spend cannot be completed
+	signBatchAs(t, signed, "buyer")
+	signBatchAs(t, signed, "seller")
+	signBatchAs(t, unsigned, "buyer")
+	ProcessBatches(now.Add(time.Minute))
+
+	rebuilt := getAs(t, GetBatch, testBuyer, "escrow_id="+signed)
+	if snapshotEscrow(t, signed).Status != StatusReleasing {
+		t.Fatalf("expected the signed escrow to wait for its inputs to be signed again")
+	}
+	if rebuilt["batch_id"] != opened["batch_id"] || rebuilt["batch_status"] != string(BatchSigning) ||
+		rebuilt["escrows"] != float64(1) || rebuilt["signers"] != nil || strings.HasPrefix(rebuilt["psbt"].(string), "signed_") {
+		t.Fatalf("expected the batch to be rebuilt without the unsigned escrow, got %v", rebuilt)
+	}
+	if !containsAction(signed, "batch_rebuilt") {
+		t.Errorf("expected batch_rebuilt in the history, got %v", historyActions(signed))
+	}
+	if !containsAction(unsigned, "batch_left_out") {
+		t.Errorf("expected batch_left_out in the history, got %v", historyActions(unsigned))
+	}
+
+	// Signed again, the rebuilt batch pays out the PSBT the parties signed
+	signBatchAs(t, signed, "buyer")
+	signBatchAs(t, signed, "seller")
+	psbt := getAs(t, GetBatch, testBuyer, "escrow_id="+signed)["psbt"].(string)
+	ProcessBatches(now.Add(2 * time.Minute))
+
+	viewEscrow(signed, func(escrow *Escrow) error {
+		if escrow.Status != StatusReleased || escrow.Payout == nil {
+			t.Fatalf("expected the escrow to be released with a payout, got %s", escrow.Status)
+		}
+		if escrow.Payout.RawTx != psbt || !strings.HasPrefix(psbt, "signed_signed_") {
+			t.Errorf("expected the payout to be the PSBT signed by both parties, got %q", escrow.Payout.RawTx)
+		}
+		if escrow.ReleaseTxID != escrow.Payout.TxID {
+			t.Errorf("expected the release txid %s to be the payout's, got %s", escrow.Payout.TxID, escrow.ReleaseTxID)
+		}
+		return nil
+	})
+
+	if completed := getAs(t, GetBatch, testBuyer, "escrow_id="+signed); completed["batch_status"] != string(BatchSigned) {
+		t.Errorf("expected the batch to be signed, not broadcast by the service, got %v", completed["batch_status"])
+	}
+
+	// The escrow left out joined a batch of its own and waits for its signatures
+	if escrow := snapshotEscrow(t, unsigned); escrow.Status != StatusReleasing {
+		t.Errorf("expected the escrow left out to stay releasing, got %s", escrow.Status)
+	}
+}
+
+func TestBatchServiceSignatureCountedOnce(t *testing.T) {
+	defer SetServiceSigner(serviceSigner)
+	SetServiceSigner(nil)
+
+	id := queueBatchedEscrow(t, 80000)
+	ProcessBatches(time.Now())
+
+	// The escrow service signs through SignBatch before its own signing of the new batch runs
+	SetServiceSigner(&probeSigner{escrowID: id})
+	mustCall(t, SignBatch, testAdmin, BatchSignRequest{
+		EscrowID:  id,
+		Party:     "escrow",
+		PublicKey: testEscrowPubKey,
+	}, http.StatusOK)
+
+	var batch *Batch
+	var entry *BatchEntry
+	viewEscrow(id, func(escrow *Escrow) error {
+		batchesMutex.Lock()
+		defer batchesMutex.Unlock()
+		batch, entry, _ = batchEntry(escrow)
+		return nil
+	})
+	if err := signServiceEntry(batch, id); err == nil {
+		t.Errorf("expected the escrow service not to sign the inputs twice")
+	}
+
+	batchesMutex.Lock()
+	signers := append([]string{}, entry.Signers...)
+	batchesMutex.Unlock()
+	if len(signers) != 1 {
+		t.Fatalf("expected the escrow service signature once, got %v", signers)
+	}
+
+	// Even recorded twice, one party's signature does not pay out the batch
+	batchesMutex.Lock()
+	entry.Signers = append(entry.Signers, "escrow")
+	batchesMutex.Unlock()
+	ProcessBatches(time.Now().Add(time.Minute))
+	if escrow := snapshotEscrow(t, id); escrow.Status != StatusReleasing {
+		t.Errorf("expected the escrow to wait for a second party, got %s", escrow.Status)
+	}
+}
@@ -2,15 +2,21 @@ package escrow
 
 import (
 	"encoding/json"
+	"errors"
 	"escrow-service/utils"
 	"fmt"
 	"io"
 	"log"
+	"mime"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 )
 
+// maxPaymentSize is the largest Payment message accepted, in bytes, the limit BIP70 sets on payment requests
+const maxPaymentSize = 50000
+
 // CreateBIP70PaymentRequest creates a BIP70 payment request
 func CreateBIP70PaymentRequest(address string, amount int64) (utils.PaymentRequest, error) {
 	// Validate input parameters
@@ -142,30 +148,36 @@ func HandlePaymentRequest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// requestID := parts[len(parts)-1]
-
-	// In a real implementation, you would fetch the payment request from a database
-	// For demo purposes, we'll create a new one
-	address := "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx" // Example testnet address
-	amount := int64(100000)                                 // 0.001 BTC in satoshis
+	requestID := parts[len(parts)-1]
 
-	paymentRequest, err := CreateBIP70PaymentRequest(address, amount)
+	// Fetch the payment request stored with its escrow
+	paymentRequest, err := lookupPaymentRequest(requestID)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to create payment request: %v", err), http.StatusInternalServerError)
+		writePaymentRequestError(w, err)
 		return
 	}
 
-	// Set the correct Content-Type header according to BIP70
-	w.Header().Set("Content-Type", "application/bitcoin-paymentrequest")
+	// Wallets get the protobuf message BIP71 defines, and clients asking for JSON get a readable form for debugging
+	mediaType, ok := negotiatePaymentRequestType(r.Header.Get("Accept"))
+	if !ok {
+		http.Error(w, "Not acceptable, supported types are "+utils.MediaTypePaymentRequest+" and application/json",
+			http.StatusNotAcceptable)
+		return
+	}
 
-	// Serialize the payment request
-	// In a real implementation, this would use protobuf serialization
-	requestBytes, err := json.Marshal(paymentRequest)
+	var requestBytes []byte
+	if mediaType == utils.MediaTypePaymentRequest {
+		requestBytes, err = utils.EncodePaymentRequestProto(&paymentRequest)
+	} else {
+		requestBytes, err = json.Marshal(paymentRequest)
+	}
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Failed to serialize payment request: %v", err), http.StatusInternalServerError)
 		return
 	}
 
+	w.Header().Set("Content-Type", mediaType)
+	w.Header().Add("Vary", "Accept")
 	w.Write(requestBytes)
 }
 
@@ -177,22 +189,39 @@ func HandlePayment(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Check Content-Type header
-	contentType := r.Header.Get("Content-Type")
-	if contentType != "application/bitcoin-payment" {
-		http.Error(w, "Invalid Content-Type, expected application/bitcoin-payment", http.StatusUnsupportedMediaType)
+	// Payments are only accepted for known, valid payment requests
+	// Expected format: /api/pay/{requestID}
+	if _, err := lookupPaymentRequest(strings.TrimPrefix(r.URL.Path, "/api/pay/")); err != nil {
+		writePaymentRequestError(w, err)
+		return
+	}
+
+	// Check Content-Type header: a protobuf Payment per BIP71, or the JSON form
+	contentType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || (contentType != utils.MediaTypePayment && contentType != "application/json") {
+		http.Error(w, "Invalid Content-Type, expected "+utils.MediaTypePayment+" or application/json",
+			http.StatusUnsupportedMediaType)
 		return
 	}
 
-	// Read the request body
-	body, err := io.ReadAll(r.Body)
+	// Read the request body, up to the size limit
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxPaymentSize))
+	if err != nil && len(body) >= maxPaymentSize {
+		http.Error(w, fmt.Sprintf("Payment is larger than %d bytes", maxPaymentSize), http.StatusRequestEntityTooLarge)
+		return
+	}
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Failed to read request body: %v", err), http.StatusBadRequest)
 		return
 	}
 
 	// Parse the payment
-	payment, err := utils.DeserializePayment(body)
+	var payment *utils.Payment
+	if contentType == utils.MediaTypePayment {
+		payment, err = utils.DecodePaymentProto(body)
+	} else {
+		payment, err = utils.DeserializePayment(body)
+	}
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Failed to parse payment: %v", err), http.StatusBadRequest)
 		return
@@ -215,19 +244,120 @@ func HandlePayment(w http.ResponseWriter, r *http.Request) {
 		Memo:    "Thank you for your payment",
 	}
 
-	// Serialize the PaymentACK
+	// Reply in the encoding the payment came in
+	if contentType == utils.MediaTypePayment {
+		w.Header().Set("Content-Type", utils.MediaTypePaymentACK)
+		w.Write(utils.EncodePaymentACKProto(&ack))
+		return
+	}
+
 	ackBytes, err := utils.SerializePaymentACK(&ack)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Failed to serialize PaymentACK: %v", err), http.StatusInternalServerError)
 		return
 	}
 
-	// Set the correct Content-Type header according to BIP70
-	w.Header().Set("Content-Type", "application/bitcoin-paymentack")
-
+	w.Header().Set("Content-Type", "application/json")
 	w.Write(ackBytes)
 }
 
+// negotiatePaymentRequestType picks the media type of a payment request from an Accept header: the BIP71
+// protobuf type, or application/json. The protobuf type is preferred on a tie or when no Accept header is sent
+func negotiatePaymentRequestType(accept string) (string, bool) {
+	if strings.TrimSpace(accept) == "" {
+		return utils.MediaTypePaymentRequest, true
+	}
+
+	protoQuality := acceptQuality(accept, utils.MediaTypePaymentRequest)
+	jsonQuality := acceptQuality(accept, "application/json")
+	switch {
+	case protoQuality > 0 && protoQuality >= jsonQuality:
+		return utils.MediaTypePaymentRequest, true
+	case jsonQuality > 0:
+		return "application/json", true
+	}
+	return "", false
+}
+
+// acceptQuality returns the quality an Accept header gives a media type, taken from the most specific
+// matching range, or 0 when no range matches
+func acceptQuality(accept, mediaType string) float64 {
+	mainType := strings.SplitN(mediaType, "/", 2)[0]
+	quality, specificity := 0.0, -1
+	for _, part := range strings.Split(accept, ",") {
+		acceptType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+
+		rangeSpecificity := -1
+		switch acceptType {
+		case mediaType:
+			rangeSpecificity = 2
+		case mainType + "/*":
+			rangeSpecificity = 1
+		case "*/*":
+			rangeSpecificity = 0
+		}
+		if rangeSpecificity <= specificity {
+			continue
+		}
+
+		q := 1.0
+		if value, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(value, 64); err != nil || q < 0 || q > 1 {
+				continue
+			}
+		}
+		quality, specificity = q, rangeSpecificity
+	}
+	return quality
+}
+
+var (
+	errPaymentRequestNotFound    = errors.New("payment request not found")
+	errPaymentRequestInvalidated = errors.New("payment request is no longer valid")
+)
+
+// lookupPaymentRequest returns the stored payment request or top-up request with the given ID
+// Requests invalidated when their escrow expired or was underpaid return errPaymentRequestInvalidated
+func lookupPaymentRequest(requestID string) (utils.PaymentRequest, error) {
+	escrow, exists := findEscrowByPaymentRequest(requestID)
+	if !exists {
+		return utils.PaymentRequest{}, errPaymentRequestNotFound
+	}
+
+	// Top-up requests replaced by a later one are no longer valid
+	var paymentRequest utils.PaymentRequest
+	now := time.Now()
+	viewEscrow(escrow.ID, func(escrow *Escrow) error {
+		switch {
+		case escrow.PaymentRequest.RequestID == requestID:
+			paymentRequest = escrow.PaymentRequest
+		case escrow.TopUpRequest != nil && escrow.TopUpRequest.RequestID == requestID:
+			paymentRequest = *escrow.TopUpRequest
+		default:
+			paymentRequest.InvalidatedAt = &now
+		}
+		return nil
+	})
+
+	if paymentRequest.InvalidatedAt != nil {
+		return utils.PaymentRequest{}, errPaymentRequestInvalidated
+	}
+
+	return paymentRequest, nil
+}
+
+// writePaymentRequestError writes the response for an error returned by lookupPaymentRequest
+func writePaymentRequestError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errPaymentRequestInvalidated) {
+		http.Error(w, "Payment request has expired", http.StatusGone)
+		return
+	}
+	http.Error(w, "Payment request not found", http.StatusNotFound)
+}
+
 // Utility function to extract transaction details from a BIP70 payment
 func extractTransactionFromPayment(payment *utils.Payment) (string, error) {
 	if len(payment.Transactions) == 0 {
@@ -0,0 +1,36 @@
+package escrow
+
+import (
+	"bytes"
+	"escrow-service/utils"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHandlePaymentBodyLimit(t *testing.T) {
+	id := createTestEscrow(t, 100000)
+	var requestID string
+	viewEscrow(id, func(escrow *Escrow) error {
+		requestID = escrow.PaymentRequest.RequestID
+		return nil
+	})
+
+	post := func(body []byte) int {
+		r := httptest.NewRequest(http.MethodPost, "/api/pay/"+requestID, bytes.NewReader(body))
+		r.Header.Set("Content-Type", utils.MediaTypePayment)
+		w := httptest.NewRecorder()
+		HandlePayment(w, r)
+		return w.Code
+	}
+
+	payment := utils.EncodePaymentProto(&utils.Payment{Transactions: [][]byte{{0x01, 0x00, 0x00, 0x00}}})
+	if code := post(payment); code != http.StatusOK {
+		t.Errorf("expected a small payment to be accepted, got %d", code)
+	}
+
+	large := utils.EncodePaymentProto(&utils.Payment{Transactions: [][]byte{make([]byte, maxPaymentSize)}})
+	if code := post(large); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected a payment over %d bytes to be refused with 413, got %d", maxPaymentSize, code)
+	}
+}
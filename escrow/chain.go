@@ -0,0 +1,407 @@
+package escrow
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"escrow-service/utils"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ChainBackend supplies chain data to the escrow service
+type ChainBackend interface {
+	// EstimateFeeRate returns the feerate, in sat/vB, expected to confirm within target blocks
+	EstimateFeeRate(target int) (float64, error)
+	// TxConfirmations returns the number of confirmations of a transaction, 0 while it is in the mempool
+	TxConfirmations(txID string) (int64, error)
+	// AddressUTXOs returns the unspent outputs paying address, including those still in the mempool
+	AddressUTXOs(address string) ([]UTXO, error)
+}
+
+// UTXO is an output paying an escrow address
+type UTXO struct {
+	TxID          string `json:"txid"`
+	Vout          uint32 `json:"vout"`
+	Value         int64  `json:"value"`
+	Confirmations int64  `json:"confirmations"`
+	SpentBy       string `json:"spent_by,omitempty"` // payout spending the output, set once the escrow pays out
+	Reverted      bool   `json:"reverted,omitempty"` // gone from the chain, double-spent or reorganized out
+}
+
+// chainBackend is the chain data source used by the escrow service
+var chainBackend ChainBackend = NewMockChain()
+
+// SetChainBackend configures the chain data source used by the escrow service
+func SetChainBackend(backend ChainBackend) {
+	chainBackend = backend
+}
+
+// feeRateForTarget picks the estimate for the largest target not above the requested one,
+// which is the more conservative choice when there is no exact match
+func feeRateForTarget(rates map[int]float64, target int) (float64, error) {
+	if len(rates) == 0 {
+		return 0, errors.New("no fee estimates available")
+	}
+
+	targets := make([]int, 0, len(rates))
+	for t := range rates {
+		targets = append(targets, t)
+	}
+	sort.Ints(targets)
+
+	// Targets below the shortest estimate use the shortest estimate
+	picked := targets[0]
+	for _, t := range targets {
+		if t <= target {
+			picked = t
+		}
+	}
+
+	return rates[picked], nil
+}
+
+// MockChain is an in-memory chain backend for demos and local testing
+type MockChain struct {
+	mu            sync.Mutex
+	feeRates      map[int]float64
+	confirmations map[string]int64
+	utxos         map[string][]UTXO // by address
+}
+
+// NewMockChain creates a mock chain with a fixed fee estimate curve
+func NewMockChain() *MockChain {
+	return &MockChain{
+		feeRates:      map[int]float64{1: 20, 3: 10, 6: 5, 144: 1},
+		confirmations: make(map[string]int64),
+		utxos:         make(map[string][]UTXO),
+	}
+}
+
+// SetFeeRate sets the estimate returned for a confirmation target
+func (c *MockChain) SetFeeRate(target int, rate float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.feeRates[target] = rate
+}
+
+// EstimateFeeRate returns the mock estimate for the confirmation target
+func (c *MockChain) EstimateFeeRate(target int) (float64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return feeRateForTarget(c.feeRates, target)
+}
+
+// SetConfirmations sets the number of confirmations reported for a transaction
+func (c *MockChain) SetConfirmations(txID string, confirmations int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.confirmations[txID] = confirmations
+}
+
+// TxConfirmations returns the confirmations set for a transaction
+// Transactions the mock chain has not been told about are treated as unconfirmed
+func (c *MockChain) TxConfirmations(txID string) (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.confirmations[txID], nil
+}
+
+// AddUTXO adds an output paying address, as if a deposit had been broadcast
+// The output's confirmations are those of its transaction, changed with SetConfirmations
+func (c *MockChain) AddUTXO(address string, utxo UTXO) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.utxos[address] = append(c.utxos[address], UTXO{TxID: utxo.TxID, Vout: utxo.Vout, Value: utxo.Value})
+	c.confirmations[utxo.TxID] = utxo.Confirmations
+}
+
+// RemoveTx removes the outputs of a transaction, as if it had been double-spent or reorganized out of the chain
+// It returns the number of outputs removed
+func (c *MockChain) RemoveTx(txID string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	removed := 0
+	for address, utxos := range c.utxos {
+		kept := utxos[:0]
+		for _, utxo := range utxos {
+			if utxo.TxID == txID {
+				removed++
+				continue
+			}
+			kept = append(kept, utxo)
+		}
+		c.utxos[address] = kept
+	}
+	delete(c.confirmations, txID)
+	return removed
+}
+
+// AddressUTXOs returns the outputs added for address
+func (c *MockChain) AddressUTXOs(address string) ([]UTXO, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	utxos := make([]UTXO, 0, len(c.utxos[address]))
+	for _, utxo := range c.utxos[address] {
+		utxo.Confirmations = c.confirmations[utxo.TxID]
+		utxos = append(utxos, utxo)
+	}
+	return utxos, nil
+}
+
+// MockDepositRequest simulates a deposit to an escrow on the mock chain
+type MockDepositRequest struct {
+	EscrowID      string `json:"escrow_id,omitempty"`
+	Address       string `json:"address,omitempty"` // used when no escrow ID is given
+	TxID          string `json:"txid,omitempty"`    // generated when empty
+	Vout          uint32 `json:"vout"`
+	Value         int64  `json:"value"`
+	Confirmations int64  `json:"confirmations"`
+}
+
+// MockDeposit adds a deposit to the mock chain so escrows can be funded without a real node
+func MockDeposit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		utils.WriteErrorResponse(w, http.StatusMethodNotAllowed, errors.New("method not allowed"), "Only POST method is allowed")
+		return
+	}
+
+	mock, ok := chainBackend.(*MockChain)
+	if !ok {
+		utils.WriteErrorResponse(w, http.StatusNotFound, errors.New("mock chain not in use"),
+			"Deposits can only be simulated on the mock chain")
+		return
+	}
+
+	var req MockDepositRequest
+	if err := utils.DecodeJSONBody(r, &req); err != nil {
+		utils.WriteErrorResponse(w, http.StatusBadRequest, err, "Invalid request payload")
+		return
+	}
+
+	if req.EscrowID != "" {
+		escrow, exists := getEscrow(req.EscrowID)
+		if !exists {
+			utils.WriteErrorResponse(w, http.StatusNotFound, errors.New("escrow not found"), "Escrow with the specified ID does not exist")
+			return
+		}
+		req.Address = escrow.MultiSigAddress
+	}
+
+	// Validate request
+	if req.Address == "" || req.Value <= 0 || req.Confirmations < 0 {
+		utils.WriteErrorResponse(w, http.StatusBadRequest, errors.New("invalid deposit"),
+			"An escrow ID or address and a positive value are required")
+		return
+	}
+
+	if req.TxID == "" {
+		txid := make([]byte, 32)
+		if _, err := rand.Read(txid); err != nil {
+			utils.WriteErrorResponse(w, http.StatusInternalServerError, err, "Failed to generate transaction ID")
+			return
+		}
+		req.TxID = hex.EncodeToString(txid)
+	}
+
+	utxo := UTXO{TxID: req.TxID, Vout: req.Vout, Value: req.Value, Confirmations: req.Confirmations}
+	mock.AddUTXO(req.Address, utxo)
+
+	log.Printf("Mock deposit of %d satoshis to %s in %s:%d", req.Value, req.Address, req.TxID, req.Vout)
+	utils.WriteJSONResponse(w, http.StatusCreated, map[string]interface{}{
+		"address": req.Address,
+		"utxo":    utxo,
+	})
+}
+
+// MockConfirm sets the confirmations of a transaction on the mock chain
+func MockConfirm(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		utils.WriteErrorResponse(w, http.StatusMethodNotAllowed, errors.New("method not allowed"), "Only POST method is allowed")
+		return
+	}
+
+	mock, ok := chainBackend.(*MockChain)
+	if !ok {
+		utils.WriteErrorResponse(w, http.StatusNotFound, errors.New("mock chain not in use"),
+			"Confirmations can only be simulated on the mock chain")
+		return
+	}
+
+	var req struct {
+		TxID          string `json:"txid"`
+		Confirmations int64  `json:"confirmations"`
+	}
+	if err := utils.DecodeJSONBody(r, &req); err != nil {
+		utils.WriteErrorResponse(w, http.StatusBadRequest, err, "Invalid request payload")
+		return
+	}
+
+	if req.TxID == "" || req.Confirmations < 0 {
+		utils.WriteErrorResponse(w, http.StatusBadRequest, errors.New("invalid confirmations"),
+			"Transaction ID and a non-negative number of confirmations are required")
+		return
+	}
+
+	mock.SetConfirmations(req.TxID, req.Confirmations)
+	utils.WriteJSONResponse(w, http.StatusOK, map[string]interface{}{
+		"txid":          req.TxID,
+		"confirmations": req.Confirmations,
+	})
+}
+
+// MockDoubleSpend removes a transaction from the mock chain, so the funding monitor sees its outputs disappear
+// Depositing again with the same txid brings them back, as if the transaction was mined after a reorg
+func MockDoubleSpend(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		utils.WriteErrorResponse(w, http.StatusMethodNotAllowed, errors.New("method not allowed"), "Only POST method is allowed")
+		return
+	}
+
+	mock, ok := chainBackend.(*MockChain)
+	if !ok {
+		utils.WriteErrorResponse(w, http.StatusNotFound, errors.New("mock chain not in use"),
+			"Double spends can only be simulated on the mock chain")
+		return
+	}
+
+	var req struct {
+		TxID string `json:"txid"`
+	}
+	if err := utils.DecodeJSONBody(r, &req); err != nil {
+		utils.WriteErrorResponse(w, http.StatusBadRequest, err, "Invalid request payload")
+		return
+	}
+
+	if req.TxID == "" {
+		utils.WriteErrorResponse(w, http.StatusBadRequest, errors.New("missing required fields"), "Transaction ID is required")
+		return
+	}
+
+	removed := mock.RemoveTx(req.TxID)
+	if removed == 0 {
+		utils.WriteErrorResponse(w, http.StatusNotFound, errors.New("transaction not found"),
+			fmt.Sprintf("Transaction %s has no outputs on the mock chain", req.TxID))
+		return
+	}
+
+	log.Printf("Mock double spend of %s removed %d outputs", req.TxID, removed)
+	utils.WriteJSONResponse(w, http.StatusOK, map[string]interface{}{
+		"txid":            req.TxID,
+		"removed_outputs": removed,
+	})
+}
+
+// EsploraChain reads chain data from an Esplora HTTP API, such as https://blockstream.info/testnet/api
+type EsploraChain struct {
+	baseURL string
+}
+
+// NewEsploraChain creates a chain backend for the Esplora API at baseURL
+func NewEsploraChain(baseURL string) *EsploraChain {
+	return &EsploraChain{baseURL: strings.TrimRight(baseURL, "/")}
+}
+
+// EstimateFeeRate fetches the node's fee estimates and returns the one for the confirmation target
+func (c *EsploraChain) EstimateFeeRate(target int) (float64, error) {
+	// Esplora keys the estimates by confirmation target as a string
+	var estimates map[string]float64
+	if err := c.get("/fee-estimates", &estimates); err != nil {
+		return 0, err
+	}
+
+	rates := make(map[int]float64, len(estimates))
+	for key, rate := range estimates {
+		if t, err := strconv.Atoi(key); err == nil {
+			rates[t] = rate
+		}
+	}
+
+	return feeRateForTarget(rates, target)
+}
+
+// esploraTxStatus is the response of Esplora's /tx/{txid}/status endpoint
+type esploraTxStatus struct {
+	Confirmed   bool  `json:"confirmed"`
+	BlockHeight int64 `json:"block_height"`
+}
+
+// TxConfirmations fetches the transaction's block height and counts confirmations from the chain tip
+func (c *EsploraChain) TxConfirmations(txID string) (int64, error) {
+	var status esploraTxStatus
+	if err := c.get("/tx/"+txID+"/status", &status); err != nil {
+		return 0, err
+	}
+
+	if !status.Confirmed {
+		return 0, nil
+	}
+
+	var tip int64
+	if err := c.get("/blocks/tip/height", &tip); err != nil {
+		return 0, err
+	}
+
+	return tip - status.BlockHeight + 1, nil
+}
+
+// esploraUTXO is an entry of Esplora's /address/{address}/utxo response
+type esploraUTXO struct {
+	TxID   string          `json:"txid"`
+	Vout   uint32          `json:"vout"`
+	Value  int64           `json:"value"`
+	Status esploraTxStatus `json:"status"`
+}
+
+// AddressUTXOs fetches the address's unspent outputs and counts their confirmations from the chain tip
+func (c *EsploraChain) AddressUTXOs(address string) ([]UTXO, error) {
+	var entries []esploraUTXO
+	if err := c.get("/address/"+address+"/utxo", &entries); err != nil {
+		return nil, err
+	}
+
+	var tip int64
+	if len(entries) > 0 {
+		if err := c.get("/blocks/tip/height", &tip); err != nil {
+			return nil, err
+		}
+	}
+
+	utxos := make([]UTXO, 0, len(entries))
+	for _, entry := range entries {
+		utxo := UTXO{TxID: entry.TxID, Vout: entry.Vout, Value: entry.Value}
+		if entry.Status.Confirmed {
+			utxo.Confirmations = tip - entry.Status.BlockHeight + 1
+		}
+		utxos = append(utxos, utxo)
+	}
+
+	return utxos, nil
+}
+
+// get performs a request against the Esplora API and decodes the JSON response into dst
+func (c *EsploraChain) get(path string, dst interface{}) error {
+	resp, err := utils.MakeHTTPRequest(http.MethodGet, c.baseURL+path, nil)
+	if err != nil {
+		return fmt.Errorf("chain backend request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("chain backend returned status %d for %s", resp.StatusCode, path)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(dst); err != nil {
+		return fmt.Errorf("invalid chain backend response for %s: %v", path, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,503 @@
+package escrow
+
+import (
+	"errors"
+	"escrow-service/utils"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Dispute outcomes an arbitrator can decide
+const (
+	OutcomeRelease = "release" // full release to the seller
+	OutcomeRefund  = "refund"  // full refund to the buyer
+	OutcomeSplit   = "split"   // the escrowed amount is divided between seller and buyer
+)
+
+// disputeResponseWindow is how long the parties and arbitrator have to act before a dispute
+// is auto-resolved or escalated
+var disputeResponseWindow = 72 * time.Hour
+
+// SetDisputeResponseWindow configures the dispute deadline
+func SetDisputeResponseWindow(window time.Duration) {
+	disputeResponseWindow = window
+}
+
+// DisputeStatement is a party's account of the dispute
+type DisputeStatement struct {
+	Party     string    `json:"party"` // "buyer" or "seller"
+	Statement string    `json:"statement"`
+	Evidence  []string  `json:"evidence,omitempty"` // links or hashes of supporting documents
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// DisputeDecision is the arbitrator's ruling on a dispute
+type DisputeDecision struct {
+	Outcome      string    `json:"outcome"` // "release", "refund", or "split"
+	SellerAmount int64     `json:"seller_amount,omitempty"`
+	BuyerAmount  int64     `json:"buyer_amount,omitempty"`
+	Fee          int64     `json:"fee,omitempty"` // miner fee of a split, on top of both amounts
+	Reason       string    `json:"reason,omitempty"`
+	DecidedBy    string    `json:"decided_by"`
+	DecidedAt    time.Time `json:"decided_at"`
+	Automatic    bool      `json:"automatic,omitempty"` // decided by the deadline monitor
+}
+
+// Dispute tracks a disagreement between buyer and seller on a funded escrow
+type Dispute struct {
+	OpenedBy       string             `json:"opened_by"`
+	Reason         string             `json:"reason"`
+	OpenedAt       time.Time          `json:"opened_at"`
+	PreviousStatus Status             `json:"previous_status"`
+	Deadline       time.Time          `json:"deadline"`
+	Escalated      bool               `json:"escalated,omitempty"`
+	EscalatedAt    *time.Time         `json:"escalated_at,omitempty"`
+	Statements     []DisputeStatement `json:"statements,omitempty"`
+	Decision       *DisputeDecision   `json:"decision,omitempty"`
+}
+
+// OpenDisputeRequest represents a request to open a dispute
+type OpenDisputeRequest struct {
+	EscrowID string `json:"escrow_id"`
+	Party    string `json:"party"` // "buyer" or "seller"
+	Reason   string `json:"reason"`
+}
+
+// DisputeStatementRequest represents a party's statement on an open dispute
+type DisputeStatementRequest struct {
+	EscrowID  string   `json:"escrow_id"`
+	Party     string   `json:"party"` // "buyer" or "seller"
+	Statement string   `json:"statement"`
+	Evidence  []string `json:"evidence,omitempty"`
+}
+
+// DisputeDecisionRequest represents an arbitrator's decision on a dispute
+type DisputeDecisionRequest struct {
+	EscrowID     string `json:"escrow_id"`
+	Outcome      string `json:"outcome"`                 // "release", "refund", or "split"
+	SellerAmount int64  `json:"seller_amount,omitempty"` // required for a split
+	BuyerAmount  int64  `json:"buyer_amount,omitempty"`  // required for a split
+	Reason       string `json:"reason,omitempty"`
+}
+
+// requireOutcome checks that the dispute was decided with the given outcome
+func (d *Dispute) requireOutcome(outcome string) error {
+	if d == nil || d.Decision == nil {
+		return &requestError{http.StatusBadRequest, errors.New("no decision"), "The dispute has not been decided"}
+	}
+
+	if d.Decision.Outcome != outcome {
+		return &requestError{http.StatusBadRequest, errors.New("outcome mismatch"),
+			fmt.Sprintf("The dispute was resolved with outcome %s", d.Decision.Outcome)}
+	}
+
+	return nil
+}
+
+// splitOutputs pays each party its share of a split decision
+func splitOutputs(escrow *Escrow, decision *DisputeDecision) []utils.PayoutOutput {
+	return []utils.PayoutOutput{
+		{Address: escrow.SellerPubKey, Amount: decision.SellerAmount},
+		{Address: escrow.refundAddress(), Amount: decision.BuyerAmount},
+	}
+}
+
+// applyDecision records a decision on a disputed escrow and adds the escrow service's co-signature
+// to the decided outcome. If the outcome already has another party's signature the payout is
+// created and signed straight away. The escrow is left untouched on error.
+func applyDecision(escrow *Escrow, decision *DisputeDecision, signing *payoutSigning) (string, error) {
+	if serviceSigner == nil {
+		return "", &requestError{http.StatusServiceUnavailable, errors.New("escrow signer not configured"),
+			"The escrow service signer must be configured to co-sign dispute decisions"}
+	}
+
+	if err := checkSignerKey(serviceSigner, escrow.EscrowPubKey); err != nil {
+		return "", &requestError{http.StatusBadGateway, err, "Escrow service signer cannot sign for this escrow"}
+	}
+
+	// LIMITATION: The co-signature is recorded, the actual signature is made when the payout is created
+	coSignature := PartySignature{
+		Party:     "escrow",
+		Signature: "dispute-decision",
+		Timestamp: decision.DecidedAt,
+		PublicKey: escrow.EscrowPubKey,
+	}
+
+	// A split becomes a settlement the escrow service has already signed
+	if decision.Outcome == OutcomeSplit {
+		settlement, err := newSettlement(splitOutputs(escrow, decision), decision.Fee, "arbitrator")
+		if err != nil {
+			return "", err
+		}
+		settlement.Signatures = []PartySignature{coSignature}
+
+		if err := escrow.transition(StatusResolved); err != nil {
+			return "", err
+		}
+		escrow.Dispute.Decision = decision
+		escrow.Settlement = settlement
+		return "", nil
+	}
+
+	// Release and refund reuse the signatures and fee collected before the dispute
+	existing, locked, outputs, final := escrow.ReleaseSignatures, escrow.ReleaseFee, releaseOutputs(escrow), StatusReleased
+	if decision.Outcome == OutcomeRefund {
+		existing, locked, outputs, final = escrow.RefundSignatures, escrow.RefundFee, refundOutputs(escrow), StatusRefunded
+	}
+
+	quote, outputs, err := quotePayout(escrow, locked, outputs)
+	if err != nil {
+		return "", err
+	}
+
+	signatures := append([]PartySignature{}, existing...)
+	hasEscrow := false
+	for _, sig := range signatures {
+		hasEscrow = hasEscrow || sig.Party == "escrow"
+	}
+	if !hasEscrow {
+		signatures = append(signatures, coSignature)
+	}
+
+	var signedTx, txID string
+	var payout *utils.Transaction
+	if len(signatures) >= 2 {
+		tx, signed, err := createPayout(escrow, outputs, quote.Fee, signing)
+		if err != nil {
+			return "", err
+		}
+		txID, signedTx, payout = tx.TxID, signed, &tx
+	}
+
+	// All checks passed, apply the changes
+	if err := escrow.transition(StatusResolved); err != nil {
+		return "", err
+	}
+	escrow.Dispute.Decision = decision
+
+	// A settlement proposed before the dispute no longer applies
+	escrow.Settlement = nil
+	if decision.Outcome == OutcomeRefund {
+		escrow.RefundSignatures, escrow.RefundFee = signatures, quote
+	} else {
+		escrow.ReleaseSignatures, escrow.ReleaseFee = signatures, quote
+	}
+
+	if txID != "" {
+		if err := escrow.transition(final); err != nil {
+			return "", err
+		}
+		if final == StatusRefunded {
+			escrow.RefundTxID = txID
+		} else {
+			escrow.ReleaseTxID = txID
+		}
+		escrow.recordPayout(payout)
+	}
+
+	return signedTx, nil
+}
+
+// disputeResponse builds the response returned by the dispute endpoints
+func disputeResponse(escrow *Escrow) map[string]interface{} {
+	return map[string]interface{}{
+		"escrow_id": escrow.ID,
+		"status":    escrow.Status,
+		"dispute":   escrow.Dispute,
+		"version":   escrow.Version,
+	}
+}
+
+// OpenDispute opens a dispute on a funded escrow, blocking release and refund until it is decided
+func OpenDispute(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		utils.WriteErrorResponse(w, http.StatusMethodNotAllowed, errors.New("method not allowed"), "Only POST method is allowed")
+		return
+	}
+
+	var req OpenDisputeRequest
+	if err := utils.DecodeJSONBody(r, &req); err != nil {
+		utils.WriteErrorResponse(w, http.StatusBadRequest, err, "Invalid request payload")
+		return
+	}
+
+	// Validate request
+	if req.EscrowID == "" || req.Party == "" || req.Reason == "" {
+		utils.WriteErrorResponse(w, http.StatusBadRequest, errors.New("missing required fields"),
+			"Escrow ID, party type, and reason are required")
+		return
+	}
+
+	if req.Party != "buyer" && req.Party != "seller" {
+		utils.WriteErrorResponse(w, http.StatusBadRequest, errors.New("invalid party type"),
+			"Party must be one of: buyer or seller")
+		return
+	}
+
+	var response map[string]interface{}
+	etag, err := updateEscrow(req.EscrowID, r.Header.Get("If-Match"), func(escrow *Escrow) error {
+		if err := authorizeParty(r, escrow, req.Party); err != nil {
+			return err
+		}
+
+		previous := escrow.Status
+		if err := escrow.transition(StatusDisputed); err != nil {
+			return &requestError{http.StatusBadRequest, err,
+				fmt.Sprintf("Escrow status is %s, only escrows holding funds can be disputed", escrow.Status)}
+		}
+
+		// The reason counts as the opening party's first statement
+		now := time.Now()
+		escrow.Dispute = &Dispute{
+			OpenedBy:       req.Party,
+			Reason:         req.Reason,
+			OpenedAt:       now,
+			PreviousStatus: previous,
+			Deadline:       now.Add(disputeResponseWindow),
+			Statements:     []DisputeStatement{{Party: req.Party, Statement: req.Reason, Timestamp: now}},
+		}
+
+		escrow.recordRequest(r, req.Party, "dispute_opened", previous, req.Reason)
+		log.Printf("Dispute opened for escrow ID: %s by %s", escrow.ID, req.Party)
+		response = disputeResponse(escrow)
+		return nil
+	})
+	if err != nil {
+		writeUpdateError(w, err)
+		return
+	}
+
+	w.Header().Set("ETag", etag)
+	utils.WriteJSONResponse(w, http.StatusCreated, response)
+}
+
+// AddDisputeStatement attaches a party's statement to an open dispute
+func AddDisputeStatement(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		utils.WriteErrorResponse(w, http.StatusMethodNotAllowed, errors.New("method not allowed"), "Only POST method is allowed")
+		return
+	}
+
+	var req DisputeStatementRequest
+	if err := utils.DecodeJSONBody(r, &req); err != nil {
+		utils.WriteErrorResponse(w, http.StatusBadRequest, err, "Invalid request payload")
+		return
+	}
+
+	// Validate request
+	if req.EscrowID == "" || req.Party == "" || req.Statement == "" {
+		utils.WriteErrorResponse(w, http.StatusBadRequest, errors.New("missing required fields"),
+			"Escrow ID, party type, and statement are required")
+		return
+	}
+
+	if req.Party != "buyer" && req.Party != "seller" {
+		utils.WriteErrorResponse(w, http.StatusBadRequest, errors.New("invalid party type"),
+			"Party must be one of: buyer or seller")
+		return
+	}
+
+	var response map[string]interface{}
+	etag, err := updateEscrow(req.EscrowID, r.Header.Get("If-Match"), func(escrow *Escrow) error {
+		if err := authorizeParty(r, escrow, req.Party); err != nil {
+			return err
+		}
+
+		if escrow.Status != StatusDisputed {
+			return &requestError{http.StatusBadRequest, errors.New("no open dispute"),
+				fmt.Sprintf("Escrow status is %s, statements can only be added to an open dispute", escrow.Status)}
+		}
+
+		escrow.Dispute.Statements = append(escrow.Dispute.Statements, DisputeStatement{
+			Party:     req.Party,
+			Statement: req.Statement,
+			Evidence:  req.Evidence,
+			Timestamp: time.Now(),
+		})
+
+		escrow.recordRequest(r, req.Party, "dispute_statement", escrow.Status, req.Statement)
+		log.Printf("Added dispute statement for escrow ID: %s from %s", escrow.ID, req.Party)
+		response = disputeResponse(escrow)
+		return nil
+	})
+	if err != nil {
+		writeUpdateError(w, err)
+		return
+	}
+
+	w.Header().Set("ETag", etag)
+	utils.WriteJSONResponse(w, http.StatusOK, response)
+}
+
+// DecideDispute records an arbitrator's decision, which the escrow service co-signs automatically
+func DecideDispute(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		utils.WriteErrorResponse(w, http.StatusMethodNotAllowed, errors.New("method not allowed"), "Only POST method is allowed")
+		return
+	}
+
+	var req DisputeDecisionRequest
+	if err := utils.DecodeJSONBody(r, &req); err != nil {
+		utils.WriteErrorResponse(w, http.StatusBadRequest, err, "Invalid request payload")
+		return
+	}
+
+	identity, err := authorizeArbitrator(r)
+	if err != nil {
+		writeUpdateError(w, err)
+		return
+	}
+
+	// Validate request
+	if req.EscrowID == "" || req.Outcome == "" {
+		utils.WriteErrorResponse(w, http.StatusBadRequest, errors.New("missing required fields"),
+			"Escrow ID and outcome are required")
+		return
+	}
+
+	if req.Outcome != OutcomeRelease && req.Outcome != OutcomeRefund && req.Outcome != OutcomeSplit {
+		utils.WriteErrorResponse(w, http.StatusBadRequest, errors.New("invalid outcome"),
+			"Outcome must be one of: release, refund, or split")
+		return
+	}
+
+	if req.Outcome == OutcomeSplit && (req.SellerAmount <= 0 || req.BuyerAmount <= 0) {
+		utils.WriteErrorResponse(w, http.StatusBadRequest, errors.New("invalid split"),
+			"A split requires positive seller and buyer amounts")
+		return
+	}
+
+	decision := &DisputeDecision{
+		Outcome:   req.Outcome,
+		Reason:    req.Reason,
+		DecidedBy: identity.ID,
+		DecidedAt: time.Now(),
+	}
+	if req.Outcome == OutcomeSplit {
+		decision.SellerAmount, decision.BuyerAmount = req.SellerAmount, req.BuyerAmount
+	}
+
+	var response map[string]interface{}
+	etag, err := updateEscrowSigned(req.EscrowID, r.Header.Get("If-Match"), serviceSigner, func(escrow *Escrow, signing *payoutSigning) error {
+		if escrow.Status != StatusDisputed {
+			return &requestError{http.StatusBadRequest, errors.New("no open dispute"),
+				fmt.Sprintf("Escrow status is %s, only open disputes can be decided", escrow.Status)}
+		}
+
+		// The split plus the fee must account for the whole escrowed amount
+		if req.Outcome == OutcomeSplit {
+			quote, err := quoteFee(escrow, settlementOutputs(escrow, splitOutputs(escrow, decision)))
+			if err != nil {
+				return err
+			}
+			if err := validateSettlement(escrow, splitOutputs(escrow, decision), quote.Fee); err != nil {
+				return err
+			}
+			decision.Fee = quote.Fee
+		}
+
+		signedTx, err := applyDecision(escrow, decision, signing)
+		if err != nil {
+			return err
+		}
+
+		escrow.recordRequest(r, requestActor(r), "dispute_decided", StatusDisputed,
+			fmt.Sprintf("Outcome: %s", req.Outcome))
+		log.Printf("Dispute decided for escrow ID: %s, outcome: %s, status: %s", escrow.ID, req.Outcome, escrow.Status)
+		response = disputeResponse(escrow)
+		response["signed_tx"] = signedTx
+		return nil
+	})
+	if err != nil {
+		writeUpdateError(w, err)
+		return
+	}
+
+	w.Header().Set("ETag", etag)
+	utils.WriteJSONResponse(w, http.StatusOK, response)
+}
+
+// ProcessDisputeDeadlines handles disputes whose deadline has passed
+// If only one party has made a statement since the dispute was opened it is auto-resolved in their favor,
+// otherwise it is escalated and the deadline extended. Without the escrow service signer, or if the decision
+// cannot be applied, the dispute is escalated too, and is not auto-resolved once escalated
+func ProcessDisputeDeadlines(now time.Time) {
+	for _, id := range escrowIDsWithStatus(StatusDisputed) {
+		_, err := updateEscrowSigned(id, "", serviceSigner, func(escrow *Escrow, signing *payoutSigning) error {
+			if escrow.Status != StatusDisputed || now.Before(escrow.Dispute.Deadline) || escrow.Dispute.Escalated {
+				return errUnchanged
+			}
+
+			// The reason given when opening does not count, or the opener would win every unanswered dispute
+			spoke := make(map[string]bool)
+			for _, statement := range escrow.Dispute.Statements {
+				if statement.Timestamp.After(escrow.Dispute.OpenedAt) {
+					spoke[statement.Party] = true
+				}
+			}
+
+			// The party that stayed silent loses the dispute
+			outcome, silent := "", ""
+			switch {
+			case spoke["buyer"] && !spoke["seller"]:
+				outcome, silent = OutcomeRefund, "seller"
+			case spoke["seller"] && !spoke["buyer"]:
+				outcome, silent = OutcomeRelease, "buyer"
+			}
+
+			detail := "Dispute deadline passed without a decision"
+			switch {
+			case outcome != "" && serviceSigner == nil:
+				detail = "Dispute deadline passed, it cannot be auto-resolved without the escrow service signer"
+			case outcome != "":
+				decision := &DisputeDecision{
+					Outcome:   outcome,
+					Reason:    fmt.Sprintf("The %s did not respond before the deadline", silent),
+					DecidedBy: "system",
+					DecidedAt: now,
+					Automatic: true,
+				}
+
+				_, err := applyDecision(escrow, decision, signing)
+				if err == errSigningPending {
+					return err
+				}
+				if err == nil {
+					escrow.recordHistory(now, "system", "dispute_auto_resolved", StatusDisputed, decision.Reason)
+					log.Printf("Dispute auto-resolved for escrow ID: %s, outcome: %s", escrow.ID, outcome)
+					return nil
+				}
+				log.Printf("Failed to auto-resolve dispute for escrow ID: %s: %v", escrow.ID, err)
+				detail = fmt.Sprintf("Dispute deadline passed, auto-resolution failed: %v", err)
+			}
+
+			escalateDispute(escrow, now, detail)
+			return nil
+		})
+		if err == nil || errors.Is(err, errUnchanged) {
+			continue
+		}
+
+		// The decision could not be signed, so it waits for an arbitrator rather than being retried every round
+		log.Printf("Failed to process dispute deadline for escrow ID: %s: %v", id, err)
+		updateEscrow(id, "", func(escrow *Escrow) error {
+			if escrow.Status != StatusDisputed || escrow.Dispute.Escalated {
+				return errUnchanged
+			}
+			escalateDispute(escrow, now, fmt.Sprintf("Dispute deadline passed, auto-resolution failed: %v", err))
+			return nil
+		})
+	}
+}
+
+// escalateDispute hands the dispute to an arbitrator and extends its deadline, which happens once
+func escalateDispute(escrow *Escrow, now time.Time, detail string) {
+	escalatedAt := now
+	escrow.Dispute.Escalated = true
+	escrow.Dispute.EscalatedAt = &escalatedAt
+	escrow.Dispute.Deadline = now.Add(disputeResponseWindow)
+	escrow.recordHistory(now, "system", "dispute_escalated", StatusDisputed, detail)
+	log.Printf("Dispute escalated for escrow ID: %s", escrow.ID)
+}
@@ -0,0 +1,185 @@
+package escrow
+
+import (
+	"escrow-service/auth"
+	"escrow-service/utils"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// countActions counts the events with the given action in the escrow's audit log
+func countActions(id, action string) int {
+	count := 0
+	for _, got := range historyActions(id) {
+		if got == action {
+			count++
+		}
+	}
+	return count
+}
+
+func TestDisputeDeadlineWithoutSigner(t *testing.T) {
+	defer SetServiceSigner(serviceSigner)
+	SetServiceSigner(nil)
+
+	id, _ := fundTestEscrow(t, 80000)
+	mustCall(t, OpenDispute, testBuyer, OpenDisputeRequest{EscrowID: id, Party: "buyer", Reason: "Not delivered"}, http.StatusCreated)
+	mustCall(t, AddDisputeStatement, testBuyer, DisputeStatementRequest{
+		EscrowID:  id,
+		Party:     "buyer",
+		Statement: "Still nothing",
+	}, http.StatusOK)
+
+	// The seller stayed silent, but the refund cannot be co-signed, so the dispute is escalated once
+	now := time.Now().Add(disputeResponseWindow + time.Hour)
+	for i := 0; i < 3; i++ {
+		ProcessDisputeDeadlines(now.Add(time.Duration(i) * 2 * disputeResponseWindow))
+	}
+
+	if escrow := snapshotEscrow(t, id); escrow.Status != StatusDisputed {
+		t.Errorf("expected the dispute to wait for an arbitrator, got %s", escrow.Status)
+	}
+	if got := countActions(id, "dispute_escalated"); got != 1 {
+		t.Errorf("expected the dispute to be escalated once, got %d in %v", got, historyActions(id))
+	}
+	if containsAction(id, "dispute_auto_resolved") {
+		t.Errorf("expected no auto-resolution without the escrow service signer")
+	}
+}
+
+func TestDisputeDecisionClearsSettlement(t *testing.T) {
+	defer SetServiceSigner(serviceSigner)
+
+	id, _ := fundTestEscrow(t, 80000)
+	SetServiceSigner(&probeSigner{escrowID: id})
+
+	quote := getAs(t, GetFeeQuote, testBuyer, "id="+id+"&operation=split")
+	fee := int64(quote["quote"].(map[string]interface{})["fee"].(float64))
+	available := int64(quote["available_amount"].(float64))
+	mustCall(t, ProposeSettlement, testBuyer, SettlementProposalRequest{
+		EscrowID: id,
+		Party:    "buyer",
+		Outputs:  []utils.PayoutOutput{{Address: testSellerPubKey, Amount: 40000}, {Address: testBuyerPubKey, Amount: available - 40000}},
+		Fee:      fee,
+	}, http.StatusCreated)
+
+	// A settling escrow can be disputed, and the decision replaces the proposal
+	mustCall(t, OpenDispute, testSeller, OpenDisputeRequest{EscrowID: id, Party: "seller", Reason: "Unfair split"}, http.StatusCreated)
+	mustCall(t, DecideDispute, testAdmin, DisputeDecisionRequest{EscrowID: id, Outcome: OutcomeRelease}, http.StatusOK)
+
+	viewEscrow(id, func(escrow *Escrow) error {
+		if escrow.Status != StatusResolved || escrow.Settlement != nil {
+			t.Errorf("expected a resolved escrow without the settlement proposal, got %s with %+v", escrow.Status, escrow.Settlement)
+		}
+		return nil
+	})
+}
+
+func TestDisputeDeadlineAutoResolves(t *testing.T) {
+	defer SetServiceSigner(serviceSigner)
+
+	id, _ := fundTestEscrow(t, 80000)
+	SetServiceSigner(&probeSigner{escrowID: id})
+	mustCall(t, OpenDispute, testBuyer, OpenDisputeRequest{EscrowID: id, Party: "buyer", Reason: "Not delivered"}, http.StatusCreated)
+	mustCall(t, AddDisputeStatement, testBuyer, DisputeStatementRequest{
+		EscrowID:  id,
+		Party:     "buyer",
+		Statement: "Tracking shows no shipment",
+	}, http.StatusOK)
+
+	// Nothing happens before the deadline
+	ProcessDisputeDeadlines(time.Now())
+	if escrow := snapshotEscrow(t, id); escrow.Status != StatusDisputed {
+		t.Fatalf("expected the dispute to stay open before its deadline, got %s", escrow.Status)
+	}
+
+	// The silent seller loses, the escrow service co-signs the refund
+	ProcessDisputeDeadlines(time.Now().Add(disputeResponseWindow + time.Hour))
+	viewEscrow(id, func(escrow *Escrow) error {
+		decision := escrow.Dispute.Decision
+		if escrow.Status != StatusResolved || decision == nil || decision.Outcome != OutcomeRefund || !decision.Automatic {
+			t.Fatalf("expected an automatic refund decision, got %s with %+v", escrow.Status, decision)
+		}
+		return nil
+	})
+	if !containsAction(id, "dispute_auto_resolved") {
+		t.Errorf("expected dispute_auto_resolved in the history, got %v", historyActions(id))
+	}
+
+	// Only the decided outcome takes signatures, and one more completes it
+	_, release := partySigning(id, "seller")
+	mustCall(t, ReleaseEscrow, testSeller, release, http.StatusBadRequest)
+	_, refund := partySigning(id, "buyer")
+	mustCall(t, RefundEscrow, testBuyer, refund, http.StatusOK)
+	if escrow := snapshotEscrow(t, id); escrow.Status != StatusRefunded {
+		t.Errorf("expected the refund to complete, got %s", escrow.Status)
+	}
+}
+
+func TestDisputeDeadlineEscalatesWhenBothResponded(t *testing.T) {
+	defer SetServiceSigner(serviceSigner)
+
+	id, _ := fundTestEscrow(t, 80000)
+	SetServiceSigner(&probeSigner{escrowID: id})
+	mustCall(t, OpenDispute, testSeller, OpenDisputeRequest{EscrowID: id, Party: "seller", Reason: "Not paid"}, http.StatusCreated)
+	for _, party := range []string{"buyer", "seller"} {
+		identity, _ := partySigning(id, party)
+		mustCall(t, AddDisputeStatement, identity, DisputeStatementRequest{
+			EscrowID:  id,
+			Party:     party,
+			Statement: "My side of it",
+		}, http.StatusOK)
+	}
+
+	now := time.Now().Add(disputeResponseWindow + time.Hour)
+	ProcessDisputeDeadlines(now)
+	var deadline time.Time
+	viewEscrow(id, func(escrow *Escrow) error {
+		if escrow.Status != StatusDisputed || !escrow.Dispute.Escalated || !escrow.Dispute.Deadline.After(now) {
+			t.Fatalf("expected the dispute to be escalated with a new deadline, got %s with %+v", escrow.Status, escrow.Dispute)
+		}
+		deadline = escrow.Dispute.Deadline
+		return nil
+	})
+
+	// Past the new deadline an escalated dispute still waits for the arbitrator
+	ProcessDisputeDeadlines(deadline.Add(time.Hour))
+	if got := countActions(id, "dispute_escalated"); got != 1 || snapshotEscrow(t, id).Status != StatusDisputed {
+		t.Errorf("expected one escalation and an open dispute, got %v", historyActions(id))
+	}
+}
+
+func TestDecideDispute(t *testing.T) {
+	defer SetServiceSigner(serviceSigner)
+
+	id, _ := fundTestEscrow(t, 80000)
+	SetServiceSigner(&probeSigner{escrowID: id})
+	mustCall(t, OpenDispute, testBuyer, OpenDisputeRequest{EscrowID: id, Party: "buyer", Reason: "Damaged"}, http.StatusCreated)
+
+	// Parties cannot decide their own dispute, and a split must account for the whole amount
+	mustCall(t, DecideDispute, testBuyer, DisputeDecisionRequest{EscrowID: id, Outcome: OutcomeRefund}, http.StatusForbidden)
+	mustCall(t, DecideDispute, testAdmin, DisputeDecisionRequest{
+		EscrowID:     id,
+		Outcome:      OutcomeSplit,
+		SellerAmount: 10000,
+		BuyerAmount:  10000,
+	}, http.StatusBadRequest)
+
+	arbitrator := &auth.Identity{ID: "test-arbitrator", Role: auth.RoleArbitrator}
+	response := mustCall(t, DecideDispute, arbitrator, DisputeDecisionRequest{
+		EscrowID: id,
+		Outcome:  OutcomeRelease,
+		Reason:   "Delivered as described",
+	}, http.StatusOK)
+	if response["status"] != string(StatusResolved) {
+		t.Fatalf("expected the escrow to be resolved, got %v", response)
+	}
+	mustCall(t, DecideDispute, arbitrator, DisputeDecisionRequest{EscrowID: id, Outcome: OutcomeRefund}, http.StatusBadRequest)
+
+	_, release := partySigning(id, "seller")
+	mustCall(t, ReleaseEscrow, testSeller, release, http.StatusOK)
+	if escrow := snapshotEscrow(t, id); escrow.Status != StatusReleased {
+		t.Errorf("expected the seller's signature to complete the release, got %s", escrow.Status)
+	}
+}
@@ -1,23 +1,17 @@
 package escrow
 
 import (
+	"encoding/hex"
 	_ "encoding/json"
 	"errors"
 	"escrow-service/utils"
 	"fmt"
 	"log"
 	"net/http"
-	"strings"
 	"sync"
 	"time"
 )
 
-// In-memory database for demo purposes
-var (
-	escrowsMutex sync.RWMutex
-	escrows      = make(map[string]*Escrow)
-)
-
 // EscrowRequest represents a request to create an escrow transaction
 type EscrowRequest struct {
 	BuyerPubKey  string `json:"buyer_pubkey"`
@@ -26,24 +20,43 @@ type EscrowRequest struct {
 	Amount       int64  `json:"amount"`
 	Description  string `json:"description,omitempty"`
 	ExpiryHours  int    `json:"expiry_hours,omitempty"`
+	// RequireAccessToken makes reading the escrow require the token returned at creation
+	RequireAccessToken bool `json:"require_access_token,omitempty"`
+	// Milestones splits the escrow into stages released one at a time; Amount may be omitted
+	Milestones []MilestoneRequest `json:"milestones,omitempty"`
+	// Timelocked adds a path letting the buyer reclaim the funds alone after the escrow expires
+	Timelocked bool `json:"timelocked,omitempty"`
+	// RefundAddress receives refunds and overpayments; the buyer's public key is used when empty
+	RefundAddress string `json:"refund_address,omitempty"`
+	// BatchRelease pays the release out in the next batched payout instead of in its own transaction
+	BatchRelease bool `json:"batch_release,omitempty"`
 }
 
 // ReleaseRequest represents a request to release funds from escrow
 type ReleaseRequest struct {
 	EscrowID   string `json:"escrow_id"`
-	PrivateKey string `json:"private_key"`
+	PrivateKey string `json:"private_key,omitempty"` // deprecated, send the signed psbt instead
+	PSBT       string `json:"psbt,omitempty"`        // the payout signed by the party
 	Signature  string `json:"signature"`
-	Party      string `json:"party"` // "buyer", "seller", or "escrow"
-	PublicKey  string `json:"public_key"`
+	Party      string `json:"party"`                // "buyer", "seller", or "escrow"
+	PublicKey  string `json:"public_key,omitempty"` // optional when authenticated with a key-bound session
 }
 
 // RefundRequest represents a request to refund funds from escrow
 type RefundRequest struct {
 	EscrowID   string `json:"escrow_id"`
-	PrivateKey string `json:"private_key"`
+	PrivateKey string `json:"private_key,omitempty"` // deprecated, send the signed psbt instead
+	PSBT       string `json:"psbt,omitempty"`        // the payout signed by the party
 	Signature  string `json:"signature"`
-	Party      string `json:"party"` // "buyer", "seller", or "escrow"
-	PublicKey  string `json:"public_key"`
+	Party      string `json:"party"`                // "buyer", "seller", or "escrow"
+	PublicKey  string `json:"public_key,omitempty"` // optional when authenticated with a key-bound session
+}
+
+// CancelRequest represents a request to cancel an escrow that was never funded
+type CancelRequest struct {
+	EscrowID string `json:"escrow_id"`
+	Party    string `json:"party"`            // "buyer", "seller", or "escrow"
+	Reason   string `json:"reason,omitempty"` // recorded in the history
 }
 
 // PartySignature represents a signature from a party
@@ -56,22 +69,50 @@ type PartySignature struct {
 
 // Escrow represents an escrow transaction
 type Escrow struct {
-	ID                string               `json:"id"`
-	BuyerPubKey       string               `json:"buyer_pubkey"`
-	SellerPubKey      string               `json:"seller_pubkey"`
-	EscrowPubKey      string               `json:"escrow_pubkey"`
-	MultiSigAddress   string               `json:"multisig_address"`
-	Amount            int64                `json:"amount"`
-	Description       string               `json:"description,omitempty"`
-	Status            string               `json:"status"`
-	PaymentRequest    utils.PaymentRequest `json:"payment_request"`
-	CreatedAt         time.Time            `json:"created_at"`
-	ExpiresAt         time.Time            `json:"expires_at"`
-	PaymentTxID       string               `json:"payment_txid,omitempty"`
-	ReleaseTxID       string               `json:"release_txid,omitempty"`
-	RefundTxID        string               `json:"refund_txid,omitempty"`
-	ReleaseSignatures []PartySignature     `json:"release_signatures,omitempty"`
-	RefundSignatures  []PartySignature     `json:"refund_signatures,omitempty"`
+	ID                string                `json:"id"`
+	BuyerPubKey       string                `json:"buyer_pubkey"`
+	SellerPubKey      string                `json:"seller_pubkey"`
+	EscrowPubKey      string                `json:"escrow_pubkey"`
+	MultiSigAddress   string                `json:"multisig_address"`
+	Amount            int64                 `json:"amount"`
+	Description       string                `json:"description,omitempty"`
+	MerchantID        string                `json:"merchant_id,omitempty"`
+	Status            Status                `json:"status"`
+	PaymentRequest    utils.PaymentRequest  `json:"payment_request"`
+	CreatedAt         time.Time             `json:"created_at"`
+	ExpiresAt         time.Time             `json:"expires_at"`
+	PaymentTxID       string                `json:"payment_txid,omitempty"`   // first deposit seen
+	FundingUTXOs      []UTXO                `json:"funding_utxos,omitempty"`  // deposits to the escrow address
+	Shortfall         int64                 `json:"shortfall,omitempty"`      // deposits missing to reach the amount
+	Overpayment       int64                 `json:"overpayment,omitempty"`    // deposits above the amount
+	TopUpRequest      *utils.PaymentRequest `json:"top_up_request,omitempty"` // payment request for the shortfall
+	RefundAddress     string                `json:"refund_address,omitempty"`
+	ServiceFee        *ServiceFee           `json:"service_fee,omitempty"` // fee owed to the escrow service
+	ReleaseTxID       string                `json:"release_txid,omitempty"`
+	RefundTxID        string                `json:"refund_txid,omitempty"`
+	ReleaseSignatures []PartySignature      `json:"release_signatures,omitempty"`
+	RefundSignatures  []PartySignature      `json:"refund_signatures,omitempty"`
+	ReleaseFee        *FeeQuote             `json:"release_fee,omitempty"` // locked in by the first release signature
+	RefundFee         *FeeQuote             `json:"refund_fee,omitempty"`  // locked in by the first refund signature
+	Payout            *utils.Transaction    `json:"payout,omitempty"`      // latest transaction paying out of the escrow
+	FeeBump           *FeeBump              `json:"fee_bump,omitempty"`    // pending replacement of the payout
+	FeeBumps          []FeeBump             `json:"fee_bumps,omitempty"`   // every replacement and child transaction
+	Dispute           *Dispute              `json:"dispute,omitempty"`
+	Settlement        *Settlement           `json:"settlement,omitempty"`
+	Milestones        []Milestone           `json:"milestones,omitempty"`
+	ReleasedAmount    int64                 `json:"released_amount,omitempty"` // paid out by milestone releases
+	RedeemScript      string                `json:"redeem_script,omitempty"`   // hex, set for timelocked escrows
+	LockTime          int64                 `json:"lock_time,omitempty"`       // Unix time the buyer recovery path opens
+	ExpiryHandledAt   *time.Time            `json:"expiry_handled_at,omitempty"`
+	RevertedFrom      Status                `json:"reverted_from,omitempty"` // status to resume once funding is safe again
+	SettlementTxID    string                `json:"settlement_txid,omitempty"`
+	BatchRelease      bool                  `json:"batch_release,omitempty"`
+	BatchQueuedAt     *time.Time            `json:"batch_queued_at,omitempty"` // release signed, waiting for a batch
+	BatchID           string                `json:"batch_id,omitempty"`        // batch paying out the release
+	Version           int64                 `json:"version"`
+
+	mu              sync.Mutex // serializes mutations of this escrow
+	accessTokenHash string     // hash of the optional read token, empty if not required
 }
 
 // CreateEscrow creates a new escrow transaction
@@ -93,22 +134,41 @@ func CreateEscrow(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// A milestone escrow locks the sum of its milestones
+	milestones, milestoneTotal, err := buildMilestones(req.Milestones, time.Now())
+	if err != nil {
+		utils.WriteErrorResponse(w, http.StatusBadRequest, err, "Invalid milestones")
+		return
+	}
+
+	if len(milestones) > 0 {
+		if req.Amount != 0 && req.Amount != milestoneTotal {
+			utils.WriteErrorResponse(w, http.StatusBadRequest, errors.New("invalid amount"),
+				fmt.Sprintf("Amount must equal the sum of the milestones (%d)", milestoneTotal))
+			return
+		}
+		req.Amount = milestoneTotal
+	}
+
 	if req.Amount <= 0 {
 		utils.WriteErrorResponse(w, http.StatusBadRequest, errors.New("invalid amount"), "Amount must be positive")
 		return
 	}
 
-	// Create MultiSig address
-	multiSigAddress, err := utils.CreateMultiSig(req.BuyerPubKey, req.SellerPubKey, req.EscrowPubKey)
-	if err != nil {
-		utils.WriteErrorResponse(w, http.StatusInternalServerError, err, "Failed to create MultiSig address")
-		return
+	if req.RefundAddress != "" {
+		if err := utils.ValidateAddress(req.RefundAddress); err != nil {
+			utils.WriteErrorResponse(w, http.StatusBadRequest, err, "Invalid refund address")
+			return
+		}
 	}
 
-	// Create BIP70 payment request
-	paymentRequest, err := utils.CreateBIP70PaymentRequest(multiSigAddress, req.Amount)
+	// Check the caller may open this escrow
+	identity, err := callerIdentity(r)
+	if err == nil {
+		err = authorizeCreate(identity, req)
+	}
 	if err != nil {
-		utils.WriteErrorResponse(w, http.StatusInternalServerError, err, "Failed to create BIP70 payment request")
+		writeUpdateError(w, err)
 		return
 	}
 
@@ -119,28 +179,100 @@ func CreateEscrow(w http.ResponseWriter, r *http.Request) {
 	}
 	expiryTime := time.Now().Add(time.Duration(expiryHours) * time.Hour)
 
+	// The escrow stays open at least until the last milestone is due
+	if len(milestones) > 0 && milestones[len(milestones)-1].Deadline.After(expiryTime) {
+		expiryTime = milestones[len(milestones)-1].Deadline
+	}
+
+	// Create MultiSig address, with the buyer recovery path once the escrow expires if requested
+	var multiSigAddress, redeemScript string
+	var lockTime int64
+	if req.Timelocked {
+		lockTime = expiryTime.Unix()
+		address, script, err := utils.CreateTimelockedMultiSig(req.BuyerPubKey, req.SellerPubKey, req.EscrowPubKey, lockTime)
+		if err != nil {
+			utils.WriteErrorResponse(w, http.StatusBadRequest, err, "Failed to create timelocked MultiSig address")
+			return
+		}
+		multiSigAddress, redeemScript = address, hex.EncodeToString(script)
+	} else {
+		multiSigAddress, err = utils.CreateMultiSig(req.BuyerPubKey, req.SellerPubKey, req.EscrowPubKey)
+		if err != nil {
+			utils.WriteErrorResponse(w, http.StatusInternalServerError, err, "Failed to create MultiSig address")
+			return
+		}
+	}
+
+	// The service fee is fixed at creation, a release fee must leave the seller a payout
+	serviceFee := newServiceFee(req.Amount)
+	if serviceFee != nil && serviceFee.ChargeAt == ServiceFeeAtRelease && serviceFee.Amount > req.Amount-dustLimit {
+		utils.WriteErrorResponse(w, http.StatusBadRequest, errors.New("invalid amount"),
+			fmt.Sprintf("Amount does not cover the service fee of %d satoshis", serviceFee.Amount))
+		return
+	}
+
+	// Create BIP70 payment request, with a second output paying a funding fee
+	paymentRequest, err := utils.CreateBIP70PaymentRequest(multiSigAddress, req.Amount)
+	if err == nil && serviceFee != nil && serviceFee.ChargeAt == ServiceFeeAtFunding {
+		err = utils.AddPaymentOutput(&paymentRequest, serviceFee.Address, serviceFee.Amount)
+	}
+	if err != nil {
+		utils.WriteErrorResponse(w, http.StatusInternalServerError, err, "Failed to create BIP70 payment request")
+		return
+	}
+
+	escrowID, err := utils.NewID("escrow")
+	if err != nil {
+		utils.WriteErrorResponse(w, http.StatusInternalServerError, err, "Failed to generate escrow ID")
+		return
+	}
+
 	// Create escrow record
 	escrow := &Escrow{
-		ID:              fmt.Sprintf("escrow-%d", time.Now().UnixNano()),
+		ID:              escrowID,
 		BuyerPubKey:     req.BuyerPubKey,
 		SellerPubKey:    req.SellerPubKey,
 		EscrowPubKey:    req.EscrowPubKey,
 		MultiSigAddress: multiSigAddress,
 		Amount:          req.Amount,
 		Description:     req.Description,
-		Status:          "created",
+		MerchantID:      identity.MerchantID,
+		Status:          StatusCreated,
 		PaymentRequest:  paymentRequest,
 		CreatedAt:       time.Now(),
 		ExpiresAt:       expiryTime,
+		Milestones:      milestones,
+		RedeemScript:    redeemScript,
+		LockTime:        lockTime,
+		RefundAddress:   req.RefundAddress,
+		ServiceFee:      serviceFee,
+		BatchRelease:    req.BatchRelease,
+		Version:         1,
+	}
+
+	// Issue a read token if requested, it is only returned once
+	var accessToken string
+	if req.RequireAccessToken {
+		accessToken, escrow.accessTokenHash, err = utils.NewAccessToken()
+		if err != nil {
+			utils.WriteErrorResponse(w, http.StatusInternalServerError, err, "Failed to generate access token")
+			return
+		}
 	}
 
+	escrow.recordRequest(r, string(identity.Role), "created", "",
+		fmt.Sprintf("Escrow of %d satoshis to %s", escrow.Amount, escrow.MultiSigAddress))
+
 	// Store in "database"
-	escrowsMutex.Lock()
-	escrows[escrow.ID] = escrow
-	escrowsMutex.Unlock()
+	saveEscrow(escrow)
 
 	log.Printf("Created escrow with ID: %s", escrow.ID)
-	utils.WriteJSONResponse(w, http.StatusCreated, escrow)
+	w.Header().Set("ETag", escrow.etag())
+	utils.WriteJSONResponse(w, http.StatusCreated, struct {
+		*Escrow
+		PaymentURI  PaymentURI `json:"payment_uri"`
+		AccessToken string     `json:"access_token,omitempty"`
+	}{escrow, escrow.paymentURI("", ""), accessToken})
 }
 
 // ReleaseEscrow releases funds from escrow to the seller
@@ -157,114 +289,141 @@ func ReleaseEscrow(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Validate request
-	if req.EscrowID == "" || req.PrivateKey == "" || req.Signature == "" || req.Party == "" || req.PublicKey == "" {
+	if req.EscrowID == "" || req.Signature == "" {
 		utils.WriteErrorResponse(w, http.StatusBadRequest, errors.New("missing required fields"),
-			"Escrow ID, private key, signature, party type, and public key are required")
-		return
-	}
-
-	// Validate party type
-	if req.Party != "buyer" && req.Party != "seller" && req.Party != "escrow" {
-		utils.WriteErrorResponse(w, http.StatusBadRequest, errors.New("invalid party type"),
-			"Party must be one of: buyer, seller, or escrow")
+			"Escrow ID and signature are required")
 		return
 	}
 
-	// Get escrow from "database"
-	escrowsMutex.RLock()
-	escrow, exists := escrows[req.EscrowID]
-	escrowsMutex.RUnlock()
-
-	if !exists {
-		utils.WriteErrorResponse(w, http.StatusNotFound, errors.New("escrow not found"), "Escrow with the specified ID does not exist")
-		return
-	}
-
-	// Check escrow status
-	if escrow.Status != "funded" && escrow.Status != "releasing" {
-		utils.WriteErrorResponse(w,
-			http.StatusBadRequest,
-			errors.New("invalid escrow status"),
-			fmt.Sprintf("Escrow status is %s, must be 'funded' or 'releasing' to process release request", escrow.Status))
+	party, err := parsePayoutSigner(r, req.Party, req.PublicKey, req.PSBT, req.PrivateKey)
+	if err != nil {
+		writeUpdateError(w, err)
 		return
 	}
+	newSignature := party.signature(req.Signature)
+
+	// Checks and mutations run under the escrow's lock so concurrent requests
+	// cannot both pass the checks and both create a transaction
+	var response map[string]interface{}
+	etag, err := updateEscrowSigned(req.EscrowID, r.Header.Get("If-Match"), party.signer, func(escrow *Escrow, signing *payoutSigning) error {
+		if err := party.check(r, escrow); err != nil {
+			return err
+		}
 
-	// LIMITATION: No cryptographic signature verification
-	// In a production implementation:
-	// 1. Verify that the signature is cryptographically valid for the transaction
-	// 2. Verify that the public key matches the one provided during escrow creation
-	// 3. Ensure the signature covers the correct transaction data
-	// 4. Validate the signature against Bitcoin consensus rules
-
-	// Check if this party has already signed
-	for _, sig := range escrow.ReleaseSignatures {
-		if sig.Party == req.Party {
-			utils.WriteErrorResponse(w, http.StatusBadRequest, errors.New("duplicate signature"),
-				fmt.Sprintf("A signature from %s has already been provided", req.Party))
-			return
+		// Check escrow status, a resolved dispute only takes signatures for the decided outcome
+		resolved := escrow.Status == StatusResolved
+		if resolved {
+			if err := escrow.Dispute.requireOutcome(OutcomeRelease); err != nil {
+				return err
+			}
+		} else if err := escrow.Status.CanTransition(StatusReleasing); err != nil {
+			return &requestError{http.StatusBadRequest, err,
+				fmt.Sprintf("Escrow status is %s, cannot process release request", escrow.Status)}
 		}
-	}
 
-	// Create new signature record
-	newSignature := PartySignature{
-		Party:     req.Party,
-		Signature: req.Signature,
-		Timestamp: time.Now(),
-		PublicKey: req.PublicKey,
-	}
+		// LIMITATION: No cryptographic signature verification
+		// In a production implementation:
+		// 1. Verify that the signature is cryptographically valid for the transaction
+		// 2. Verify that the public key matches the one provided during escrow creation
+		// 3. Ensure the signature covers the correct transaction data
+		// 4. Validate the signature against Bitcoin consensus rules
+
+		// A batched release takes no more signatures once queued
+		batched := escrow.BatchRelease && !resolved
+		if batched && escrow.BatchQueuedAt != nil {
+			return &requestError{http.StatusBadRequest, errors.New("release queued"),
+				"Release is already queued for a batched payout"}
+		}
 
-	// Update escrow record with new signature
-	escrowsMutex.Lock()
-	defer escrowsMutex.Unlock()
+		// Check if this party has already signed
+		for _, sig := range escrow.ReleaseSignatures {
+			if sig.Party == req.Party {
+				return &requestError{http.StatusBadRequest, errors.New("duplicate signature"),
+					fmt.Sprintf("A signature from %s has already been provided", req.Party)}
+			}
+		}
 
-	// Add the signature
-	escrow.ReleaseSignatures = append(escrow.ReleaseSignatures, newSignature)
+		signatures := append(append([]PartySignature{}, escrow.ReleaseSignatures...), newSignature)
 
-	// Check if we have reached the 2-of-3 threshold
-	if len(escrow.ReleaseSignatures) >= 2 {
-		// LIMITATION: Simplified transaction creation
-		// In a production implementation:
-		// 1. Construct a proper Bitcoin transaction with correct inputs and outputs
-		// 2. Use UTXO management to track available funds
-		// 3. Apply proper fee estimation based on transaction size and network conditions
-		// 4. Create and sign a proper multisig transaction using the redeem script
-		// 5. Broadcast the transaction to the Bitcoin network
-		// 6. Use Partially Signed Bitcoin Transactions (PSBT) for more robust handling
-		
-		// Create release transaction (simplified for demo)
-		releaseTransaction, err := utils.CreateTransaction(
-			escrow.MultiSigAddress,
-			escrow.SellerPubKey, // This would be an actual address in a real implementation
-			escrow.Amount-1000,  // Subtract fee (fixed fee, not dynamic)
-			req.PrivateKey,
-		)
+		// The first signature locks in the fee, later signatures sign the same payout
+		quote, outputs, err := quotePayout(escrow, escrow.ReleaseFee, releaseOutputs(escrow))
 		if err != nil {
-			utils.WriteErrorResponse(w, http.StatusInternalServerError, err, "Failed to create release transaction")
-			return
+			return err
 		}
 
-		// Update to released status
-		escrow.Status = "released"
-		escrow.ReleaseTxID = releaseTransaction.TxID
-		log.Printf("Released escrow with ID: %s, TxID: %s", escrow.ID, releaseTransaction.TxID)
-	} else {
-		// Update to releasing status
-		escrow.Status = "releasing"
-		log.Printf("Added release signature for escrow ID: %s from %s", escrow.ID, req.Party)
-	}
+		var signedTx, txID string
+		var payout *utils.Transaction
+
+		// Check if we have reached the 2-of-3 threshold, a batched release is paid out by the batcher
+		if len(signatures) >= 2 && !batched {
+			// LIMITATION: Simplified transaction creation
+			// In a production implementation:
+			// 1. Construct a proper Bitcoin transaction with correct inputs and outputs
+			// 2. Use UTXO management to track available funds
+			// 3. Create and sign a proper multisig transaction using the redeem script
+			// 4. Broadcast the transaction to the Bitcoin network
+			// 5. Use Partially Signed Bitcoin Transactions (PSBT) for more robust handling
+
+			// Create release transaction (simplified for demo)
+			releaseTransaction, signed, err := createPayout(escrow, outputs, quote.Fee, signing)
+			if err != nil {
+				return err
+			}
+			txID, signedTx, payout = releaseTransaction.TxID, signed, &releaseTransaction
+		}
 
-	// Save the updated escrow
-	escrows[req.EscrowID] = escrow
+		// All checks passed, apply the changes
+		from := escrow.Status
+		if !resolved {
+			if err := escrow.transition(StatusReleasing); err != nil {
+				return err
+			}
+		}
+		escrow.ReleaseSignatures = signatures
+		escrow.ReleaseFee = quote
+
+		if txID != "" {
+			// Update to released status
+			if err := escrow.transition(StatusReleased); err != nil {
+				return err
+			}
+			escrow.ReleaseTxID = txID
+			escrow.recordPayout(payout)
+			log.Printf("Released escrow with ID: %s, TxID: %s", escrow.ID, txID)
+		} else if batched && len(signatures) >= 2 {
+			now := time.Now()
+			escrow.BatchQueuedAt = &now
+			log.Printf("Queued release of escrow ID: %s for a batched payout", escrow.ID)
+		} else {
+			log.Printf("Added release signature for escrow ID: %s from %s", escrow.ID, req.Party)
+		}
+		escrow.recordRequest(r, req.Party, "release_signed", from,
+			fmt.Sprintf("Release signature %d of 2", len(signatures)))
+
+		response = map[string]interface{}{
+			"escrow_id":         escrow.ID,
+			"status":            escrow.Status,
+			"txid":              escrow.ReleaseTxID,
+			"signatures_count":  len(escrow.ReleaseSignatures),
+			"signatures_needed": 2,
+			"signatures":        escrow.ReleaseSignatures,
+			"fee":               escrow.ReleaseFee,
+			"signed_tx":         signedTx,
+			"version":           escrow.Version,
+		}
+		if escrow.BatchQueuedAt != nil {
+			response["batch_queued_at"] = escrow.BatchQueuedAt
+		}
+		return nil
+	})
+	if err != nil {
+		writeUpdateError(w, err)
+		return
+	}
 
 	// Response
-	utils.WriteJSONResponse(w, http.StatusOK, map[string]interface{}{
-		"escrow_id":         escrow.ID,
-		"status":            escrow.Status,
-		"txid":              escrow.ReleaseTxID,
-		"signatures_count":  len(escrow.ReleaseSignatures),
-		"signatures_needed": 2,
-		"signatures":        escrow.ReleaseSignatures,
-	})
+	w.Header().Set("ETag", etag)
+	utils.WriteJSONResponse(w, http.StatusOK, response)
 }
 
 // RefundEscrow refunds funds from escrow to the buyer
@@ -281,104 +440,119 @@ func RefundEscrow(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Validate request
-	if req.EscrowID == "" || req.PrivateKey == "" || req.Signature == "" || req.Party == "" || req.PublicKey == "" {
+	if req.EscrowID == "" || req.Signature == "" {
 		utils.WriteErrorResponse(w, http.StatusBadRequest, errors.New("missing required fields"),
-			"Escrow ID, private key, signature, party type, and public key are required")
-		return
-	}
-
-	// Validate party type
-	if req.Party != "buyer" && req.Party != "seller" && req.Party != "escrow" {
-		utils.WriteErrorResponse(w, http.StatusBadRequest, errors.New("invalid party type"),
-			"Party must be one of: buyer, seller, or escrow")
+			"Escrow ID and signature are required")
 		return
 	}
 
-	// Get escrow from "database"
-	escrowsMutex.RLock()
-	escrow, exists := escrows[req.EscrowID]
-	escrowsMutex.RUnlock()
-
-	if !exists {
-		utils.WriteErrorResponse(w, http.StatusNotFound, errors.New("escrow not found"), "Escrow with the specified ID does not exist")
-		return
-	}
-
-	// Check escrow status
-	if escrow.Status != "funded" && escrow.Status != "refunding" {
-		utils.WriteErrorResponse(w,
-			http.StatusBadRequest,
-			errors.New("invalid escrow status"),
-			fmt.Sprintf("Escrow status is %s, must be 'funded' or 'refunding' to process refund request", escrow.Status))
+	party, err := parsePayoutSigner(r, req.Party, req.PublicKey, req.PSBT, req.PrivateKey)
+	if err != nil {
+		writeUpdateError(w, err)
 		return
 	}
+	newSignature := party.signature(req.Signature)
+
+	// Checks and mutations run under the escrow's lock so concurrent requests
+	// cannot both pass the checks and both create a transaction
+	var response map[string]interface{}
+	etag, err := updateEscrowSigned(req.EscrowID, r.Header.Get("If-Match"), party.signer, func(escrow *Escrow, signing *payoutSigning) error {
+		if err := party.check(r, escrow); err != nil {
+			return err
+		}
 
-	// Verify signature (simplified for demo)
-	// In a real app, you would verify that the signature is valid and corresponds to an authorized key
-
-	// Check if this party has already signed
-	for _, sig := range escrow.RefundSignatures {
-		if sig.Party == req.Party {
-			utils.WriteErrorResponse(w, http.StatusBadRequest, errors.New("duplicate signature"),
-				fmt.Sprintf("A signature from %s has already been provided", req.Party))
-			return
+		// Check escrow status, a resolved dispute only takes signatures for the decided outcome
+		resolved := escrow.Status == StatusResolved
+		if resolved {
+			if err := escrow.Dispute.requireOutcome(OutcomeRefund); err != nil {
+				return err
+			}
+		} else if err := escrow.Status.CanTransition(StatusRefunding); err != nil {
+			return &requestError{http.StatusBadRequest, err,
+				fmt.Sprintf("Escrow status is %s, cannot process refund request", escrow.Status)}
 		}
-	}
 
-	// Create new signature record
-	newSignature := PartySignature{
-		Party:     req.Party,
-		Signature: req.Signature,
-		Timestamp: time.Now(),
-		PublicKey: req.PublicKey,
-	}
+		// Verify signature (simplified for demo)
+		// In a real app, you would verify that the signature is valid and corresponds to an authorized key
 
-	// Update escrow record with new signature
-	escrowsMutex.Lock()
-	defer escrowsMutex.Unlock()
+		// Check if this party has already signed
+		for _, sig := range escrow.RefundSignatures {
+			if sig.Party == req.Party {
+				return &requestError{http.StatusBadRequest, errors.New("duplicate signature"),
+					fmt.Sprintf("A signature from %s has already been provided", req.Party)}
+			}
+		}
 
-	// Add the signature
-	escrow.RefundSignatures = append(escrow.RefundSignatures, newSignature)
+		signatures := append(append([]PartySignature{}, escrow.RefundSignatures...), newSignature)
 
-	// Check if we have reached the 2-of-3 threshold
-	if len(escrow.RefundSignatures) >= 2 {
-		// Create refund transaction (simplified for demo)
-		refundTransaction, err := utils.CreateTransaction(
-			escrow.MultiSigAddress,
-			escrow.BuyerPubKey, // This would be an actual address in a real implementation
-			escrow.Amount-1000, // Subtract fee
-			req.PrivateKey,
-		)
+		// The first signature locks in the fee, later signatures sign the same payout
+		quote, outputs, err := quotePayout(escrow, escrow.RefundFee, refundOutputs(escrow))
 		if err != nil {
-			utils.WriteErrorResponse(w, http.StatusInternalServerError, err, "Failed to create refund transaction")
-			return
+			return err
 		}
 
-		// Update to refunded status
-		escrow.Status = "refunded"
-		escrow.RefundTxID = refundTransaction.TxID
-		log.Printf("Refunded escrow with ID: %s, TxID: %s", escrow.ID, refundTransaction.TxID)
-	} else {
-		// Update to refunding status
-		escrow.Status = "refunding"
-		log.Printf("Added refund signature for escrow ID: %s from %s", escrow.ID, req.Party)
-	}
+		var signedTx, txID string
+		var payout *utils.Transaction
+
+		// Check if we have reached the 2-of-3 threshold
+		if len(signatures) >= 2 {
+			// Create refund transaction (simplified for demo)
+			refundTransaction, signed, err := createPayout(escrow, outputs, quote.Fee, signing)
+			if err != nil {
+				return err
+			}
+			txID, signedTx, payout = refundTransaction.TxID, signed, &refundTransaction
+		}
 
-	// Save the updated escrow
-	escrows[req.EscrowID] = escrow
+		// All checks passed, apply the changes
+		from := escrow.Status
+		if !resolved {
+			if err := escrow.transition(StatusRefunding); err != nil {
+				return err
+			}
+		}
+		escrow.RefundSignatures = signatures
+		escrow.RefundFee = quote
+
+		if txID != "" {
+			// Update to refunded status
+			if err := escrow.transition(StatusRefunded); err != nil {
+				return err
+			}
+			escrow.RefundTxID = txID
+			escrow.recordPayout(payout)
+			log.Printf("Refunded escrow with ID: %s, TxID: %s", escrow.ID, txID)
+		} else {
+			log.Printf("Added refund signature for escrow ID: %s from %s", escrow.ID, req.Party)
+		}
+		escrow.recordRequest(r, req.Party, "refund_signed", from,
+			fmt.Sprintf("Refund signature %d of 2", len(signatures)))
+
+		response = map[string]interface{}{
+			"escrow_id":         escrow.ID,
+			"status":            escrow.Status,
+			"txid":              escrow.RefundTxID,
+			"signatures_count":  len(escrow.RefundSignatures),
+			"signatures_needed": 2,
+			"signatures":        escrow.RefundSignatures,
+			"fee":               escrow.RefundFee,
+			"signed_tx":         signedTx,
+			"version":           escrow.Version,
+		}
+		return nil
+	})
+	if err != nil {
+		writeUpdateError(w, err)
+		return
+	}
 
 	// Response
-	utils.WriteJSONResponse(w, http.StatusOK, map[string]interface{}{
-		"escrow_id":         escrow.ID,
-		"status":            escrow.Status,
-		"txid":              escrow.RefundTxID,
-		"signatures_count":  len(escrow.RefundSignatures),
-		"signatures_needed": 2,
-		"signatures":        escrow.RefundSignatures,
-	})
+	w.Header().Set("ETag", etag)
+	utils.WriteJSONResponse(w, http.StatusOK, response)
 }
 
-// VerifyPayment verifies a payment to an escrow
+// VerifyPayment verifies the payments to an escrow, marking it funded once its confirmed deposits reach the amount
+// It can be called again to pick up deposits made later
 func VerifyPayment(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		utils.WriteErrorResponse(w, http.StatusMethodNotAllowed, errors.New("method not allowed"), "Only POST method is allowed")
@@ -387,7 +561,7 @@ func VerifyPayment(w http.ResponseWriter, r *http.Request) {
 
 	var req struct {
 		EscrowID string `json:"escrow_id"`
-		TxID     string `json:"txid"`
+		TxID     string `json:"txid,omitempty"` // optional, must be one of the deposits found
 	}
 
 	if err := utils.DecodeJSONBody(r, &req); err != nil {
@@ -396,81 +570,271 @@ func VerifyPayment(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Validate request
-	if req.EscrowID == "" || req.TxID == "" {
-		utils.WriteErrorResponse(w, http.StatusBadRequest, errors.New("missing required fields"), "Escrow ID and transaction ID are required")
+	if req.EscrowID == "" {
+		utils.WriteErrorResponse(w, http.StatusBadRequest, errors.New("missing required fields"), "Escrow ID is required")
 		return
 	}
 
 	// Get escrow from "database"
-	escrowsMutex.RLock()
-	escrow, exists := escrows[req.EscrowID]
-	escrowsMutex.RUnlock()
-
+	escrow, exists := getEscrow(req.EscrowID)
 	if !exists {
 		utils.WriteErrorResponse(w, http.StatusNotFound, errors.New("escrow not found"), "Escrow with the specified ID does not exist")
 		return
 	}
 
-	// Check if payment is already verified for this escrow
-	if escrow.Status == "funded" {
-		utils.WriteErrorResponse(w, http.StatusBadRequest, errors.New("payment already verified"),
-			fmt.Sprintf("Escrow ID: %s already has a verified payment with txID: %s", escrow.ID, escrow.PaymentTxID))
+	// Parties, keys and merchant never change after creation, so this check needs no lock
+	if err := authorizeAccess(r, escrow); err != nil {
+		writeUpdateError(w, err)
 		return
 	}
 
-	// Verify transaction against our validation rules and "blockchain"
-	verified, err := utils.VerifyTransaction(req.TxID)
+	// Look up the deposits before taking the escrow lock, the chain backend may be slow
+	utxos, err := chainBackend.AddressUTXOs(escrow.MultiSigAddress)
 	if err != nil {
-		// Provide specific error from transaction verification
-		code := http.StatusBadRequest
-		if strings.Contains(err.Error(), "not found") {
-			// Transaction not found in our known transactions list
-			code = http.StatusNotFound
+		utils.WriteErrorResponse(w, http.StatusBadGateway, err, "Failed to look up deposits to the escrow address")
+		return
+	}
+
+	// A funding fee is paid by the deposit transactions, its output is found among those paying the service address
+	var feeUTXOs []UTXO
+	if fee := escrow.ServiceFee; fee != nil && fee.ChargeAt == ServiceFeeAtFunding {
+		if feeUTXOs, err = chainBackend.AddressUTXOs(fee.Address); err != nil {
+			utils.WriteErrorResponse(w, http.StatusBadGateway, err, "Failed to look up the service fee payment")
+			return
+		}
+	}
+
+	// Update escrow record
+	var response map[string]interface{}
+	etag, err := updateEscrow(escrow.ID, r.Header.Get("If-Match"), func(escrow *Escrow) error {
+		// Deposits only count towards funding until the escrow starts paying out
+		if escrow.Status != StatusCreated && escrow.Status != StatusUnderfunded && escrow.Status != StatusFunded {
+			return &requestError{http.StatusBadRequest, errors.New("invalid status"),
+				fmt.Sprintf("Escrow status is %s, cannot accept a payment", escrow.Status)}
+		}
+
+		// Claims are kept even if the update fails below, the deposits still belong to this escrow
+		utxos := claimUTXOs(escrow.ID, utxos)
+		if req.TxID != "" {
+			found := false
+			for _, utxo := range utxos {
+				found = found || utxo.TxID == req.TxID
+			}
+			if !found {
+				return &requestError{http.StatusNotFound, errors.New("transaction not found"),
+					fmt.Sprintf("Transaction %s does not pay the escrow address", req.TxID)}
+			}
+		}
+
+		previous := append([]UTXO(nil), escrow.FundingUTXOs...)
+		added := escrow.trackUTXOs(utxos)
+		shortfall := escrow.fundingShortfall()
+
+		// A shortfall within the tolerance is absorbed by the payouts, a larger one needs a top-up
+		funded := escrow.confirmedAmount() >= escrow.Amount-fundingPolicy.Tolerance
+		underfunded := !funded && escrow.Status != StatusFunded && len(escrow.FundingUTXOs) > 0 &&
+			shortfall > fundingPolicy.Tolerance
+
+		var topUp *utils.PaymentRequest
+		if underfunded && (escrow.TopUpRequest == nil || escrow.TopUpRequest.Amount != shortfall) {
+			request, err := CreateCustomBIP70PaymentRequest(escrow.MultiSigAddress, shortfall,
+				fmt.Sprintf("Top-up for escrow #%s", escrow.ID), 0)
+			if err != nil {
+				escrow.FundingUTXOs = previous
+				return &requestError{http.StatusInternalServerError, err, "Failed to create top-up payment request"}
+			}
+			topUp = &request
 		}
-		utils.WriteErrorResponse(w, code, err, fmt.Sprintf("Transaction verification failed: %v", err))
+
+		// All checks passed, apply the changes, starting with the status so a rejected change leaves the escrow as it was
+		now := time.Now()
+		from := escrow.Status
+		var err error
+		switch {
+		case funded && escrow.Status != StatusFunded:
+			// Both created and underfunded escrows can be funded
+			err = escrow.transition(StatusFunded)
+		case underfunded && escrow.Status == StatusCreated:
+			err = escrow.transition(StatusUnderfunded)
+		}
+		if err != nil {
+			escrow.FundingUTXOs = previous
+			return err
+		}
+
+		if escrow.PaymentTxID == "" && len(escrow.FundingUTXOs) > 0 {
+			escrow.PaymentTxID = escrow.FundingUTXOs[0].TxID
+		}
+		escrow.Shortfall = shortfall
+		escrow.Overpayment = 0
+		if overpayment := escrow.fundedAmount() - escrow.Amount; overpayment > 0 {
+			escrow.Overpayment = overpayment
+		}
+
+		switch {
+		case funded && from != StatusFunded:
+			if escrow.TopUpRequest != nil {
+				escrow.TopUpRequest.InvalidatedAt = &now
+			}
+
+			log.Printf("Payment verified for escrow ID: %s, %d satoshis confirmed", escrow.ID, escrow.confirmedAmount())
+		case underfunded:
+			if from == StatusCreated {
+				// The original request asks for the full amount, the top-up replaces it
+				escrow.PaymentRequest.InvalidatedAt = &now
+			}
+			if topUp != nil {
+				indexPaymentRequest(topUp.RequestID, escrow.ID)
+				escrow.TopUpRequest = topUp
+			}
+			log.Printf("Escrow ID: %s is underfunded by %d satoshis", escrow.ID, shortfall)
+		case added > 0:
+			log.Printf("Found %d new deposits for escrow ID: %s", added, escrow.ID)
+		}
+		escrow.collectFundingFee(feeUTXOs, now)
+		if escrow.Status != from || added > 0 {
+			escrow.recordRequest(r, requestActor(r), "payment_verified", from,
+				fmt.Sprintf("%d new deposits, %d of %d satoshis confirmed", added, escrow.confirmedAmount(), escrow.Amount))
+		}
+
+		// Create comprehensive response with all details
+		response = map[string]interface{}{
+			"escrow_id":        escrow.ID,
+			"status":           escrow.Status,
+			"payment_txid":     escrow.PaymentTxID,
+			"funding_utxos":    escrow.unspentUTXOs(),
+			"funded_amount":    escrow.fundedAmount(),
+			"confirmed_amount": escrow.confirmedAmount(),
+			"multisig_address": escrow.MultiSigAddress,
+			"amount":           escrow.Amount,
+			"buyer_pubkey":     escrow.BuyerPubKey,
+			"seller_pubkey":    escrow.SellerPubKey,
+			"escrow_pubkey":    escrow.EscrowPubKey,
+			"created_at":       escrow.CreatedAt,
+			"expires_at":       escrow.ExpiresAt,
+			"version":          escrow.Version,
+		}
+
+		if escrow.Overpayment > 0 {
+			response["overpayment"] = escrow.Overpayment
+		}
+
+		switch escrow.Status {
+		case StatusCreated:
+			response["message"] = fmt.Sprintf("Waiting for %d more confirmed satoshis",
+				escrow.Amount-escrow.confirmedAmount())
+		case StatusUnderfunded:
+			response["shortfall"] = escrow.Shortfall
+			response["top_up_request"] = escrow.TopUpRequest
+			response["message"] = fmt.Sprintf("Escrow is underfunded by %d satoshis, pay the top-up request",
+				escrow.Shortfall)
+		}
+
+		// Add signatures information if any exists
+		if len(escrow.ReleaseSignatures) > 0 {
+			response["release_signatures"] = escrow.ReleaseSignatures
+			response["release_signatures_count"] = len(escrow.ReleaseSignatures)
+		}
+
+		if len(escrow.RefundSignatures) > 0 {
+			response["refund_signatures"] = escrow.RefundSignatures
+			response["refund_signatures_count"] = len(escrow.RefundSignatures)
+		}
+		return nil
+	})
+	if err != nil {
+		writeUpdateError(w, err)
 		return
 	}
 
-	if !verified {
-		utils.WriteErrorResponse(w, http.StatusBadRequest, errors.New("invalid transaction"),
-			"Transaction could not be verified - it may be invalid or have insufficient confirmations")
+	w.Header().Set("ETag", etag)
+	utils.WriteJSONResponse(w, http.StatusOK, response)
+}
+
+// CancelEscrow cancels an escrow before anything was deposited to it and invalidates its payment request
+func CancelEscrow(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		utils.WriteErrorResponse(w, http.StatusMethodNotAllowed, errors.New("method not allowed"), "Only POST method is allowed")
 		return
 	}
 
-	// Update escrow record
-	escrowsMutex.Lock()
-	escrow.Status = "funded"
-	escrow.PaymentTxID = req.TxID
-	escrows[req.EscrowID] = escrow
-	escrowsMutex.Unlock()
+	var req CancelRequest
+	if err := utils.DecodeJSONBody(r, &req); err != nil {
+		utils.WriteErrorResponse(w, http.StatusBadRequest, err, "Invalid request payload")
+		return
+	}
 
-	log.Printf("Payment verified for escrow ID: %s, TxID: %s", escrow.ID, req.TxID)
+	// Validate request
+	if req.EscrowID == "" || req.Party == "" {
+		utils.WriteErrorResponse(w, http.StatusBadRequest, errors.New("missing required fields"),
+			"Escrow ID and party type are required")
+		return
+	}
 
-	// Create comprehensive response with all details
-	response := map[string]interface{}{
-		"escrow_id":        escrow.ID,
-		"status":           escrow.Status,
-		"payment_txid":     req.TxID,
-		"multisig_address": escrow.MultiSigAddress,
-		"amount":           escrow.Amount,
-		"buyer_pubkey":     escrow.BuyerPubKey,
-		"seller_pubkey":    escrow.SellerPubKey,
-		"escrow_pubkey":    escrow.EscrowPubKey,
-		"created_at":       escrow.CreatedAt,
-		"expires_at":       escrow.ExpiresAt,
+	if req.Party != "buyer" && req.Party != "seller" && req.Party != "escrow" {
+		utils.WriteErrorResponse(w, http.StatusBadRequest, errors.New("invalid party type"),
+			"Party must be one of: buyer, seller, or escrow")
+		return
 	}
 
-	// Add signatures information if any exists
-	if len(escrow.ReleaseSignatures) > 0 {
-		response["release_signatures"] = escrow.ReleaseSignatures
-		response["release_signatures_count"] = len(escrow.ReleaseSignatures)
+	escrow, exists := getEscrow(req.EscrowID)
+	if !exists {
+		utils.WriteErrorResponse(w, http.StatusNotFound, errors.New("escrow not found"), "Escrow with the specified ID does not exist")
+		return
 	}
 
-	if len(escrow.RefundSignatures) > 0 {
-		response["refund_signatures"] = escrow.RefundSignatures
-		response["refund_signatures_count"] = len(escrow.RefundSignatures)
+	// Look up the deposits before taking the escrow lock, the chain backend may be slow.
+	// Funds already sent to the address would be stranded by a cancelled escrow
+	utxos, err := chainBackend.AddressUTXOs(escrow.MultiSigAddress)
+	if err != nil {
+		utils.WriteErrorResponse(w, http.StatusBadGateway, err, "Failed to look up deposits to the escrow address")
+		return
 	}
 
+	var response map[string]interface{}
+	etag, err := updateEscrow(req.EscrowID, r.Header.Get("If-Match"), func(escrow *Escrow) error {
+		if err := authorizeParty(r, escrow, req.Party); err != nil {
+			return err
+		}
+
+		if err := escrow.Status.CanTransition(StatusCancelled); err != nil {
+			return &requestError{http.StatusBadRequest, err,
+				fmt.Sprintf("Escrow status is %s, only escrows that were never funded can be cancelled", escrow.Status)}
+		}
+
+		if len(unclaimedUTXOs(escrow.ID, utxos)) > 0 || len(escrow.FundingUTXOs) > 0 {
+			return &requestError{http.StatusConflict, errors.New("deposits found"),
+				"Escrow address has received deposits, verify the payment instead of cancelling"}
+		}
+
+		// All checks passed, apply the changes
+		if err := escrow.transition(StatusCancelled); err != nil {
+			return err
+		}
+
+		now := time.Now()
+		escrow.PaymentRequest.InvalidatedAt = &now
+		detail := fmt.Sprintf("Payment request %s invalidated", escrow.PaymentRequest.RequestID)
+		if req.Reason != "" {
+			detail += ": " + req.Reason
+		}
+		escrow.recordRequest(r, req.Party, "cancelled", StatusCreated, detail)
+
+		log.Printf("Escrow ID: %s cancelled by %s", escrow.ID, req.Party)
+		response = map[string]interface{}{
+			"escrow_id":    escrow.ID,
+			"status":       escrow.Status,
+			"cancelled_by": req.Party,
+			"version":      escrow.Version,
+		}
+		return nil
+	})
+	if err != nil {
+		writeUpdateError(w, err)
+		return
+	}
+
+	w.Header().Set("ETag", etag)
 	utils.WriteJSONResponse(w, http.StatusOK, response)
 }
 
@@ -488,16 +852,28 @@ func GetEscrow(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Get escrow from "database"
-	escrowsMutex.RLock()
-	escrow, exists := escrows[escrowID]
-	escrowsMutex.RUnlock()
-
-	if !exists {
-		utils.WriteErrorResponse(w, http.StatusNotFound, errors.New("escrow not found"), "Escrow with the specified ID does not exist")
+	// Read the escrow under its lock so the response is a consistent snapshot
+	var response map[string]interface{}
+	var etag string
+	err := viewEscrow(escrowID, func(escrow *Escrow) error {
+		if err := authorizeRead(r, escrow); err != nil {
+			return err
+		}
+		response = escrowDetails(r, escrow)
+		etag = escrow.etag()
+		return nil
+	})
+	if err != nil {
+		writeUpdateError(w, err)
 		return
 	}
 
+	w.Header().Set("ETag", etag)
+	utils.WriteJSONResponse(w, http.StatusOK, response)
+}
+
+// escrowDetails builds the detailed representation of an escrow returned by GetEscrow to the caller of r
+func escrowDetails(r *http.Request, escrow *Escrow) map[string]interface{} {
 	// Create comprehensive response with all details
 	response := map[string]interface{}{
 		"escrow_id":        escrow.ID,
@@ -510,7 +886,9 @@ func GetEscrow(w http.ResponseWriter, r *http.Request) {
 		"created_at":       escrow.CreatedAt,
 		"expires_at":       escrow.ExpiresAt,
 		"description":      escrow.Description,
+		"merchant_id":      escrow.MerchantID,
 		"payment_request":  escrow.PaymentRequest,
+		"version":          escrow.Version,
 	}
 
 	// Add transaction IDs if they exist
@@ -518,6 +896,38 @@ func GetEscrow(w http.ResponseWriter, r *http.Request) {
 		response["payment_txid"] = escrow.PaymentTxID
 	}
 
+	if len(escrow.FundingUTXOs) > 0 {
+		response["funding_utxos"] = escrow.FundingUTXOs
+		response["funded_amount"] = escrow.fundedAmount()
+	}
+
+	if escrow.Shortfall > 0 {
+		response["shortfall"] = escrow.Shortfall
+	}
+
+	if escrow.Overpayment > 0 {
+		response["overpayment"] = escrow.Overpayment
+	}
+
+	if escrow.awaitingPayment() {
+		response["payment_uri"] = escrow.paymentURI("", "")
+	}
+
+	if escrow.TopUpRequest != nil {
+		response["top_up_request"] = escrow.TopUpRequest
+	}
+
+	if escrow.RefundAddress != "" {
+		response["refund_address"] = escrow.RefundAddress
+	}
+
+	if escrow.ServiceFee != nil {
+		response["service_fee"] = struct {
+			*ServiceFee
+			Status string `json:"status"`
+		}{escrow.ServiceFee, escrow.ServiceFee.status(escrow.Status)}
+	}
+
 	if escrow.ReleaseTxID != "" {
 		response["release_txid"] = escrow.ReleaseTxID
 	}
@@ -526,6 +936,73 @@ func GetEscrow(w http.ResponseWriter, r *http.Request) {
 		response["refund_txid"] = escrow.RefundTxID
 	}
 
+	if escrow.SettlementTxID != "" {
+		response["settlement_txid"] = escrow.SettlementTxID
+	}
+
+	if escrow.ReleaseFee != nil {
+		response["release_fee"] = escrow.ReleaseFee
+	}
+
+	if escrow.RefundFee != nil {
+		response["refund_fee"] = escrow.RefundFee
+	}
+
+	if escrow.Payout != nil {
+		response["payout"] = escrow.Payout
+	}
+
+	if escrow.FeeBump != nil {
+		response["fee_bump"] = escrow.FeeBump
+	}
+
+	if len(escrow.FeeBumps) > 0 {
+		response["fee_bumps"] = escrow.FeeBumps
+	}
+
+	if escrow.Settlement != nil {
+		response["settlement"] = escrow.Settlement
+	}
+
+	if escrow.BatchRelease {
+		response["batch_release"] = true
+	}
+
+	if escrow.BatchQueuedAt != nil {
+		response["batch_queued_at"] = escrow.BatchQueuedAt
+	}
+
+	if escrow.BatchID != "" {
+		response["batch_id"] = escrow.BatchID
+	}
+
+	if escrow.ExpiryHandledAt != nil {
+		response["expiry_handled_at"] = escrow.ExpiryHandledAt
+	}
+
+	if escrow.RevertedFrom != "" {
+		response["reverted_from"] = escrow.RevertedFrom
+	}
+
+	if events := escrowEvents(escrow.ID); len(events) > 0 {
+		response["history"] = visibleEvents(r, events)
+	}
+
+	if escrow.RedeemScript != "" {
+		response["redeem_script"] = escrow.RedeemScript
+		response["lock_time"] = escrow.LockTime
+	}
+
+	if len(escrow.Milestones) > 0 {
+		response["milestones"] = escrow.Milestones
+		response["released_amount"] = escrow.ReleasedAmount
+		response["locked_amount"] = escrow.lockedAmount()
+	}
+
+	if escrow.Dispute != nil {
+		response["dispute"] = escrow.Dispute
+	}
+
 	// Add signatures information if any exists
 	if len(escrow.ReleaseSignatures) > 0 {
 		response["release_signatures"] = escrow.ReleaseSignatures
@@ -551,5 +1028,5 @@ func GetEscrow(w http.ResponseWriter, r *http.Request) {
 		response["refund_parties"] = parties
 	}
 
-	utils.WriteJSONResponse(w, http.StatusOK, response)
+	return response
 }
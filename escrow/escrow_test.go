@@ -0,0 +1,206 @@
+package escrow
+
+import (
+	"bytes"
+	"encoding/json"
+	"escrow-service/auth"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// partySigning returns the identity and release or refund request of a party signing with its private key
+func partySigning(id, party string) (*auth.Identity, ReleaseRequest) {
+	identity, privateKey, publicKey := testBuyer, testBuyerPrivKey, testBuyerPubKey
+	if party == "seller" {
+		identity, privateKey, publicKey = testSeller, testSellerPrivKey, testSellerPubKey
+	}
+	return identity, ReleaseRequest{
+		EscrowID:   id,
+		PrivateKey: privateKey,
+		Signature:  "signature",
+		Party:      party,
+		PublicKey:  publicKey,
+	}
+}
+
+// postIfMatch sends body to handler as identity with an If-Match header
+func postIfMatch(t *testing.T, handler http.HandlerFunc, identity *auth.Identity, body interface{}, ifMatch string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	payload, err := json.Marshal(body)
+	if err != nil {
+		t.Fatalf("failed to encode request: %v", err)
+	}
+	r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(payload))
+	r.Header.Set("If-Match", ifMatch)
+	r = r.WithContext(auth.WithIdentity(r.Context(), identity))
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+func TestConcurrentReleaseAndRefund(t *testing.T) {
+	for round := 0; round < 10; round++ {
+		id, _ := fundTestEscrow(t, 60000)
+
+		// Both parties sign both payouts at once, only one payout may come out of it
+		var wg sync.WaitGroup
+		for _, handler := range []http.HandlerFunc{ReleaseEscrow, RefundEscrow} {
+			for _, party := range []string{"buyer", "seller"} {
+				wg.Add(1)
+				go func(handler http.HandlerFunc, party string) {
+					defer wg.Done()
+					identity, req := partySigning(id, party)
+					postIfMatch(t, handler, identity, req, "")
+				}(handler, party)
+			}
+		}
+		wg.Wait()
+
+		viewEscrow(id, func(escrow *Escrow) error {
+			if (escrow.ReleaseTxID == "") == (escrow.RefundTxID == "") {
+				t.Errorf("expected exactly one payout, got release %q and refund %q in status %s",
+					escrow.ReleaseTxID, escrow.RefundTxID, escrow.Status)
+			}
+			if escrow.Status != StatusReleased && escrow.Status != StatusRefunded {
+				t.Errorf("expected the first payout signed by both parties to complete, got %s", escrow.Status)
+			}
+			return nil
+		})
+	}
+}
+
+func TestReleaseIfMatch(t *testing.T) {
+	id, _ := fundTestEscrow(t, 60000)
+
+	r := httptest.NewRequest(http.MethodGet, "/?id="+id, nil)
+	r = r.WithContext(auth.WithIdentity(r.Context(), testBuyer))
+	w := httptest.NewRecorder()
+	GetEscrow(w, r)
+	etag := w.Header().Get("ETag")
+	if etag == "" {
+		t.Fatalf("expected an ETag on the escrow")
+	}
+
+	// The buyer signs against the version read, the seller's copy is then stale
+	identity, req := partySigning(id, "buyer")
+	if w := postIfMatch(t, ReleaseEscrow, identity, req, etag); w.Code != http.StatusOK || w.Header().Get("ETag") == etag {
+		t.Fatalf("expected the release to be signed with a new ETag, got %d: %s", w.Code, w.Body.String())
+	}
+	identity, req = partySigning(id, "seller")
+	if w := postIfMatch(t, ReleaseEscrow, identity, req, etag); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("expected a stale If-Match to be refused with 412, got %d", w.Code)
+	}
+	if escrow := snapshotEscrow(t, id); escrow.Status != StatusReleasing {
+		t.Errorf("expected the refused signature to leave the escrow releasing, got %s", escrow.Status)
+	}
+
+	// Without If-Match the signature applies to whatever the current version is
+	mustCall(t, ReleaseEscrow, identity, req, http.StatusOK)
+}
+
+func TestCancelUnfundedEscrow(t *testing.T) {
+	// Escrows between the test keys share an address, a fresh chain keeps other tests' deposits off it
+	defer SetChainBackend(chainBackend)
+	SetChainBackend(NewMockChain())
+
+	id := createTestEscrow(t, 50000)
+	mustCall(t, CancelEscrow, testSeller, CancelRequest{EscrowID: id, Party: "buyer"}, http.StatusForbidden)
+	response := mustCall(t, CancelEscrow, testBuyer, CancelRequest{EscrowID: id, Party: "buyer", Reason: "order withdrawn"}, http.StatusOK)
+	if response["status"] != string(StatusCancelled) || !containsAction(id, "cancelled") {
+		t.Errorf("expected the escrow to be cancelled, got %v with history %v", response["status"], historyActions(id))
+	}
+	viewEscrow(id, func(escrow *Escrow) error {
+		if escrow.PaymentRequest.InvalidatedAt == nil {
+			t.Errorf("expected the payment request to be invalidated")
+		}
+		return nil
+	})
+	mustCall(t, CancelEscrow, testBuyer, CancelRequest{EscrowID: id, Party: "buyer"}, http.StatusBadRequest)
+
+	// Deposits not verified yet still keep an escrow from being cancelled
+	deposited := createTestEscrow(t, 50000)
+	depositTestFunds(t, deposited, 50000, 0)
+	mustCall(t, CancelEscrow, testSeller, CancelRequest{EscrowID: deposited, Party: "seller"}, http.StatusConflict)
+	if escrow := snapshotEscrow(t, deposited); escrow.Status != StatusCreated {
+		t.Errorf("expected the escrow to stay created, got %s", escrow.Status)
+	}
+}
+
+func TestEscrowAccessToken(t *testing.T) {
+	response := mustCall(t, CreateEscrow, testAdmin, EscrowRequest{
+		BuyerPubKey:        testBuyerPubKey,
+		SellerPubKey:       testSellerPubKey,
+		EscrowPubKey:       testEscrowPubKey,
+		Amount:             50000,
+		RequireAccessToken: true,
+	}, http.StatusCreated)
+	id := response["id"].(string)
+	token, _ := response["access_token"].(string)
+	if token == "" {
+		t.Fatalf("expected an access token at creation, got %v", response)
+	}
+
+	read := func(identity *auth.Identity, token string) int {
+		r := httptest.NewRequest(http.MethodGet, "/?id="+id, nil)
+		if token != "" {
+			r.Header.Set("X-Escrow-Token", token)
+		}
+		if identity != nil {
+			r = r.WithContext(auth.WithIdentity(r.Context(), identity))
+		}
+		w := httptest.NewRecorder()
+		GetEscrow(w, r)
+		return w.Code
+	}
+
+	outsider := &auth.Identity{ID: "test-outsider", Role: auth.RoleParticipant,
+		PubKey: "0279be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798"}
+	for _, c := range []struct {
+		name     string
+		identity *auth.Identity
+		token    string
+		code     int
+	}{
+		{"token", nil, token, http.StatusOK},
+		{"party", testBuyer, "", http.StatusOK},
+		{"wrong token", testBuyer, "not-the-token", http.StatusForbidden},
+		{"anonymous", nil, "", http.StatusUnauthorized},
+		{"outsider", outsider, "", http.StatusForbidden},
+	} {
+		if code := read(c.identity, c.token); code != c.code {
+			t.Errorf("%s: expected %d, got %d", c.name, c.code, code)
+		}
+	}
+
+	// IDs are random, not derived from the creation time
+	if other := createTestEscrow(t, 50000); other == id || len(other) != len("escrow-")+36 {
+		t.Errorf("expected distinct UUID-based IDs, got %s and %s", id, other)
+	}
+}
+
+func TestPartyAuthorization(t *testing.T) {
+	id, _ := fundTestEscrow(t, 60000)
+
+	// The buyer cannot sign as the seller, even with the seller's key in the request
+	_, req := partySigning(id, "seller")
+	mustCall(t, ReleaseEscrow, testBuyer, req, http.StatusForbidden)
+
+	// Only admins act for the escrow service, and merchants of other escrows see nothing
+	mustCall(t, ReleaseEscrow, testSeller, ReleaseRequest{
+		EscrowID:   id,
+		Signature:  "signature",
+		Party:      "escrow",
+		PublicKey:  testEscrowPubKey,
+		PrivateKey: testBuyerPrivKey,
+	}, http.StatusForbidden)
+	merchant := &auth.Identity{ID: "test-merchant", Role: auth.RoleMerchant, MerchantID: "other-merchant"}
+	mustCall(t, VerifyPayment, merchant, map[string]string{"escrow_id": id}, http.StatusForbidden)
+
+	if escrow := snapshotEscrow(t, id); escrow.Status != StatusFunded || len(historyActions(id)) == 0 ||
+		containsAction(id, "release_signed") {
+		t.Errorf("expected refused signatures to leave the escrow funded, got %s with %v", escrow.Status, historyActions(id))
+	}
+}
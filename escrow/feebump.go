@@ -0,0 +1,531 @@
+package escrow
+
+import (
+	"errors"
+	"escrow-service/utils"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Fee bump methods
+const (
+	FeeBumpRBF  = "rbf"  // the payout is replaced by a version paying a higher fee
+	FeeBumpCPFP = "cpfp" // a child spending one of the payout's outputs pays for both
+)
+
+// minRelayFeeRate is the feerate, in sat/vB, a replacement must pay on top of the fee it replaces (BIP125 rule 4)
+const minRelayFeeRate = 1.0
+
+// FeeBump is a transaction that speeds up confirmation of an escrow payout
+type FeeBump struct {
+	ID         string               `json:"id"`
+	Method     string               `json:"method"`      // "rbf" or "cpfp"
+	ParentTxID string               `json:"parent_txid"` // the payout replaced (rbf) or spent (cpfp)
+	Outputs    []utils.PayoutOutput `json:"outputs"`
+	Fee        *FeeQuote            `json:"fee"`
+	ProposedBy string               `json:"proposed_by"`
+	ProposedAt time.Time            `json:"proposed_at"`
+	Signatures []PartySignature     `json:"signatures,omitempty"`
+	TxID       string               `json:"txid,omitempty"`
+}
+
+// FeeBumpProposalRequest represents a request to replace the payout with a higher-fee version
+type FeeBumpProposalRequest struct {
+	EscrowID string  `json:"escrow_id"`
+	Party    string  `json:"party"`              // "buyer", "seller", or "escrow"
+	FeeRate  float64 `json:"fee_rate,omitempty"` // sat/vB, defaults to the current estimate
+}
+
+// FeeBumpSignRequest represents a party's signature on the proposed replacement
+type FeeBumpSignRequest struct {
+	EscrowID   string `json:"escrow_id"`
+	BumpID     string `json:"bump_id"`
+	PrivateKey string `json:"private_key,omitempty"` // deprecated, send the signed psbt instead
+	PSBT       string `json:"psbt,omitempty"`        // the payout signed by the party
+	Signature  string `json:"signature"`
+	Party      string `json:"party"`                // "buyer", "seller", or "escrow"
+	PublicKey  string `json:"public_key,omitempty"` // optional when authenticated with a key-bound session
+}
+
+// CPFPRequest represents a payout recipient spending their output with a high-fee child
+type CPFPRequest struct {
+	EscrowID  string  `json:"escrow_id"`
+	Party     string  `json:"party"`              // "buyer" or "seller"
+	Vout      int     `json:"vout"`               // payout output paying the party
+	Address   string  `json:"address,omitempty"`  // defaults to the address of the spent output
+	FeeRate   float64 `json:"fee_rate,omitempty"` // sat/vB for parent and child together, defaults to the current estimate
+	Signature string  `json:"signature"`
+	PublicKey string  `json:"public_key,omitempty"` // optional when authenticated with a key-bound session
+}
+
+// bumpFeeRate returns the requested feerate, or the current estimate when none was requested
+func bumpFeeRate(requested float64) (float64, error) {
+	if requested < 0 || requested > feePolicy.MaxFeeRate {
+		return 0, &requestError{http.StatusBadRequest, errors.New("invalid fee rate"),
+			fmt.Sprintf("Fee rate must be between 0 and the cap of %g sat/vB", feePolicy.MaxFeeRate)}
+	}
+
+	if requested > 0 {
+		return requested, nil
+	}
+	return currentFeeRate()
+}
+
+// payoutLookup holds the confirmations of an escrow's payout, looked up before the escrow is locked
+type payoutLookup struct {
+	txID          string
+	confirmations int64
+}
+
+// lookupPayout fetches the confirmations of the escrow's payout without holding its lock, since the chain
+// backend may be remote. A missing escrow or payout is left to the checks made under the lock
+func lookupPayout(escrowID string) (*payoutLookup, error) {
+	lookup := &payoutLookup{}
+	viewEscrow(escrowID, func(escrow *Escrow) error {
+		if escrow.Payout != nil {
+			lookup.txID = escrow.Payout.TxID
+		}
+		return nil
+	})
+	if lookup.txID == "" {
+		return lookup, nil
+	}
+
+	confirmations, err := chainBackend.TxConfirmations(lookup.txID)
+	if err != nil {
+		return nil, &requestError{http.StatusBadGateway, err, "Failed to look up the payout transaction"}
+	}
+	lookup.confirmations = confirmations
+	return lookup, nil
+}
+
+// unconfirmedPayout returns the escrow's payout if it is still waiting for confirmation
+func unconfirmedPayout(escrow *Escrow, lookup *payoutLookup) (*utils.Transaction, error) {
+	if escrow.Payout == nil {
+		return nil, &requestError{http.StatusBadRequest, errors.New("no payout"),
+			fmt.Sprintf("Escrow status is %s, there is no payout to bump", escrow.Status)}
+	}
+
+	if escrow.BatchID != "" {
+		return nil, &requestError{http.StatusConflict, errors.New("batched payout"),
+			fmt.Sprintf("Payout %s is shared with the other escrows of batch %s and cannot be bumped for one of them",
+				escrow.Payout.TxID, escrow.BatchID)}
+	}
+
+	// The payout may have been created or replaced while its confirmations were looked up
+	if escrow.Payout.TxID != lookup.txID {
+		return nil, &requestError{http.StatusConflict, errors.New("payout changed"),
+			fmt.Sprintf("Payout changed to %s while it was looked up, retry the request", escrow.Payout.TxID)}
+	}
+
+	if lookup.confirmations > 0 {
+		return nil, &requestError{http.StatusConflict, errors.New("payout confirmed"),
+			fmt.Sprintf("Payout %s already has %d confirmations", escrow.Payout.TxID, lookup.confirmations)}
+	}
+
+	return escrow.Payout, nil
+}
+
+// replacePayoutTxID points every reference to a replaced payout at its replacement
+func (e *Escrow) replacePayoutTxID(oldTxID, newTxID string) {
+	e.recordHistory(time.Now(), "system", "payout_replaced", e.Status, fmt.Sprintf("TxID: %s replaced by %s", oldTxID, newTxID))
+
+	for _, txID := range []*string{&e.ReleaseTxID, &e.RefundTxID, &e.SettlementTxID} {
+		if *txID == oldTxID {
+			*txID = newTxID
+		}
+	}
+
+	if e.Settlement != nil && e.Settlement.TxID == oldTxID {
+		e.Settlement.TxID = newTxID
+	}
+
+	if e.ServiceFee != nil && e.ServiceFee.TxID == oldTxID {
+		e.ServiceFee.TxID = newTxID
+	}
+
+	// The replacement spends the same outputs and pays any change back to the escrow at the new txid
+	for i := range e.FundingUTXOs {
+		if e.FundingUTXOs[i].SpentBy == oldTxID {
+			e.FundingUTXOs[i].SpentBy = newTxID
+		}
+		if e.FundingUTXOs[i].TxID == oldTxID {
+			e.FundingUTXOs[i].TxID = newTxID
+		}
+	}
+
+	for i := range e.Milestones {
+		if e.Milestones[i].TxID == oldTxID {
+			e.Milestones[i].TxID = newTxID
+		}
+	}
+}
+
+// feeBumpResponse builds the response returned by the fee bump endpoints
+func feeBumpResponse(escrow *Escrow, bump *FeeBump) map[string]interface{} {
+	response := map[string]interface{}{
+		"escrow_id": escrow.ID,
+		"status":    escrow.Status,
+		"fee_bump":  bump,
+		"payout":    escrow.Payout,
+		"version":   escrow.Version,
+	}
+	if bump.TxID == "" && escrow.Payout != nil {
+		response["unsigned_tx"] = unsignedPayout(escrow.Payout.Inputs, bump.Outputs, bump.Fee.Fee)
+	}
+	return response
+}
+
+// ProposeFeeBump proposes replacing an unconfirmed payout with one paying a higher fee
+// The extra fee is taken from the payout's first output, and the replacement needs 2 of 3 signatures
+func ProposeFeeBump(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		utils.WriteErrorResponse(w, http.StatusMethodNotAllowed, errors.New("method not allowed"), "Only POST method is allowed")
+		return
+	}
+
+	var req FeeBumpProposalRequest
+	if err := utils.DecodeJSONBody(r, &req); err != nil {
+		utils.WriteErrorResponse(w, http.StatusBadRequest, err, "Invalid request payload")
+		return
+	}
+
+	// Validate request
+	if req.EscrowID == "" || req.Party == "" {
+		utils.WriteErrorResponse(w, http.StatusBadRequest, errors.New("missing required fields"),
+			"Escrow ID and party type are required")
+		return
+	}
+
+	if req.Party != "buyer" && req.Party != "seller" && req.Party != "escrow" {
+		utils.WriteErrorResponse(w, http.StatusBadRequest, errors.New("invalid party type"),
+			"Party must be one of: buyer, seller, or escrow")
+		return
+	}
+
+	// Confirmations come from the chain backend, which is asked before the escrow is locked
+	lookup, err := lookupPayout(req.EscrowID)
+	if err != nil {
+		writeUpdateError(w, err)
+		return
+	}
+
+	var response map[string]interface{}
+	etag, err := updateEscrow(req.EscrowID, r.Header.Get("If-Match"), func(escrow *Escrow) error {
+		if err := authorizeParty(r, escrow, req.Party); err != nil {
+			return err
+		}
+
+		payout, err := unconfirmedPayout(escrow, lookup)
+		if err != nil {
+			return err
+		}
+
+		rate, err := bumpFeeRate(req.FeeRate)
+		if err != nil {
+			return err
+		}
+
+		// The replacement has the same shape as the payout, only the first output shrinks
+		vsize := utils.EstimateVsize(escrow.spendPath(), 2, len(payout.Inputs), outputAddresses(payout.Outputs))
+		if rate <= float64(payout.Fee)/float64(vsize) {
+			return &requestError{http.StatusBadRequest, errors.New("fee rate too low"),
+				fmt.Sprintf("Fee rate must be above the payout's %.2f sat/vB", float64(payout.Fee)/float64(vsize))}
+		}
+
+		fee := utils.FeeForVsize(vsize, rate)
+		if minimum := payout.Fee + utils.FeeForVsize(vsize, minRelayFeeRate); fee < minimum {
+			fee = minimum
+		}
+
+		outputs := append([]utils.PayoutOutput{}, payout.Outputs...)
+		if outputs[0].Amount-(fee-payout.Fee) < dustLimit {
+			return &requestError{http.StatusBadRequest, errors.New("amount too small"),
+				fmt.Sprintf("Output to %s cannot cover an extra fee of %d satoshis", outputs[0].Address, fee-payout.Fee)}
+		}
+		outputs[0].Amount -= fee - payout.Fee
+
+		id, err := utils.NewID("bump")
+		if err != nil {
+			return &requestError{http.StatusInternalServerError, err, "Failed to generate fee bump ID"}
+		}
+
+		// All checks passed, a new proposal replaces the previous one
+		escrow.FeeBump = &FeeBump{
+			ID:         id,
+			Method:     FeeBumpRBF,
+			ParentTxID: payout.TxID,
+			Outputs:    outputs,
+			Fee: &FeeQuote{
+				FeeRate:    float64(fee) / float64(vsize),
+				Vsize:      vsize,
+				Fee:        fee,
+				ConfTarget: feePolicy.ConfTarget,
+				QuotedAt:   time.Now(),
+			},
+			ProposedBy: req.Party,
+			ProposedAt: time.Now(),
+		}
+
+		escrow.recordRequest(r, req.Party, "fee_bump_proposed", escrow.Status,
+			fmt.Sprintf("Replacement %s of payout %s at %d satoshis", id, payout.TxID, fee))
+		log.Printf("Fee bump %s proposed for escrow ID: %s by %s", id, escrow.ID, req.Party)
+		response = feeBumpResponse(escrow, escrow.FeeBump)
+		return nil
+	})
+	if err != nil {
+		writeUpdateError(w, err)
+		return
+	}
+
+	w.Header().Set("ETag", etag)
+	utils.WriteJSONResponse(w, http.StatusCreated, response)
+}
+
+// SignFeeBump adds a party's signature to the proposed replacement
+// Once 2 of 3 parties have signed the replacement is created and becomes the escrow's payout
+func SignFeeBump(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		utils.WriteErrorResponse(w, http.StatusMethodNotAllowed, errors.New("method not allowed"), "Only POST method is allowed")
+		return
+	}
+
+	var req FeeBumpSignRequest
+	if err := utils.DecodeJSONBody(r, &req); err != nil {
+		utils.WriteErrorResponse(w, http.StatusBadRequest, err, "Invalid request payload")
+		return
+	}
+
+	// Validate request
+	if req.EscrowID == "" || req.BumpID == "" || req.Signature == "" {
+		utils.WriteErrorResponse(w, http.StatusBadRequest, errors.New("missing required fields"),
+			"Escrow ID, bump ID, and signature are required")
+		return
+	}
+
+	party, err := parsePayoutSigner(r, req.Party, req.PublicKey, req.PSBT, req.PrivateKey)
+	if err != nil {
+		writeUpdateError(w, err)
+		return
+	}
+	newSignature := party.signature(req.Signature)
+
+	// Confirmations come from the chain backend, which is asked before the escrow is locked
+	lookup, err := lookupPayout(req.EscrowID)
+	if err != nil {
+		writeUpdateError(w, err)
+		return
+	}
+
+	var response map[string]interface{}
+	etag, err := updateEscrowSigned(req.EscrowID, r.Header.Get("If-Match"), party.signer, func(escrow *Escrow, signing *payoutSigning) error {
+		if err := party.check(r, escrow); err != nil {
+			return err
+		}
+
+		bump := escrow.FeeBump
+		if bump == nil {
+			return &requestError{http.StatusBadRequest, errors.New("no fee bump"), "There is no fee bump to sign"}
+		}
+
+		// Signatures cover a specific replacement, so a replaced proposal cannot be signed
+		if bump.ID != req.BumpID {
+			return &requestError{http.StatusConflict, errors.New("fee bump replaced"),
+				fmt.Sprintf("Fee bump %s is no longer current, the current proposal is %s", req.BumpID, bump.ID)}
+		}
+
+		payout, err := unconfirmedPayout(escrow, lookup)
+		if err != nil {
+			return err
+		}
+
+		for _, sig := range bump.Signatures {
+			if sig.Party == req.Party {
+				return &requestError{http.StatusBadRequest, errors.New("duplicate signature"),
+					fmt.Sprintf("A signature from %s has already been provided", req.Party)}
+			}
+		}
+
+		signatures := append(append([]PartySignature{}, bump.Signatures...), newSignature)
+
+		var signedTx string
+		var replacement *utils.Transaction
+
+		// Check if we have reached the 2-of-3 threshold
+		if len(signatures) >= 2 {
+			tx, signed, err := signing.payout(payout.Inputs, bump.Outputs, bump.Fee.Fee)
+			if err != nil {
+				return err
+			}
+			signedTx, replacement = signed, &tx
+		}
+
+		// All checks passed, apply the changes
+		bump.Signatures = signatures
+		if replacement != nil {
+			bump.TxID = replacement.TxID
+			escrow.replacePayoutTxID(payout.TxID, replacement.TxID)
+			escrow.Payout = replacement
+			escrow.FeeBumps = append(escrow.FeeBumps, *bump)
+			escrow.FeeBump = nil
+			log.Printf("Replaced payout %s of escrow ID: %s with %s", payout.TxID, escrow.ID, replacement.TxID)
+		} else {
+			log.Printf("Added fee bump signature for escrow ID: %s from %s", escrow.ID, req.Party)
+		}
+		escrow.recordRequest(r, req.Party, "fee_bump_signed", escrow.Status,
+			fmt.Sprintf("Replacement %s signature %d of 2", bump.ID, len(signatures)))
+
+		response = feeBumpResponse(escrow, bump)
+		response["signatures_count"] = len(bump.Signatures)
+		response["signatures_needed"] = 2
+		response["signed_tx"] = signedTx
+		return nil
+	})
+	if err != nil {
+		writeUpdateError(w, err)
+		return
+	}
+
+	w.Header().Set("ETag", etag)
+	utils.WriteJSONResponse(w, http.StatusOK, response)
+}
+
+// paysKey reports whether address pays the given public key, directly or by its hash
+func paysKey(address, pubKey string) bool {
+	if strings.EqualFold(address, pubKey) {
+		return true
+	}
+	hashAddress, err := utils.PubKeyHashAddress(pubKey)
+	return err == nil && address == hashAddress
+}
+
+// CreateCPFP builds a child spending a payout recipient's output with enough fee for both transactions
+// to confirm at the target feerate. The child is returned unsigned, the recipient signs and broadcasts it
+// with their own key, which the service never sees
+func CreateCPFP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		utils.WriteErrorResponse(w, http.StatusMethodNotAllowed, errors.New("method not allowed"), "Only POST method is allowed")
+		return
+	}
+
+	var req CPFPRequest
+	if err := utils.DecodeJSONBody(r, &req); err != nil {
+		utils.WriteErrorResponse(w, http.StatusBadRequest, err, "Invalid request payload")
+		return
+	}
+
+	// Validate request
+	if req.EscrowID == "" || req.Signature == "" {
+		utils.WriteErrorResponse(w, http.StatusBadRequest, errors.New("missing required fields"),
+			"Escrow ID and signature are required")
+		return
+	}
+
+	// Only a payout recipient can spend its output
+	party, err := parseSigningParty(r, req.Party, req.PublicKey, "buyer", "seller")
+	if err != nil {
+		writeUpdateError(w, err)
+		return
+	}
+
+	// Confirmations come from the chain backend, which is asked before the escrow is locked
+	lookup, err := lookupPayout(req.EscrowID)
+	if err != nil {
+		writeUpdateError(w, err)
+		return
+	}
+
+	var response map[string]interface{}
+	etag, err := updateEscrow(req.EscrowID, r.Header.Get("If-Match"), func(escrow *Escrow) error {
+		if err := party.check(r, escrow); err != nil {
+			return err
+		}
+
+		payout, err := unconfirmedPayout(escrow, lookup)
+		if err != nil {
+			return err
+		}
+
+		if req.Vout < 0 || req.Vout >= len(payout.Outputs) || !paysKey(payout.Outputs[req.Vout].Address, party.publicKey) {
+			return &requestError{http.StatusBadRequest, errors.New("invalid output"),
+				fmt.Sprintf("Output %d of payout %s does not pay the %s", req.Vout, payout.TxID, req.Party)}
+		}
+		spent := payout.Outputs[req.Vout]
+
+		rate, err := bumpFeeRate(req.FeeRate)
+		if err != nil {
+			return err
+		}
+
+		address := req.Address
+		if address == "" {
+			address = spent.Address
+		}
+
+		// The child pays for the package, less what the payout already pays
+		parentVsize := utils.EstimateVsize(escrow.spendPath(), 2, len(payout.Inputs), outputAddresses(payout.Outputs))
+		childVsize := utils.EstimateVsize(utils.SpendPubKeyHash, 1, 1, []string{address})
+		fee := utils.FeeForVsize(parentVsize+childVsize, rate) - payout.Fee
+		if fee < utils.FeeForVsize(childVsize, rate) {
+			return &requestError{http.StatusBadRequest, errors.New("fee rate too low"),
+				fmt.Sprintf("Fee rate must be above the payout's %.2f sat/vB", float64(payout.Fee)/float64(parentVsize))}
+		}
+
+		if spent.Amount-fee < dustLimit {
+			return &requestError{http.StatusBadRequest, errors.New("amount too small"),
+				fmt.Sprintf("Output of %d satoshis cannot cover a child fee of %d satoshis", spent.Amount, fee)}
+		}
+		outputs := []utils.PayoutOutput{{Address: address, Amount: spent.Amount - fee}}
+
+		input := utils.TxInput{TxID: payout.TxID, Vout: uint32(req.Vout), Value: spent.Amount}
+		tx, err := utils.CreatePayoutTransaction([]utils.TxInput{input}, outputs, fee)
+		if err != nil {
+			return &requestError{http.StatusInternalServerError, err, "Failed to create child transaction"}
+		}
+
+		id, err := utils.NewID("bump")
+		if err != nil {
+			return &requestError{http.StatusInternalServerError, err, "Failed to generate fee bump ID"}
+		}
+
+		// All checks passed, apply the changes
+		now := time.Now()
+		bump := FeeBump{
+			ID:         id,
+			Method:     FeeBumpCPFP,
+			ParentTxID: payout.TxID,
+			Outputs:    outputs,
+			Fee: &FeeQuote{
+				FeeRate:    float64(fee+payout.Fee) / float64(parentVsize+childVsize),
+				Vsize:      childVsize,
+				Fee:        fee,
+				ConfTarget: feePolicy.ConfTarget,
+				QuotedAt:   now,
+			},
+			ProposedBy: req.Party,
+			ProposedAt: now,
+			Signatures: []PartySignature{party.signature(req.Signature)},
+			TxID:       tx.TxID,
+		}
+		escrow.FeeBumps = append(escrow.FeeBumps, bump)
+		escrow.recordRequest(r, req.Party, "cpfp_created", escrow.Status,
+			fmt.Sprintf("Child %s of payout %s paying %d satoshis", tx.TxID, payout.TxID, fee))
+
+		log.Printf("Created CPFP child %s for payout %s of escrow ID: %s", tx.TxID, payout.TxID, escrow.ID)
+
+		// The child spends the recipient's own output, so only the recipient can sign it
+		response = feeBumpResponse(escrow, &bump)
+		response["unsigned_tx"] = tx.RawTx
+		return nil
+	})
+	if err != nil {
+		writeUpdateError(w, err)
+		return
+	}
+
+	w.Header().Set("ETag", etag)
+	utils.WriteJSONResponse(w, http.StatusOK, response)
+}
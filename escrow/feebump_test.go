@@ -0,0 +1,83 @@
+package escrow
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestCPFPReturnsUnsignedChild(t *testing.T) {
+	id, _ := fundTestEscrow(t, 80000)
+	mustCall(t, ReleaseEscrow, testBuyer, ReleaseRequest{
+		EscrowID:   id,
+		PrivateKey: testBuyerPrivKey,
+		Signature:  "signature",
+		Party:      "buyer",
+		PublicKey:  testBuyerPubKey,
+	}, http.StatusOK)
+	mustCall(t, ReleaseEscrow, testSeller, ReleaseRequest{
+		EscrowID:   id,
+		PrivateKey: testSellerPrivKey,
+		Signature:  "signature",
+		Party:      "seller",
+		PublicKey:  testSellerPubKey,
+	}, http.StatusOK)
+
+	// The seller gets the child to sign, without sending a private key
+	response := mustCall(t, CreateCPFP, testSeller, CPFPRequest{
+		EscrowID:  id,
+		Party:     "seller",
+		FeeRate:   30,
+		Signature: "signature",
+		PublicKey: testSellerPubKey,
+	}, http.StatusOK)
+	if unsigned, _ := response["unsigned_tx"].(string); unsigned == "" {
+		t.Errorf("expected the unsigned child transaction, got %v", response)
+	}
+	if _, signed := response["signed_tx"]; signed {
+		t.Errorf("expected no signed child, got %v", response["signed_tx"])
+	}
+
+	// Nothing is broadcast by the service, so the history only records what it created
+	for _, action := range []string{"payout_created", "cpfp_created"} {
+		if !containsAction(id, action) {
+			t.Errorf("expected %s in the history, got %v", action, historyActions(id))
+		}
+	}
+}
+
+func TestFeeBumpRechecksPayoutUnderLock(t *testing.T) {
+	id, _ := fundTestEscrow(t, 80000)
+	for _, party := range []string{"buyer", "seller"} {
+		identity, privateKey, publicKey := testBuyer, testBuyerPrivKey, testBuyerPubKey
+		if party == "seller" {
+			identity, privateKey, publicKey = testSeller, testSellerPrivKey, testSellerPubKey
+		}
+		mustCall(t, ReleaseEscrow, identity, ReleaseRequest{
+			EscrowID:   id,
+			PrivateKey: privateKey,
+			Signature:  "signature",
+			Party:      party,
+			PublicKey:  publicKey,
+		}, http.StatusOK)
+	}
+
+	lookup, err := lookupPayout(id)
+	if err != nil || lookup.txID == "" {
+		t.Fatalf("expected the payout to be looked up, got %v", err)
+	}
+
+	viewEscrow(id, func(escrow *Escrow) error {
+		if _, err := unconfirmedPayout(escrow, lookup); err != nil {
+			t.Errorf("expected the looked up payout to be bumpable, got %v", err)
+		}
+
+		// A lookup made before the payout was replaced, or one that found it confirmed, is refused
+		for _, stale := range []*payoutLookup{{txID: "replaced"}, {txID: lookup.txID, confirmations: 1}} {
+			_, err := unconfirmedPayout(escrow, stale)
+			if reqErr, ok := err.(*requestError); !ok || reqErr.code != http.StatusConflict {
+				t.Errorf("expected a conflict for %+v, got %v", *stale, err)
+			}
+		}
+		return nil
+	})
+}
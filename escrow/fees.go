@@ -0,0 +1,212 @@
+package escrow
+
+import (
+	"errors"
+	"escrow-service/utils"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+)
+
+// FeePolicy controls how payout feerates are picked from the chain backend's estimates
+type FeePolicy struct {
+	ConfTarget int     // number of blocks the payout should confirm within
+	MinFeeRate float64 // floor in sat/vB, applied when the estimate is lower
+	MaxFeeRate float64 // cap in sat/vB, applied when the estimate is higher
+}
+
+// feePolicy is the policy used to quote payout fees
+var feePolicy = FeePolicy{ConfTarget: 6, MinFeeRate: 1, MaxFeeRate: 200}
+
+// SetFeePolicy configures the confirmation target, floor and cap used to quote payout fees
+func SetFeePolicy(policy FeePolicy) error {
+	if policy.ConfTarget < 1 {
+		return fmt.Errorf("confirmation target must be at least 1 block, got %d", policy.ConfTarget)
+	}
+	if policy.MinFeeRate <= 0 || policy.MaxFeeRate < policy.MinFeeRate {
+		return fmt.Errorf("fee rate floor must be positive and not above the cap, got %g and %g",
+			policy.MinFeeRate, policy.MaxFeeRate)
+	}
+	feePolicy = policy
+	return nil
+}
+
+// FeeQuote is the miner fee for a payout, derived from its size and the current feerate
+// A quote is locked in with the first signature so every signer signs the same transaction
+type FeeQuote struct {
+	FeeRate    float64   `json:"fee_rate"` // sat/vB
+	Vsize      int64     `json:"vsize"`
+	Fee        int64     `json:"fee"`
+	ConfTarget int       `json:"conf_target"`
+	QuotedAt   time.Time `json:"quoted_at"`
+}
+
+// spendPath returns how the escrow's multisig output is spent
+func (e *Escrow) spendPath() utils.SpendPath {
+	if e.RedeemScript != "" {
+		return utils.SpendTimelockedMultiSig
+	}
+	return utils.SpendMultiSig
+}
+
+// currentFeeRate returns the chain backend's estimate for the policy's target, kept within the floor and cap
+func currentFeeRate() (float64, error) {
+	rate, err := chainBackend.EstimateFeeRate(feePolicy.ConfTarget)
+	if err != nil {
+		return 0, &requestError{http.StatusBadGateway, err, "Failed to estimate the payout fee"}
+	}
+	return math.Min(math.Max(rate, feePolicy.MinFeeRate), feePolicy.MaxFeeRate), nil
+}
+
+// quoteSpend quotes the fee for spending inputs escrow outputs along path to the given addresses
+func quoteSpend(path utils.SpendPath, signatures, inputs int, addresses []string) (*FeeQuote, error) {
+	rate, err := currentFeeRate()
+	if err != nil {
+		return nil, err
+	}
+
+	vsize := utils.EstimateVsize(path, signatures, inputs, addresses)
+	return &FeeQuote{
+		FeeRate:    rate,
+		Vsize:      vsize,
+		Fee:        utils.FeeForVsize(vsize, rate),
+		ConfTarget: feePolicy.ConfTarget,
+		QuotedAt:   time.Now(),
+	}, nil
+}
+
+// outputAddresses returns the address of each output
+func outputAddresses(outputs []utils.PayoutOutput) []string {
+	addresses := make([]string, 0, len(outputs))
+	for _, output := range outputs {
+		addresses = append(addresses, output.Address)
+	}
+	return addresses
+}
+
+// payoutInputCount returns how many inputs a payout spends, counting one before any deposit is seen
+func payoutInputCount(escrow *Escrow) int {
+	if inputs := len(escrow.unspentUTXOs()); inputs > 0 {
+		return inputs
+	}
+	return 1
+}
+
+// quoteFee quotes the fee for a 2-of-3 payout from the escrow to outputs,
+// including the output createPayout adds to return an overpayment to the buyer
+func quoteFee(escrow *Escrow, outputs []utils.PayoutOutput) (*FeeQuote, error) {
+	addresses := outputAddresses(outputs)
+	if change, ok := escrow.changeOutput(); ok {
+		addresses = append(addresses, change.Address)
+	}
+	return quoteSpend(escrow.spendPath(), 2, payoutInputCount(escrow), addresses)
+}
+
+// quotePayout quotes the fee for outputs, or reuses the quote locked in by an earlier signature,
+// and deducts it from the first output, which pays the recipient
+func quotePayout(escrow *Escrow, locked *FeeQuote, outputs []utils.PayoutOutput) (*FeeQuote, []utils.PayoutOutput, error) {
+	quote := locked
+	if quote == nil {
+		var err error
+		if quote, err = quoteFee(escrow, outputs); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	outputs = append([]utils.PayoutOutput{}, outputs...)
+	if outputs[0].Amount-quote.Fee < dustLimit {
+		return nil, nil, &requestError{http.StatusBadRequest, errors.New("amount too small"),
+			fmt.Sprintf("Payout of %d satoshis does not cover the fee of %d satoshis", outputs[0].Amount, quote.Fee)}
+	}
+	outputs[0].Amount -= quote.Fee
+
+	return quote, outputs, nil
+}
+
+// GetFeeQuote shows the fee a payout would pay, so signers can check it before signing
+// Once a payout has a signature the quote is locked and returned as is
+func GetFeeQuote(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		utils.WriteErrorResponse(w, http.StatusMethodNotAllowed, errors.New("method not allowed"), "Only GET method is allowed")
+		return
+	}
+
+	escrowID := r.URL.Query().Get("id")
+	operation := r.URL.Query().Get("operation")
+	if escrowID == "" || operation == "" {
+		utils.WriteErrorResponse(w, http.StatusBadRequest, errors.New("missing required fields"),
+			"Escrow ID and operation are required")
+		return
+	}
+
+	var response map[string]interface{}
+	err := viewEscrow(escrowID, func(escrow *Escrow) error {
+		if err := authorizeRead(r, escrow); err != nil {
+			return err
+		}
+
+		if escrow.Status.IsTerminal() {
+			return &requestError{http.StatusBadRequest, errors.New("escrow closed"),
+				fmt.Sprintf("Escrow status is %s, there is no payout to quote", escrow.Status)}
+		}
+
+		var locked *FeeQuote
+		var outputs []utils.PayoutOutput
+		switch operation {
+		case "release":
+			locked, outputs = escrow.ReleaseFee, releaseOutputs(escrow)
+		case "refund":
+			locked, outputs = escrow.RefundFee, refundOutputs(escrow)
+		case "milestone":
+			next := escrow.nextMilestone()
+			if next < 0 {
+				return &requestError{http.StatusBadRequest, errors.New("no pending milestone"),
+					"Escrow has no pending milestone"}
+			}
+			locked, outputs = escrow.Milestones[next].Fee, milestoneOutputs(escrow, &escrow.Milestones[next])
+		case "split":
+			// Splits pay fixed amounts, so the fee comes out of the amount available to divide
+			quote, err := quoteFee(escrow, settlementOutputs(escrow,
+				[]utils.PayoutOutput{{Address: escrow.SellerPubKey}, {Address: escrow.refundAddress()}}))
+			if err != nil {
+				return err
+			}
+			response = map[string]interface{}{
+				"escrow_id":        escrow.ID,
+				"operation":        operation,
+				"quote":            quote,
+				"locked":           false,
+				"available_amount": settlementAmount(escrow) - quote.Fee,
+			}
+			return nil
+		default:
+			return &requestError{http.StatusBadRequest, errors.New("invalid operation"),
+				"Operation must be one of: release, refund, milestone, or split"}
+		}
+
+		quote, outputs, err := quotePayout(escrow, locked, outputs)
+		if err != nil {
+			return err
+		}
+
+		// Show the outputs as createPayout builds them, with any overpayment
+		outputs = payoutOutputs(escrow, outputs)
+
+		response = map[string]interface{}{
+			"escrow_id":   escrow.ID,
+			"operation":   operation,
+			"quote":       quote,
+			"locked":      locked != nil,
+			"outputs":     outputs,
+			"unsigned_tx": unsignedPayout(escrow.payoutInputs(), outputs, quote.Fee),
+		}
+		return nil
+	})
+	if err != nil {
+		writeUpdateError(w, err)
+		return
+	}
+
+	utils.WriteJSONResponse(w, http.StatusOK, response)
+}
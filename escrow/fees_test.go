@@ -0,0 +1,90 @@
+package escrow
+
+import (
+	"escrow-service/utils"
+	"net/http"
+	"testing"
+)
+
+// payoutQuote returns the fee quote of an escrow payout and whether it is locked
+func payoutQuote(t *testing.T, id, operation string) (map[string]interface{}, bool) {
+	t.Helper()
+
+	response := getAs(t, GetFeeQuote, testBuyer, "id="+id+"&operation="+operation)
+	if response["unsigned_tx"] == "" {
+		t.Errorf("expected the unsigned %s transaction to be shown with its fee", operation)
+	}
+	return response["quote"].(map[string]interface{}), response["locked"].(bool)
+}
+
+func TestFeeRateFloorAndCap(t *testing.T) {
+	defer SetChainBackend(chainBackend)
+	SetChainBackend(NewMockChain())
+	defer SetFeePolicy(feePolicy)
+	id, _ := fundTestEscrow(t, 200000)
+
+	for _, c := range []struct {
+		name       string
+		confTarget int
+		estimate   float64
+		expected   float64
+	}{
+		{"within the bounds", 6, 12, 12},
+		{"above the cap", 6, 500, 200},
+		{"below the floor", 6, 0.5, 1},
+		{"configured target", 1, 20, 20},
+	} {
+		if err := SetFeePolicy(FeePolicy{ConfTarget: c.confTarget, MinFeeRate: 1, MaxFeeRate: 200}); err != nil {
+			t.Fatalf("failed to set the fee policy: %v", err)
+		}
+		chainBackend.(*MockChain).SetFeeRate(c.confTarget, c.estimate)
+
+		quote, _ := payoutQuote(t, id, "release")
+		vsize := int64(quote["vsize"].(float64))
+		if rate := quote["fee_rate"].(float64); rate != c.expected {
+			t.Errorf("%s: expected %g sat/vB, got %g", c.name, c.expected, rate)
+		}
+		if fee := int64(quote["fee"].(float64)); fee != utils.FeeForVsize(vsize, c.expected) {
+			t.Errorf("%s: expected the fee of %d vbytes at %g sat/vB, got %d", c.name, vsize, c.expected, fee)
+		}
+	}
+
+	if err := SetFeePolicy(FeePolicy{ConfTarget: 6, MinFeeRate: 10, MaxFeeRate: 5}); err == nil {
+		t.Error("expected a floor above the cap to be rejected")
+	}
+	if err := SetFeePolicy(FeePolicy{ConfTarget: 0, MinFeeRate: 1, MaxFeeRate: 5}); err == nil {
+		t.Error("expected a zero confirmation target to be rejected")
+	}
+}
+
+func TestFeeQuoteLockedBySignature(t *testing.T) {
+	defer SetChainBackend(chainBackend)
+	SetChainBackend(NewMockChain())
+	defer SetServiceSigner(serviceSigner)
+	SetServiceSigner(nil)
+	id, _ := fundTestEscrow(t, 60000)
+
+	quoted, locked := payoutQuote(t, id, "release")
+	if locked {
+		t.Fatal("expected the release quote to follow the feerate before any signature")
+	}
+
+	identity, req := partySigning(id, "buyer")
+	mustCall(t, ReleaseEscrow, identity, req, http.StatusOK)
+
+	// The feerate moves after the first signature, the release keeps the fee it was signed with
+	chainBackend.(*MockChain).SetFeeRate(feePolicy.ConfTarget, 50)
+	quote, locked := payoutQuote(t, id, "release")
+	if !locked || quote["fee"] != quoted["fee"] {
+		t.Errorf("expected the signed release to keep its quote of %v, got %v (locked %v)", quoted["fee"], quote["fee"], locked)
+	}
+	if quote, locked := payoutQuote(t, id, "refund"); locked || quote["fee_rate"].(float64) != 50 {
+		t.Errorf("expected the unsigned refund to follow the feerate, got %v (locked %v)", quote["fee_rate"], locked)
+	}
+
+	identity, req = partySigning(id, "seller")
+	response := mustCall(t, ReleaseEscrow, identity, req, http.StatusOK)
+	if fee := response["fee"].(map[string]interface{})["fee"]; response["status"] != string(StatusReleased) || fee != quoted["fee"] {
+		t.Errorf("expected the release to pay the quoted fee of %v, got %v in status %v", quoted["fee"], fee, response["status"])
+	}
+}
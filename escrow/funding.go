@@ -0,0 +1,179 @@
+package escrow
+
+import (
+	"escrow-service/utils"
+	"fmt"
+	"time"
+)
+
+// OverpaymentAction decides where deposits above the escrow amount go
+type OverpaymentAction string
+
+const (
+	OverpaymentRefund  OverpaymentAction = "refund"  // returned to the buyer's refund address by every payout
+	OverpaymentRelease OverpaymentAction = "release" // paid along with the payout, to whoever it pays
+)
+
+// FundingPolicy controls when deposits fund an escrow and how under- and overpayments are handled
+type FundingPolicy struct {
+	Confirmations int64             // confirmations a deposit needs to count towards funding
+	Tolerance     int64             // satoshis a payment may be short or over without being under- or overpaid
+	Overpayment   OverpaymentAction // where deposits above the amount, less the tolerance, go
+}
+
+// fundingPolicy is the policy applied by VerifyPayment and the payouts
+var fundingPolicy = FundingPolicy{Confirmations: 1, Tolerance: 1000, Overpayment: OverpaymentRefund}
+
+// SetFundingPolicy configures the confirmations, tolerance and overpayment handling of deposits
+func SetFundingPolicy(policy FundingPolicy) error {
+	if policy.Confirmations < 0 {
+		return fmt.Errorf("funding confirmations cannot be negative, got %d", policy.Confirmations)
+	}
+	if policy.Tolerance < 0 {
+		return fmt.Errorf("funding tolerance cannot be negative, got %d", policy.Tolerance)
+	}
+	if policy.Overpayment != OverpaymentRefund && policy.Overpayment != OverpaymentRelease {
+		return fmt.Errorf("overpayment action must be %q or %q, got %q",
+			OverpaymentRefund, OverpaymentRelease, policy.Overpayment)
+	}
+	fundingPolicy = policy
+	return nil
+}
+
+// unspentUTXOs returns the tracked outputs no payout has spent yet and that are still on the chain
+func (e *Escrow) unspentUTXOs() []UTXO {
+	var utxos []UTXO
+	for _, utxo := range e.FundingUTXOs {
+		if utxo.SpentBy == "" && !utxo.Reverted {
+			utxos = append(utxos, utxo)
+		}
+	}
+	return utxos
+}
+
+// fundedAmount returns the value of the unspent outputs, confirmed or not
+func (e *Escrow) fundedAmount() int64 {
+	var total int64
+	for _, utxo := range e.unspentUTXOs() {
+		total += utxo.Value
+	}
+	return total
+}
+
+// confirmedAmount returns the value of the unspent outputs with enough confirmations to count as funding
+func (e *Escrow) confirmedAmount() int64 {
+	var total int64
+	for _, utxo := range e.unspentUTXOs() {
+		if utxo.Confirmations >= fundingPolicy.Confirmations {
+			total += utxo.Value
+		}
+	}
+	return total
+}
+
+// excessAmount returns what the unspent outputs hold above the locked amount
+func (e *Escrow) excessAmount() int64 {
+	if excess := e.fundedAmount() - e.lockedAmount(); excess > 0 {
+		return excess
+	}
+	return 0
+}
+
+// refundAddress returns where refunds and overpayments are paid
+func (e *Escrow) refundAddress() string {
+	if e.RefundAddress != "" {
+		return e.RefundAddress
+	}
+	return e.BuyerPubKey // This would be an actual address in a real implementation
+}
+
+// changeOutput returns the output returning an overpayment to the buyer, if the policy and the
+// tolerance call for one. Any other excess is paid along with the payout's first output
+func (e *Escrow) changeOutput() (utils.PayoutOutput, bool) {
+	excess := e.excessAmount()
+	if fundingPolicy.Overpayment != OverpaymentRefund || excess <= fundingPolicy.Tolerance || excess < dustLimit {
+		return utils.PayoutOutput{}, false
+	}
+	return utils.PayoutOutput{Address: e.refundAddress(), Amount: excess}, true
+}
+
+// fundingShortfall returns how much the deposits seen so far fall short of the escrow amount
+func (e *Escrow) fundingShortfall() int64 {
+	if shortfall := e.Amount - e.fundedAmount(); shortfall > 0 {
+		return shortfall
+	}
+	return 0
+}
+
+// payoutInputs returns every unspent output, so a payout leaves nothing behind at the escrow address
+func (e *Escrow) payoutInputs() []utils.TxInput {
+	unspent := e.unspentUTXOs()
+	inputs := make([]utils.TxInput, 0, len(unspent))
+	for _, utxo := range unspent {
+		inputs = append(inputs, utils.TxInput{TxID: utxo.TxID, Vout: utxo.Vout, Value: utxo.Value})
+	}
+	return inputs
+}
+
+// trackUTXOs adds newly seen outputs and refreshes the confirmations of those already tracked,
+// restoring any that had been reverted. It returns the number of outputs added
+func (e *Escrow) trackUTXOs(utxos []UTXO) int {
+	added := 0
+	for _, utxo := range utxos {
+		tracked := false
+		for i := range e.FundingUTXOs {
+			if e.FundingUTXOs[i].TxID == utxo.TxID && e.FundingUTXOs[i].Vout == utxo.Vout {
+				e.FundingUTXOs[i].Confirmations = utxo.Confirmations
+				e.FundingUTXOs[i].Reverted = false
+				tracked = true
+				break
+			}
+		}
+
+		if !tracked {
+			e.FundingUTXOs = append(e.FundingUTXOs, UTXO{TxID: utxo.TxID, Vout: utxo.Vout, Value: utxo.Value,
+				Confirmations: utxo.Confirmations})
+			added++
+		}
+	}
+	return added
+}
+
+// isPayoutOutput reports whether utxo was paid back to the escrow by one of its own payouts
+func (e *Escrow) isPayoutOutput(utxo UTXO) bool {
+	for _, spent := range e.FundingUTXOs {
+		if spent.SpentBy == utxo.TxID {
+			return true
+		}
+	}
+	return false
+}
+
+// recordPayout records tx as the escrow's payout: it spends every unspent output,
+// and any output paying the escrow address back, such as milestone change, is tracked in their place
+func (e *Escrow) recordPayout(tx *utils.Transaction) {
+	e.Payout = tx
+
+	for i := range e.FundingUTXOs {
+		if e.FundingUTXOs[i].SpentBy == "" && !e.FundingUTXOs[i].Reverted {
+			e.FundingUTXOs[i].SpentBy = tx.TxID
+		}
+	}
+
+	for vout, output := range tx.Outputs {
+		if output.Address == e.MultiSigAddress {
+			e.FundingUTXOs = append(e.FundingUTXOs, UTXO{TxID: tx.TxID, Vout: uint32(vout), Value: output.Amount})
+		}
+	}
+
+	// A release fee is collected by the payouts paying the service address
+	if fee := e.ServiceFee; fee != nil && fee.ChargeAt == ServiceFeeAtRelease {
+		for _, output := range tx.Outputs {
+			if output.Address == fee.Address {
+				fee.collect(output.Amount, tx.TxID, time.Now())
+			}
+		}
+	}
+
+	e.recordHistory(time.Now(), "system", "payout_created", e.Status, fmt.Sprintf("TxID: %s, fee: %d satoshis", tx.TxID, tx.Fee))
+}
@@ -0,0 +1,170 @@
+package escrow
+
+import (
+	"net/http"
+	"testing"
+)
+
+// verifyTestPayment verifies the escrow's deposits and returns its status
+func verifyTestPayment(t *testing.T, id string) Status {
+	t.Helper()
+
+	return responseStatus(t, mustCall(t, VerifyPayment, testAdmin, map[string]string{"escrow_id": id}, http.StatusOK))
+}
+
+// responseStatus returns the status of a handler response
+func responseStatus(t *testing.T, response map[string]interface{}) Status {
+	t.Helper()
+
+	status, ok := response["status"].(string)
+	if !ok {
+		t.Fatalf("expected a status in the response, got %v", response)
+	}
+	return Status(status)
+}
+
+// releaseTestEscrow has the buyer and the seller sign the release and returns its payout
+func releaseTestEscrow(t *testing.T, id string) *Escrow {
+	t.Helper()
+
+	for _, party := range []string{"buyer", "seller"} {
+		identity, req := partySigning(id, party)
+		mustCall(t, ReleaseEscrow, identity, req, http.StatusOK)
+	}
+
+	var released *Escrow
+	viewEscrow(id, func(escrow *Escrow) error {
+		released = &Escrow{
+			Status:       escrow.Status,
+			Payout:       escrow.Payout,
+			FundingUTXOs: append([]UTXO{}, escrow.FundingUTXOs...),
+		}
+		return nil
+	})
+	if released.Status != StatusReleased || released.Payout == nil {
+		t.Fatalf("expected the escrow to be released, got %s", released.Status)
+	}
+	return released
+}
+
+func TestMultipleDeposits(t *testing.T) {
+	defer SetChainBackend(chainBackend)
+	SetChainBackend(NewMockChain())
+	id := createTestEscrow(t, 60000)
+
+	// Half the amount is confirmed, the other half is still in the mempool
+	depositTestFunds(t, id, 30000, 1)
+	pending := depositTestFunds(t, id, 30000, 0)
+	if status := verifyTestPayment(t, id); status != StatusCreated {
+		t.Fatalf("expected an unconfirmed deposit to leave the escrow created, got %s", status)
+	}
+
+	chainBackend.(*MockChain).SetConfirmations(pending, 1)
+	if status := verifyTestPayment(t, id); status != StatusFunded {
+		t.Fatalf("expected the confirmed deposits to fund the escrow, got %s", status)
+	}
+
+	// A deposit to the same address by another escrow is not counted
+	other := createTestEscrow(t, 60000)
+	depositTestFunds(t, other, 60000, 1)
+	verifyTestPayment(t, other)
+	if escrow := snapshotEscrow(t, id); len(escrow.FundingUTXOs) != 2 {
+		t.Fatalf("expected 2 funding outputs, got %d", len(escrow.FundingUTXOs))
+	}
+
+	// The release spends every deposit, leaving nothing at the escrow address
+	released := releaseTestEscrow(t, id)
+	if len(released.Payout.Inputs) != 2 {
+		t.Errorf("expected the release to spend 2 inputs, got %d", len(released.Payout.Inputs))
+	}
+	for _, utxo := range released.FundingUTXOs {
+		if utxo.SpentBy != released.Payout.TxID {
+			t.Errorf("expected %s:%d to be spent by the release, got %q", utxo.TxID, utxo.Vout, utxo.SpentBy)
+		}
+	}
+	if released.Payout.Outputs[0].Amount+released.Payout.Fee != 60000 {
+		t.Errorf("expected the release to pay out the 60000 satoshis deposited, got %d plus a fee of %d",
+			released.Payout.Outputs[0].Amount, released.Payout.Fee)
+	}
+}
+
+func TestUnderpayment(t *testing.T) {
+	defer SetChainBackend(chainBackend)
+	SetChainBackend(NewMockChain())
+
+	// A shortfall within the tolerance funds the escrow
+	id := createTestEscrow(t, 60000)
+	depositTestFunds(t, id, 60000-fundingPolicy.Tolerance, 1)
+	if status := verifyTestPayment(t, id); status != StatusFunded {
+		t.Errorf("expected a shortfall within the tolerance to fund the escrow, got %s", status)
+	}
+
+	// A larger one asks for a top-up of the difference
+	id = createTestEscrow(t, 60000)
+	depositTestFunds(t, id, 50000, 1)
+	if status := verifyTestPayment(t, id); status != StatusUnderfunded {
+		t.Fatalf("expected the escrow to be underfunded, got %s", status)
+	}
+	viewEscrow(id, func(escrow *Escrow) error {
+		if escrow.Shortfall != 10000 || escrow.TopUpRequest == nil || escrow.TopUpRequest.Amount != 10000 {
+			t.Errorf("expected a top-up request for the 10000 satoshis short, got %+v", escrow.TopUpRequest)
+		}
+		if escrow.PaymentRequest.InvalidatedAt == nil {
+			t.Error("expected the top-up to replace the original payment request")
+		}
+		return nil
+	})
+
+	depositTestFunds(t, id, 10000, 1)
+	if status := verifyTestPayment(t, id); status != StatusFunded {
+		t.Fatalf("expected the top-up to fund the escrow, got %s", status)
+	}
+	viewEscrow(id, func(escrow *Escrow) error {
+		if escrow.Shortfall != 0 || escrow.TopUpRequest.InvalidatedAt == nil {
+			t.Errorf("expected the top-up request to be closed, got a shortfall of %d", escrow.Shortfall)
+		}
+		return nil
+	})
+}
+
+func TestOverpayment(t *testing.T) {
+	defer SetChainBackend(chainBackend)
+	SetChainBackend(NewMockChain())
+	defer SetFundingPolicy(fundingPolicy)
+
+	for _, c := range []struct {
+		name        string
+		overpayment OverpaymentAction
+		deposit     int64
+		change      int64 // expected change output to the buyer, 0 if the excess goes to the seller
+	}{
+		{"refunded to the buyer", OverpaymentRefund, 70000, 10000},
+		{"within the tolerance", OverpaymentRefund, 60000 + fundingPolicy.Tolerance, 0},
+		{"released with the payout", OverpaymentRelease, 70000, 0},
+	} {
+		if err := SetFundingPolicy(FundingPolicy{Confirmations: 1, Tolerance: fundingPolicy.Tolerance, Overpayment: c.overpayment}); err != nil {
+			t.Fatalf("failed to set the funding policy: %v", err)
+		}
+		id := createTestEscrow(t, 60000)
+		depositTestFunds(t, id, c.deposit, 1)
+		response := mustCall(t, VerifyPayment, testAdmin, map[string]string{"escrow_id": id}, http.StatusOK)
+		if response["status"] != string(StatusFunded) || int64(response["overpayment"].(float64)) != c.deposit-60000 {
+			t.Errorf("%s: expected a funded escrow recording the overpayment, got %v", c.name, response)
+		}
+
+		released := releaseTestEscrow(t, id)
+		outputs := released.Payout.Outputs
+		if c.change == 0 {
+			if len(outputs) != 1 || outputs[0].Amount+released.Payout.Fee != c.deposit {
+				t.Errorf("%s: expected the seller to be paid the whole deposit, got %+v", c.name, outputs)
+			}
+			continue
+		}
+		if len(outputs) != 2 || outputs[1].Address != testBuyerPubKey || outputs[1].Amount != c.change {
+			t.Errorf("%s: expected a change output of %d satoshis to the buyer, got %+v", c.name, c.change, outputs)
+		}
+		if outputs[0].Amount+released.Payout.Fee != 60000 {
+			t.Errorf("%s: expected the seller to be paid the amount, got %d", c.name, outputs[0].Amount)
+		}
+	}
+}
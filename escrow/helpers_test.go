@@ -0,0 +1,126 @@
+package escrow
+
+import (
+	"bytes"
+	"encoding/json"
+	"escrow-service/auth"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Test keys of the escrow parties, the private keys are testnet WIF
+const (
+	testBuyerPubKey   = "03b26e6806273fa2cb19a7af87c6d522c2efcd86bc352b6e25b0ec9a014af0c9ce"
+	testBuyerPrivKey  = "cTbvZEpbBYM4T9WbzoiyQcZfqBg8YwdwUm1gUMTXQWCeTs2K6HPo"
+	testSellerPubKey  = "020f8cdf31a27660abd9fd1cf9f6adca835e70d8716babe517dfbdae6af644a7e3"
+	testSellerPrivKey = "cMnYGg4HUGLbvs84d1zQbGB192znWBbAm4WaMUycy3keZzTPcZkw"
+	testEscrowPubKey  = "02e9ceadcfdafd1819a02001e77a64c242b809211db379f781b57edd9a479ba317"
+)
+
+// Identities the tests call the handlers as
+var (
+	testAdmin  = &auth.Identity{ID: "test-admin", Role: auth.RoleAdmin}
+	testBuyer  = &auth.Identity{ID: "test-buyer", Role: auth.RoleParticipant, PubKey: testBuyerPubKey}
+	testSeller = &auth.Identity{ID: "test-seller", Role: auth.RoleParticipant, PubKey: testSellerPubKey}
+)
+
+// callHandler sends body as JSON to handler as identity and decodes the JSON response
+func callHandler(t *testing.T, handler http.HandlerFunc, identity *auth.Identity, body interface{}) (int, map[string]interface{}) {
+	t.Helper()
+
+	payload, err := json.Marshal(body)
+	if err != nil {
+		t.Fatalf("failed to encode request: %v", err)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(payload))
+	r.Header.Set("Content-Type", "application/json")
+	if identity != nil {
+		r = r.WithContext(auth.WithIdentity(r.Context(), identity))
+	}
+
+	w := httptest.NewRecorder()
+	handler(w, r)
+
+	var response map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("invalid response %q: %v", w.Body.String(), err)
+	}
+	return w.Code, response
+}
+
+// mustCall is callHandler failing the test unless the handler answers with the expected status code
+func mustCall(t *testing.T, handler http.HandlerFunc, identity *auth.Identity, body interface{}, code int) map[string]interface{} {
+	t.Helper()
+
+	got, response := callHandler(t, handler, identity, body)
+	if got != code {
+		t.Fatalf("expected status %d, got %d: %v", code, got, response)
+	}
+	return response
+}
+
+// createTestEscrow creates an escrow between the test keys, leaving it unfunded
+func createTestEscrow(t *testing.T, amount int64) string {
+	t.Helper()
+
+	response := mustCall(t, CreateEscrow, testAdmin, EscrowRequest{
+		BuyerPubKey:  testBuyerPubKey,
+		SellerPubKey: testSellerPubKey,
+		EscrowPubKey: testEscrowPubKey,
+		Amount:       amount,
+	}, http.StatusCreated)
+	return response["id"].(string)
+}
+
+// depositTestFunds deposits value to the escrow on the mock chain and returns the deposit's txid
+func depositTestFunds(t *testing.T, id string, value, confirmations int64) string {
+	t.Helper()
+
+	response := mustCall(t, MockDeposit, testAdmin, MockDepositRequest{
+		EscrowID:      id,
+		Value:         value,
+		Confirmations: confirmations,
+	}, http.StatusCreated)
+	return response["utxo"].(map[string]interface{})["txid"].(string)
+}
+
+// fundTestEscrow creates an escrow and funds it with one confirmed deposit, returning its ID and the deposit's txid
+func fundTestEscrow(t *testing.T, amount int64) (string, string) {
+	t.Helper()
+
+	id := createTestEscrow(t, amount)
+	txID := depositTestFunds(t, id, amount, 1)
+	mustCall(t, VerifyPayment, testAdmin, map[string]string{"escrow_id": id}, http.StatusOK)
+	return id, txID
+}
+
+// snapshotEscrow returns a copy of the escrow's fields read under its lock
+func snapshotEscrow(t *testing.T, id string) *Escrow {
+	t.Helper()
+
+	var snapshot *Escrow
+	err := viewEscrow(id, func(escrow *Escrow) error {
+		snapshot = &Escrow{
+			ID:           escrow.ID,
+			Status:       escrow.Status,
+			RevertedFrom: escrow.RevertedFrom,
+			FundingUTXOs: append([]UTXO{}, escrow.FundingUTXOs...),
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to read escrow %s: %v", id, err)
+	}
+	return snapshot
+}
+
+// historyActions returns the actions recorded in the escrow's audit log, oldest first
+func historyActions(id string) []string {
+	var actions []string
+	for _, event := range escrowEvents(id) {
+		actions = append(actions, event.Action)
+	}
+	return actions
+}
@@ -0,0 +1,321 @@
+package escrow
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Secondary indexes over the escrow store, kept under escrowsMutex so listing does not scan every escrow
+// Only the status changes after an escrow is created, and it is reindexed whenever the escrow's lock is released
+var (
+	statusIndex   = make(setIndex)           // IDs by status
+	partyIndex    = make(setIndex)           // IDs by buyer, seller and escrow public key, lowercased
+	merchantIndex = make(setIndex)           // IDs by merchant ID
+	indexedStatus = make(map[string]Status)  // status each escrow is indexed under
+	sortIndexes   = map[string]*sortedIndex{ // IDs ordered by each sortable field
+		"created_at": {},
+		"expires_at": {},
+		"amount":     {},
+	}
+)
+
+// setIndex maps a key to the set of escrow IDs that have it
+type setIndex map[string]map[string]struct{}
+
+// add records that the escrow id has key
+func (x setIndex) add(key, id string) {
+	if x[key] == nil {
+		x[key] = make(map[string]struct{})
+	}
+	x[key][id] = struct{}{}
+}
+
+// remove forgets that the escrow id has key
+func (x setIndex) remove(key, id string) {
+	delete(x[key], id)
+	if len(x[key]) == 0 {
+		delete(x, key)
+	}
+}
+
+// indexEntry is a position in a sorted index, ties between equal keys are broken by ID
+type indexEntry struct {
+	key int64
+	id  string
+}
+
+// less reports whether e sorts before other
+func (e indexEntry) less(other indexEntry) bool {
+	return e.key < other.key || (e.key == other.key && e.id < other.id)
+}
+
+// sortedIndex keeps escrow IDs ordered by a numeric key
+type sortedIndex []indexEntry
+
+// search returns the position of the first entry not before entry
+func (x sortedIndex) search(entry indexEntry) int {
+	return sort.Search(len(x), func(i int) bool { return !x[i].less(entry) })
+}
+
+// insert adds an entry at its position
+func (x *sortedIndex) insert(key int64, id string) {
+	entry := indexEntry{key, id}
+	i := x.search(entry)
+	*x = append(*x, indexEntry{})
+	copy((*x)[i+1:], (*x)[i:])
+	(*x)[i] = entry
+}
+
+// sortKey returns the escrow's key in the sorted index of field, which never changes once the escrow is created
+func sortKey(escrow *Escrow, field string) int64 {
+	switch field {
+	case "expires_at":
+		return escrow.ExpiresAt.UnixNano()
+	case "amount":
+		return escrow.Amount
+	default:
+		return escrow.CreatedAt.UnixNano()
+	}
+}
+
+// indexEscrow adds a newly stored escrow to every index. Callers hold escrowsMutex
+func indexEscrow(escrow *Escrow) {
+	for _, pubKey := range []string{escrow.BuyerPubKey, escrow.SellerPubKey, escrow.EscrowPubKey} {
+		partyIndex.add(strings.ToLower(pubKey), escrow.ID)
+	}
+	if escrow.MerchantID != "" {
+		merchantIndex.add(escrow.MerchantID, escrow.ID)
+	}
+	for field, index := range sortIndexes {
+		index.insert(sortKey(escrow, field), escrow.ID)
+	}
+
+	statusIndex.add(string(escrow.Status), escrow.ID)
+	indexedStatus[escrow.ID] = escrow.Status
+}
+
+// reindexStatus moves the escrow to its current status in the status index
+// Callers hold the escrow's lock, and take escrowsMutex after it as usual
+func reindexStatus(escrow *Escrow) {
+	escrowsMutex.Lock()
+	defer escrowsMutex.Unlock()
+
+	previous, exists := indexedStatus[escrow.ID]
+	if !exists || previous == escrow.Status {
+		return
+	}
+
+	statusIndex.remove(string(previous), escrow.ID)
+	statusIndex.add(string(escrow.Status), escrow.ID)
+	indexedStatus[escrow.ID] = escrow.Status
+}
+
+// escrowIDsWithStatus returns the IDs of the escrows indexed under any of the given statuses
+// The status may change once the IDs are returned, so callers check it again under the escrow's lock
+func escrowIDsWithStatus(statuses ...Status) []string {
+	escrowsMutex.RLock()
+	defer escrowsMutex.RUnlock()
+
+	var ids []string
+	for _, status := range statuses {
+		for id := range statusIndex[string(status)] {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// keyRange is a range of sort keys, from inclusive and to exclusive
+type keyRange struct {
+	from, to int64
+}
+
+// anyKey is the range matching every key
+var anyKey = keyRange{math.MinInt64, math.MaxInt64}
+
+// contains reports whether key is in the range
+func (r keyRange) contains(key int64) bool {
+	return key >= r.from && key < r.to
+}
+
+// timeRange returns the range of UnixNano keys from from up to to, either of which may be zero for no bound
+func timeRange(from, to time.Time) keyRange {
+	r := anyKey
+	if !from.IsZero() {
+		r.from = from.UnixNano()
+	}
+	if !to.IsZero() {
+		r.to = to.UnixNano()
+	}
+	return r
+}
+
+// escrowQuery selects and orders escrows using the indexes
+type escrowQuery struct {
+	Statuses   []Status
+	Party      string
+	MerchantID string
+	Created    keyRange
+	Expires    keyRange
+	Amount     keyRange
+	SortBy     string // created_at, expires_at or amount
+	Descending bool
+	Limit      int
+	After      *indexEntry // cursor: only entries after it in the query's order are returned
+}
+
+// matches reports whether the stored escrow id passes the query's filters. Callers hold escrowsMutex
+// Only fields that never change after creation are read, along with the indexed status
+func (q *escrowQuery) matches(id string) bool {
+	escrow := escrows[id]
+	if escrow == nil {
+		return false
+	}
+
+	if len(q.Statuses) > 0 {
+		found := false
+		for _, status := range q.Statuses {
+			found = found || indexedStatus[id] == status
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if q.Party != "" && !strings.EqualFold(escrow.BuyerPubKey, q.Party) &&
+		!strings.EqualFold(escrow.SellerPubKey, q.Party) && !strings.EqualFold(escrow.EscrowPubKey, q.Party) {
+		return false
+	}
+
+	if q.MerchantID != "" && escrow.MerchantID != q.MerchantID {
+		return false
+	}
+
+	return q.Created.contains(escrow.CreatedAt.UnixNano()) && q.Expires.contains(escrow.ExpiresAt.UnixNano()) &&
+		q.Amount.contains(escrow.Amount)
+}
+
+// sortRange returns the query's range on the field it sorts by
+func (q *escrowQuery) sortRange() keyRange {
+	switch q.SortBy {
+	case "expires_at":
+		return q.Expires
+	case "amount":
+		return q.Amount
+	default:
+		return q.Created
+	}
+}
+
+// candidates returns the IDs in the smallest set index matching the query's equality filters,
+// or false if it has none. Callers hold escrowsMutex
+func (q *escrowQuery) candidates() (map[string]struct{}, bool) {
+	var sets []map[string]struct{}
+	if len(q.Statuses) == 1 {
+		sets = append(sets, statusIndex[string(q.Statuses[0])])
+	} else if len(q.Statuses) > 1 {
+		union := make(map[string]struct{})
+		for _, status := range q.Statuses {
+			for id := range statusIndex[string(status)] {
+				union[id] = struct{}{}
+			}
+		}
+		sets = append(sets, union)
+	}
+	if q.Party != "" {
+		sets = append(sets, partyIndex[strings.ToLower(q.Party)])
+	}
+	if q.MerchantID != "" {
+		sets = append(sets, merchantIndex[q.MerchantID])
+	}
+
+	if len(sets) == 0 {
+		return nil, false
+	}
+
+	smallest := sets[0]
+	for _, set := range sets[1:] {
+		if len(set) < len(smallest) {
+			smallest = set
+		}
+	}
+	return smallest, true
+}
+
+// queryEscrows returns the IDs of up to q.Limit escrows matching the query in its order, and whether more follow
+// It either walks the sorted index of the sort field or, when an equality filter selects fewer escrows, sorts those
+func queryEscrows(q *escrowQuery) ([]indexEntry, bool) {
+	escrowsMutex.RLock()
+	defer escrowsMutex.RUnlock()
+
+	index := *sortIndexes[q.SortBy]
+	bounds := q.sortRange()
+	lo, hi := index.search(indexEntry{bounds.from, ""}), index.search(indexEntry{bounds.to, ""})
+
+	// Narrow the range to the entries after the cursor
+	if q.After != nil {
+		position := index.search(*q.After)
+		if q.Descending {
+			hi = minInt(hi, position)
+		} else {
+			if position < len(index) && index[position] == *q.After {
+				position++
+			}
+			lo = maxInt(lo, position)
+		}
+	}
+
+	if set, ok := q.candidates(); ok && len(set) < hi-lo {
+		index = make(sortedIndex, 0, len(set))
+		for id := range set {
+			entry := indexEntry{sortKey(escrows[id], q.SortBy), id}
+			if bounds.contains(entry.key) && (q.After == nil || q.after(entry)) {
+				index = append(index, entry)
+			}
+		}
+		sort.Slice(index, func(i, j int) bool { return index[i].less(index[j]) })
+		lo, hi = 0, len(index)
+	}
+
+	var page []indexEntry
+	for i := 0; i < hi-lo; i++ {
+		entry := index[lo+i]
+		if q.Descending {
+			entry = index[hi-1-i]
+		}
+		if !q.matches(entry.id) {
+			continue
+		}
+		if len(page) == q.Limit {
+			return page, true
+		}
+		page = append(page, entry)
+	}
+	return page, false
+}
+
+// after reports whether entry comes after the query's cursor in its order
+func (q *escrowQuery) after(entry indexEntry) bool {
+	if q.Descending {
+		return entry.less(*q.After)
+	}
+	return q.After.less(entry)
+}
+
+// minInt returns the smaller of a and b
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// maxInt returns the larger of a and b
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,254 @@
+package escrow
+
+import (
+	"errors"
+	"escrow-service/utils"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Milestone statuses
+const (
+	MilestonePending  = "pending"
+	MilestoneReleased = "released"
+)
+
+// MilestoneRequest describes one stage of a milestone escrow at creation
+type MilestoneRequest struct {
+	Amount      int64     `json:"amount"`
+	Description string    `json:"description"`
+	Deadline    time.Time `json:"deadline"`
+}
+
+// Milestone is one stage of an escrow, released to the seller on its own
+type Milestone struct {
+	Index       int              `json:"index"`
+	Amount      int64            `json:"amount"`
+	Description string           `json:"description"`
+	Deadline    time.Time        `json:"deadline"`
+	Status      string           `json:"status"` // "pending" or "released"
+	Signatures  []PartySignature `json:"signatures,omitempty"`
+	Fee         *FeeQuote        `json:"fee,omitempty"` // locked in by the first signature
+	TxID        string           `json:"txid,omitempty"`
+	ReleasedAt  *time.Time       `json:"released_at,omitempty"`
+}
+
+// MilestoneReleaseRequest represents a signature on the release of one milestone
+type MilestoneReleaseRequest struct {
+	EscrowID   string `json:"escrow_id"`
+	Milestone  int    `json:"milestone"`             // index of the milestone
+	PrivateKey string `json:"private_key,omitempty"` // deprecated, send the signed psbt instead
+	PSBT       string `json:"psbt,omitempty"`        // the payout signed by the party
+	Signature  string `json:"signature"`
+	Party      string `json:"party"`                // "buyer", "seller", or "escrow"
+	PublicKey  string `json:"public_key,omitempty"` // optional when authenticated with a key-bound session
+}
+
+// buildMilestones validates the requested milestones and returns them with their total amount
+func buildMilestones(requests []MilestoneRequest, now time.Time) ([]Milestone, int64, error) {
+	milestones := make([]Milestone, 0, len(requests))
+	var total int64
+	var previous time.Time
+
+	for i, req := range requests {
+		// Each partial release pays the fee out of the milestone amount, which is checked on release
+		if req.Amount <= dustLimit {
+			return nil, 0, fmt.Errorf("milestone %d amount must be more than %d satoshis", i, dustLimit)
+		}
+
+		if req.Description == "" {
+			return nil, 0, fmt.Errorf("milestone %d needs a description", i)
+		}
+
+		if !req.Deadline.After(now) || req.Deadline.Before(previous) {
+			return nil, 0, fmt.Errorf("milestone %d deadline must be in the future and not before the previous one", i)
+		}
+		previous = req.Deadline
+
+		milestones = append(milestones, Milestone{
+			Index:       i,
+			Amount:      req.Amount,
+			Description: req.Description,
+			Deadline:    req.Deadline,
+			Status:      MilestonePending,
+		})
+		total += req.Amount
+	}
+
+	return milestones, total, nil
+}
+
+// lockedAmount returns the amount still held in the multisig output
+// Once deposits are seen it is capped at what they hold, so a shortfall within the funding tolerance
+// is absorbed by the payouts
+func (e *Escrow) lockedAmount() int64 {
+	locked := e.Amount - e.ReleasedAmount
+	if funded := e.fundedAmount(); len(e.FundingUTXOs) > 0 && funded < locked {
+		return funded
+	}
+	return locked
+}
+
+// nextMilestone returns the index of the first unreleased milestone, or -1 if all are released
+func (e *Escrow) nextMilestone() int {
+	for i, milestone := range e.Milestones {
+		if milestone.Status == MilestonePending {
+			return i
+		}
+	}
+	return -1
+}
+
+// milestoneOutputs pays the milestone to the seller, before the fee is deducted and less its share of a
+// release service fee, and returns the rest of the locked funds to the multisig address as change
+func milestoneOutputs(escrow *Escrow, milestone *Milestone) []utils.PayoutOutput {
+	// A funding shortfall is taken from the last milestone
+	amount := milestone.Amount
+	if locked := escrow.lockedAmount(); amount > locked {
+		amount = locked
+	}
+
+	change := escrow.lockedAmount() - amount
+	outputs := escrow.sellerOutputs(amount, change == 0)
+
+	if change > 0 {
+		outputs = append(outputs, utils.PayoutOutput{Address: escrow.MultiSigAddress, Amount: change})
+	}
+
+	return outputs
+}
+
+// ReleaseMilestone adds a signature to the release of the next milestone
+// Once 2 of 3 parties have signed, a partial release pays the milestone and keeps the rest locked
+func ReleaseMilestone(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		utils.WriteErrorResponse(w, http.StatusMethodNotAllowed, errors.New("method not allowed"), "Only POST method is allowed")
+		return
+	}
+
+	var req MilestoneReleaseRequest
+	if err := utils.DecodeJSONBody(r, &req); err != nil {
+		utils.WriteErrorResponse(w, http.StatusBadRequest, err, "Invalid request payload")
+		return
+	}
+
+	// Validate request
+	if req.EscrowID == "" || req.Signature == "" {
+		utils.WriteErrorResponse(w, http.StatusBadRequest, errors.New("missing required fields"),
+			"Escrow ID and signature are required")
+		return
+	}
+
+	party, err := parsePayoutSigner(r, req.Party, req.PublicKey, req.PSBT, req.PrivateKey)
+	if err != nil {
+		writeUpdateError(w, err)
+		return
+	}
+	newSignature := party.signature(req.Signature)
+
+	var response map[string]interface{}
+	etag, err := updateEscrowSigned(req.EscrowID, r.Header.Get("If-Match"), party.signer, func(escrow *Escrow, signing *payoutSigning) error {
+		if err := party.check(r, escrow); err != nil {
+			return err
+		}
+
+		if len(escrow.Milestones) == 0 {
+			return &requestError{http.StatusBadRequest, errors.New("no milestones"), "Escrow was not created with milestones"}
+		}
+
+		if escrow.Status != StatusFunded && escrow.Status != StatusPartiallyReleased {
+			return &requestError{http.StatusBadRequest, errors.New("invalid status"),
+				fmt.Sprintf("Escrow status is %s, cannot release a milestone", escrow.Status)}
+		}
+
+		// Milestones are released in order
+		next := escrow.nextMilestone()
+		if req.Milestone != next {
+			return &requestError{http.StatusBadRequest, errors.New("milestone out of order"),
+				fmt.Sprintf("Milestones are released in order, the next milestone is %d", next)}
+		}
+		milestone := &escrow.Milestones[next]
+
+		for _, sig := range milestone.Signatures {
+			if sig.Party == req.Party {
+				return &requestError{http.StatusBadRequest, errors.New("duplicate signature"),
+					fmt.Sprintf("A signature from %s has already been provided", req.Party)}
+			}
+		}
+
+		signatures := append(append([]PartySignature{}, milestone.Signatures...), newSignature)
+
+		// The first signature locks in the fee, later signatures sign the same payout
+		quote, outputs, err := quotePayout(escrow, milestone.Fee, milestoneOutputs(escrow, milestone))
+		if err != nil {
+			return err
+		}
+
+		var signedTx, txID string
+		var payout *utils.Transaction
+
+		// Check if we have reached the 2-of-3 threshold
+		if len(signatures) >= 2 {
+			tx, signed, err := createPayout(escrow, outputs, quote.Fee, signing)
+			if err != nil {
+				return err
+			}
+			txID, signedTx, payout = tx.TxID, signed, &tx
+		}
+
+		// All checks passed, apply the changes
+		from := escrow.Status
+		if txID != "" {
+			// The last milestone releases everything, earlier ones leave change locked
+			if escrow.lockedAmount() > milestone.Amount {
+				if err := escrow.transition(StatusPartiallyReleased); err != nil {
+					return err
+				}
+			} else {
+				if err := escrow.transition(StatusReleasing); err != nil {
+					return err
+				}
+				if err := escrow.transition(StatusReleased); err != nil {
+					return err
+				}
+				escrow.ReleaseTxID = txID
+			}
+
+			now := time.Now()
+			milestone.Status = MilestoneReleased
+			milestone.TxID = txID
+			escrow.recordPayout(payout)
+			milestone.ReleasedAt = &now
+			escrow.ReleasedAmount += milestone.Amount
+			log.Printf("Released milestone %d of escrow ID: %s, TxID: %s", next, escrow.ID, txID)
+		} else {
+			log.Printf("Added milestone %d signature for escrow ID: %s from %s", next, escrow.ID, req.Party)
+		}
+		escrow.recordRequest(r, req.Party, "milestone_signed", from,
+			fmt.Sprintf("Milestone %d signature %d of 2", next, len(signatures)))
+		milestone.Signatures = signatures
+		milestone.Fee = quote
+
+		response = map[string]interface{}{
+			"escrow_id":         escrow.ID,
+			"status":            escrow.Status,
+			"milestone":         milestone,
+			"released_amount":   escrow.ReleasedAmount,
+			"locked_amount":     escrow.lockedAmount(),
+			"signatures_count":  len(milestone.Signatures),
+			"signatures_needed": 2,
+			"signed_tx":         signedTx,
+			"version":           escrow.Version,
+		}
+		return nil
+	})
+	if err != nil {
+		writeUpdateError(w, err)
+		return
+	}
+
+	w.Header().Set("ETag", etag)
+	utils.WriteJSONResponse(w, http.StatusOK, response)
+}
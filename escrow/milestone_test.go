@@ -0,0 +1,109 @@
+package escrow
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+// signMilestoneAs signs the release of a milestone as the buyer or the seller and returns the response status code
+func signMilestoneAs(t *testing.T, id string, milestone int, party string) int {
+	t.Helper()
+
+	identity, req := partySigning(id, party)
+	code, _ := callHandler(t, ReleaseMilestone, identity, MilestoneReleaseRequest{
+		EscrowID:   id,
+		Milestone:  milestone,
+		PrivateKey: req.PrivateKey,
+		Signature:  req.Signature,
+		Party:      party,
+		PublicKey:  req.PublicKey,
+	})
+	return code
+}
+
+func TestBuildMilestones(t *testing.T) {
+	now := time.Now()
+	later := now.Add(24 * time.Hour)
+
+	for _, c := range []struct {
+		name       string
+		milestones []MilestoneRequest
+	}{
+		{"dust amount", []MilestoneRequest{{Amount: dustLimit, Description: "Design", Deadline: later}}},
+		{"no description", []MilestoneRequest{{Amount: 10000, Deadline: later}}},
+		{"past deadline", []MilestoneRequest{{Amount: 10000, Description: "Design", Deadline: now.Add(-time.Hour)}}},
+		{"deadlines out of order", []MilestoneRequest{
+			{Amount: 10000, Description: "Design", Deadline: later},
+			{Amount: 10000, Description: "Build", Deadline: later.Add(-time.Hour)},
+		}},
+	} {
+		if _, _, err := buildMilestones(c.milestones, now); err == nil {
+			t.Errorf("%s: expected the milestones to be refused", c.name)
+		}
+	}
+
+	milestones, total, err := buildMilestones([]MilestoneRequest{
+		{Amount: 10000, Description: "Design", Deadline: later},
+		{Amount: 20000, Description: "Build", Deadline: later},
+	}, now)
+	if err != nil || total != 30000 || milestones[1].Index != 1 || milestones[1].Status != MilestonePending {
+		t.Errorf("expected two pending milestones of 30000 satoshis, got %+v, %d (%v)", milestones, total, err)
+	}
+}
+
+func TestMilestonesReleaseInOrderWithChange(t *testing.T) {
+	deadline := time.Now().Add(24 * time.Hour)
+	response := mustCall(t, CreateEscrow, testAdmin, EscrowRequest{
+		BuyerPubKey:  testBuyerPubKey,
+		SellerPubKey: testSellerPubKey,
+		EscrowPubKey: testEscrowPubKey,
+		Milestones: []MilestoneRequest{
+			{Amount: 30000, Description: "Design", Deadline: deadline},
+			{Amount: 50000, Description: "Build", Deadline: deadline},
+		},
+	}, http.StatusCreated)
+	id := response["id"].(string)
+	depositTestFunds(t, id, 80000, 1)
+	mustCall(t, VerifyPayment, testAdmin, map[string]string{"escrow_id": id}, http.StatusOK)
+
+	if code := signMilestoneAs(t, id, 1, "buyer"); code != http.StatusBadRequest {
+		t.Errorf("expected the second milestone to be refused before the first, got %d", code)
+	}
+
+	// The first release pays the seller and returns the rest to the multisig address
+	signMilestoneAs(t, id, 0, "buyer")
+	if code := signMilestoneAs(t, id, 0, "seller"); code != http.StatusOK {
+		t.Fatalf("expected the first milestone to be released, got %d", code)
+	}
+	viewEscrow(id, func(escrow *Escrow) error {
+		if escrow.Status != StatusPartiallyReleased || escrow.ReleasedAmount != 30000 || escrow.lockedAmount() != 50000 {
+			t.Fatalf("expected 50000 satoshis to stay locked, got %s with %d released", escrow.Status, escrow.ReleasedAmount)
+		}
+		outputs := escrow.Payout.Outputs
+		if len(outputs) != 2 || outputs[1].Address != escrow.MultiSigAddress || outputs[1].Amount != 50000 {
+			t.Errorf("expected change of 50000 satoshis to the multisig address, got %+v", outputs)
+		}
+		if outputs[0].Amount+escrow.Payout.Fee != 30000 {
+			t.Errorf("expected the fee to come out of the milestone, got %d plus %d", outputs[0].Amount, escrow.Payout.Fee)
+		}
+		return nil
+	})
+
+	// The last release spends everything, without change
+	signMilestoneAs(t, id, 1, "seller")
+	if code := signMilestoneAs(t, id, 1, "buyer"); code != http.StatusOK {
+		t.Fatalf("expected the last milestone to be released, got %d", code)
+	}
+	viewEscrow(id, func(escrow *Escrow) error {
+		if escrow.Status != StatusReleased || escrow.nextMilestone() != -1 || escrow.ReleaseTxID == "" {
+			t.Errorf("expected the escrow to be released, got %s", escrow.Status)
+		}
+		for _, output := range escrow.Payout.Outputs {
+			if output.Address == escrow.MultiSigAddress {
+				t.Errorf("expected no change from the last milestone, got %+v", escrow.Payout.Outputs)
+			}
+		}
+		return nil
+	})
+}
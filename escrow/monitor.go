@@ -0,0 +1,138 @@
+package escrow
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// ProcessFundingChecks rechecks the funding outpoints of escrows holding deposits against the chain backend
+// A deposit gone from the chain, double-spent by a replacement or reorganized out, is marked reverted and
+// can no longer be spent by a payout. An escrow whose remaining confirmed deposits no longer cover the
+// amount held moves to funding_reverted until they do again
+func ProcessFundingChecks(now time.Time) {
+	for _, escrow := range listEscrows() {
+		var address string
+		monitored := false
+		viewEscrow(escrow.ID, func(escrow *Escrow) error {
+			address = escrow.MultiSigAddress
+			monitored = len(escrow.unspentUTXOs()) > 0 || escrow.Status == StatusFundingReverted
+			return nil
+		})
+		if !monitored {
+			continue
+		}
+
+		// Query the chain before taking the escrow's lock
+		utxos, err := chainBackend.AddressUTXOs(address)
+		if err != nil {
+			log.Printf("Failed to check funding for escrow ID: %s: %v", escrow.ID, err)
+			continue
+		}
+
+		_, err = updateEscrow(escrow.ID, "", func(escrow *Escrow) error {
+			return checkFunding(escrow, utxos, now)
+		})
+		if err != nil && !errors.Is(err, errUnchanged) {
+			log.Printf("Failed to check funding for escrow ID: %s: %v", escrow.ID, err)
+		}
+	}
+}
+
+// checkFunding compares the escrow's unspent deposits with utxos, the outputs now at its address
+func checkFunding(escrow *Escrow, utxos []UTXO, now time.Time) error {
+	if escrow.Status.IsTerminal() || escrow.Status == StatusCreated {
+		return errUnchanged
+	}
+
+	onChain := make(map[string]UTXO, len(utxos))
+	for _, utxo := range utxos {
+		onChain[fmt.Sprintf("%s:%d", utxo.TxID, utxo.Vout)] = utxo
+	}
+
+	// Outputs paid back by the escrow's own payouts are not deposits, and are not checked
+	changed := false
+	var reverted []string
+	for i := range escrow.FundingUTXOs {
+		utxo := &escrow.FundingUTXOs[i]
+		if utxo.SpentBy != "" || escrow.isPayoutOutput(*utxo) {
+			continue
+		}
+
+		outpoint := fmt.Sprintf("%s:%d", utxo.TxID, utxo.Vout)
+		current, found := onChain[outpoint]
+		switch {
+		case !found && !utxo.Reverted:
+			utxo.Reverted = true
+			reverted = append(reverted, outpoint)
+			changed = true
+		case found && (utxo.Reverted || utxo.Confirmations != current.Confirmations):
+			utxo.Reverted = false
+			utxo.Confirmations = current.Confirmations
+			changed = true
+		}
+	}
+
+	// A reverted escrow also picks up replacement deposits, which may restore its funding
+	if escrow.Status == StatusFundingReverted && escrow.trackUTXOs(claimUTXOs(escrow.ID, utxos)) > 0 {
+		changed = true
+	}
+
+	// Underfunded escrows cannot be released, and a refund only spends the deposits still on the chain
+	safe := escrow.Status == StatusUnderfunded || escrow.fundingSafe()
+
+	from := escrow.Status
+	switch {
+	case !safe && from != StatusFundingReverted:
+		if err := escrow.revert(); err != nil {
+			return err
+		}
+
+		// LIMITATION: Alerts are only recorded in the escrow history and the log
+		detail := fmt.Sprintf("Confirmed deposits of %d satoshis no longer cover the %d satoshis held",
+			escrow.safeAmount(), escrow.Amount-escrow.ReleasedAmount)
+		if len(reverted) > 0 {
+			detail = fmt.Sprintf("%s, reverted outpoints: %s", detail, strings.Join(reverted, ", "))
+		}
+		escrow.recordHistory(now, "system", "funding_reverted", from, detail)
+		log.Printf("ALERT: Funding of escrow ID: %s reverted while %s: %s", escrow.ID, from, detail)
+
+	case safe && from == StatusFundingReverted:
+		if err := escrow.resume(); err != nil {
+			return err
+		}
+		escrow.recordHistory(now, "system", "funding_restored", from,
+			fmt.Sprintf("Confirmed deposits of %d satoshis cover the amount held again", escrow.safeAmount()))
+		log.Printf("Funding of escrow ID: %s restored, resumed as %s", escrow.ID, escrow.Status)
+
+	case len(reverted) > 0:
+		escrow.recordHistory(now, "system", "deposit_reverted", from,
+			fmt.Sprintf("Reverted outpoints: %s", strings.Join(reverted, ", ")))
+		log.Printf("Deposits of escrow ID: %s reverted: %s", escrow.ID, strings.Join(reverted, ", "))
+
+	case !changed:
+		return errUnchanged
+	}
+
+	return nil
+}
+
+// safeAmount returns the value of the unspent outputs a payout can rely on: confirmed deposits,
+// and outputs paid back by the escrow's own payouts
+func (e *Escrow) safeAmount() int64 {
+	var total int64
+	for _, utxo := range e.unspentUTXOs() {
+		if utxo.Confirmations >= fundingPolicy.Confirmations || e.isPayoutOutput(utxo) {
+			total += utxo.Value
+		}
+	}
+	return total
+}
+
+// fundingSafe reports whether the escrow's safe outputs still cover the amount not yet released, less the tolerance
+// Unlike lockedAmount, the amount is not capped at the deposits, which are what is being checked
+func (e *Escrow) fundingSafe() bool {
+	return e.safeAmount() >= e.Amount-e.ReleasedAmount-fundingPolicy.Tolerance
+}
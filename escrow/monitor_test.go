@@ -0,0 +1,136 @@
+package escrow
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+// containsAction reports whether action was recorded in the escrow's audit log
+func containsAction(id, action string) bool {
+	for _, recorded := range historyActions(id) {
+		if recorded == action {
+			return true
+		}
+	}
+	return false
+}
+
+func TestFundingRevertedByDoubleSpendAndRestoredByReorg(t *testing.T) {
+	id, txID := fundTestEscrow(t, 100000)
+	if escrow := snapshotEscrow(t, id); escrow.Status != StatusFunded {
+		t.Fatalf("expected a funded escrow, got %s", escrow.Status)
+	}
+
+	// The deposit is double-spent
+	mustCall(t, MockDoubleSpend, testAdmin, map[string]string{"txid": txID}, http.StatusOK)
+	ProcessFundingChecks(time.Now())
+
+	escrow := snapshotEscrow(t, id)
+	if escrow.Status != StatusFundingReverted {
+		t.Fatalf("expected funding_reverted after the double spend, got %s", escrow.Status)
+	}
+	if escrow.RevertedFrom != StatusFunded {
+		t.Errorf("expected reverted_from %s, got %q", StatusFunded, escrow.RevertedFrom)
+	}
+	if len(escrow.FundingUTXOs) != 1 || !escrow.FundingUTXOs[0].Reverted {
+		t.Errorf("expected the deposit to be marked reverted, got %+v", escrow.FundingUTXOs)
+	}
+	if !containsAction(id, "funding_reverted") {
+		t.Errorf("expected a funding_reverted event, got %v", historyActions(id))
+	}
+
+	// The same transaction is mined again after a reorg
+	mustCall(t, MockDeposit, testAdmin, MockDepositRequest{EscrowID: id, TxID: txID, Value: 100000, Confirmations: 1},
+		http.StatusCreated)
+	ProcessFundingChecks(time.Now())
+
+	escrow = snapshotEscrow(t, id)
+	if escrow.Status != StatusFunded {
+		t.Fatalf("expected funded once the deposit is back, got %s", escrow.Status)
+	}
+	if escrow.RevertedFrom != "" {
+		t.Errorf("expected reverted_from to be cleared, got %q", escrow.RevertedFrom)
+	}
+	if len(escrow.FundingUTXOs) != 1 || escrow.FundingUTXOs[0].Reverted {
+		t.Errorf("expected the deposit to be restored, got %+v", escrow.FundingUTXOs)
+	}
+	if !containsAction(id, "funding_restored") {
+		t.Errorf("expected a funding_restored event, got %v", historyActions(id))
+	}
+}
+
+func TestFundingRevertedByLostConfirmations(t *testing.T) {
+	id, txID := fundTestEscrow(t, 50000)
+
+	// A reorg leaves the deposit unconfirmed, it no longer counts towards funding
+	mustCall(t, MockConfirm, testAdmin, map[string]interface{}{"txid": txID, "confirmations": 0}, http.StatusOK)
+	ProcessFundingChecks(time.Now())
+
+	escrow := snapshotEscrow(t, id)
+	if escrow.Status != StatusFundingReverted || escrow.RevertedFrom != StatusFunded {
+		t.Fatalf("expected funding_reverted from funded, got %s from %q", escrow.Status, escrow.RevertedFrom)
+	}
+	if escrow.FundingUTXOs[0].Reverted {
+		t.Errorf("an unconfirmed deposit is still on the chain, it should not be marked reverted")
+	}
+
+	// Nothing can be paid out while the funding is unsafe
+	code, _ := callHandler(t, ReleaseEscrow, testBuyer, ReleaseRequest{
+		EscrowID:   id,
+		PrivateKey: testBuyerPrivKey,
+		Signature:  "signature",
+		Party:      "buyer",
+		PublicKey:  testBuyerPubKey,
+	})
+	if code == http.StatusOK {
+		t.Errorf("expected the release of a reverted escrow to be refused")
+	}
+
+	mustCall(t, MockConfirm, testAdmin, map[string]interface{}{"txid": txID, "confirmations": 1}, http.StatusOK)
+	ProcessFundingChecks(time.Now())
+
+	escrow = snapshotEscrow(t, id)
+	if escrow.Status != StatusFunded || escrow.RevertedFrom != "" {
+		t.Errorf("expected funded once confirmed again, got %s with reverted_from %q", escrow.Status, escrow.RevertedFrom)
+	}
+}
+
+func TestReleasedEscrowNotReverted(t *testing.T) {
+	id, txID := fundTestEscrow(t, 80000)
+
+	mustCall(t, ReleaseEscrow, testBuyer, ReleaseRequest{
+		EscrowID:   id,
+		PrivateKey: testBuyerPrivKey,
+		Signature:  "signature",
+		Party:      "buyer",
+		PublicKey:  testBuyerPubKey,
+	}, http.StatusOK)
+	mustCall(t, ReleaseEscrow, testSeller, ReleaseRequest{
+		EscrowID:   id,
+		PrivateKey: testSellerPrivKey,
+		Signature:  "signature",
+		Party:      "seller",
+		PublicKey:  testSellerPubKey,
+	}, http.StatusOK)
+	if escrow := snapshotEscrow(t, id); escrow.Status != StatusReleased {
+		t.Fatalf("expected a released escrow, got %s", escrow.Status)
+	}
+
+	// The deposit the payout spent disappears from the address, as it does once the payout confirms
+	mustCall(t, MockDoubleSpend, testAdmin, map[string]string{"txid": txID}, http.StatusOK)
+	ProcessFundingChecks(time.Now())
+
+	escrow := snapshotEscrow(t, id)
+	if escrow.Status != StatusReleased || escrow.RevertedFrom != "" {
+		t.Errorf("expected the escrow to stay released, got %s with reverted_from %q", escrow.Status, escrow.RevertedFrom)
+	}
+	for _, utxo := range escrow.FundingUTXOs {
+		if utxo.Reverted {
+			t.Errorf("expected spent deposits to be left alone, %s:%d was marked reverted", utxo.TxID, utxo.Vout)
+		}
+	}
+	if containsAction(id, "funding_reverted") || containsAction(id, "deposit_reverted") {
+		t.Errorf("expected no revert events, got %v", historyActions(id))
+	}
+}
@@ -1,8 +1,11 @@
 package escrow
 
 import (
+	"errors"
 	"escrow-service/utils"
 	"fmt"
+	"net/http"
+	"reflect"
 )
 
 // CreateMultiSig creates a 2-of-3 multisig address
@@ -21,17 +24,20 @@ func CreateMultiSig(buyerPubKey, sellerPubKey, escrowPubKey string) (string, err
 	return multiSigAddress, nil
 }
 
-// SignMultiSigTransaction signs a multisig transaction with the provided private key
-func SignMultiSigTransaction(txHex string, privateKey string) (string, error) {
+// SignMultiSigTransaction signs each of the multisig inputs of a transaction with the provided signer
+func SignMultiSigTransaction(txHex string, inputs int, signer Signer) (string, error) {
 	// Validate input parameters
-	if txHex == "" || privateKey == "" {
-		return "", fmt.Errorf("transaction hex and private key are required")
+	if txHex == "" || signer == nil {
+		return "", fmt.Errorf("transaction hex and signer are required")
 	}
 
-	// Call the utility function to sign the transaction
-	signedTxHex, err := utils.SignTransaction(txHex, privateKey)
-	if err != nil {
-		return "", fmt.Errorf("failed to sign transaction: %v", err)
+	// Every input spends an output of the same escrow address
+	signedTxHex := txHex
+	for i := 0; i < inputs; i++ {
+		var err error
+		if signedTxHex, err = signer.SignPSBTInput(signedTxHex, i); err != nil {
+			return "", fmt.Errorf("failed to sign input %d: %v", i, err)
+		}
 	}
 
 	return signedTxHex, nil
@@ -52,3 +58,110 @@ func VerifyMultiSigTransaction(txID string) (bool, error) {
 
 	return verified, nil
 }
+
+// createPayout creates the transaction spending every unspent escrow output to the given outputs, signed as planned by signing
+// Deposits above the locked amount are handled as the funding policy says, and the fee is whatever the outputs leave
+func createPayout(escrow *Escrow, outputs []utils.PayoutOutput, fee int64, signing *payoutSigning) (utils.Transaction, string, error) {
+	return signing.payout(escrow.payoutInputs(), payoutOutputs(escrow, outputs), fee)
+}
+
+// unsignedPayout returns the unsigned transaction spending inputs to outputs, which a party signs as a PSBT
+// and sends instead of its private key to complete a payout. It is empty if the payout cannot be built
+func unsignedPayout(inputs []utils.TxInput, outputs []utils.PayoutOutput, fee int64) string {
+	tx, err := utils.CreatePayoutTransaction(inputs, outputs, fee)
+	if err != nil {
+		return ""
+	}
+	return tx.RawTx
+}
+
+// payoutOutputs adds any overpayment to outputs, as an output returning it to the buyer or paid with the first output
+func payoutOutputs(escrow *Escrow, outputs []utils.PayoutOutput) []utils.PayoutOutput {
+	outputs = append([]utils.PayoutOutput{}, outputs...)
+	if change, ok := escrow.changeOutput(); ok {
+		outputs = append(outputs, change)
+	} else {
+		outputs[0].Amount += escrow.excessAmount()
+	}
+	return outputs
+}
+
+// errSigningPending aborts the first pass of an update whose payout must be signed before it can be applied
+var errSigningPending = errors.New("payout signing pending")
+
+// payoutSigning signs a payout without holding the escrow's lock, since the signer may be a remote daemon.
+// The first pass of an update plans the payout and aborts, leaving the escrow untouched. The planned
+// transaction is then signed, and the second pass applies the update with it if the escrow is unchanged
+type payoutSigning struct {
+	signer  Signer
+	version int64 // escrow version seen by the first pass
+	planned *utils.Transaction
+	signed  string
+}
+
+// payout returns the signed transaction spending inputs to outputs, or plans it on the first pass
+func (s *payoutSigning) payout(inputs []utils.TxInput, outputs []utils.PayoutOutput, fee int64) (utils.Transaction, string, error) {
+	if s.planned == nil {
+		// Create the transaction (simplified for demo)
+		tx, err := utils.CreatePayoutTransaction(inputs, outputs, fee)
+		if err != nil {
+			return utils.Transaction{}, "", &requestError{http.StatusInternalServerError, err, "Failed to create payout transaction"}
+		}
+		s.planned = &tx
+		return utils.Transaction{}, "", errSigningPending
+	}
+
+	// The escrow is unchanged since the first pass, so it pays out the planned transaction again
+	if !sameInputs(inputs, s.planned.Inputs) || !reflect.DeepEqual(outputs, s.planned.Outputs) || fee != s.planned.Fee {
+		return utils.Transaction{}, "", &requestError{http.StatusConflict, errors.New("payout changed"),
+			"Payout changed while it was being signed, retry the request"}
+	}
+	return *s.planned, s.signed, nil
+}
+
+// updateEscrowSigned runs fn like updateEscrow, signing any payout fn creates with signer outside the escrow's lock
+// If the escrow changed while the payout was being signed, the update is refused with 409 and may be retried
+func updateEscrowSigned(id, ifMatch string, signer Signer, fn func(escrow *Escrow, signing *payoutSigning) error) (string, error) {
+	signing := &payoutSigning{signer: signer}
+	etag, err := updateEscrow(id, ifMatch, func(escrow *Escrow) error {
+		signing.version = escrow.Version
+		return fn(escrow, signing)
+	})
+	if err != errSigningPending {
+		return etag, err
+	}
+
+	signed, err := SignMultiSigTransaction(signing.planned.RawTx, len(signing.planned.Inputs), signer)
+	if err != nil {
+		return "", signingFailed(signer, err, "Failed to sign payout transaction")
+	}
+	signing.signed = signed
+
+	return updateEscrow(id, "", func(escrow *Escrow) error {
+		if escrow.Version != signing.version {
+			return &requestError{http.StatusConflict, errors.New("escrow changed"),
+				"Escrow changed while the payout was being signed, retry the request"}
+		}
+		return fn(escrow, signing)
+	})
+}
+
+// releaseOutputs pays the locked amount to the seller, before the fee is deducted,
+// less what is left of a release service fee
+func releaseOutputs(escrow *Escrow) []utils.PayoutOutput {
+	return escrow.sellerOutputs(escrow.lockedAmount(), true)
+}
+
+// settlementOutputs pays the outputs a settlement or split divides the locked amount between,
+// plus what is left of a release service fee
+func settlementOutputs(escrow *Escrow, outputs []utils.PayoutOutput) []utils.PayoutOutput {
+	return append(append([]utils.PayoutOutput{}, outputs...), escrow.serviceFeeOutputs()...)
+}
+
+// refundOutputs pays the locked amount back to the buyer's refund address, before the fee is deducted
+func refundOutputs(escrow *Escrow) []utils.PayoutOutput {
+	return []utils.PayoutOutput{{
+		Address: escrow.refundAddress(),
+		Amount:  escrow.lockedAmount(),
+	}}
+}
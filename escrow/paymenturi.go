@@ -0,0 +1,184 @@
+package escrow
+
+import (
+	"errors"
+	"escrow-service/utils"
+	"net/http"
+	"strconv"
+	"unicode/utf8"
+)
+
+const (
+	defaultQRScale = 8   // pixels per module of PNG QR codes
+	maxQRScale     = 32  // largest scale accepted
+	qrBorder       = 4   // quiet zone in modules, the minimum the standard allows
+	maxURITextLen  = 200 // longest label or message accepted
+)
+
+// PaymentURI is a BIP21 URI for an escrow's outstanding payment request, with its parts
+type PaymentURI struct {
+	URI        string `json:"uri"`
+	Address    string `json:"address"`
+	Amount     int64  `json:"amount"`     // satoshis
+	AmountBTC  string `json:"amount_btc"` // as written in the URI
+	Label      string `json:"label,omitempty"`
+	Message    string `json:"message,omitempty"`
+	RequestID  string `json:"request_id"`
+	RequestURL string `json:"request_url"` // the BIP72 r parameter
+	// RequestOnly is set when the request pays several outputs, which a BIP21 address and amount cannot carry,
+	// so the URI only points at the payment request
+	RequestOnly bool `json:"request_only,omitempty"`
+}
+
+// awaitingPayment reports whether the escrow still takes deposits through a payment request
+// An underfunded escrow stops once its expiry has been handled, which invalidates the top-up request
+func (e *Escrow) awaitingPayment() bool {
+	return e.Status == StatusCreated || (e.Status == StatusUnderfunded && e.ExpiryHandledAt == nil)
+}
+
+// paymentURI returns the BIP21 URI paying the escrow's outstanding payment request: the top-up request
+// for the shortfall once underpaid, otherwise the original one. An empty label or message gets a default,
+// the message being the description cut to the length accepted for messages. A request paying a funding
+// fee has a second output, so its URI has no address and amount, and only wallets fetching the request can pay
+func (e *Escrow) paymentURI(label, message string) PaymentURI {
+	request := e.PaymentRequest
+	if e.Status == StatusUnderfunded && e.TopUpRequest != nil {
+		request = *e.TopUpRequest
+	}
+
+	if label == "" {
+		label = "Escrow"
+	}
+	if message == "" {
+		message = truncateText(e.Description, maxURITextLen)
+	}
+
+	requestURL := utils.PaymentRequestURL(request.RequestID)
+	uri := PaymentURI{
+		URI:        utils.BIP21URI(request.Address, request.Amount, label, message, requestURL),
+		Address:    request.Address,
+		Amount:     request.Amount,
+		AmountBTC:  utils.FormatBTC(request.Amount),
+		Label:      label,
+		Message:    message,
+		RequestID:  request.RequestID,
+		RequestURL: requestURL,
+	}
+
+	// A wallet paying the address and amount would skip the other outputs
+	if details, err := utils.DeserializePaymentDetails(request.SerializedDetails); err != nil || len(details.Outputs) > 1 {
+		uri.URI = utils.BIP21URI("", 0, label, message, requestURL)
+		uri.Address, uri.Amount, uri.AmountBTC, uri.RequestOnly = "", 0, "", true
+	}
+	return uri
+}
+
+// truncateText cuts text to at most max characters
+func truncateText(text string, max int) string {
+	if utf8.RuneCountInString(text) <= max {
+		return text
+	}
+	return string([]rune(text)[:max])
+}
+
+// readPaymentURI reads the escrow's payment URI for a request with escrow_id, label and message query parameters
+func readPaymentURI(r *http.Request) (PaymentURI, error) {
+	query := r.URL.Query()
+	escrowID, label, message := query.Get("escrow_id"), query.Get("label"), query.Get("message")
+	if escrowID == "" {
+		return PaymentURI{}, &requestError{http.StatusBadRequest, errors.New("missing required fields"), "Escrow ID is required"}
+	}
+	if utf8.RuneCountInString(label) > maxURITextLen || utf8.RuneCountInString(message) > maxURITextLen {
+		return PaymentURI{}, &requestError{http.StatusBadRequest, errors.New("text too long"),
+			"Label and message must be at most 200 characters"}
+	}
+
+	var uri PaymentURI
+	err := viewEscrow(escrowID, func(escrow *Escrow) error {
+		if err := authorizeRead(r, escrow); err != nil {
+			return err
+		}
+		if !escrow.awaitingPayment() {
+			return &requestError{http.StatusConflict, errors.New("not awaiting payment"),
+				"Escrow is " + string(escrow.Status) + " and no longer takes payments"}
+		}
+		uri = escrow.paymentURI(label, message)
+		return nil
+	})
+	return uri, err
+}
+
+// GetPaymentURI returns the BIP21 URI, with a BIP72 payment request URL, that pays the escrow
+func GetPaymentURI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		utils.WriteErrorResponse(w, http.StatusMethodNotAllowed, errors.New("method not allowed"), "Only GET method is allowed")
+		return
+	}
+
+	uri, err := readPaymentURI(r)
+	if err != nil {
+		writeUpdateError(w, err)
+		return
+	}
+
+	utils.WriteJSONResponse(w, http.StatusOK, map[string]interface{}{
+		"escrow_id":   r.URL.Query().Get("escrow_id"),
+		"payment_uri": uri,
+	})
+}
+
+// GetPaymentQR renders the escrow's payment URI as a QR code, a PNG by default or an SVG with format=svg
+func GetPaymentQR(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		utils.WriteErrorResponse(w, http.StatusMethodNotAllowed, errors.New("method not allowed"), "Only GET method is allowed")
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "png"
+	}
+	if format != "png" && format != "svg" {
+		utils.WriteErrorResponse(w, http.StatusBadRequest, errors.New("invalid format"), "Format must be png or svg")
+		return
+	}
+
+	scale := defaultQRScale
+	if value := r.URL.Query().Get("scale"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > maxQRScale {
+			utils.WriteErrorResponse(w, http.StatusBadRequest, errors.New("invalid scale"),
+				"Scale must be between 1 and 32 pixels per module")
+			return
+		}
+		scale = parsed
+	}
+
+	uri, err := readPaymentURI(r)
+	if err != nil {
+		writeUpdateError(w, err)
+		return
+	}
+
+	code, err := utils.EncodeQR([]byte(uri.URI))
+	if err != nil {
+		utils.WriteErrorResponse(w, http.StatusInternalServerError, err, "Failed to encode QR code")
+		return
+	}
+
+	// The URI changes once the escrow is underpaid or funded, so the image is not cached
+	w.Header().Set("Cache-Control", "no-store")
+	if format == "svg" {
+		w.Header().Set("Content-Type", "image/svg+xml")
+		w.Write([]byte(code.SVG(qrBorder)))
+		return
+	}
+
+	image, err := code.PNG(scale, qrBorder)
+	if err != nil {
+		utils.WriteErrorResponse(w, http.StatusInternalServerError, err, "Failed to render QR code")
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Write(image)
+}
@@ -0,0 +1,66 @@
+package escrow
+
+import (
+	"escrow-service/utils"
+	"net/url"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestPaymentURIDefaultMessageTruncated(t *testing.T) {
+	escrow := &Escrow{
+		Status:      StatusCreated,
+		Description: strings.Repeat("é", maxURITextLen+50),
+		PaymentRequest: utils.PaymentRequest{
+			RequestID: "payreq-test",
+			Address:   "2N7DRF4Ny72Ws7p2TwQbd8J7oK4RHiFuLhX",
+			Amount:    100000,
+		},
+	}
+
+	uri := escrow.paymentURI("", "")
+	if got := utf8.RuneCountInString(uri.Message); got != maxURITextLen {
+		t.Fatalf("expected the default message to be cut to %d characters, got %d", maxURITextLen, got)
+	}
+
+	parsed, err := url.Parse(uri.URI)
+	if err != nil {
+		t.Fatalf("invalid URI %q: %v", uri.URI, err)
+	}
+	if message := parsed.Query().Get("message"); message != uri.Message {
+		t.Errorf("expected the URI to carry the cut message, got %q", message)
+	}
+
+	if short := escrow.paymentURI("", "Order 42"); short.Message != "Order 42" {
+		t.Errorf("expected a given message to be kept, got %q", short.Message)
+	}
+}
+
+func TestPaymentURIWithFundingFee(t *testing.T) {
+	defaultPolicy := serviceFeePolicy
+	defer SetServiceFeePolicy(defaultPolicy)
+
+	plain := createTestEscrow(t, 100000)
+	uri := getAs(t, GetPaymentURI, testAdmin, "escrow_id="+plain)["payment_uri"].(map[string]interface{})
+	if !strings.HasPrefix(uri["uri"].(string), "bitcoin:2") || uri["request_only"] != nil {
+		t.Errorf("expected a URI with the escrow address, got %v", uri)
+	}
+
+	// The fee is a second output, which the URI's address and amount would leave unpaid
+	if err := SetServiceFeePolicy(ServiceFeePolicy{Flat: 2000, ChargeAt: ServiceFeeAtFunding, Address: "mipcBbFg9gMiCh81Kj8tqqdgoZub1ZJRfn"}); err != nil {
+		t.Fatal(err)
+	}
+	id := createTestEscrow(t, 100000)
+	uri = getAs(t, GetPaymentURI, testAdmin, "escrow_id="+id)["payment_uri"].(map[string]interface{})
+	parsed, err := url.Parse(uri["uri"].(string))
+	if err != nil {
+		t.Fatalf("invalid URI %v: %v", uri["uri"], err)
+	}
+	if parsed.Opaque != "" || parsed.Query().Get("amount") != "" || parsed.Query().Get("r") != uri["request_url"] {
+		t.Errorf("expected a URI with only the payment request URL, got %s", uri["uri"])
+	}
+	if uri["request_only"] != true || uri["address"] != "" {
+		t.Errorf("expected the URI to be marked request only, got %v", uri)
+	}
+}
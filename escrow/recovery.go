@@ -0,0 +1,132 @@
+package escrow
+
+import (
+	"encoding/hex"
+	"errors"
+	"escrow-service/utils"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// RecoveryKit holds what the buyer needs to reclaim a timelocked escrow without the service
+type RecoveryKit struct {
+	EscrowID        string    `json:"escrow_id"`
+	MultiSigAddress string    `json:"multisig_address"`
+	RedeemScript    string    `json:"redeem_script"`
+	LockTime        int64     `json:"lock_time"`
+	SpendableAfter  time.Time `json:"spendable_after"`
+	Inputs          []UTXO    `json:"inputs,omitempty"` // escrow outputs the recovery transaction spends
+	Amount          int64     `json:"amount"`
+	Fee             int64     `json:"fee"`
+	FeeRate         float64   `json:"fee_rate"` // sat/vB
+	RecoveryAddress string    `json:"recovery_address"`
+	UnsignedTx      string    `json:"unsigned_tx,omitempty"`
+	SigHashes       []string  `json:"sighashes,omitempty"` // one per input
+	ScriptSig       string    `json:"script_sig_template,omitempty"`
+	Instructions    []string  `json:"instructions"`
+}
+
+// buildRecoveryKit creates the recovery kit for a timelocked escrow
+func buildRecoveryKit(escrow *Escrow) (*RecoveryKit, error) {
+	if escrow.RedeemScript == "" {
+		return nil, &requestError{http.StatusBadRequest, errors.New("not timelocked"),
+			"Escrow was not created with a timelocked recovery path"}
+	}
+
+	if escrow.Status.IsTerminal() {
+		return nil, &requestError{http.StatusBadRequest, errors.New("escrow closed"),
+			fmt.Sprintf("Escrow status is %s, there are no funds left to recover", escrow.Status)}
+	}
+
+	recoveryAddress, err := utils.PubKeyHashAddress(escrow.BuyerPubKey)
+	if err != nil {
+		return nil, &requestError{http.StatusInternalServerError, err, "Failed to derive the buyer's recovery address"}
+	}
+
+	// The recovery path carries only the buyer's signature, on every escrow output
+	quote, err := quoteSpend(utils.SpendTimelockedRecovery, 1, payoutInputCount(escrow), []string{recoveryAddress})
+	if err != nil {
+		return nil, err
+	}
+
+	kit := &RecoveryKit{
+		EscrowID:        escrow.ID,
+		MultiSigAddress: escrow.MultiSigAddress,
+		RedeemScript:    escrow.RedeemScript,
+		LockTime:        escrow.LockTime,
+		SpendableAfter:  time.Unix(escrow.LockTime, 0).UTC(),
+		Inputs:          escrow.unspentUTXOs(),
+		Amount:          escrow.fundedAmount(),
+		Fee:             quote.Fee,
+		FeeRate:         quote.FeeRate,
+		RecoveryAddress: recoveryAddress,
+	}
+
+	if len(kit.Inputs) == 0 {
+		kit.Instructions = []string{
+			"The recovery transaction can be built once a deposit to the escrow address is verified",
+			"Keep the redeem script and lock time: they are all that is needed to spend the output after the lock time",
+		}
+		return kit, nil
+	}
+
+	redeemScript, err := hex.DecodeString(escrow.RedeemScript)
+	if err != nil {
+		return nil, &requestError{http.StatusInternalServerError, err, "Stored redeem script is invalid"}
+	}
+
+	recovery, err := utils.CreateRecoveryTransaction(escrow.payoutInputs(), redeemScript, escrow.LockTime,
+		recoveryAddress, quote.Fee)
+	if err != nil {
+		return nil, &requestError{http.StatusInternalServerError, err, "Failed to build the recovery transaction"}
+	}
+
+	kit.UnsignedTx, err = utils.SerializeTransaction(recovery.Tx)
+	if err != nil {
+		return nil, &requestError{http.StatusInternalServerError, err, "Failed to serialize the recovery transaction"}
+	}
+	for _, sigHash := range recovery.SigHashes {
+		kit.SigHashes = append(kit.SigHashes, hex.EncodeToString(sigHash))
+	}
+	kit.ScriptSig = recovery.ScriptSig
+	kit.Instructions = []string{
+		"Sign each of sighashes with the buyer key and append the SIGHASH_ALL byte (0x01) to each DER signature",
+		"Set each input script of unsigned_tx to script_sig_template with the signature for that input filled in",
+		fmt.Sprintf("Broadcast the transaction after %s; it is rejected before the lock time",
+			kit.SpendableAfter.Format(time.RFC3339)),
+	}
+
+	return kit, nil
+}
+
+// GetRecoveryKit returns the buyer's recovery kit for a timelocked escrow
+func GetRecoveryKit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		utils.WriteErrorResponse(w, http.StatusMethodNotAllowed, errors.New("method not allowed"), "Only GET method is allowed")
+		return
+	}
+
+	escrowID := r.URL.Query().Get("id")
+	if escrowID == "" {
+		utils.WriteErrorResponse(w, http.StatusBadRequest, errors.New("missing escrow ID"), "Escrow ID is required")
+		return
+	}
+
+	var kit *RecoveryKit
+	err := viewEscrow(escrowID, func(escrow *Escrow) error {
+		if err := authorizeRead(r, escrow); err != nil {
+			return err
+		}
+
+		var err error
+		kit, err = buildRecoveryKit(escrow)
+		return err
+	})
+	if err != nil {
+		writeUpdateError(w, err)
+		return
+	}
+
+	utils.WriteJSONResponse(w, http.StatusOK, kit)
+}
@@ -0,0 +1,72 @@
+package escrow
+
+import (
+	"bytes"
+	"encoding/hex"
+	"escrow-service/auth"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/btcsuite/btcd/wire"
+)
+
+func TestRecoveryKit(t *testing.T) {
+	response := mustCall(t, CreateEscrow, testAdmin, EscrowRequest{
+		BuyerPubKey:  testBuyerPubKey,
+		SellerPubKey: testSellerPubKey,
+		EscrowPubKey: testEscrowPubKey,
+		Amount:       80000,
+		Timelocked:   true,
+	}, http.StatusCreated)
+	id := response["id"].(string)
+
+	// Before any deposit the kit only holds the script and lock time
+	kit := getAs(t, GetRecoveryKit, testBuyer, "id="+id)
+	if kit["redeem_script"] == "" || kit["unsigned_tx"] != nil {
+		t.Fatalf("expected a kit without a transaction before funding, got %v", kit)
+	}
+
+	depositTestFunds(t, id, 50000, 1)
+	depositTestFunds(t, id, 30000, 1)
+	mustCall(t, VerifyPayment, testAdmin, map[string]string{"escrow_id": id}, http.StatusOK)
+
+	kit = getAs(t, GetRecoveryKit, testBuyer, "id="+id)
+	var lockTime int64
+	viewEscrow(id, func(escrow *Escrow) error {
+		lockTime = escrow.LockTime
+		if lockTime != escrow.ExpiresAt.Unix() || int64(kit["lock_time"].(float64)) != lockTime {
+			t.Errorf("expected the kit to open at the escrow expiry %d, got %v", escrow.ExpiresAt.Unix(), kit["lock_time"])
+		}
+		return nil
+	})
+
+	raw, err := hex.DecodeString(kit["unsigned_tx"].(string))
+	if err != nil {
+		t.Fatalf("invalid unsigned transaction: %v", err)
+	}
+	var tx wire.MsgTx
+	if err := tx.Deserialize(bytes.NewReader(raw)); err != nil {
+		t.Fatalf("invalid unsigned transaction: %v", err)
+	}
+	sigHashes := kit["sighashes"].([]interface{})
+	if len(tx.TxIn) != 2 || len(sigHashes) != 2 || sigHashes[0] == sigHashes[1] {
+		t.Errorf("expected one distinct sighash for each of the 2 deposits, got %d inputs and %v", len(tx.TxIn), sigHashes)
+	}
+	if int64(tx.LockTime) != lockTime {
+		t.Errorf("expected the transaction to be locked until %d, got %d", lockTime, tx.LockTime)
+	}
+	if fee := int64(kit["fee"].(float64)); tx.TxOut[0].Value != 80000-fee {
+		t.Errorf("expected the recovery to pay 80000 less the %d fee, got %d", fee, tx.TxOut[0].Value)
+	}
+
+	// Escrows without the recovery path have no kit
+	plain := createTestEscrow(t, 50000)
+	r := httptest.NewRequest(http.MethodGet, "/?id="+plain, nil)
+	r = r.WithContext(auth.WithIdentity(r.Context(), testBuyer))
+	w := httptest.NewRecorder()
+	GetRecoveryKit(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected no kit for an escrow without the recovery path, got %d", w.Code)
+	}
+}
@@ -0,0 +1,212 @@
+package escrow
+
+import (
+	"errors"
+	"escrow-service/utils"
+	"fmt"
+	"log"
+	"time"
+)
+
+// ExpiryPolicy decides what happens to a funded escrow that reaches its expiry
+type ExpiryPolicy string
+
+const (
+	ExpiryPolicyRefund  ExpiryPolicy = "refund"  // the escrow service co-signs a refund to the buyer
+	ExpiryPolicyNotify  ExpiryPolicy = "notify"  // the parties are notified and nothing else changes
+	ExpiryPolicyDispute ExpiryPolicy = "dispute" // the escrow is escalated to a dispute
+)
+
+// expiryPolicy is the policy applied to funded escrows past expiry
+var expiryPolicy = ExpiryPolicyNotify
+
+// SetExpiryPolicy configures the policy applied to funded escrows past expiry
+func SetExpiryPolicy(policy ExpiryPolicy) error {
+	switch policy {
+	case ExpiryPolicyRefund, ExpiryPolicyNotify, ExpiryPolicyDispute:
+		expiryPolicy = policy
+		return nil
+	}
+	return fmt.Errorf("unknown expiry policy %q, must be one of: refund, notify, or dispute", policy)
+}
+
+// errUnchanged tells updateEscrow that a background check had nothing to do
+var errUnchanged = errors.New("escrow unchanged")
+
+// ProcessExpirations handles escrows whose expiry has passed
+// Unfunded escrows expire and their payment request is invalidated; funded escrows follow the expiry policy once
+func ProcessExpirations(now time.Time) {
+	for _, escrow := range listEscrows() {
+		_, err := updateEscrowSigned(escrow.ID, "", serviceSigner, func(escrow *Escrow, signing *payoutSigning) error {
+			if now.Before(escrow.ExpiresAt) || escrow.Status.IsTerminal() || escrow.ExpiryHandledAt != nil {
+				return errUnchanged
+			}
+
+			if escrow.Status == StatusCreated {
+				return expireUnfunded(escrow, now)
+			}
+
+			// Disputed and resolved escrows are already waiting on an arbitrator or a payout,
+			// and reverted ones on the chain
+			if escrow.Status == StatusDisputed || escrow.Status == StatusResolved || escrow.Status == StatusFundingReverted {
+				return errUnchanged
+			}
+
+			return applyExpiryPolicy(escrow, now, signing)
+		})
+		if err != nil && !errors.Is(err, errUnchanged) {
+			log.Printf("Failed to process expiry for escrow ID: %s: %v", escrow.ID, err)
+		}
+	}
+}
+
+// expireUnfunded moves an unfunded escrow to expired and invalidates its payment request
+func expireUnfunded(escrow *Escrow, now time.Time) error {
+	if err := escrow.transition(StatusExpired); err != nil {
+		return err
+	}
+
+	escrow.PaymentRequest.InvalidatedAt = &now
+	escrow.ExpiryHandledAt = &now
+	escrow.recordHistory(now, "system", "expired", StatusCreated,
+		fmt.Sprintf("Payment request %s invalidated", escrow.PaymentRequest.RequestID))
+
+	log.Printf("Expired unfunded escrow ID: %s", escrow.ID)
+	return nil
+}
+
+// applyExpiryPolicy applies the configured policy to a funded escrow past expiry
+// A refund or dispute that cannot be applied falls back to notifying the parties
+func applyExpiryPolicy(escrow *Escrow, now time.Time, signing *payoutSigning) error {
+	from := escrow.Status
+
+	// An underfunded escrow takes no more top-ups once expired, whatever the policy does with it.
+	// It is invalidated once the policy is applied, since a refund must be signed before it applies
+	invalidateTopUp := func() {
+		if from == StatusUnderfunded && escrow.TopUpRequest != nil && escrow.TopUpRequest.InvalidatedAt == nil {
+			escrow.TopUpRequest.InvalidatedAt = &now
+			escrow.recordHistory(now, "system", "top_up_invalidated", from,
+				fmt.Sprintf("Top-up request %s invalidated", escrow.TopUpRequest.RequestID))
+		}
+	}
+
+	switch expiryPolicy {
+	case ExpiryPolicyRefund:
+		signedTx, err := proposeExpiryRefund(escrow, now, signing)
+		if err == errSigningPending {
+			return err
+		}
+		if err == nil {
+			invalidateTopUp()
+			escrow.ExpiryHandledAt = &now
+			detail := "Escrow service co-signed a refund to the buyer"
+			if signedTx != "" {
+				detail = fmt.Sprintf("Refunded to the buyer, TxID: %s", escrow.RefundTxID)
+			}
+			escrow.recordHistory(now, "system", "expiry_refund_proposed", from, detail)
+			log.Printf("Proposed refund for expired escrow ID: %s", escrow.ID)
+			return nil
+		}
+		log.Printf("Failed to propose refund for expired escrow ID: %s: %v", escrow.ID, err)
+
+	case ExpiryPolicyDispute:
+		if err := escrow.transition(StatusDisputed); err == nil {
+			escrow.Dispute = &Dispute{
+				OpenedBy:       "system",
+				Reason:         "Escrow expired while funded",
+				OpenedAt:       now,
+				PreviousStatus: from,
+				Deadline:       now.Add(disputeResponseWindow),
+			}
+			invalidateTopUp()
+			escrow.ExpiryHandledAt = &now
+			escrow.recordHistory(now, "system", "expiry_dispute_opened", from, "Escalated to a dispute after expiry")
+			log.Printf("Opened dispute for expired escrow ID: %s", escrow.ID)
+			return nil
+		}
+	}
+
+	// LIMITATION: Notifications are only recorded in the escrow history and the log
+	invalidateTopUp()
+	escrow.ExpiryHandledAt = &now
+	escrow.recordHistory(now, "system", "expiry_notified", from, "Escrow expired while funded, parties notified")
+	log.Printf("Escrow ID: %s expired while funded, parties notified", escrow.ID)
+	return nil
+}
+
+// proposeExpiryRefund adds the escrow service's refund signature, completing the refund if the
+// buyer or seller already signed one. The escrow is left untouched on error.
+func proposeExpiryRefund(escrow *Escrow, now time.Time, signing *payoutSigning) (string, error) {
+	if serviceSigner == nil {
+		return "", errors.New("escrow service signer is not configured")
+	}
+
+	if err := escrow.Status.CanTransition(StatusRefunding); err != nil {
+		return "", err
+	}
+
+	if err := checkSignerKey(serviceSigner, escrow.EscrowPubKey); err != nil {
+		return "", err
+	}
+
+	signatures := append([]PartySignature{}, escrow.RefundSignatures...)
+	for _, sig := range signatures {
+		if sig.Party == "escrow" {
+			return "", errors.New("escrow service already signed the refund")
+		}
+	}
+
+	// LIMITATION: The co-signature is recorded, the actual signature is made when the payout is created
+	signatures = append(signatures, PartySignature{
+		Party:     "escrow",
+		Signature: "expiry-refund",
+		Timestamp: now,
+		PublicKey: escrow.EscrowPubKey,
+	})
+
+	quote, outputs, err := quotePayout(escrow, escrow.RefundFee, refundOutputs(escrow))
+	if err != nil {
+		return "", err
+	}
+
+	var signedTx, txID string
+	var payout *utils.Transaction
+	if len(signatures) >= 2 {
+		tx, signed, err := createPayout(escrow, outputs, quote.Fee, signing)
+		if err != nil {
+			return "", err
+		}
+		txID, signedTx, payout = tx.TxID, signed, &tx
+	}
+
+	// All checks passed, apply the changes
+	if err := escrow.transition(StatusRefunding); err != nil {
+		return "", err
+	}
+	escrow.RefundSignatures = signatures
+	escrow.RefundFee = quote
+
+	if txID != "" {
+		if err := escrow.transition(StatusRefunded); err != nil {
+			return "", err
+		}
+		escrow.RefundTxID = txID
+		escrow.recordPayout(payout)
+	}
+
+	return signedTx, nil
+}
+
+// StartScheduler runs the expiry, dispute deadline and funding checks every interval in the background
+func StartScheduler(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for now := range ticker.C {
+			ProcessExpirations(now)
+			ProcessDisputeDeadlines(now)
+			ProcessFundingChecks(now)
+		}
+	}()
+}
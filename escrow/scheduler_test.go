@@ -0,0 +1,124 @@
+package escrow
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+// expireUnder runs the expiry checks past every escrow's expiry with policy applied
+func expireUnder(t *testing.T, policy ExpiryPolicy) {
+	t.Helper()
+
+	if err := SetExpiryPolicy(policy); err != nil {
+		t.Fatalf("failed to set the expiry policy: %v", err)
+	}
+	ProcessExpirations(time.Now().Add(365 * 24 * time.Hour))
+}
+
+// underfundTestEscrow creates an escrow and verifies a deposit short of its amount by more than the tolerance
+func underfundTestEscrow(t *testing.T, amount, deposit int64) string {
+	t.Helper()
+
+	id := createTestEscrow(t, amount)
+	depositTestFunds(t, id, deposit, 1)
+	mustCall(t, VerifyPayment, testAdmin, map[string]string{"escrow_id": id}, http.StatusOK)
+	if escrow := snapshotEscrow(t, id); escrow.Status != StatusUnderfunded {
+		t.Fatalf("expected the escrow to be underfunded, got %s", escrow.Status)
+	}
+	return id
+}
+
+func TestExpiryOfUnfundedEscrow(t *testing.T) {
+	defer SetExpiryPolicy(expiryPolicy)
+
+	id := createTestEscrow(t, 50000)
+	expireUnder(t, ExpiryPolicyRefund)
+
+	viewEscrow(id, func(escrow *Escrow) error {
+		if escrow.Status != StatusExpired || escrow.PaymentRequest.InvalidatedAt == nil {
+			t.Errorf("expected an expired escrow with its payment request invalidated, got %s", escrow.Status)
+		}
+		return nil
+	})
+}
+
+func TestExpiryNotifyPolicy(t *testing.T) {
+	defer SetExpiryPolicy(expiryPolicy)
+
+	id, _ := fundTestEscrow(t, 50000)
+	expireUnder(t, ExpiryPolicyNotify)
+	expireUnder(t, ExpiryPolicyNotify)
+
+	if escrow := snapshotEscrow(t, id); escrow.Status != StatusFunded {
+		t.Errorf("expected the escrow to stay funded, got %s", escrow.Status)
+	}
+	if got := countActions(id, "expiry_notified"); got != 1 {
+		t.Errorf("expected the expiry to be handled once, got %d in %v", got, historyActions(id))
+	}
+}
+
+func TestExpiryRefundPolicy(t *testing.T) {
+	defer SetExpiryPolicy(expiryPolicy)
+	defer SetServiceSigner(serviceSigner)
+
+	// Without the escrow service signer the refund cannot be co-signed, the parties are notified instead
+	SetServiceSigner(nil)
+	unsigned, _ := fundTestEscrow(t, 50000)
+	expireUnder(t, ExpiryPolicyRefund)
+	if escrow := snapshotEscrow(t, unsigned); escrow.Status != StatusFunded || !containsAction(unsigned, "expiry_notified") {
+		t.Errorf("expected a fallback to notify, got %s with %v", escrow.Status, historyActions(unsigned))
+	}
+
+	// With it, the escrow service signs and one more signature completes the refund
+	id, _ := fundTestEscrow(t, 50000)
+	SetServiceSigner(&probeSigner{escrowID: id})
+	expireUnder(t, ExpiryPolicyRefund)
+	if escrow := snapshotEscrow(t, id); escrow.Status != StatusRefunding || !containsAction(id, "expiry_refund_proposed") {
+		t.Fatalf("expected the service to propose the refund, got %s with %v", escrow.Status, historyActions(id))
+	}
+
+	identity, req := partySigning(id, "buyer")
+	mustCall(t, RefundEscrow, identity, req, http.StatusOK)
+	if escrow := snapshotEscrow(t, id); escrow.Status != StatusRefunded {
+		t.Errorf("expected the buyer's signature to complete the refund, got %s", escrow.Status)
+	}
+}
+
+func TestExpiryOfUnderfundedEscrow(t *testing.T) {
+	defer SetExpiryPolicy(expiryPolicy)
+	defer SetServiceSigner(serviceSigner)
+
+	// A disputed underfunded escrow no longer takes top-ups
+	disputed := underfundTestEscrow(t, 50000, 20000)
+	expireUnder(t, ExpiryPolicyDispute)
+	viewEscrow(disputed, func(escrow *Escrow) error {
+		if escrow.Status != StatusDisputed || escrow.Dispute == nil || escrow.Dispute.PreviousStatus != StatusUnderfunded {
+			t.Errorf("expected a dispute opened from underfunded, got %s", escrow.Status)
+		}
+		if escrow.TopUpRequest == nil || escrow.TopUpRequest.InvalidatedAt == nil {
+			t.Errorf("expected the top-up request to be invalidated")
+		}
+		return nil
+	})
+
+	// A refund returns what was deposited, not the amount asked for
+	refunded := underfundTestEscrow(t, 50000, 30000)
+	SetServiceSigner(&probeSigner{escrowID: refunded})
+	expireUnder(t, ExpiryPolicyRefund)
+	identity, req := partySigning(refunded, "buyer")
+	mustCall(t, RefundEscrow, identity, req, http.StatusOK)
+	viewEscrow(refunded, func(escrow *Escrow) error {
+		if escrow.Status != StatusRefunded || escrow.TopUpRequest.InvalidatedAt == nil {
+			t.Fatalf("expected a refunded escrow without a top-up request, got %s", escrow.Status)
+		}
+		var paid int64
+		for _, output := range escrow.Payout.Outputs {
+			paid += output.Amount
+		}
+		if paid+escrow.Payout.Fee != 30000 {
+			t.Errorf("expected the refund to spend the 30000 satoshis deposited, got %d plus %d", paid, escrow.Payout.Fee)
+		}
+		return nil
+	})
+}
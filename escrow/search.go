@@ -0,0 +1,233 @@
+package escrow
+
+import (
+	"encoding/base64"
+	"errors"
+	"escrow-service/auth"
+	"escrow-service/utils"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultListLimit = 50
+	maxListLimit     = 200
+)
+
+// encodeCursor returns the opaque cursor resuming a listing sorted by field after entry
+func encodeCursor(field string, entry indexEntry) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%s:%d:%s", field, entry.key, entry.id)))
+}
+
+// decodeCursor parses a cursor returned by an earlier page of a listing sorted by field
+func decodeCursor(field, cursor string) (*indexEntry, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, errors.New("malformed cursor")
+	}
+
+	parts := strings.SplitN(string(raw), ":", 3)
+	if len(parts) != 3 {
+		return nil, errors.New("malformed cursor")
+	}
+	if parts[0] != field {
+		return nil, fmt.Errorf("cursor is for a listing sorted by %s", parts[0])
+	}
+
+	key, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return nil, errors.New("malformed cursor")
+	}
+	return &indexEntry{key: key, id: parts[2]}, nil
+}
+
+// parseListQuery builds the index query from the listing's query parameters
+func parseListQuery(values url.Values) (*escrowQuery, error) {
+	q := &escrowQuery{Created: anyKey, Expires: anyKey, Amount: anyKey, SortBy: "created_at", Descending: true,
+		Limit: defaultListLimit}
+
+	if statuses := values.Get("status"); statuses != "" {
+		for _, status := range strings.Split(statuses, ",") {
+			status := Status(strings.TrimSpace(status))
+			if !isStatus(status) {
+				return nil, fmt.Errorf("unknown status %q", status)
+			}
+			q.Statuses = append(q.Statuses, status)
+		}
+	}
+	q.Party = values.Get("party")
+	q.MerchantID = values.Get("merchant_id")
+
+	times := make(map[string]time.Time)
+	for _, name := range []string{"created_from", "created_to", "expires_from", "expires_to"} {
+		if value := values.Get(name); value != "" {
+			parsed, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return nil, fmt.Errorf("%s must be an RFC 3339 time", name)
+			}
+			times[name] = parsed
+		}
+	}
+	q.Created = timeRange(times["created_from"], times["created_to"])
+	q.Expires = timeRange(times["expires_from"], times["expires_to"])
+
+	for _, name := range []string{"min_amount", "max_amount"} {
+		value := values.Get(name)
+		if value == "" {
+			continue
+		}
+		amount, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || amount < 0 {
+			return nil, fmt.Errorf("%s must be a non-negative number of satoshis", name)
+		}
+		if name == "min_amount" {
+			q.Amount.from = amount
+		} else {
+			q.Amount.to = amount + 1 // inclusive
+		}
+	}
+
+	if sortBy := values.Get("sort"); sortBy != "" {
+		if _, ok := sortIndexes[sortBy]; !ok {
+			return nil, errors.New("sort must be one of: created_at, expires_at, or amount")
+		}
+		q.SortBy = sortBy
+	}
+
+	switch values.Get("order") {
+	case "", "desc":
+	case "asc":
+		q.Descending = false
+	default:
+		return nil, errors.New("order must be asc or desc")
+	}
+
+	if limit := values.Get("limit"); limit != "" {
+		parsed, err := strconv.Atoi(limit)
+		if err != nil || parsed < 1 || parsed > maxListLimit {
+			return nil, fmt.Errorf("limit must be between 1 and %d", maxListLimit)
+		}
+		q.Limit = parsed
+	}
+
+	if cursor := values.Get("cursor"); cursor != "" {
+		after, err := decodeCursor(q.SortBy, cursor)
+		if err != nil {
+			return nil, err
+		}
+		q.After = after
+	}
+
+	return q, nil
+}
+
+// isStatus reports whether status is one of the escrow statuses
+func isStatus(status Status) bool {
+	switch status {
+	case StatusCreated, StatusUnderfunded, StatusFunded, StatusReleasing, StatusReleased, StatusPartiallyReleased,
+		StatusRefunding, StatusRefunded, StatusSettling, StatusCancelled, StatusExpired, StatusDisputed,
+		StatusResolved, StatusSettled, StatusFundingReverted:
+		return true
+	}
+	return false
+}
+
+// scopeListQuery limits the listing to the escrows the caller may read
+// Admins see every escrow, merchants their own escrows, and participants those their key is a party to
+func scopeListQuery(r *http.Request, q *escrowQuery) error {
+	identity, err := callerIdentity(r)
+	if err != nil {
+		return err
+	}
+
+	switch identity.Role {
+	case auth.RoleAdmin:
+		return nil
+	case auth.RoleMerchant:
+		if q.MerchantID != "" && q.MerchantID != identity.MerchantID {
+			return &requestError{http.StatusForbidden, errors.New("forbidden"), "Merchants can only list their own escrows"}
+		}
+		q.MerchantID = identity.MerchantID
+		return nil
+	case auth.RoleParticipant:
+		if identity.PubKey == "" || (q.Party != "" && !strings.EqualFold(q.Party, identity.PubKey)) {
+			return &requestError{http.StatusForbidden, errors.New("forbidden"),
+				"Participants can only list the escrows their key is a party to"}
+		}
+		q.Party = identity.PubKey
+		return nil
+	}
+
+	return &requestError{http.StatusForbidden, errors.New("forbidden"),
+		"Only admins, merchants and participants can list escrows"}
+}
+
+// escrowSummary is the short representation of an escrow returned by ListEscrows
+func escrowSummary(escrow *Escrow) map[string]interface{} {
+	return map[string]interface{}{
+		"escrow_id":        escrow.ID,
+		"status":           escrow.Status,
+		"amount":           escrow.Amount,
+		"multisig_address": escrow.MultiSigAddress,
+		"buyer_pubkey":     escrow.BuyerPubKey,
+		"seller_pubkey":    escrow.SellerPubKey,
+		"escrow_pubkey":    escrow.EscrowPubKey,
+		"merchant_id":      escrow.MerchantID,
+		"description":      escrow.Description,
+		"created_at":       escrow.CreatedAt,
+		"expires_at":       escrow.ExpiresAt,
+		"version":          escrow.Version,
+	}
+}
+
+// ListEscrows lists the escrows matching the query's filters, a page at a time
+// Pass the returned next_cursor as cursor, with the same filters and sort, to get the following page
+func ListEscrows(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		utils.WriteErrorResponse(w, http.StatusMethodNotAllowed, errors.New("method not allowed"), "Only GET method is allowed")
+		return
+	}
+
+	q, err := parseListQuery(r.URL.Query())
+	if err != nil {
+		utils.WriteErrorResponse(w, http.StatusBadRequest, err, "Invalid list query")
+		return
+	}
+
+	if err := scopeListQuery(r, q); err != nil {
+		writeUpdateError(w, err)
+		return
+	}
+
+	page, more := queryEscrows(q)
+
+	// Statuses are read again under each escrow's lock, and may have moved on since the query
+	list := make([]map[string]interface{}, 0, len(page))
+	for _, entry := range page {
+		viewEscrow(entry.id, func(escrow *Escrow) error {
+			list = append(list, escrowSummary(escrow))
+			return nil
+		})
+	}
+
+	order := "asc"
+	if q.Descending {
+		order = "desc"
+	}
+
+	response := map[string]interface{}{
+		"escrows": list,
+		"count":   len(list),
+		"sort":    q.SortBy,
+		"order":   order,
+	}
+	if more {
+		response["next_cursor"] = encodeCursor(q.SortBy, page[len(page)-1])
+	}
+
+	utils.WriteJSONResponse(w, http.StatusOK, response)
+}
@@ -0,0 +1,142 @@
+package escrow
+
+import (
+	"escrow-service/auth"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// listAll follows the listing's cursors from the first page and returns the escrow IDs in order
+func listAll(t *testing.T, query url.Values) []string {
+	t.Helper()
+
+	var ids []string
+	for pages := 0; ; pages++ {
+		if pages > 10 {
+			t.Fatalf("expected the listing to end, got %d pages", pages)
+		}
+
+		response := getAs(t, ListEscrows, testAdmin, query.Encode())
+		for _, escrow := range response["escrows"].([]interface{}) {
+			ids = append(ids, escrow.(map[string]interface{})["escrow_id"].(string))
+		}
+
+		cursor, ok := response["next_cursor"].(string)
+		if !ok {
+			return ids
+		}
+		query.Set("cursor", cursor)
+	}
+}
+
+// sameOrder reports whether got lists the same IDs as expected, in the same order
+func sameOrder(got, expected []string) bool {
+	if len(got) != len(expected) {
+		return false
+	}
+	for i := range got {
+		if got[i] != expected[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestListEscrowsPagination(t *testing.T) {
+	defer SetChainBackend(chainBackend)
+	SetChainBackend(NewMockChain())
+
+	// The creation time and amounts no other test uses keep the listing to these escrows
+	since := time.Now().Format(time.RFC3339Nano)
+	var ids []string
+	for amount := int64(777001); amount <= 777005; amount++ {
+		ids = append(ids, createTestEscrow(t, amount))
+	}
+	reversed := []string{ids[4], ids[3], ids[2], ids[1], ids[0]}
+
+	for _, c := range []struct {
+		sort, order string
+		expected    []string
+	}{
+		{"amount", "asc", ids},
+		{"amount", "desc", reversed},
+		{"created_at", "asc", ids},
+		{"created_at", "desc", reversed},
+	} {
+		query := url.Values{"created_from": {since}, "min_amount": {"777001"}, "max_amount": {"777005"}, "sort": {c.sort}, "order": {c.order},
+			"limit": {"2"}}
+		if got := listAll(t, query); !sameOrder(got, c.expected) {
+			t.Errorf("sorted by %s %s: expected %v, got %v", c.sort, c.order, c.expected, got)
+		}
+	}
+
+	// The status index narrows the listing, and follows the escrows as they change status
+	for _, id := range []string{ids[1], ids[3]} {
+		depositTestFunds(t, id, 777000, 1)
+		verifyTestPayment(t, id)
+	}
+	for _, order := range []string{"asc", "desc"} {
+		query := url.Values{"created_from": {since}, "min_amount": {"777001"}, "max_amount": {"777005"}, "status": {"funded"}, "sort": {"amount"},
+			"order": {order}, "limit": {"1"}}
+		expected := []string{ids[1], ids[3]}
+		if order == "desc" {
+			expected = []string{ids[3], ids[1]}
+		}
+		if got := listAll(t, query); !sameOrder(got, expected) {
+			t.Errorf("funded escrows in %s order: expected %v, got %v", order, expected, got)
+		}
+	}
+	query := url.Values{"created_from": {since}, "min_amount": {"777001"}, "max_amount": {"777005"}, "status": {"created"}, "sort": {"amount"},
+		"order": {"asc"}, "limit": {"2"}}
+	if got := listAll(t, query); !sameOrder(got, []string{ids[0], ids[2], ids[4]}) {
+		t.Errorf("expected the funded escrows to leave the created index, got %v", got)
+	}
+
+	// An escrow created after the first page is listed by the later pages only if it sorts after the cursor
+	query = url.Values{"created_from": {since}, "min_amount": {"777001"}, "max_amount": {"777010"}, "sort": {"amount"}, "order": {"asc"},
+		"limit": {"2"}}
+	first := getAs(t, ListEscrows, testAdmin, query.Encode())
+	later := createTestEscrow(t, 777010)
+	query.Set("cursor", first["next_cursor"].(string))
+	if got := listAll(t, query); !sameOrder(got, []string{ids[2], ids[3], ids[4], later}) {
+		t.Errorf("expected the pages after the cursor to include the new escrow, got %v", got)
+	}
+}
+
+func TestListEscrowsQuery(t *testing.T) {
+	createTestEscrow(t, 60000)
+	createTestEscrow(t, 60000)
+	cursor := getAs(t, ListEscrows, testAdmin, "sort=amount&limit=1")["next_cursor"].(string)
+
+	for _, query := range []string{
+		"sort=created_at&cursor=" + cursor, // cursor of another sort
+		"cursor=not-a-cursor",
+		"status=unknown",
+		"sort=status",
+		"order=sideways",
+		"limit=0",
+		"min_amount=-1",
+		"created_from=yesterday",
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/?"+query, nil)
+		r = r.WithContext(auth.WithIdentity(r.Context(), testAdmin))
+		w := httptest.NewRecorder()
+		ListEscrows(w, r)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", query, w.Code)
+		}
+	}
+
+	// Participants only see the escrows their key is a party to
+	outsider := &auth.Identity{ID: "test-outsider", Role: auth.RoleParticipant, PubKey: testEscrowPubKey}
+	r := httptest.NewRequest(http.MethodGet, "/?party="+testBuyerPubKey, nil)
+	r = r.WithContext(auth.WithIdentity(r.Context(), outsider))
+	w := httptest.NewRecorder()
+	ListEscrows(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected a participant listing another key's escrows to be forbidden, got %d", w.Code)
+	}
+}
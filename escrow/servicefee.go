@@ -0,0 +1,245 @@
+package escrow
+
+import (
+	"errors"
+	"escrow-service/utils"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+)
+
+// ServiceFeeMode decides when the escrow service's fee is charged
+type ServiceFeeMode string
+
+const (
+	ServiceFeeAtFunding ServiceFeeMode = "funding" // paid by a second output of the payment request
+	ServiceFeeAtRelease ServiceFeeMode = "release" // deducted from the seller's payout, in part by each milestone
+)
+
+// ServiceFeePolicy controls the fee the escrow service charges for each escrow
+// A flat fee, when set, replaces the percentage; a percentage fee is kept between Min and Max
+type ServiceFeePolicy struct {
+	Percent  float64        `json:"percent"`   // percentage of the escrow amount
+	Flat     int64          `json:"flat"`      // fixed fee in satoshis
+	Min      int64          `json:"min"`       // floor in satoshis for percentage fees
+	Max      int64          `json:"max"`       // cap in satoshis for percentage fees, 0 for none
+	ChargeAt ServiceFeeMode `json:"charge_at"` // when the fee is charged
+	Address  string         `json:"address"`   // where the fee is paid
+}
+
+// serviceFeePolicy is the policy applied to new escrows, no fee is charged by default
+var serviceFeePolicy = ServiceFeePolicy{ChargeAt: ServiceFeeAtRelease}
+
+// SetServiceFeePolicy configures the fee charged for new escrows
+func SetServiceFeePolicy(policy ServiceFeePolicy) error {
+	if policy.Percent < 0 || policy.Percent >= 100 {
+		return fmt.Errorf("service fee percentage must be at least 0 and below 100, got %g", policy.Percent)
+	}
+	if policy.Flat < 0 || policy.Min < 0 || policy.Max < 0 {
+		return errors.New("service fee amounts cannot be negative")
+	}
+	if policy.Max > 0 && policy.Max < policy.Min {
+		return fmt.Errorf("service fee cap %d is below the floor %d", policy.Max, policy.Min)
+	}
+	if policy.ChargeAt != ServiceFeeAtFunding && policy.ChargeAt != ServiceFeeAtRelease {
+		return fmt.Errorf("service fee must be charged at %q or %q, got %q",
+			ServiceFeeAtFunding, ServiceFeeAtRelease, policy.ChargeAt)
+	}
+	if policy.Percent > 0 || policy.Flat > 0 {
+		if err := utils.ValidateAddress(policy.Address); err != nil {
+			return fmt.Errorf("service fee address: %v", err)
+		}
+	}
+	serviceFeePolicy = policy
+	return nil
+}
+
+// ServiceFee is the fee an escrow pays the service, fixed when the escrow is created
+type ServiceFee struct {
+	Amount      int64          `json:"amount"`
+	Address     string         `json:"address"`
+	ChargeAt    ServiceFeeMode `json:"charge_at"`
+	Collected   int64          `json:"collected"`
+	TxID        string         `json:"txid,omitempty"`         // latest payout paying part of a release fee
+	CollectedAt *time.Time     `json:"collected_at,omitempty"` // set once the whole fee is collected
+}
+
+// newServiceFee returns the fee for an escrow of amount under the current policy, or nil if none is charged
+// Fees below the dust limit are not charged
+func newServiceFee(amount int64) *ServiceFee {
+	policy := serviceFeePolicy
+
+	fee := policy.Flat
+	if fee == 0 {
+		fee = int64(math.Round(float64(amount) * policy.Percent / 100))
+		if fee < policy.Min {
+			fee = policy.Min
+		}
+		if policy.Max > 0 && fee > policy.Max {
+			fee = policy.Max
+		}
+	}
+
+	if fee < dustLimit {
+		return nil
+	}
+	return &ServiceFee{Amount: fee, Address: policy.Address, ChargeAt: policy.ChargeAt}
+}
+
+// status reports how far the fee of an escrow in the given status has been collected: pending, partial,
+// collected, waived once the escrow closed without paying it, or unverified while the output paying a
+// funding fee has not been found confirmed on the chain
+func (f *ServiceFee) status(escrow Status) string {
+	switch {
+	case f.CollectedAt != nil:
+		return "collected"
+	case escrow.IsTerminal():
+		return "waived"
+	case f.unverified(escrow):
+		return "unverified"
+	case f.Collected > 0:
+		return "partial"
+	default:
+		return "pending"
+	}
+}
+
+// unverified reports whether the escrow was funded without the funding fee being found paid
+func (f *ServiceFee) unverified(escrow Status) bool {
+	return f.ChargeAt == ServiceFeeAtFunding && f.CollectedAt == nil &&
+		escrow != StatusCreated && escrow != StatusUnderfunded
+}
+
+// collect records that txID paid amount of the fee
+func (f *ServiceFee) collect(amount int64, txID string, now time.Time) {
+	f.Collected += amount
+	f.TxID = txID
+	if f.Collected >= f.Amount && f.CollectedAt == nil {
+		f.CollectedAt = &now
+	}
+}
+
+// collectFundingFee collects the funding fee from utxos, the outputs paying the service address, counting
+// those of the escrow's deposit transactions once they have the confirmations a deposit needs
+func (e *Escrow) collectFundingFee(utxos []UTXO, now time.Time) {
+	fee := e.ServiceFee
+	if fee == nil || fee.ChargeAt != ServiceFeeAtFunding || fee.CollectedAt != nil {
+		return
+	}
+
+	deposits := make(map[string]bool)
+	for _, utxo := range e.FundingUTXOs {
+		if !utxo.Reverted {
+			deposits[utxo.TxID] = true
+		}
+	}
+
+	var paid int64
+	var txID string
+	for _, utxo := range utxos {
+		if deposits[utxo.TxID] && utxo.Confirmations >= fundingPolicy.Confirmations {
+			paid += utxo.Value
+			txID = utxo.TxID
+		}
+	}
+	if paid > fee.Collected {
+		fee.collect(paid-fee.Collected, txID, now)
+	}
+}
+
+// serviceFeeShare returns the part of a release fee collected by a payout of amount to the seller
+// Milestones pay in proportion to their amount, and the last payout pays whatever is left
+// Shares below the dust limit are left to later payouts
+func (e *Escrow) serviceFeeShare(amount int64, last bool) int64 {
+	fee := e.ServiceFee
+	if fee == nil || fee.ChargeAt != ServiceFeeAtRelease {
+		return 0
+	}
+
+	remaining := fee.Amount - fee.Collected
+	share := remaining
+	if proportional := int64(float64(fee.Amount) * float64(amount) / float64(e.Amount)); !last && proportional < remaining {
+		share = proportional
+	}
+
+	if share < dustLimit {
+		return 0
+	}
+	return share
+}
+
+// sellerOutputs pays amount to the seller, less the share of the service fee it collects, which is paid
+// to the service address in a second output
+func (e *Escrow) sellerOutputs(amount int64, last bool) []utils.PayoutOutput {
+	share := e.serviceFeeShare(amount, last)
+	outputs := []utils.PayoutOutput{{
+		Address: e.SellerPubKey, // This would be an actual address in a real implementation
+		Amount:  amount - share,
+	}}
+
+	if share > 0 {
+		outputs = append(outputs, utils.PayoutOutput{Address: e.ServiceFee.Address, Amount: share})
+	}
+	return outputs
+}
+
+// serviceFeeOutputs returns the output paying what is left of a release fee, which a settlement pays on top
+// of the outputs dividing the rest of the locked amount, or none if nothing is left to charge
+func (e *Escrow) serviceFeeOutputs() []utils.PayoutOutput {
+	share := e.serviceFeeShare(e.lockedAmount(), true)
+	if share == 0 {
+		return nil
+	}
+	return []utils.PayoutOutput{{Address: e.ServiceFee.Address, Amount: share}}
+}
+
+// GetServiceFees reports the service fees of all escrows, or of one merchant's escrows, in aggregate
+func GetServiceFees(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		utils.WriteErrorResponse(w, http.StatusMethodNotAllowed, errors.New("method not allowed"), "Only GET method is allowed")
+		return
+	}
+
+	merchantID := r.URL.Query().Get("merchant_id")
+
+	count := 0
+	totals := make(map[string]int64)
+	for _, escrow := range listEscrows() {
+		viewEscrow(escrow.ID, func(escrow *Escrow) error {
+			fee := escrow.ServiceFee
+			if fee == nil || (merchantID != "" && escrow.MerchantID != merchantID) {
+				return nil
+			}
+
+			count++
+			totals[string(fee.ChargeAt)] += fee.Amount
+			totals["collected"] += fee.Collected
+			switch fee.status(escrow.Status) {
+			case "waived":
+				totals["waived"] += fee.Amount - fee.Collected
+			case "unverified":
+				totals["unverified"] += fee.Amount - fee.Collected
+			default:
+				totals["pending"] += fee.Amount - fee.Collected
+			}
+			return nil
+		})
+	}
+
+	response := map[string]interface{}{
+		"escrows":            count,
+		"charged_at_funding": totals[string(ServiceFeeAtFunding)],
+		"charged_at_release": totals[string(ServiceFeeAtRelease)],
+		"total_collected":    totals["collected"],
+		"total_pending":      totals["pending"],
+		"total_unverified":   totals["unverified"],
+		"total_waived":       totals["waived"],
+		"policy":             serviceFeePolicy,
+	}
+	if merchantID != "" {
+		response["merchant_id"] = merchantID
+	}
+
+	utils.WriteJSONResponse(w, http.StatusOK, response)
+}
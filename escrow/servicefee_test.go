@@ -0,0 +1,126 @@
+package escrow
+
+import (
+	"escrow-service/utils"
+	"net/http"
+	"testing"
+)
+
+func TestSettlementPaysReleaseServiceFee(t *testing.T) {
+	const feeAddress = "mipcBbFg9gMiCh81Kj8tqqdgoZub1ZJRfn"
+
+	defaultPolicy := serviceFeePolicy
+	defer SetServiceFeePolicy(defaultPolicy)
+	if err := SetServiceFeePolicy(ServiceFeePolicy{Flat: 2000, ChargeAt: ServiceFeeAtRelease, Address: feeAddress}); err != nil {
+		t.Fatal(err)
+	}
+
+	id, _ := fundTestEscrow(t, 100000)
+
+	// The split quote leaves the service fee out of the amount to divide
+	quote := getAs(t, GetFeeQuote, testBuyer, "id="+id+"&operation=split")
+	fee := int64(quote["quote"].(map[string]interface{})["fee"].(float64))
+	available := int64(quote["available_amount"].(float64))
+	if available != 100000-2000-fee {
+		t.Fatalf("expected %d satoshis to divide, got %d", 100000-2000-fee, available)
+	}
+
+	// Outputs spending the whole locked amount leave nothing for the service fee
+	code, _ := callHandler(t, ProposeSettlement, testBuyer, SettlementProposalRequest{
+		EscrowID: id,
+		Party:    "buyer",
+		Outputs:  []utils.PayoutOutput{{Address: testSellerPubKey, Amount: 50000}, {Address: testBuyerPubKey, Amount: available + 2000 - 50000}},
+		Fee:      fee,
+	})
+	if code != http.StatusBadRequest {
+		t.Errorf("expected a settlement ignoring the service fee to be refused with 400, got %d", code)
+	}
+
+	response := mustCall(t, ProposeSettlement, testBuyer, SettlementProposalRequest{
+		EscrowID: id,
+		Party:    "buyer",
+		Outputs:  []utils.PayoutOutput{{Address: testSellerPubKey, Amount: 50000}, {Address: testBuyerPubKey, Amount: available - 50000}},
+		Fee:      fee,
+	}, http.StatusCreated)
+	settlementID := response["settlement"].(map[string]interface{})["id"].(string)
+
+	mustCall(t, SignSettlement, testBuyer, SettlementSignRequest{
+		EscrowID:     id,
+		SettlementID: settlementID,
+		PrivateKey:   testBuyerPrivKey,
+		Signature:    "signature",
+		Party:        "buyer",
+		PublicKey:    testBuyerPubKey,
+	}, http.StatusOK)
+	mustCall(t, SignSettlement, testSeller, SettlementSignRequest{
+		EscrowID:     id,
+		SettlementID: settlementID,
+		PrivateKey:   testSellerPrivKey,
+		Signature:    "signature",
+		Party:        "seller",
+		PublicKey:    testSellerPubKey,
+	}, http.StatusOK)
+
+	viewEscrow(id, func(escrow *Escrow) error {
+		if escrow.Status != StatusSettled || escrow.Payout == nil {
+			t.Fatalf("expected a settled escrow with a payout, got %s", escrow.Status)
+		}
+		paid := int64(0)
+		for _, output := range escrow.Payout.Outputs {
+			if output.Address == feeAddress {
+				paid += output.Amount
+			}
+		}
+		if paid != 2000 {
+			t.Errorf("expected the settlement to pay the service fee of 2000 satoshis, got %d in %+v", paid, escrow.Payout.Outputs)
+		}
+		if escrow.ServiceFee.CollectedAt == nil {
+			t.Errorf("expected the service fee to be collected")
+		}
+		return nil
+	})
+}
+
+func TestFundingServiceFeeVerifiedOnChain(t *testing.T) {
+	const feeAddress = "mipcBbFg9gMiCh81Kj8tqqdgoZub1ZJRfn"
+
+	defaultPolicy := serviceFeePolicy
+	defer SetServiceFeePolicy(defaultPolicy)
+	if err := SetServiceFeePolicy(ServiceFeePolicy{Flat: 2000, ChargeAt: ServiceFeeAtFunding, Address: feeAddress}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The deposit pays the escrow but not the fee
+	id, txID := fundTestEscrow(t, 100000)
+	feeStatus := func() (string, int64) {
+		var status string
+		var collected int64
+		viewEscrow(id, func(escrow *Escrow) error {
+			status, collected = escrow.ServiceFee.status(escrow.Status), escrow.ServiceFee.Collected
+			return nil
+		})
+		return status, collected
+	}
+	if status, collected := feeStatus(); status != "unverified" || collected != 0 {
+		t.Fatalf("expected an unpaid funding fee to be unverified, got %s with %d collected", status, collected)
+	}
+
+	// The fee output of the same transaction is found once confirmed
+	mustCall(t, MockDeposit, testAdmin, MockDepositRequest{
+		Address:       feeAddress,
+		TxID:          txID,
+		Vout:          1,
+		Value:         2000,
+		Confirmations: 1,
+	}, http.StatusCreated)
+	mustCall(t, VerifyPayment, testAdmin, map[string]string{"escrow_id": id}, http.StatusOK)
+	if status, collected := feeStatus(); status != "collected" || collected != 2000 {
+		t.Errorf("expected the paid funding fee to be collected, got %s with %d collected", status, collected)
+	}
+
+	// Verifying again does not count it twice
+	mustCall(t, VerifyPayment, testAdmin, map[string]string{"escrow_id": id}, http.StatusOK)
+	if _, collected := feeStatus(); collected != 2000 {
+		t.Errorf("expected the funding fee to be collected once, got %d", collected)
+	}
+}
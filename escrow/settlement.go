@@ -0,0 +1,399 @@
+package escrow
+
+import (
+	"errors"
+	"escrow-service/utils"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// dustLimit is the smallest output amount the network relays
+const dustLimit int64 = 546
+
+// Settlement is a negotiated payout that divides the escrowed amount between several outputs
+type Settlement struct {
+	ID             string               `json:"id"`
+	Outputs        []utils.PayoutOutput `json:"outputs"`
+	Fee            int64                `json:"fee"`
+	ProposedBy     string               `json:"proposed_by"`
+	ProposedAt     time.Time            `json:"proposed_at"`
+	PreviousStatus Status               `json:"previous_status,omitempty"` // status to return to if the proposal is cancelled
+	Signatures     []PartySignature     `json:"signatures,omitempty"`
+	TxID           string               `json:"txid,omitempty"`
+}
+
+// SettlementProposalRequest represents a request to propose a settlement
+type SettlementProposalRequest struct {
+	EscrowID string               `json:"escrow_id"`
+	Party    string               `json:"party"` // "buyer", "seller", or "escrow"
+	Outputs  []utils.PayoutOutput `json:"outputs"`
+	Fee      int64                `json:"fee,omitempty"` // defaults to the quoted fee for the outputs
+}
+
+// SettlementCancelRequest represents the proposer withdrawing, or another party rejecting, the proposed settlement
+type SettlementCancelRequest struct {
+	EscrowID     string `json:"escrow_id"`
+	SettlementID string `json:"settlement_id"`
+	Party        string `json:"party"` // "buyer", "seller", or "escrow"
+	Reason       string `json:"reason,omitempty"`
+}
+
+// SettlementSignRequest represents a party's signature on the proposed settlement
+type SettlementSignRequest struct {
+	EscrowID     string `json:"escrow_id"`
+	SettlementID string `json:"settlement_id"`
+	PrivateKey   string `json:"private_key,omitempty"` // deprecated, send the signed psbt instead
+	PSBT         string `json:"psbt,omitempty"`        // the payout signed by the party
+	Signature    string `json:"signature"`
+	Party        string `json:"party"`                // "buyer", "seller", or "escrow"
+	PublicKey    string `json:"public_key,omitempty"` // optional when authenticated with a key-bound session
+}
+
+// validateSettlement checks that the outputs plus the fee spend exactly the locked amount,
+// less what is left of a release service fee, which the payout adds in its own output
+func validateSettlement(escrow *Escrow, outputs []utils.PayoutOutput, fee int64) error {
+	if len(outputs) == 0 {
+		return &requestError{http.StatusBadRequest, errors.New("invalid settlement"), "At least one output is required"}
+	}
+
+	if fee <= 0 {
+		return &requestError{http.StatusBadRequest, errors.New("invalid settlement"), "Fee must be positive"}
+	}
+
+	total := fee
+	for _, output := range outputs {
+		if output.Address == "" {
+			return &requestError{http.StatusBadRequest, errors.New("invalid settlement"), "Every output needs an address"}
+		}
+		if output.Amount < dustLimit {
+			return &requestError{http.StatusBadRequest, errors.New("invalid settlement"),
+				fmt.Sprintf("Output to %s is below the dust limit of %d satoshis", output.Address, dustLimit)}
+		}
+		total += output.Amount
+	}
+
+	if available := settlementAmount(escrow); total != available {
+		return &requestError{http.StatusBadRequest, errors.New("invalid settlement"),
+			fmt.Sprintf("Outputs plus fee add up to %d, but the locked amount less any service fee is %d", total, available)}
+	}
+
+	return nil
+}
+
+// settlementAmount returns the amount a settlement divides, the locked amount less what is left of a release service fee
+func settlementAmount(escrow *Escrow) int64 {
+	amount := escrow.lockedAmount()
+	for _, output := range escrow.serviceFeeOutputs() {
+		amount -= output.Amount
+	}
+	return amount
+}
+
+// newSettlement creates a settlement proposal with a fresh ID
+func newSettlement(outputs []utils.PayoutOutput, fee int64, proposedBy string) (*Settlement, error) {
+	id, err := utils.NewID("settlement")
+	if err != nil {
+		return nil, &requestError{http.StatusInternalServerError, err, "Failed to generate settlement ID"}
+	}
+
+	return &Settlement{
+		ID:         id,
+		Outputs:    outputs,
+		Fee:        fee,
+		ProposedBy: proposedBy,
+		ProposedAt: time.Now(),
+	}, nil
+}
+
+// settlementResponse builds the response returned by the settlement endpoints
+func settlementResponse(escrow *Escrow) map[string]interface{} {
+	response := map[string]interface{}{
+		"escrow_id":         escrow.ID,
+		"status":            escrow.Status,
+		"settlement":        escrow.Settlement,
+		"txid":              escrow.SettlementTxID,
+		"signatures_count":  len(escrow.Settlement.Signatures),
+		"signatures_needed": 2,
+		"version":           escrow.Version,
+	}
+	if escrow.SettlementTxID == "" {
+		response["unsigned_tx"] = unsignedPayout(escrow.payoutInputs(),
+			payoutOutputs(escrow, settlementOutputs(escrow, escrow.Settlement.Outputs)), escrow.Settlement.Fee)
+	}
+	return response
+}
+
+// ProposeSettlement proposes dividing a funded escrow between several outputs
+// A new proposal replaces the previous one and discards its signatures
+func ProposeSettlement(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		utils.WriteErrorResponse(w, http.StatusMethodNotAllowed, errors.New("method not allowed"), "Only POST method is allowed")
+		return
+	}
+
+	var req SettlementProposalRequest
+	if err := utils.DecodeJSONBody(r, &req); err != nil {
+		utils.WriteErrorResponse(w, http.StatusBadRequest, err, "Invalid request payload")
+		return
+	}
+
+	// Validate request
+	if req.EscrowID == "" || req.Party == "" || len(req.Outputs) == 0 {
+		utils.WriteErrorResponse(w, http.StatusBadRequest, errors.New("missing required fields"),
+			"Escrow ID, party type, and outputs are required")
+		return
+	}
+
+	if req.Party != "buyer" && req.Party != "seller" && req.Party != "escrow" {
+		utils.WriteErrorResponse(w, http.StatusBadRequest, errors.New("invalid party type"),
+			"Party must be one of: buyer, seller, or escrow")
+		return
+	}
+
+	var response map[string]interface{}
+	etag, err := updateEscrow(req.EscrowID, r.Header.Get("If-Match"), func(escrow *Escrow) error {
+		if err := authorizeParty(r, escrow, req.Party); err != nil {
+			return err
+		}
+
+		if err := escrow.Status.CanTransition(StatusSettling); err != nil {
+			return &requestError{http.StatusBadRequest, err,
+				fmt.Sprintf("Escrow status is %s, cannot propose a settlement", escrow.Status)}
+		}
+
+		// Without an explicit fee the proposal pays the current quote for its outputs,
+		// and an explicit fee may not pay more than the policy's feerate cap allows
+		quote, err := quoteFee(escrow, settlementOutputs(escrow, req.Outputs))
+		if err != nil {
+			return err
+		}
+		fee := req.Fee
+		if fee == 0 {
+			fee = quote.Fee
+		}
+		if maxFee := utils.FeeForVsize(quote.Vsize, feePolicy.MaxFeeRate); fee > maxFee {
+			return &requestError{http.StatusBadRequest, errors.New("fee too high"),
+				fmt.Sprintf("Fee of %d satoshis is above the cap of %d satoshis (%g sat/vB for %d vB)",
+					fee, maxFee, feePolicy.MaxFeeRate, quote.Vsize)}
+		}
+
+		if err := validateSettlement(escrow, req.Outputs, fee); err != nil {
+			return err
+		}
+
+		settlement, err := newSettlement(req.Outputs, fee, req.Party)
+		if err != nil {
+			return err
+		}
+
+		// A replaced proposal hands on the status the escrow returns to if negotiation fails
+		settlement.PreviousStatus = escrow.Status
+		if escrow.Status == StatusSettling {
+			settlement.PreviousStatus = escrow.Settlement.PreviousStatus
+		}
+
+		// All checks passed, apply the changes
+		from := escrow.Status
+		if err := escrow.transition(StatusSettling); err != nil {
+			return err
+		}
+		escrow.Settlement = settlement
+		escrow.recordRequest(r, req.Party, "settlement_proposed", from,
+			fmt.Sprintf("Settlement %s with %d outputs", settlement.ID, len(settlement.Outputs)))
+
+		log.Printf("Settlement %s proposed for escrow ID: %s by %s", settlement.ID, escrow.ID, req.Party)
+		response = settlementResponse(escrow)
+		return nil
+	})
+	if err != nil {
+		writeUpdateError(w, err)
+		return
+	}
+
+	w.Header().Set("ETag", etag)
+	utils.WriteJSONResponse(w, http.StatusCreated, response)
+}
+
+// CancelSettlement withdraws or rejects the proposed settlement, returning the escrow to the status it had
+// before negotiation so it can be released, refunded or settled differently
+func CancelSettlement(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		utils.WriteErrorResponse(w, http.StatusMethodNotAllowed, errors.New("method not allowed"), "Only POST method is allowed")
+		return
+	}
+
+	var req SettlementCancelRequest
+	if err := utils.DecodeJSONBody(r, &req); err != nil {
+		utils.WriteErrorResponse(w, http.StatusBadRequest, err, "Invalid request payload")
+		return
+	}
+
+	// Validate request
+	if req.EscrowID == "" || req.SettlementID == "" || req.Party == "" {
+		utils.WriteErrorResponse(w, http.StatusBadRequest, errors.New("missing required fields"),
+			"Escrow ID, settlement ID, and party type are required")
+		return
+	}
+
+	if req.Party != "buyer" && req.Party != "seller" && req.Party != "escrow" {
+		utils.WriteErrorResponse(w, http.StatusBadRequest, errors.New("invalid party type"),
+			"Party must be one of: buyer, seller, or escrow")
+		return
+	}
+
+	var response map[string]interface{}
+	etag, err := updateEscrow(req.EscrowID, r.Header.Get("If-Match"), func(escrow *Escrow) error {
+		if err := authorizeParty(r, escrow, req.Party); err != nil {
+			return err
+		}
+
+		// A split decided by an arbitrator is not negotiable
+		if escrow.Status != StatusSettling {
+			return &requestError{http.StatusBadRequest, errors.New("no settlement"),
+				fmt.Sprintf("Escrow status is %s, there is no settlement proposal to cancel", escrow.Status)}
+		}
+
+		settlement := escrow.Settlement
+		if settlement.ID != req.SettlementID {
+			return &requestError{http.StatusConflict, errors.New("settlement replaced"),
+				fmt.Sprintf("Settlement %s is no longer current, the current proposal is %s", req.SettlementID, settlement.ID)}
+		}
+
+		// All checks passed, apply the changes
+		if err := escrow.transition(settlement.PreviousStatus); err != nil {
+			return err
+		}
+		escrow.Settlement = nil
+
+		action := "settlement_rejected"
+		if req.Party == settlement.ProposedBy {
+			action = "settlement_withdrawn"
+		}
+		detail := fmt.Sprintf("Settlement %s", settlement.ID)
+		if req.Reason != "" {
+			detail += ": " + req.Reason
+		}
+		escrow.recordRequest(r, req.Party, action, StatusSettling, detail)
+
+		log.Printf("Settlement %s for escrow ID: %s cancelled by %s", settlement.ID, escrow.ID, req.Party)
+		response = map[string]interface{}{
+			"escrow_id":     escrow.ID,
+			"status":        escrow.Status,
+			"settlement_id": settlement.ID,
+			"cancelled_by":  req.Party,
+			"version":       escrow.Version,
+		}
+		return nil
+	})
+	if err != nil {
+		writeUpdateError(w, err)
+		return
+	}
+
+	w.Header().Set("ETag", etag)
+	utils.WriteJSONResponse(w, http.StatusOK, response)
+}
+
+// SignSettlement adds a party's signature to the proposed settlement
+// Once 2 of 3 parties have signed the multi-output payout is created
+func SignSettlement(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		utils.WriteErrorResponse(w, http.StatusMethodNotAllowed, errors.New("method not allowed"), "Only POST method is allowed")
+		return
+	}
+
+	var req SettlementSignRequest
+	if err := utils.DecodeJSONBody(r, &req); err != nil {
+		utils.WriteErrorResponse(w, http.StatusBadRequest, err, "Invalid request payload")
+		return
+	}
+
+	// Validate request
+	if req.EscrowID == "" || req.SettlementID == "" || req.Signature == "" {
+		utils.WriteErrorResponse(w, http.StatusBadRequest, errors.New("missing required fields"),
+			"Escrow ID, settlement ID, and signature are required")
+		return
+	}
+
+	party, err := parsePayoutSigner(r, req.Party, req.PublicKey, req.PSBT, req.PrivateKey)
+	if err != nil {
+		writeUpdateError(w, err)
+		return
+	}
+	newSignature := party.signature(req.Signature)
+
+	var response map[string]interface{}
+	etag, err := updateEscrowSigned(req.EscrowID, r.Header.Get("If-Match"), party.signer, func(escrow *Escrow, signing *payoutSigning) error {
+		if err := party.check(r, escrow); err != nil {
+			return err
+		}
+
+		// Settlements are signed while negotiating, or after an arbitrator decided a split
+		if escrow.Status == StatusResolved {
+			if err := escrow.Dispute.requireOutcome(OutcomeSplit); err != nil {
+				return err
+			}
+		} else if escrow.Status != StatusSettling {
+			return &requestError{http.StatusBadRequest, errors.New("no settlement"),
+				fmt.Sprintf("Escrow status is %s, there is no settlement to sign", escrow.Status)}
+		}
+
+		// Signatures cover a specific proposal, so a replaced one cannot be signed
+		settlement := escrow.Settlement
+		if settlement.ID != req.SettlementID {
+			return &requestError{http.StatusConflict, errors.New("settlement replaced"),
+				fmt.Sprintf("Settlement %s is no longer current, the current proposal is %s", req.SettlementID, settlement.ID)}
+		}
+
+		for _, sig := range settlement.Signatures {
+			if sig.Party == req.Party {
+				return &requestError{http.StatusBadRequest, errors.New("duplicate signature"),
+					fmt.Sprintf("A signature from %s has already been provided", req.Party)}
+			}
+		}
+
+		signatures := append(append([]PartySignature{}, settlement.Signatures...), newSignature)
+
+		var signedTx, txID string
+		var payout *utils.Transaction
+
+		// Check if we have reached the 2-of-3 threshold
+		if len(signatures) >= 2 {
+			tx, signed, err := createPayout(escrow, settlementOutputs(escrow, settlement.Outputs), settlement.Fee, signing)
+			if err != nil {
+				return err
+			}
+			txID, signedTx, payout = tx.TxID, signed, &tx
+		}
+
+		// All checks passed, apply the changes
+		from := escrow.Status
+		if txID != "" {
+			if err := escrow.transition(StatusSettled); err != nil {
+				return err
+			}
+			settlement.TxID = txID
+			escrow.SettlementTxID = txID
+			escrow.recordPayout(payout)
+			log.Printf("Settled escrow with ID: %s, TxID: %s", escrow.ID, txID)
+		} else {
+			log.Printf("Added settlement signature for escrow ID: %s from %s", escrow.ID, req.Party)
+		}
+		settlement.Signatures = signatures
+		escrow.recordRequest(r, req.Party, "settlement_signed", from,
+			fmt.Sprintf("Settlement %s signature %d of 2", settlement.ID, len(signatures)))
+
+		response = settlementResponse(escrow)
+		response["signed_tx"] = signedTx
+		return nil
+	})
+	if err != nil {
+		writeUpdateError(w, err)
+		return
+	}
+
+	w.Header().Set("ETag", etag)
+	utils.WriteJSONResponse(w, http.StatusOK, response)
+}
@@ -0,0 +1,136 @@
+package escrow
+
+import (
+	"escrow-service/utils"
+	"net/http"
+	"testing"
+)
+
+// splitQuote returns the fee quoted for a two-output split of the escrow and the amount it divides
+func splitQuote(t *testing.T, id string) (int64, int64) {
+	t.Helper()
+
+	quote := getAs(t, GetFeeQuote, testBuyer, "id="+id+"&operation=split")
+	return int64(quote["quote"].(map[string]interface{})["fee"].(float64)), int64(quote["available_amount"].(float64))
+}
+
+// signSettlementAs signs the settlement as the buyer or the seller and returns the response status code
+func signSettlementAs(t *testing.T, id, settlementID, party string) int {
+	t.Helper()
+
+	identity, req := partySigning(id, party)
+	code, _ := callHandler(t, SignSettlement, identity, SettlementSignRequest{
+		EscrowID:     id,
+		SettlementID: settlementID,
+		PrivateKey:   req.PrivateKey,
+		Signature:    req.Signature,
+		Party:        party,
+		PublicKey:    req.PublicKey,
+	})
+	return code
+}
+
+func TestSettlementValidation(t *testing.T) {
+	id, _ := fundTestEscrow(t, 80000)
+	defer SetFeePolicy(feePolicy)
+	if err := SetFeePolicy(FeePolicy{ConfTarget: feePolicy.ConfTarget, MinFeeRate: 1, MaxFeeRate: 20}); err != nil {
+		t.Fatalf("failed to set the fee policy: %v", err)
+	}
+	fee, available := splitQuote(t, id)
+
+	for _, c := range []struct {
+		name    string
+		outputs []utils.PayoutOutput
+		fee     int64
+	}{
+		{"short of the amount", []utils.PayoutOutput{{Address: testSellerPubKey, Amount: 30000}, {Address: testBuyerPubKey, Amount: 30000}}, fee},
+		{"above the amount", []utils.PayoutOutput{{Address: testSellerPubKey, Amount: available}, {Address: testBuyerPubKey, Amount: 1000}}, fee},
+		{"dust output", []utils.PayoutOutput{{Address: testSellerPubKey, Amount: available - dustLimit + 1}, {Address: testBuyerPubKey, Amount: dustLimit - 1}}, fee},
+		{"missing address", []utils.PayoutOutput{{Amount: 40000}, {Address: testBuyerPubKey, Amount: available - 40000}}, fee},
+		{"fee above the cap", []utils.PayoutOutput{{Address: testSellerPubKey, Amount: 30000}, {Address: testBuyerPubKey, Amount: 30000}}, available + fee - 60000},
+	} {
+		code, response := callHandler(t, ProposeSettlement, testBuyer, SettlementProposalRequest{
+			EscrowID: id,
+			Party:    "buyer",
+			Outputs:  c.outputs,
+			Fee:      c.fee,
+		})
+		if code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d: %v", c.name, code, response)
+		}
+	}
+	if escrow := snapshotEscrow(t, id); escrow.Status != StatusFunded {
+		t.Fatalf("expected refused proposals to leave the escrow funded, got %s", escrow.Status)
+	}
+
+	// Without a fee the proposal pays the quote, which the outputs must leave room for
+	response := mustCall(t, ProposeSettlement, testBuyer, SettlementProposalRequest{
+		EscrowID: id,
+		Party:    "buyer",
+		Outputs:  []utils.PayoutOutput{{Address: testSellerPubKey, Amount: 50000}, {Address: testBuyerPubKey, Amount: available - 50000}},
+	}, http.StatusCreated)
+	if response["status"] != string(StatusSettling) {
+		t.Errorf("expected the escrow to be settling, got %v", response["status"])
+	}
+}
+
+func TestSettlementSigning(t *testing.T) {
+	id, _ := fundTestEscrow(t, 80000)
+	fee, available := splitQuote(t, id)
+	propose := func(sellerAmount int64) string {
+		response := mustCall(t, ProposeSettlement, testSeller, SettlementProposalRequest{
+			EscrowID: id,
+			Party:    "seller",
+			Outputs:  []utils.PayoutOutput{{Address: testSellerPubKey, Amount: sellerAmount}, {Address: testBuyerPubKey, Amount: available - sellerAmount}},
+			Fee:      fee,
+		}, http.StatusCreated)
+		return response["settlement"].(map[string]interface{})["id"].(string)
+	}
+
+	first := propose(60000)
+	if code := signSettlementAs(t, id, first, "seller"); code != http.StatusOK {
+		t.Fatalf("expected the seller to sign, got %d", code)
+	}
+	if code := signSettlementAs(t, id, first, "seller"); code != http.StatusBadRequest {
+		t.Errorf("expected a second signature from the seller to be refused, got %d", code)
+	}
+
+	// A new proposal discards the signatures, the old one can no longer be signed
+	second := propose(45000)
+	if code := signSettlementAs(t, id, first, "buyer"); code != http.StatusConflict {
+		t.Errorf("expected the replaced proposal to be refused with 409, got %d", code)
+	}
+	signSettlementAs(t, id, second, "buyer")
+	if code := signSettlementAs(t, id, second, "seller"); code != http.StatusOK {
+		t.Fatalf("expected the second signature to settle the escrow, got %d", code)
+	}
+
+	viewEscrow(id, func(escrow *Escrow) error {
+		if escrow.Status != StatusSettled || escrow.SettlementTxID == "" || escrow.Payout == nil {
+			t.Fatalf("expected a settled escrow with a payout, got %s", escrow.Status)
+		}
+		if escrow.Settlement.ID != second || escrow.Payout.Outputs[0].Amount != 45000 {
+			t.Errorf("expected the payout of the second proposal, got %+v", escrow.Payout.Outputs)
+		}
+		return nil
+	})
+}
+
+func TestSettlementCancel(t *testing.T) {
+	id, _ := fundTestEscrow(t, 80000)
+	fee, available := splitQuote(t, id)
+	response := mustCall(t, ProposeSettlement, testBuyer, SettlementProposalRequest{
+		EscrowID: id,
+		Party:    "buyer",
+		Outputs:  []utils.PayoutOutput{{Address: testSellerPubKey, Amount: 40000}, {Address: testBuyerPubKey, Amount: available - 40000}},
+		Fee:      fee,
+	}, http.StatusCreated)
+	settlementID := response["settlement"].(map[string]interface{})["id"].(string)
+
+	// The other party rejects it, and the escrow goes back to funded
+	mustCall(t, CancelSettlement, testSeller, SettlementCancelRequest{EscrowID: id, SettlementID: settlementID, Party: "seller"}, http.StatusOK)
+	if escrow := snapshotEscrow(t, id); escrow.Status != StatusFunded || !containsAction(id, "settlement_rejected") {
+		t.Errorf("expected a rejected settlement to return the escrow to funded, got %s with %v", escrow.Status, historyActions(id))
+	}
+	mustCall(t, CancelSettlement, testSeller, SettlementCancelRequest{EscrowID: id, SettlementID: settlementID, Party: "seller"}, http.StatusBadRequest)
+}
@@ -0,0 +1,221 @@
+package escrow
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"escrow-service/utils"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Signer produces signatures for escrow spending transactions
+// Implementations may hold the key in-process or delegate to a separate signer daemon
+type Signer interface {
+	// SignPSBTInput signs the input at inputIndex and returns the updated PSBT
+	SignPSBTInput(psbt string, inputIndex int) (string, error)
+	// PublicKey returns the hex-encoded public key of the signing key
+	PublicKey() (string, error)
+}
+
+// SignRequest is the body sent to the signer daemon's /sign endpoint
+type SignRequest struct {
+	PSBT       string `json:"psbt"`
+	InputIndex int    `json:"input_index"`
+}
+
+// SignResponse is returned by the signer daemon's /sign endpoint
+type SignResponse struct {
+	PSBT string `json:"psbt"`
+}
+
+// PublicKeyResponse is returned by the signer daemon's /pubkey endpoint
+type PublicKeyResponse struct {
+	PublicKey string `json:"public_key"`
+}
+
+// serviceSigner signs on behalf of the escrow service key, if configured
+var serviceSigner Signer
+
+// SetServiceSigner configures the signer used for the escrow service's own key
+func SetServiceSigner(signer Signer) {
+	serviceSigner = signer
+}
+
+// LocalSigner signs in-process with a private key held in memory
+type LocalSigner struct {
+	privateKey string
+}
+
+// NewLocalSigner creates a signer for the given private key
+func NewLocalSigner(privateKey string) *LocalSigner {
+	return &LocalSigner{privateKey: privateKey}
+}
+
+// SignPSBTInput signs the input at inputIndex with the local private key
+func (s *LocalSigner) SignPSBTInput(psbt string, inputIndex int) (string, error) {
+	if inputIndex < 0 {
+		return "", fmt.Errorf("invalid input index: %d", inputIndex)
+	}
+
+	// LIMITATION: utils.SignTransaction is a mock, so the input index is not used yet
+	return utils.SignTransaction(psbt, s.privateKey)
+}
+
+// PublicKey derives the public key from the local private key
+func (s *LocalSigner) PublicKey() (string, error) {
+	return utils.PublicKeyFromWIF(s.privateKey)
+}
+
+// RemoteSigner delegates signing to a signer daemon over authenticated HTTP
+// The daemon's public key is fetched once and cached, so checking it makes no further requests
+type RemoteSigner struct {
+	baseURL string
+	token   string
+
+	mu        sync.Mutex
+	publicKey string
+}
+
+// NewRemoteSigner creates a signer that talks to the signer daemon at baseURL
+func NewRemoteSigner(baseURL, token string) *RemoteSigner {
+	return &RemoteSigner{
+		baseURL: strings.TrimRight(baseURL, "/"),
+		token:   token,
+	}
+}
+
+// SignPSBTInput asks the signer daemon to sign the input at inputIndex
+func (s *RemoteSigner) SignPSBTInput(psbt string, inputIndex int) (string, error) {
+	body, err := json.Marshal(SignRequest{PSBT: psbt, InputIndex: inputIndex})
+	if err != nil {
+		return "", fmt.Errorf("failed to encode sign request: %v", err)
+	}
+
+	var resp SignResponse
+	if err := s.call(http.MethodPost, "/sign", body, &resp); err != nil {
+		return "", err
+	}
+
+	return resp.PSBT, nil
+}
+
+// PublicKey returns the signer daemon's public key, asking the daemon the first time only
+func (s *RemoteSigner) PublicKey() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.publicKey != "" {
+		return s.publicKey, nil
+	}
+
+	var resp PublicKeyResponse
+	if err := s.call(http.MethodGet, "/pubkey", nil, &resp); err != nil {
+		return "", err
+	}
+	if resp.PublicKey == "" {
+		return "", errors.New("signer returned no public key")
+	}
+
+	s.publicKey = resp.PublicKey
+	return s.publicKey, nil
+}
+
+// call performs an authenticated request against the signer daemon
+func (s *RemoteSigner) call(method, path string, body []byte, dst interface{}) error {
+	headers := map[string]string{"Authorization": "Bearer " + s.token}
+
+	resp, err := utils.MakeHTTPRequestWithHeaders(nil, method, s.baseURL+path, bytes.NewReader(body), headers)
+	if err != nil {
+		return fmt.Errorf("signer request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var errResp utils.ErrorResponse
+		if err := json.NewDecoder(resp.Body).Decode(&errResp); err != nil || errResp.Error == "" {
+			return fmt.Errorf("signer returned status %d", resp.StatusCode)
+		}
+		return fmt.Errorf("signer returned status %d: %s", resp.StatusCode, errResp.Error)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(dst); err != nil {
+		return fmt.Errorf("invalid signer response: %v", err)
+	}
+
+	return nil
+}
+
+// PSBTSigner stands in for a party that signed the payout itself and sent back the signed PSBT
+// It never sees the party's private key, and only "signs" the transaction the party actually signed
+type PSBTSigner struct {
+	psbt      string
+	publicKey string
+}
+
+// NewPSBTSigner creates a signer returning psbt, as signed by the holder of publicKey
+func NewPSBTSigner(psbt, publicKey string) *PSBTSigner {
+	return &PSBTSigner{psbt: psbt, publicKey: publicKey}
+}
+
+// SignPSBTInput returns the party's signed PSBT if it signs psbt
+func (s *PSBTSigner) SignPSBTInput(psbt string, inputIndex int) (string, error) {
+	if inputIndex < 0 {
+		return "", fmt.Errorf("invalid input index: %d", inputIndex)
+	}
+
+	// LIMITATION: The whole PSBT is checked rather than the input at inputIndex
+	if !utils.SignsTransaction(s.psbt, psbt) {
+		return "", errors.New("PSBT does not sign the payout transaction")
+	}
+
+	return s.psbt, nil
+}
+
+// PublicKey returns the public key of the party that signed the PSBT
+func (s *PSBTSigner) PublicKey() (string, error) {
+	return s.publicKey, nil
+}
+
+// signerForParty returns the signer to use for a party's signature
+// The escrow service key is always taken from the service signer when one is configured. Other
+// parties send the payout signed as a PSBT, or, for older clients, their private key
+func signerForParty(party, psbt, privateKey, publicKey string) (Signer, error) {
+	if party == "escrow" && serviceSigner != nil {
+		return serviceSigner, nil
+	}
+
+	if psbt != "" {
+		return NewPSBTSigner(psbt, publicKey), nil
+	}
+
+	if privateKey == "" {
+		return nil, errors.New("signed PSBT or private key is required")
+	}
+
+	return NewLocalSigner(privateKey), nil
+}
+
+// signingFailed returns the error for a failed signature, which is the request's fault if the party sent a PSBT
+func signingFailed(signer Signer, err error, message string) error {
+	if _, ok := signer.(*PSBTSigner); ok {
+		return &requestError{http.StatusBadRequest, err, "PSBT does not sign the unsigned transaction of the payout"}
+	}
+	return &requestError{http.StatusBadGateway, err, message}
+}
+
+// checkSignerKey verifies that the signer controls the expected public key
+func checkSignerKey(signer Signer, expectedPubKey string) error {
+	pubKey, err := signer.PublicKey()
+	if err != nil {
+		return fmt.Errorf("failed to get signer public key: %v", err)
+	}
+
+	if !strings.EqualFold(pubKey, expectedPubKey) {
+		return errors.New("signer public key does not match escrow public key")
+	}
+
+	return nil
+}
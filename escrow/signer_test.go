@@ -0,0 +1,135 @@
+package escrow
+
+import (
+	"errors"
+	"escrow-service/utils"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// probeSigner is an escrow service signer checking that the escrow is not locked while it signs.
+// With change set it also updates the escrow while signing, as a concurrent request would
+type probeSigner struct {
+	escrowID string
+	change   bool
+}
+
+// SignPSBTInput signs like the mock signer, failing if the escrow's lock cannot be taken meanwhile
+func (s *probeSigner) SignPSBTInput(psbt string, inputIndex int) (string, error) {
+	done := make(chan struct{})
+	go func() {
+		if s.change {
+			updateEscrow(s.escrowID, "", func(escrow *Escrow) error { return nil })
+		} else {
+			viewEscrow(s.escrowID, func(escrow *Escrow) error { return nil })
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return utils.SignTransaction(psbt, "escrow-key")
+	case <-time.After(time.Second):
+		return "", errors.New("escrow locked while signing")
+	}
+}
+
+// PublicKey returns the escrow service key of the test escrows
+func (s *probeSigner) PublicKey() (string, error) {
+	return testEscrowPubKey, nil
+}
+
+func TestReleaseWithSignedPSBT(t *testing.T) {
+	id, _ := fundTestEscrow(t, 80000)
+
+	quote := getAs(t, GetFeeQuote, testBuyer, "id="+id+"&operation=release")
+	unsigned, _ := quote["unsigned_tx"].(string)
+	if unsigned == "" {
+		t.Fatalf("expected the quote to include the unsigned transaction, got %v", quote)
+	}
+	signed, _ := utils.SignTransaction(unsigned, testBuyerPrivKey)
+
+	// Neither party sends its private key
+	mustCall(t, ReleaseEscrow, testBuyer, ReleaseRequest{
+		EscrowID:  id,
+		PSBT:      signed,
+		Signature: "signature",
+		Party:     "buyer",
+		PublicKey: testBuyerPubKey,
+	}, http.StatusOK)
+
+	code, response := callHandler(t, ReleaseEscrow, testSeller, ReleaseRequest{
+		EscrowID:  id,
+		PSBT:      "signed_0200000000",
+		Signature: "signature",
+		Party:     "seller",
+		PublicKey: testSellerPubKey,
+	})
+	if code != http.StatusBadRequest {
+		t.Fatalf("expected a PSBT of another transaction to be refused with 400, got %d: %v", code, response)
+	}
+	if escrow := snapshotEscrow(t, id); escrow.Status != StatusReleasing {
+		t.Fatalf("expected the escrow to wait for a valid signature, got %s", escrow.Status)
+	}
+
+	response = mustCall(t, ReleaseEscrow, testSeller, ReleaseRequest{
+		EscrowID:  id,
+		PSBT:      signed,
+		Signature: "signature",
+		Party:     "seller",
+		PublicKey: testSellerPubKey,
+	}, http.StatusOK)
+	if response["status"] != string(StatusReleased) || response["signed_tx"] != signed {
+		t.Errorf("expected the escrow to be released with the signed PSBT, got %v", response)
+	}
+
+	// A party sending neither is refused
+	id, _ = fundTestEscrow(t, 80000)
+	code, _ = callHandler(t, ReleaseEscrow, testBuyer, ReleaseRequest{
+		EscrowID:  id,
+		Signature: "signature",
+		Party:     "buyer",
+		PublicKey: testBuyerPubKey,
+	})
+	if code != http.StatusBadRequest {
+		t.Errorf("expected a release without PSBT or private key to be refused with 400, got %d", code)
+	}
+}
+
+func TestServiceSignerSignsOutsideLock(t *testing.T) {
+	defer SetServiceSigner(serviceSigner)
+
+	for _, change := range []bool{false, true} {
+		id, _ := fundTestEscrow(t, 80000)
+		SetServiceSigner(&probeSigner{escrowID: id, change: change})
+
+		mustCall(t, ReleaseEscrow, testBuyer, ReleaseRequest{
+			EscrowID:   id,
+			PrivateKey: testBuyerPrivKey,
+			Signature:  "signature",
+			Party:      "buyer",
+			PublicKey:  testBuyerPubKey,
+		}, http.StatusOK)
+
+		code, response := callHandler(t, ReleaseEscrow, testAdmin, ReleaseRequest{
+			EscrowID:  id,
+			Signature: "signature",
+			Party:     "escrow",
+			PublicKey: testEscrowPubKey,
+		})
+		escrow := snapshotEscrow(t, id)
+
+		if !change {
+			if code != http.StatusOK || escrow.Status != StatusReleased {
+				t.Errorf("expected the escrow service to complete the release, got %d with %s: %v", code, escrow.Status, response)
+			}
+			continue
+		}
+
+		// The escrow changed while the payout was being signed, so the signature is not applied
+		if code != http.StatusConflict || escrow.Status != StatusReleasing {
+			t.Errorf("expected a conflict leaving the escrow releasing, got %d with %s: %v", code, escrow.Status, response)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package escrow
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Status represents the lifecycle state of an escrow
+type Status string
+
+const (
+	StatusCreated           Status = "created"
+	StatusUnderfunded       Status = "underfunded"
+	StatusFunded            Status = "funded"
+	StatusReleasing         Status = "releasing"
+	StatusReleased          Status = "released"
+	StatusPartiallyReleased Status = "partially_released"
+	StatusRefunding         Status = "refunding"
+	StatusRefunded          Status = "refunded"
+	StatusSettling          Status = "settling"
+	StatusCancelled         Status = "cancelled"
+	StatusExpired           Status = "expired"
+	StatusDisputed          Status = "disputed"
+	StatusResolved          Status = "resolved"
+	StatusSettled           Status = "settled"
+	StatusFundingReverted   Status = "funding_reverted"
+)
+
+// transitions is the single source of truth for which status changes are allowed
+// Statuses without an entry are terminal; milestone escrows stay partially_released between partial releases
+// A withdrawn or rejected settlement returns the escrow from settling to the status it was proposed in
+// An escrow leaves funding_reverted only through resume, so nothing can be paid out while its funding is unsafe
+var transitions = map[Status][]Status{
+	StatusCreated:           {StatusFunded, StatusUnderfunded, StatusCancelled, StatusExpired},
+	StatusUnderfunded:       {StatusFunded, StatusRefunding, StatusDisputed},
+	StatusFunded:            {StatusReleasing, StatusRefunding, StatusSettling, StatusDisputed, StatusPartiallyReleased, StatusFundingReverted},
+	StatusPartiallyReleased: {StatusPartiallyReleased, StatusReleasing, StatusRefunding, StatusSettling, StatusDisputed, StatusFundingReverted},
+	StatusReleasing:         {StatusReleasing, StatusReleased, StatusDisputed, StatusFundingReverted},
+	StatusRefunding:         {StatusRefunding, StatusRefunded, StatusDisputed, StatusFundingReverted},
+	StatusSettling:          {StatusSettling, StatusSettled, StatusFunded, StatusPartiallyReleased, StatusDisputed, StatusFundingReverted},
+	StatusDisputed:          {StatusResolved, StatusFundingReverted},
+	StatusResolved:          {StatusReleased, StatusRefunded, StatusSettled, StatusFundingReverted},
+	StatusFundingReverted:   {StatusFundingReverted},
+}
+
+// TransitionError is returned when a status change is not allowed
+type TransitionError struct {
+	From    Status
+	To      Status
+	Allowed []Status
+}
+
+// Error implements the error interface
+func (e *TransitionError) Error() string {
+	if len(e.Allowed) == 0 {
+		return fmt.Sprintf("invalid status transition %s -> %s: %s is a terminal status", e.From, e.To, e.From)
+	}
+
+	allowed := make([]string, 0, len(e.Allowed))
+	for _, status := range e.Allowed {
+		allowed = append(allowed, string(status))
+	}
+	return fmt.Sprintf("invalid status transition %s -> %s: allowed transitions are %s",
+		e.From, e.To, strings.Join(allowed, ", "))
+}
+
+// IsTerminal reports whether no further transitions are possible from this status
+func (s Status) IsTerminal() bool {
+	return len(transitions[s]) == 0
+}
+
+// CanTransition checks whether the status may change to the given status
+func (s Status) CanTransition(to Status) error {
+	for _, allowed := range transitions[s] {
+		if allowed == to {
+			return nil
+		}
+	}
+
+	return &TransitionError{From: s, To: to, Allowed: transitions[s]}
+}
+
+// transition moves the escrow to a new status if the transition table allows it
+func (e *Escrow) transition(to Status) error {
+	if err := e.Status.CanTransition(to); err != nil {
+		return err
+	}
+
+	e.Status = to
+	return nil
+}
+
+// revert moves the escrow to funding_reverted, remembering the status to resume once its funding is safe again
+func (e *Escrow) revert() error {
+	from := e.Status
+	if err := e.transition(StatusFundingReverted); err != nil {
+		return err
+	}
+
+	e.RevertedFrom = from
+	return nil
+}
+
+// resume returns an escrow in funding_reverted to the status it was reverted from
+func (e *Escrow) resume() error {
+	if e.Status != StatusFundingReverted || e.RevertedFrom == "" {
+		return &TransitionError{From: e.Status, To: e.RevertedFrom, Allowed: transitions[e.Status]}
+	}
+
+	e.Status, e.RevertedFrom = e.RevertedFrom, ""
+	return nil
+}
@@ -0,0 +1,225 @@
+package escrow
+
+import (
+	"errors"
+	"escrow-service/utils"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// In-memory database for demo purposes
+var (
+	escrowsMutex    sync.RWMutex
+	escrows         = make(map[string]*Escrow)
+	paymentRequests = make(map[string]string) // escrow ID by payment request ID, including top-ups
+	fundingClaims   = make(map[string]string) // escrow ID by funding outpoint, as "txid:vout"
+)
+
+var (
+	errEscrowNotFound  = errors.New("escrow not found")
+	errVersionMismatch = errors.New("version mismatch")
+)
+
+// requestError carries the HTTP status and message for an error raised inside an escrow update
+type requestError struct {
+	code    int
+	err     error
+	message string
+}
+
+// Error implements the error interface
+func (e *requestError) Error() string {
+	return e.err.Error()
+}
+
+// getEscrow looks up an escrow by ID
+func getEscrow(id string) (*Escrow, bool) {
+	escrowsMutex.RLock()
+	defer escrowsMutex.RUnlock()
+
+	escrow, exists := escrows[id]
+	return escrow, exists
+}
+
+// saveEscrow stores a newly created escrow
+func saveEscrow(escrow *Escrow) {
+	escrowsMutex.Lock()
+	defer escrowsMutex.Unlock()
+
+	escrows[escrow.ID] = escrow
+	paymentRequests[escrow.PaymentRequest.RequestID] = escrow.ID
+	indexEscrow(escrow)
+}
+
+// indexPaymentRequest records that a payment request issued after creation, such as a top-up, belongs to an escrow
+func indexPaymentRequest(requestID, escrowID string) {
+	escrowsMutex.Lock()
+	defer escrowsMutex.Unlock()
+
+	paymentRequests[requestID] = escrowID
+}
+
+// claimUTXOs returns the outputs not yet claimed by another escrow and claims them for escrowID
+// Escrows created with the same keys share an address, so a deposit funds whichever escrow verifies it first
+func claimUTXOs(escrowID string, utxos []UTXO) []UTXO {
+	escrowsMutex.Lock()
+	defer escrowsMutex.Unlock()
+
+	var claimed []UTXO
+	for _, utxo := range utxos {
+		outpoint := fmt.Sprintf("%s:%d", utxo.TxID, utxo.Vout)
+		if owner, exists := fundingClaims[outpoint]; exists && owner != escrowID {
+			continue
+		}
+		fundingClaims[outpoint] = escrowID
+		claimed = append(claimed, utxo)
+	}
+	return claimed
+}
+
+// unclaimedUTXOs returns the outputs not already claimed by another escrow, without claiming them
+func unclaimedUTXOs(escrowID string, utxos []UTXO) []UTXO {
+	escrowsMutex.RLock()
+	defer escrowsMutex.RUnlock()
+
+	var unclaimed []UTXO
+	for _, utxo := range utxos {
+		if owner, exists := fundingClaims[fmt.Sprintf("%s:%d", utxo.TxID, utxo.Vout)]; exists && owner != escrowID {
+			continue
+		}
+		unclaimed = append(unclaimed, utxo)
+	}
+	return unclaimed
+}
+
+// findEscrowByPaymentRequest looks up the escrow a BIP70 payment request belongs to
+func findEscrowByPaymentRequest(requestID string) (*Escrow, bool) {
+	escrowsMutex.RLock()
+	defer escrowsMutex.RUnlock()
+
+	escrow, exists := escrows[paymentRequests[requestID]]
+	return escrow, exists
+}
+
+// listEscrows returns a snapshot of all stored escrows
+func listEscrows() []*Escrow {
+	escrowsMutex.RLock()
+	defer escrowsMutex.RUnlock()
+
+	list := make([]*Escrow, 0, len(escrows))
+	for _, escrow := range escrows {
+		list = append(list, escrow)
+	}
+	return list
+}
+
+// updateEscrow runs fn while holding the escrow's lock, so the checks and mutations
+// inside fn are atomic with respect to other requests for the same escrow.
+// If ifMatch is set it must match the escrow's current ETag. The version is bumped
+// before fn runs so fn can report it, and restored if fn fails; fn must leave the
+// escrow untouched when it returns an error. The new ETag is returned on success.
+func updateEscrow(id, ifMatch string, fn func(escrow *Escrow) error) (string, error) {
+	escrow, exists := getEscrow(id)
+	if !exists {
+		return "", errEscrowNotFound
+	}
+
+	escrow.mu.Lock()
+	defer escrow.mu.Unlock()
+
+	if !etagMatches(ifMatch, escrow.etag()) {
+		return "", errVersionMismatch
+	}
+
+	escrow.Version++
+	if err := fn(escrow); err != nil {
+		escrow.Version--
+		return "", err
+	}
+
+	reindexStatus(escrow)
+	return escrow.etag(), nil
+}
+
+// viewEscrow runs fn while holding the escrow's lock, for consistent reads
+func viewEscrow(id string, fn func(escrow *Escrow) error) error {
+	escrow, exists := getEscrow(id)
+	if !exists {
+		return errEscrowNotFound
+	}
+
+	escrow.mu.Lock()
+	defer escrow.mu.Unlock()
+
+	return fn(escrow)
+}
+
+// lockEscrows locks the escrows with the given IDs, for changes that must be atomic across several of them,
+// and returns those that exist with a function releasing the locks. Locks are taken in ID order, and no
+// other code holds one escrow's lock while taking another's, so callers cannot deadlock
+func lockEscrows(ids []string) ([]*Escrow, func()) {
+	ids = append([]string{}, ids...)
+	sort.Strings(ids)
+
+	var locked []*Escrow
+	for _, id := range ids {
+		if escrow, exists := getEscrow(id); exists {
+			escrow.mu.Lock()
+			locked = append(locked, escrow)
+		}
+	}
+
+	return locked, func() {
+		for _, escrow := range locked {
+			reindexStatus(escrow)
+			escrow.mu.Unlock()
+		}
+	}
+}
+
+// etag returns the entity tag for the escrow's current version
+func (e *Escrow) etag() string {
+	return strconv.Quote(strconv.FormatInt(e.Version, 10))
+}
+
+// etagMatches evaluates an If-Match header value against the current ETag
+func etagMatches(ifMatch, current string) bool {
+	ifMatch = strings.TrimSpace(ifMatch)
+	if ifMatch == "" || ifMatch == "*" {
+		return true
+	}
+
+	for _, candidate := range strings.Split(ifMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == current || strconv.Quote(candidate) == current {
+			return true
+		}
+	}
+
+	return false
+}
+
+// writeUpdateError writes the HTTP response for an error returned by updateEscrow or viewEscrow
+func writeUpdateError(w http.ResponseWriter, err error) {
+	var reqErr *requestError
+	var transitionErr *TransitionError
+
+	switch {
+	case errors.Is(err, errEscrowNotFound):
+		utils.WriteErrorResponse(w, http.StatusNotFound, err, "Escrow with the specified ID does not exist")
+	case errors.Is(err, errVersionMismatch):
+		utils.WriteErrorResponse(w, http.StatusPreconditionFailed, err,
+			"Escrow has been modified since it was read, fetch it again and retry")
+	case errors.As(err, &reqErr):
+		utils.WriteErrorResponse(w, reqErr.code, reqErr.err, reqErr.message)
+	case errors.As(err, &transitionErr):
+		utils.WriteErrorResponse(w, http.StatusBadRequest, err,
+			fmt.Sprintf("Escrow status is %s, cannot move to %s", transitionErr.From, transitionErr.To))
+	default:
+		utils.WriteErrorResponse(w, http.StatusInternalServerError, err, "Failed to update escrow")
+	}
+}
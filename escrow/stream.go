@@ -0,0 +1,456 @@
+package escrow
+
+import (
+	"encoding/json"
+	"errors"
+	"escrow-service/utils"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Types of events pushed to stream subscribers
+const (
+	EventFunded         = "funded"
+	EventSignatureAdded = "signature_added"
+	EventReleased       = "released"
+	EventRefunded       = "refunded"
+	EventDisputed       = "disputed"
+)
+
+const (
+	streamBacklog   = 1000             // recent events kept so clients can resume after reconnecting
+	streamBuffer    = 64               // events queued for a slow subscriber before it is dropped
+	streamKeepAlive = 15 * time.Second // interval of SSE comments and WebSocket pings on an idle stream
+)
+
+// StreamEvent is an escrow event pushed to subscribers
+type StreamEvent struct {
+	ID            string    `json:"id"` // resume cursor, "<epoch>-<sequence>" with the sequence increasing across all escrows
+	Type          string    `json:"type"`
+	EscrowID      string    `json:"escrow_id"`
+	Timestamp     time.Time `json:"timestamp"`
+	Status        Status    `json:"status"`
+	Actor         string    `json:"actor"`
+	Action        string    `json:"action"`
+	Detail        string    `json:"detail,omitempty"`
+	AuditSequence int64     `json:"audit_sequence"` // the audit event behind it
+}
+
+// streamRecord is a published event with what subscriptions filter on
+type streamRecord struct {
+	event      StreamEvent
+	sequence   int64
+	merchantID string
+	parties    []string
+}
+
+// streamFilter selects the events a subscription receives, empty fields match everything
+type streamFilter struct {
+	EscrowID   string
+	Party      string
+	MerchantID string
+	Types      map[string]bool
+}
+
+// matches reports whether the record passes the filter
+func (f *streamFilter) matches(record streamRecord) bool {
+	if f.EscrowID != "" && record.event.EscrowID != f.EscrowID {
+		return false
+	}
+	if f.MerchantID != "" && record.merchantID != f.MerchantID {
+		return false
+	}
+	if len(f.Types) > 0 && !f.Types[record.event.Type] {
+		return false
+	}
+	if f.Party == "" {
+		return true
+	}
+	for _, party := range record.parties {
+		if strings.EqualFold(party, f.Party) {
+			return true
+		}
+	}
+	return false
+}
+
+// subscription receives the events matching its filter until it is dropped or unsubscribed
+type subscription struct {
+	filter *streamFilter
+	events chan StreamEvent // closed when the subscriber falls too far behind
+}
+
+// The stream is fed from the audit log, so auditMutex is held when streamMutex is taken
+var (
+	streamMutex    sync.Mutex
+	streamSequence int64
+	streamRecent   []streamRecord // the last streamBacklog events, oldest first
+	subscriptions  = make(map[*subscription]struct{})
+)
+
+// streamEpoch identifies this run of the service in cursors, the sequence starts over after a restart
+var streamEpoch = strconv.FormatInt(time.Now().UnixNano(), 36)
+
+// allowedOrigins are the browser origins WebSocket subscribers may connect from
+var allowedOrigins = make(map[string]bool)
+
+// SetAllowedOrigins configures the origins allowed to open WebSocket streams, the same as the CORS allow-list
+// "*" allows any origin
+func SetAllowedOrigins(origins []string) {
+	allowed := make(map[string]bool, len(origins))
+	for _, origin := range origins {
+		allowed[origin] = true
+	}
+	allowedOrigins = allowed
+}
+
+// errCursorExpired reports a resume cursor older than the events kept, or from before a restart
+var errCursorExpired = &requestError{http.StatusGone, errors.New("cursor expired"),
+	"Events after this cursor are no longer available, reload the escrow and subscribe without a cursor"}
+
+// isStreamEventType reports whether eventType is one of the escrow event types
+func isStreamEventType(eventType string) bool {
+	switch eventType {
+	case EventFunded, EventSignatureAdded, EventReleased, EventRefunded, EventDisputed:
+		return true
+	}
+	return false
+}
+
+// streamTypes returns the stream event types of an audit event, given the escrow's status before it
+func streamTypes(event AuditEvent, previous Status) []string {
+	var types []string
+	if strings.HasSuffix(event.Action, "_signed") {
+		types = append(types, EventSignatureAdded)
+	}
+	if event.ToStatus != previous {
+		switch event.ToStatus {
+		case StatusFunded:
+			types = append(types, EventFunded)
+		case StatusReleased:
+			types = append(types, EventReleased)
+		case StatusRefunded:
+			types = append(types, EventRefunded)
+		case StatusDisputed:
+			types = append(types, EventDisputed)
+		}
+	}
+	return types
+}
+
+// publishEvent pushes the stream events of an audit event to the matching subscriptions
+// It never blocks: a subscriber whose queue is full is dropped and must resume from its cursor
+func (e *Escrow) publishEvent(event AuditEvent, previous Status) {
+	types := streamTypes(event, previous)
+	if len(types) == 0 {
+		return
+	}
+
+	streamMutex.Lock()
+	defer streamMutex.Unlock()
+
+	for _, eventType := range types {
+		streamSequence++
+		record := streamRecord{
+			event: StreamEvent{
+				ID:            fmt.Sprintf("%s-%d", streamEpoch, streamSequence),
+				Type:          eventType,
+				EscrowID:      e.ID,
+				Timestamp:     event.Timestamp,
+				Status:        event.ToStatus,
+				Actor:         event.Actor,
+				Action:        event.Action,
+				Detail:        event.Detail,
+				AuditSequence: event.Sequence,
+			},
+			sequence:   streamSequence,
+			merchantID: e.MerchantID,
+			parties:    []string{e.BuyerPubKey, e.SellerPubKey, e.EscrowPubKey},
+		}
+
+		enqueueWebhooks(record)
+
+		streamRecent = append(streamRecent, record)
+		if len(streamRecent) > streamBacklog {
+			streamRecent = streamRecent[len(streamRecent)-streamBacklog:]
+		}
+
+		for sub := range subscriptions {
+			if !sub.filter.matches(record) {
+				continue
+			}
+			select {
+			case sub.events <- record.event:
+			default:
+				close(sub.events)
+				delete(subscriptions, sub)
+			}
+		}
+	}
+}
+
+// subscribe registers a subscription and returns the events after the cursor it missed, if resuming
+// Both happen under streamMutex, so no event is missed or sent twice in between
+func subscribe(filter *streamFilter, cursor int64, resume bool) (*subscription, []StreamEvent, error) {
+	streamMutex.Lock()
+	defer streamMutex.Unlock()
+
+	var missed []StreamEvent
+	if resume {
+		oldest := streamSequence + 1
+		if len(streamRecent) > 0 {
+			oldest = streamRecent[0].sequence
+		}
+		if cursor > streamSequence || cursor < oldest-1 {
+			return nil, nil, errCursorExpired
+		}
+		for _, record := range streamRecent {
+			if record.sequence > cursor && filter.matches(record) {
+				missed = append(missed, record.event)
+			}
+		}
+	}
+
+	sub := &subscription{filter: filter, events: make(chan StreamEvent, streamBuffer)}
+	subscriptions[sub] = struct{}{}
+	return sub, missed, nil
+}
+
+// unsubscribe stops delivery to the subscription
+func (s *subscription) unsubscribe() {
+	streamMutex.Lock()
+	defer streamMutex.Unlock()
+
+	delete(subscriptions, s)
+}
+
+// parseStreamFilter reads the filter from the query and limits it to the escrows the caller may read
+// A single escrow is authorized like any read of it, otherwise the scope is that of escrow listings
+func parseStreamFilter(r *http.Request) (*streamFilter, error) {
+	values := r.URL.Query()
+	filter := &streamFilter{EscrowID: values.Get("escrow_id"), Party: values.Get("party")}
+
+	if types := values.Get("types"); types != "" {
+		filter.Types = make(map[string]bool)
+		for _, eventType := range strings.Split(types, ",") {
+			eventType = strings.TrimSpace(eventType)
+			if !isStreamEventType(eventType) {
+				return nil, &requestError{http.StatusBadRequest, fmt.Errorf("unknown event type %q", eventType),
+					"types must be a comma-separated list of: funded, signature_added, released, refunded, or disputed"}
+			}
+			filter.Types[eventType] = true
+		}
+	}
+
+	if filter.EscrowID != "" {
+		return filter, viewEscrow(filter.EscrowID, func(escrow *Escrow) error {
+			return authorizeRead(r, escrow)
+		})
+	}
+
+	q := &escrowQuery{Party: filter.Party}
+	if err := scopeListQuery(r, q); err != nil {
+		return nil, err
+	}
+	filter.Party, filter.MerchantID = q.Party, q.MerchantID
+	return filter, nil
+}
+
+// streamCursor returns the sequence of the resume cursor from the cursor query parameter or, when an EventSource
+// reconnects, the Last-Event-ID header, and whether one was given. A cursor from another epoch is expired
+func streamCursor(r *http.Request) (int64, bool, error) {
+	cursor := r.URL.Query().Get("cursor")
+	if cursor == "" {
+		cursor = r.Header.Get("Last-Event-ID")
+	}
+	if cursor == "" {
+		return 0, false, nil
+	}
+
+	malformed := &requestError{http.StatusBadRequest, errors.New("malformed cursor"),
+		"The cursor must be the id of a previous event"}
+	dash := strings.LastIndex(cursor, "-")
+	if dash <= 0 {
+		return 0, false, malformed
+	}
+	parsed, err := strconv.ParseInt(cursor[dash+1:], 10, 64)
+	if err != nil || parsed < 0 {
+		return 0, false, malformed
+	}
+	if cursor[:dash] != streamEpoch {
+		return 0, false, errCursorExpired
+	}
+	return parsed, true, nil
+}
+
+// StreamEvents pushes escrow events as they happen, over Server-Sent Events or, when the request asks
+// to upgrade, a WebSocket. Clients that reconnect pass the id of the last event they saw as the cursor
+func StreamEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		utils.WriteErrorResponse(w, http.StatusMethodNotAllowed, errors.New("method not allowed"), "Only GET method is allowed")
+		return
+	}
+
+	// Browsers send WebSocket handshakes cross-origin without a CORS preflight, so the origin is checked here
+	if utils.IsWebSocketUpgrade(r) && !websocketOriginAllowed(r) {
+		utils.WriteErrorResponse(w, http.StatusForbidden, errors.New("origin not allowed"),
+			"WebSocket streams cannot be opened from this origin")
+		return
+	}
+
+	filter, err := parseStreamFilter(r)
+	if err != nil {
+		writeUpdateError(w, err)
+		return
+	}
+
+	cursor, resume, err := streamCursor(r)
+	if err != nil {
+		writeUpdateError(w, err)
+		return
+	}
+
+	if utils.IsWebSocketUpgrade(r) {
+		conn, err := utils.UpgradeWebSocket(w, r)
+		if err != nil {
+			utils.WriteErrorResponse(w, http.StatusBadRequest, err, "WebSocket handshake failed")
+			return
+		}
+		sub, missed, err := subscribe(filter, cursor, resume)
+		if err != nil {
+			conn.CloseWithReason(4410, err.(*requestError).message)
+			return
+		}
+		defer sub.unsubscribe()
+		streamWebSocket(conn, sub, missed)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		utils.WriteErrorResponse(w, http.StatusInternalServerError, errors.New("streaming unsupported"),
+			"The connection does not support streaming")
+		return
+	}
+	sub, missed, err := subscribe(filter, cursor, resume)
+	if err != nil {
+		writeUpdateError(w, err)
+		return
+	}
+	defer sub.unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	streamSSE(w, flusher, r, sub, missed)
+}
+
+// websocketOriginAllowed reports whether a WebSocket handshake comes from an allowed origin
+// Clients other than browsers send no Origin, and pages served by the service itself are same-origin
+func websocketOriginAllowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || allowedOrigins["*"] || allowedOrigins[origin] {
+		return true
+	}
+
+	parsed, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(parsed.Host, r.Host)
+}
+
+// streamSSE writes events as Server-Sent Events until the client goes away or falls behind
+func streamSSE(w http.ResponseWriter, flusher http.Flusher, r *http.Request, sub *subscription, missed []StreamEvent) {
+	write := func(event StreamEvent) error {
+		data, _ := json.Marshal(event)
+		_, err := fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+		flusher.Flush()
+		return err
+	}
+
+	for _, event := range missed {
+		if write(event) != nil {
+			return
+		}
+	}
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case event, ok := <-sub.events:
+			if !ok {
+				// The EventSource reconnects with Last-Event-ID
+				log.Printf("Dropped slow event stream subscriber")
+				return
+			}
+			if write(event) != nil {
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// streamWebSocket sends events as JSON text messages until the client closes or falls behind
+func streamWebSocket(conn *utils.WebSocketConn, sub *subscription, missed []StreamEvent) {
+	// Messages from the client are not used, reading only handles pings and notices the close
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	defer conn.Close()
+
+	write := func(event StreamEvent) error {
+		data, _ := json.Marshal(event)
+		return conn.WriteText(data)
+	}
+
+	for _, event := range missed {
+		if write(event) != nil {
+			return
+		}
+	}
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case event, ok := <-sub.events:
+			if !ok {
+				log.Printf("Dropped slow event stream subscriber")
+				conn.CloseWithReason(1013, "Subscriber fell behind, reconnect with the last cursor")
+				return
+			}
+			if write(event) != nil {
+				return
+			}
+		case <-keepAlive.C:
+			if conn.Ping() != nil {
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package escrow
+
+import (
+	"errors"
+	"escrow-service/auth"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestStreamCursorEpoch(t *testing.T) {
+	tests := []struct {
+		cursor   string
+		sequence int64
+		err      error
+	}{
+		{cursor: streamEpoch + "-42", sequence: 42},
+		{cursor: streamEpoch + "-0", sequence: 0},
+		{cursor: "0000000000-42", err: errCursorExpired},
+		{cursor: "42", err: errors.New("malformed cursor")},
+		{cursor: streamEpoch + "-", err: errors.New("malformed cursor")},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/?cursor="+test.cursor, nil)
+		sequence, resume, err := streamCursor(r)
+		switch {
+		case test.err == nil && err != nil:
+			t.Errorf("cursor %q: unexpected error: %v", test.cursor, err)
+		case test.err != nil && (err == nil || err.Error() != test.err.Error()):
+			t.Errorf("cursor %q: expected error %v, got %v", test.cursor, test.err, err)
+		case test.err == nil && (!resume || sequence != test.sequence):
+			t.Errorf("cursor %q: expected to resume after %d, got %d", test.cursor, test.sequence, sequence)
+		}
+	}
+}
+
+func TestStreamWebSocketOrigin(t *testing.T) {
+	SetAllowedOrigins([]string{"https://shop.example.com"})
+	defer SetAllowedOrigins(nil)
+
+	tests := []struct {
+		origin  string
+		allowed bool
+	}{
+		{origin: "", allowed: true},
+		{origin: "https://shop.example.com", allowed: true},
+		{origin: "http://example.com", allowed: true}, // the service's own origin
+		{origin: "https://evil.example.net", allowed: false},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, "http://example.com/api/escrow/events", nil)
+		r.Header.Set("Connection", "Upgrade")
+		r.Header.Set("Upgrade", "websocket")
+		if test.origin != "" {
+			r.Header.Set("Origin", test.origin)
+		}
+		if websocketOriginAllowed(r) != test.allowed {
+			t.Errorf("origin %q: expected allowed to be %v", test.origin, test.allowed)
+		}
+		if test.allowed {
+			continue
+		}
+
+		r = r.WithContext(auth.WithIdentity(r.Context(), testAdmin))
+		w := httptest.NewRecorder()
+		StreamEvents(w, r)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("origin %q: expected the handshake to be refused with 403, got %d", test.origin, w.Code)
+		}
+	}
+}
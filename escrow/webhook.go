@@ -0,0 +1,539 @@
+package escrow
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"escrow-service/auth"
+	"escrow-service/utils"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Webhook is a merchant's URL that escrow events are POSTed to
+type Webhook struct {
+	ID         string    `json:"id"`
+	MerchantID string    `json:"merchant_id"`
+	URL        string    `json:"url"`
+	EventTypes []string  `json:"event_types,omitempty"` // empty for every type
+	CreatedAt  time.Time `json:"created_at"`
+	secret     string    // signs deliveries, only returned when the webhook is registered
+}
+
+// wants reports whether the webhook is registered for the event type
+func (h *Webhook) wants(eventType string) bool {
+	if len(h.EventTypes) == 0 {
+		return true
+	}
+	for _, wanted := range h.EventTypes {
+		if wanted == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// DeliveryStatus is the state of a webhook delivery
+type DeliveryStatus string
+
+const (
+	DeliveryPending   DeliveryStatus = "pending"   // waiting for its next attempt
+	DeliveryDelivered DeliveryStatus = "delivered" // the receiver answered with a 2xx status
+	DeliveryDead      DeliveryStatus = "dead"      // every attempt failed, listed as a dead letter until redelivered
+)
+
+// WebhookDelivery is one event sent, or to be sent, to one webhook
+type WebhookDelivery struct {
+	ID             string         `json:"id"`
+	WebhookID      string         `json:"webhook_id"`
+	MerchantID     string         `json:"merchant_id"`
+	Event          StreamEvent    `json:"event"`
+	Status         DeliveryStatus `json:"status"`
+	Attempts       int            `json:"attempts"` // since it was queued or last redelivered
+	Redeliveries   int            `json:"redeliveries,omitempty"`
+	NextAttemptAt  *time.Time     `json:"next_attempt_at,omitempty"`
+	LastAttemptAt  *time.Time     `json:"last_attempt_at,omitempty"`
+	LastStatusCode int            `json:"last_status_code,omitempty"`
+	LastError      string         `json:"last_error,omitempty"`
+	CreatedAt      time.Time      `json:"created_at"`
+	DeliveredAt    *time.Time     `json:"delivered_at,omitempty"`
+	DeadAt         *time.Time     `json:"dead_at,omitempty"`
+	body           []byte         // the same body is sent on every attempt
+	inFlight       bool
+}
+
+// WebhookRetryPolicy controls how failed deliveries are retried
+// The delay doubles after each failed attempt, from BaseDelay up to MaxDelay
+type WebhookRetryPolicy struct {
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	MaxAttempts int // attempts before a delivery is dead
+}
+
+// webhookRetryPolicy retries for about two hours by default
+var webhookRetryPolicy = WebhookRetryPolicy{BaseDelay: 30 * time.Second, MaxDelay: time.Hour, MaxAttempts: 8}
+
+// How long finished deliveries are kept for redelivery. Dead letters are kept longer, to allow fixing the receiver
+const (
+	deliveredRetention = 24 * time.Hour
+	deadRetention      = 7 * 24 * time.Hour
+)
+
+// Deliveries only go to public addresses unless private ones are allowed, for local testing
+var (
+	allowPrivateWebhooks = false
+	webhookClient        = utils.NewWebhookClient(false)
+)
+
+// SetWebhookAllowPrivate configures whether webhooks may point at loopback, link-local and private addresses
+func SetWebhookAllowPrivate(allow bool) {
+	allowPrivateWebhooks = allow
+	webhookClient = utils.NewWebhookClient(allow)
+}
+
+// SetWebhookRetryPolicy configures how failed deliveries are retried
+func SetWebhookRetryPolicy(policy WebhookRetryPolicy) error {
+	if policy.BaseDelay <= 0 || policy.MaxDelay < policy.BaseDelay {
+		return fmt.Errorf("webhook retry delays must be positive with the maximum at least the base, got %s and %s",
+			policy.BaseDelay, policy.MaxDelay)
+	}
+	if policy.MaxAttempts < 1 {
+		return fmt.Errorf("webhooks must be attempted at least once, got %d", policy.MaxAttempts)
+	}
+	webhookRetryPolicy = policy
+	return nil
+}
+
+// retryDelay returns the wait after the given number of failed attempts
+func (p WebhookRetryPolicy) retryDelay(attempts int) time.Duration {
+	delay := p.BaseDelay
+	for i := 1; i < attempts && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	return delay
+}
+
+// Deliveries are queued from publishEvent, so streamMutex is held when webhooksMutex is taken
+var (
+	webhooksMutex sync.Mutex
+	webhooks      = make(map[string]*Webhook)
+	deliveries    = make(map[string]*WebhookDelivery)
+	webhookWake   = make(chan struct{}, 1) // wakes the dispatcher when a delivery is queued
+)
+
+// wakeDispatcher makes the dispatcher attempt due deliveries without waiting for its interval
+func wakeDispatcher() {
+	select {
+	case webhookWake <- struct{}{}:
+	default:
+	}
+}
+
+// enqueueWebhooks queues a delivery of the event to each of the escrow merchant's webhooks that wants it
+func enqueueWebhooks(record streamRecord) {
+	if record.merchantID == "" {
+		return
+	}
+
+	webhooksMutex.Lock()
+	defer webhooksMutex.Unlock()
+
+	queued := false
+	now := time.Now()
+	for _, hook := range webhooks {
+		if hook.MerchantID != record.merchantID || !hook.wants(record.event.Type) {
+			continue
+		}
+
+		id, err := utils.NewID("delivery")
+		if err != nil {
+			log.Printf("Failed to queue webhook %s for event %s: %v", hook.ID, record.event.ID, err)
+			continue
+		}
+		body, _ := json.Marshal(map[string]interface{}{
+			"delivery_id": id,
+			"webhook_id":  hook.ID,
+			"merchant_id": hook.MerchantID,
+			"event":       record.event,
+		})
+
+		deliveries[id] = &WebhookDelivery{
+			ID:            id,
+			WebhookID:     hook.ID,
+			MerchantID:    hook.MerchantID,
+			Event:         record.event,
+			Status:        DeliveryPending,
+			NextAttemptAt: &now,
+			CreatedAt:     now,
+			body:          body,
+		}
+		queued = true
+	}
+
+	if queued {
+		wakeDispatcher()
+	}
+}
+
+// postWebhook sends a delivery's body to the webhook, signed with its secret and the current time
+func postWebhook(hook Webhook, delivery *WebhookDelivery) (int, error) {
+	timestamp := time.Now().Unix()
+	headers := map[string]string{
+		utils.WebhookIDHeader:        hook.ID,
+		utils.WebhookDeliveryHeader:  delivery.ID,
+		utils.WebhookEventHeader:     delivery.Event.Type,
+		utils.WebhookTimestampHeader: strconv.FormatInt(timestamp, 10),
+		utils.WebhookSignatureHeader: utils.SignWebhook(hook.secret, timestamp, delivery.body),
+	}
+
+	resp, err := utils.MakeHTTPRequestWithHeaders(webhookClient, http.MethodPost, hook.URL, bytes.NewReader(delivery.body), headers)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("receiver responded with %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// ProcessWebhooks attempts every delivery that is due, concurrently, and schedules retries of those that fail
+func ProcessWebhooks(now time.Time) {
+	type attempt struct {
+		hook     Webhook
+		delivery *WebhookDelivery
+	}
+
+	webhooksMutex.Lock()
+	var due []attempt
+	for id, delivery := range deliveries {
+		switch {
+		case delivery.Status == DeliveryDelivered && now.Sub(*delivery.DeliveredAt) > deliveredRetention:
+			delete(deliveries, id)
+		case delivery.Status == DeliveryDead && now.Sub(*delivery.DeadAt) > deadRetention:
+			delete(deliveries, id)
+		case delivery.Status != DeliveryPending || delivery.inFlight || delivery.NextAttemptAt.After(now):
+		case webhooks[delivery.WebhookID] == nil:
+			delivery.Status, delivery.NextAttemptAt, delivery.LastError = DeliveryDead, nil, "webhook deleted"
+			delivery.DeadAt = &now
+		default:
+			delivery.inFlight = true
+			due = append(due, attempt{*webhooks[delivery.WebhookID], delivery})
+		}
+	}
+	webhooksMutex.Unlock()
+
+	var wg sync.WaitGroup
+	for _, a := range due {
+		wg.Add(1)
+		go func(a attempt) {
+			defer wg.Done()
+			code, err := postWebhook(a.hook, a.delivery)
+
+			webhooksMutex.Lock()
+			defer webhooksMutex.Unlock()
+
+			delivery := a.delivery
+			attemptedAt := time.Now()
+			delivery.inFlight = false
+			delivery.Attempts++
+			delivery.LastAttemptAt = &attemptedAt
+			delivery.LastStatusCode = code
+
+			switch {
+			case err == nil:
+				delivery.Status, delivery.NextAttemptAt, delivery.LastError = DeliveryDelivered, nil, ""
+				delivery.DeliveredAt = &attemptedAt
+			case delivery.Attempts >= webhookRetryPolicy.MaxAttempts:
+				delivery.Status, delivery.NextAttemptAt, delivery.LastError = DeliveryDead, nil, err.Error()
+				delivery.DeadAt = &attemptedAt
+				log.Printf("Webhook delivery %s to %s is dead after %d attempts: %v", delivery.ID, a.hook.URL,
+					delivery.Attempts, err)
+			default:
+				next := attemptedAt.Add(webhookRetryPolicy.retryDelay(delivery.Attempts))
+				delivery.NextAttemptAt, delivery.LastError = &next, err.Error()
+			}
+		}(a)
+	}
+	wg.Wait()
+}
+
+// StartWebhookDispatcher attempts due deliveries every interval, and as soon as new ones are queued
+func StartWebhookDispatcher(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case now := <-ticker.C:
+				ProcessWebhooks(now)
+			case <-webhookWake:
+				ProcessWebhooks(time.Now())
+			}
+		}
+	}()
+}
+
+// webhookMerchant returns the merchant whose webhooks the caller manages
+// Merchants manage their own, admins name the merchant
+func webhookMerchant(r *http.Request, merchantID string) (string, error) {
+	identity, err := callerIdentity(r)
+	if err != nil {
+		return "", err
+	}
+
+	switch identity.Role {
+	case auth.RoleAdmin:
+		if merchantID == "" {
+			return "", &requestError{http.StatusBadRequest, errors.New("missing required fields"),
+				"Admins must give the merchant ID"}
+		}
+		return merchantID, nil
+	case auth.RoleMerchant:
+		if identity.MerchantID == "" || (merchantID != "" && merchantID != identity.MerchantID) {
+			return "", &requestError{http.StatusForbidden, errors.New("forbidden"),
+				"Merchants can only manage their own webhooks"}
+		}
+		return identity.MerchantID, nil
+	}
+
+	return "", &requestError{http.StatusForbidden, errors.New("forbidden"), "Only merchants and admins can manage webhooks"}
+}
+
+// WebhookRequest registers a webhook
+type WebhookRequest struct {
+	URL        string   `json:"url"`
+	EventTypes []string `json:"event_types"`           // empty for every type
+	MerchantID string   `json:"merchant_id,omitempty"` // required for admins
+}
+
+// RegisterWebhook registers a URL to receive the merchant's escrow events
+// The signing secret is only returned here
+func RegisterWebhook(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		utils.WriteErrorResponse(w, http.StatusMethodNotAllowed, errors.New("method not allowed"), "Only POST method is allowed")
+		return
+	}
+
+	var req WebhookRequest
+	if err := utils.DecodeJSONBody(r, &req); err != nil {
+		utils.WriteErrorResponse(w, http.StatusBadRequest, err, "Invalid request payload")
+		return
+	}
+
+	merchantID, err := webhookMerchant(r, req.MerchantID)
+	if err != nil {
+		writeUpdateError(w, err)
+		return
+	}
+
+	// Validate request, the URL must not reach the service's own network
+	if err := utils.CheckWebhookURL(req.URL, allowPrivateWebhooks); err != nil {
+		utils.WriteErrorResponse(w, http.StatusBadRequest, err, "URL must be an absolute http or https URL of a public host")
+		return
+	}
+	for _, eventType := range req.EventTypes {
+		if !isStreamEventType(eventType) {
+			utils.WriteErrorResponse(w, http.StatusBadRequest, fmt.Errorf("unknown event type %q", eventType),
+				"Event types must be: funded, signature_added, released, refunded, or disputed")
+			return
+		}
+	}
+
+	id, err := utils.NewID("webhook")
+	if err != nil {
+		utils.WriteErrorResponse(w, http.StatusInternalServerError, err, "Failed to register webhook")
+		return
+	}
+	secret, err := utils.NewWebhookSecret()
+	if err != nil {
+		utils.WriteErrorResponse(w, http.StatusInternalServerError, err, "Failed to register webhook")
+		return
+	}
+
+	hook := &Webhook{
+		ID:         id,
+		MerchantID: merchantID,
+		URL:        req.URL,
+		EventTypes: req.EventTypes,
+		CreatedAt:  time.Now(),
+		secret:     secret,
+	}
+
+	webhooksMutex.Lock()
+	webhooks[id] = hook
+	webhooksMutex.Unlock()
+
+	log.Printf("Registered webhook %s for merchant %s at %s", id, merchantID, req.URL)
+	utils.WriteJSONResponse(w, http.StatusCreated, map[string]interface{}{
+		"webhook": hook,
+		"secret":  secret, // only returned once
+	})
+}
+
+// ListWebhooks lists the merchant's webhooks
+func ListWebhooks(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		utils.WriteErrorResponse(w, http.StatusMethodNotAllowed, errors.New("method not allowed"), "Only GET method is allowed")
+		return
+	}
+
+	merchantID, err := webhookMerchant(r, r.URL.Query().Get("merchant_id"))
+	if err != nil {
+		writeUpdateError(w, err)
+		return
+	}
+
+	webhooksMutex.Lock()
+	list := make([]Webhook, 0)
+	for _, hook := range webhooks {
+		if hook.MerchantID == merchantID {
+			list = append(list, *hook)
+		}
+	}
+	webhooksMutex.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+
+	utils.WriteJSONResponse(w, http.StatusOK, map[string]interface{}{
+		"merchant_id": merchantID,
+		"webhooks":    list,
+		"count":       len(list),
+	})
+}
+
+// DeleteWebhook removes a webhook, its pending deliveries become dead letters
+func DeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		utils.WriteErrorResponse(w, http.StatusMethodNotAllowed, errors.New("method not allowed"), "Only POST method is allowed")
+		return
+	}
+
+	var req struct {
+		WebhookID string `json:"webhook_id"`
+	}
+	if err := utils.DecodeJSONBody(r, &req); err != nil {
+		utils.WriteErrorResponse(w, http.StatusBadRequest, err, "Invalid request payload")
+		return
+	}
+
+	webhooksMutex.Lock()
+	hook := webhooks[req.WebhookID]
+	webhooksMutex.Unlock()
+	if hook == nil {
+		utils.WriteErrorResponse(w, http.StatusNotFound, errors.New("webhook not found"), "Webhook not found")
+		return
+	}
+	if _, err := webhookMerchant(r, hook.MerchantID); err != nil {
+		writeUpdateError(w, err)
+		return
+	}
+
+	webhooksMutex.Lock()
+	delete(webhooks, hook.ID)
+	webhooksMutex.Unlock()
+
+	log.Printf("Deleted webhook %s of merchant %s", hook.ID, hook.MerchantID)
+	utils.WriteJSONResponse(w, http.StatusOK, map[string]interface{}{
+		"webhook_id": hook.ID,
+		"deleted":    true,
+	})
+}
+
+// ListDeadLetters lists the merchant's deliveries that failed every attempt, oldest first
+func ListDeadLetters(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		utils.WriteErrorResponse(w, http.StatusMethodNotAllowed, errors.New("method not allowed"), "Only GET method is allowed")
+		return
+	}
+
+	merchantID, err := webhookMerchant(r, r.URL.Query().Get("merchant_id"))
+	if err != nil {
+		writeUpdateError(w, err)
+		return
+	}
+	webhookID := r.URL.Query().Get("webhook_id")
+
+	webhooksMutex.Lock()
+	list := make([]WebhookDelivery, 0)
+	for _, delivery := range deliveries {
+		if delivery.Status == DeliveryDead && delivery.MerchantID == merchantID &&
+			(webhookID == "" || delivery.WebhookID == webhookID) {
+			list = append(list, *delivery)
+		}
+	}
+	webhooksMutex.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+
+	utils.WriteJSONResponse(w, http.StatusOK, map[string]interface{}{
+		"merchant_id":  merchantID,
+		"dead_letters": list,
+		"count":        len(list),
+	})
+}
+
+// RedeliverWebhook queues a dead or delivered delivery again, with a fresh set of attempts
+func RedeliverWebhook(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		utils.WriteErrorResponse(w, http.StatusMethodNotAllowed, errors.New("method not allowed"), "Only POST method is allowed")
+		return
+	}
+
+	var req struct {
+		DeliveryID string `json:"delivery_id"`
+	}
+	if err := utils.DecodeJSONBody(r, &req); err != nil {
+		utils.WriteErrorResponse(w, http.StatusBadRequest, err, "Invalid request payload")
+		return
+	}
+
+	webhooksMutex.Lock()
+	defer webhooksMutex.Unlock()
+
+	delivery := deliveries[req.DeliveryID]
+	if delivery == nil {
+		utils.WriteErrorResponse(w, http.StatusNotFound, errors.New("delivery not found"), "Delivery not found")
+		return
+	}
+	if _, err := webhookMerchant(r, delivery.MerchantID); err != nil {
+		writeUpdateError(w, err)
+		return
+	}
+
+	switch {
+	case delivery.Status == DeliveryPending:
+		utils.WriteErrorResponse(w, http.StatusConflict, errors.New("delivery pending"),
+			"The delivery is still being attempted")
+		return
+	case webhooks[delivery.WebhookID] == nil:
+		utils.WriteErrorResponse(w, http.StatusConflict, errors.New("webhook deleted"),
+			"The webhook of this delivery has been deleted")
+		return
+	}
+
+	now := time.Now()
+	delivery.Status = DeliveryPending
+	delivery.Attempts = 0
+	delivery.Redeliveries++
+	delivery.NextAttemptAt = &now
+	delivery.DeliveredAt = nil
+	delivery.DeadAt = nil
+	wakeDispatcher()
+
+	log.Printf("Redelivering webhook delivery %s", delivery.ID)
+	utils.WriteJSONResponse(w, http.StatusAccepted, map[string]interface{}{
+		"delivery": delivery,
+	})
+}
@@ -0,0 +1,275 @@
+package escrow
+
+import (
+	"encoding/json"
+	"escrow-service/auth"
+	"escrow-service/utils"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var testMerchant = &auth.Identity{ID: "test-merchant", Role: auth.RoleMerchant, MerchantID: "test-shop"}
+
+// webhookReceiver is a merchant endpoint recording the deliveries it receives
+type webhookReceiver struct {
+	mu       sync.Mutex
+	status   int
+	received []*http.Request
+	bodies   [][]byte
+}
+
+// ServeHTTP records the delivery and answers with the receiver's current status
+func (rec *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.received = append(rec.received, r)
+	rec.bodies = append(rec.bodies, body)
+	w.WriteHeader(rec.status)
+}
+
+// setStatus changes the status the receiver answers with
+func (rec *webhookReceiver) setStatus(status int) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.status = status
+}
+
+// count returns the number of deliveries received
+func (rec *webhookReceiver) count() int {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return len(rec.received)
+}
+
+// registerTestWebhook starts a receiver and registers it for the test merchant's funded events,
+// returning the receiver, the webhook ID and its secret. Private addresses are allowed until the test ends
+func registerTestWebhook(t *testing.T, status int) (*webhookReceiver, string, string) {
+	t.Helper()
+
+	receiver := &webhookReceiver{status: status}
+	server := httptest.NewServer(receiver)
+	t.Cleanup(server.Close)
+
+	SetWebhookAllowPrivate(true)
+	t.Cleanup(func() { SetWebhookAllowPrivate(false) })
+
+	response := mustCall(t, RegisterWebhook, testMerchant, WebhookRequest{
+		URL:        server.URL + "/escrow-events",
+		EventTypes: []string{EventFunded},
+	}, http.StatusCreated)
+	hookID := response["webhook"].(map[string]interface{})["id"].(string)
+	t.Cleanup(func() {
+		webhooksMutex.Lock()
+		delete(webhooks, hookID)
+		webhooksMutex.Unlock()
+	})
+	return receiver, hookID, response["secret"].(string)
+}
+
+// fundMerchantEscrow creates and funds an escrow of the test merchant, which queues its funded webhooks
+func fundMerchantEscrow(t *testing.T) string {
+	t.Helper()
+
+	response := mustCall(t, CreateEscrow, testMerchant, EscrowRequest{
+		BuyerPubKey:  testBuyerPubKey,
+		SellerPubKey: testSellerPubKey,
+		EscrowPubKey: testEscrowPubKey,
+		Amount:       70000,
+	}, http.StatusCreated)
+	id := response["id"].(string)
+	depositTestFunds(t, id, 70000, 1)
+	mustCall(t, VerifyPayment, testMerchant, map[string]string{"escrow_id": id}, http.StatusOK)
+	return id
+}
+
+// webhookDelivery returns a copy of the webhook's only delivery
+func webhookDelivery(t *testing.T, hookID string) WebhookDelivery {
+	t.Helper()
+
+	webhooksMutex.Lock()
+	defer webhooksMutex.Unlock()
+
+	var found []WebhookDelivery
+	for _, delivery := range deliveries {
+		if delivery.WebhookID == hookID {
+			found = append(found, *delivery)
+		}
+	}
+	if len(found) != 1 {
+		t.Fatalf("expected one delivery for webhook %s, got %d", hookID, len(found))
+	}
+	return found[0]
+}
+
+func TestWebhookDeliverySigned(t *testing.T) {
+	receiver, hookID, secret := registerTestWebhook(t, http.StatusOK)
+	id := fundMerchantEscrow(t)
+
+	ProcessWebhooks(time.Now())
+	if receiver.count() != 1 {
+		t.Fatalf("expected one delivery, got %d", receiver.count())
+	}
+
+	r, body := receiver.received[0], receiver.bodies[0]
+	err := utils.VerifyWebhook(secret, r.Header.Get(utils.WebhookTimestampHeader),
+		r.Header.Get(utils.WebhookSignatureHeader), body, 5*time.Minute, time.Now())
+	if err != nil {
+		t.Errorf("delivery signature does not verify: %v", err)
+	}
+	if err := utils.VerifyWebhook("whsec_other", r.Header.Get(utils.WebhookTimestampHeader),
+		r.Header.Get(utils.WebhookSignatureHeader), body, 5*time.Minute, time.Now()); err == nil {
+		t.Errorf("expected the signature not to verify with another secret")
+	}
+	if r.Header.Get(utils.WebhookIDHeader) != hookID || r.Header.Get(utils.WebhookEventHeader) != EventFunded {
+		t.Errorf("unexpected delivery headers: %v", r.Header)
+	}
+
+	var payload struct {
+		WebhookID string      `json:"webhook_id"`
+		Event     StreamEvent `json:"event"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		t.Fatalf("invalid delivery body: %v", err)
+	}
+	if payload.WebhookID != hookID || payload.Event.EscrowID != id || payload.Event.Type != EventFunded {
+		t.Errorf("unexpected delivery body: %s", body)
+	}
+
+	if delivery := webhookDelivery(t, hookID); delivery.Status != DeliveryDelivered || delivery.DeliveredAt == nil {
+		t.Errorf("expected the delivery to be delivered, got %s", delivery.Status)
+	}
+}
+
+func TestWebhookRetryDeadLetterAndRedelivery(t *testing.T) {
+	defaultPolicy := webhookRetryPolicy
+	defer SetWebhookRetryPolicy(defaultPolicy)
+	if err := SetWebhookRetryPolicy(WebhookRetryPolicy{BaseDelay: time.Minute, MaxDelay: 3 * time.Minute, MaxAttempts: 3}); err != nil {
+		t.Fatal(err)
+	}
+
+	receiver, hookID, _ := registerTestWebhook(t, http.StatusInternalServerError)
+	fundMerchantEscrow(t)
+	start := time.Now()
+
+	// The delay doubles after each failed attempt, and nothing is attempted before it is due
+	for attempt, delay := range []time.Duration{time.Minute, 2 * time.Minute} {
+		ProcessWebhooks(time.Now().Add(4 * time.Minute * time.Duration(attempt)))
+		delivery := webhookDelivery(t, hookID)
+		if delivery.Status != DeliveryPending || delivery.Attempts != attempt+1 || delivery.LastStatusCode != 500 {
+			t.Fatalf("attempt %d: expected a pending delivery with %d attempts, got %+v", attempt+1, attempt+1, delivery)
+		}
+		if got := delivery.NextAttemptAt.Sub(*delivery.LastAttemptAt); got != delay {
+			t.Errorf("attempt %d: expected a retry after %s, got %s", attempt+1, delay, got)
+		}
+
+		ProcessWebhooks(delivery.NextAttemptAt.Add(-time.Second))
+		if receiver.count() != attempt+1 {
+			t.Errorf("attempt %d: expected no attempt before the retry is due", attempt+1)
+		}
+	}
+
+	// The last attempt fails too, the delivery is a dead letter
+	ProcessWebhooks(start.Add(10 * time.Minute))
+	delivery := webhookDelivery(t, hookID)
+	if delivery.Status != DeliveryDead || delivery.Attempts != 3 || delivery.DeadAt == nil || delivery.NextAttemptAt != nil {
+		t.Fatalf("expected a dead delivery after 3 attempts, got %+v", delivery)
+	}
+	ProcessWebhooks(start.Add(time.Hour))
+	if receiver.count() != 3 {
+		t.Errorf("expected dead deliveries not to be attempted, got %d attempts", receiver.count())
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/?webhook_id="+hookID, nil)
+	r = r.WithContext(auth.WithIdentity(r.Context(), testMerchant))
+	w := httptest.NewRecorder()
+	ListDeadLetters(w, r)
+	if !strings.Contains(w.Body.String(), delivery.ID) {
+		t.Errorf("expected the dead letter to be listed, got %s", w.Body.String())
+	}
+
+	// Redelivered once the receiver is fixed, with a fresh set of attempts
+	receiver.setStatus(http.StatusNoContent)
+	response := mustCall(t, RedeliverWebhook, testMerchant, map[string]string{"delivery_id": delivery.ID}, http.StatusAccepted)
+	if status := response["delivery"].(map[string]interface{})["status"]; status != string(DeliveryPending) {
+		t.Errorf("expected the redelivery to be pending, got %v", status)
+	}
+	ProcessWebhooks(time.Now())
+
+	delivery = webhookDelivery(t, hookID)
+	if delivery.Status != DeliveryDelivered || delivery.Attempts != 1 || delivery.Redeliveries != 1 || delivery.DeadAt != nil {
+		t.Errorf("expected the redelivery to be delivered on its first attempt, got %+v", delivery)
+	}
+}
+
+func TestWebhookDeadLetterRetention(t *testing.T) {
+	defaultPolicy := webhookRetryPolicy
+	defer SetWebhookRetryPolicy(defaultPolicy)
+	if err := SetWebhookRetryPolicy(WebhookRetryPolicy{BaseDelay: time.Minute, MaxDelay: time.Minute, MaxAttempts: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	_, hookID, _ := registerTestWebhook(t, http.StatusBadGateway)
+	fundMerchantEscrow(t)
+	ProcessWebhooks(time.Now())
+
+	delivery := webhookDelivery(t, hookID)
+	if delivery.Status != DeliveryDead {
+		t.Fatalf("expected a dead delivery, got %s", delivery.Status)
+	}
+
+	ProcessWebhooks(delivery.DeadAt.Add(deadRetention - time.Minute))
+	webhookDelivery(t, hookID)
+
+	ProcessWebhooks(delivery.DeadAt.Add(deadRetention + time.Minute))
+	webhooksMutex.Lock()
+	_, kept := deliveries[delivery.ID]
+	webhooksMutex.Unlock()
+	if kept {
+		t.Errorf("expected the dead letter to be removed after %s", deadRetention)
+	}
+}
+
+func TestWebhookPrivateDestinations(t *testing.T) {
+	for _, url := range []string{
+		"http://127.0.0.1:8080/hook",
+		"http://localhost/hook",
+		"http://[::1]/hook",
+		"http://169.254.169.254/latest/meta-data",
+		"http://10.1.2.3/hook",
+		"http://172.16.0.1/hook",
+		"https://192.168.1.10/hook",
+		"http://0.0.0.0/hook",
+		"ftp://example.com/hook",
+	} {
+		code, _ := callHandler(t, RegisterWebhook, testMerchant, WebhookRequest{URL: url})
+		if code != http.StatusBadRequest {
+			t.Errorf("%s: expected registration to be refused with 400, got %d", url, code)
+		}
+	}
+
+	// A public address literal needs no resolution
+	response := mustCall(t, RegisterWebhook, testMerchant, WebhookRequest{URL: "https://93.184.216.34/hook"}, http.StatusCreated)
+	webhooksMutex.Lock()
+	delete(webhooks, response["webhook"].(map[string]interface{})["id"].(string))
+	webhooksMutex.Unlock()
+
+	// A webhook reaching a private address once registered is refused when the delivery connects
+	receiver, hookID, _ := registerTestWebhook(t, http.StatusOK)
+	SetWebhookAllowPrivate(false)
+	fundMerchantEscrow(t)
+	ProcessWebhooks(time.Now())
+
+	if receiver.count() != 0 {
+		t.Errorf("expected no delivery to reach a loopback receiver")
+	}
+	if delivery := webhookDelivery(t, hookID); !strings.Contains(delivery.LastError, "not a public address") {
+		t.Errorf("expected the connection to be refused, got %q", delivery.LastError)
+	}
+}
@@ -1,25 +1,79 @@
 package main
 
 import (
+	"escrow-service/auth"
 	"escrow-service/escrow"
 	"escrow-service/utils"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // Define API routes
-func setupRoutes() {
-	// Escrow API endpoints
-	http.HandleFunc("/api/escrow/create", escrow.CreateEscrow)
-	http.HandleFunc("/api/escrow/release", escrow.ReleaseEscrow)
-	http.HandleFunc("/api/escrow/refund", escrow.RefundEscrow)
-	http.HandleFunc("/api/escrow/verify-payment", escrow.VerifyPayment)
-	http.HandleFunc("/api/escrow/get", escrow.GetEscrow)
+// POST endpoints are wrapped so retries carrying an Idempotency-Key replay the first response
+func setupRoutes(idempotency *utils.IdempotencyStore) {
+	// Escrow API endpoints (authenticated, each action is authorized against the caller's role on the escrow)
+	http.HandleFunc("/api/escrow/create", auth.RequireAuth(idempotency.Wrap(escrow.CreateEscrow)))
+	http.HandleFunc("/api/escrow/release", auth.RequireAuth(idempotency.Wrap(escrow.ReleaseEscrow)))
+	http.HandleFunc("/api/escrow/refund", auth.RequireAuth(idempotency.Wrap(escrow.RefundEscrow)))
+	http.HandleFunc("/api/escrow/verify-payment", auth.RequireAuth(idempotency.Wrap(escrow.VerifyPayment)))
+	http.HandleFunc("/api/escrow/cancel", auth.RequireAuth(idempotency.Wrap(escrow.CancelEscrow)))
+	http.HandleFunc("/api/escrow/get", escrow.GetEscrow)               // also accepts a per-escrow access token
+	http.HandleFunc("/api/escrow/recovery-kit", escrow.GetRecoveryKit) // also accepts a per-escrow access token
+	http.HandleFunc("/api/escrow/fee-quote", escrow.GetFeeQuote)       // also accepts a per-escrow access token
+	http.HandleFunc("/api/escrow/list", auth.RequireAuth(escrow.ListEscrows))
+	http.HandleFunc("/api/escrow/history", escrow.GetHistory)        // also accepts a per-escrow access token
+	http.HandleFunc("/api/escrow/events", escrow.StreamEvents)       // SSE or WebSocket, also accepts a per-escrow access token
+	http.HandleFunc("/api/escrow/payment-uri", escrow.GetPaymentURI) // also accepts a per-escrow access token
+	http.HandleFunc("/api/escrow/payment-qr", escrow.GetPaymentQR)   // also accepts a per-escrow access token
+	http.HandleFunc("/api/escrow/milestone/release", auth.RequireAuth(idempotency.Wrap(escrow.ReleaseMilestone)))
+
+	// Dispute endpoints: parties open and argue a dispute, an arbitrator decides it
+	http.HandleFunc("/api/escrow/dispute/open", auth.RequireAuth(idempotency.Wrap(escrow.OpenDispute)))
+	http.HandleFunc("/api/escrow/dispute/statement", auth.RequireAuth(idempotency.Wrap(escrow.AddDisputeStatement)))
+	http.HandleFunc("/api/escrow/dispute/decide", auth.RequireAuth(idempotency.Wrap(escrow.DecideDispute)))
+
+	// Settlement endpoints: divide the escrowed amount between several outputs
+	http.HandleFunc("/api/escrow/settlement/propose", auth.RequireAuth(idempotency.Wrap(escrow.ProposeSettlement)))
+	http.HandleFunc("/api/escrow/settlement/sign", auth.RequireAuth(idempotency.Wrap(escrow.SignSettlement)))
+	http.HandleFunc("/api/escrow/settlement/cancel", auth.RequireAuth(idempotency.Wrap(escrow.CancelSettlement)))
+
+	// Fee bump endpoints: replace (RBF) or spend (CPFP) an unconfirmed payout to raise its fee
+	http.HandleFunc("/api/escrow/fee-bump/propose", auth.RequireAuth(idempotency.Wrap(escrow.ProposeFeeBump)))
+	http.HandleFunc("/api/escrow/fee-bump/sign", auth.RequireAuth(idempotency.Wrap(escrow.SignFeeBump)))
+	http.HandleFunc("/api/escrow/fee-bump/cpfp", auth.RequireAuth(idempotency.Wrap(escrow.CreateCPFP)))
+
+	// Batch endpoints: sign an escrow's inputs of the batched payout it is queued for
+	http.HandleFunc("/api/escrow/batch", escrow.GetBatch) // also accepts a per-escrow access token
+	http.HandleFunc("/api/escrow/batch/sign", auth.RequireAuth(idempotency.Wrap(escrow.SignBatch)))
+
+	// Proof-of-key login: sign a nonce with the escrow key to get a session token
+	http.HandleFunc("/api/auth/challenge", auth.IssueChallenge)
+	http.HandleFunc("/api/auth/verify", auth.VerifyChallenge)
+
+	// Admin-only endpoints
+	http.HandleFunc("/api/admin/credentials", auth.RequireAdmin(idempotency.Wrap(auth.IssueCredential)))
+	http.HandleFunc("/api/admin/credentials/revoke", auth.RequireAdmin(idempotency.Wrap(auth.RevokeCredential)))
+	http.HandleFunc("/api/admin/service-fees", auth.RequireAdmin(escrow.GetServiceFees))
+
+	// Webhook endpoints: merchants register URLs that escrow events are POSTed to
+	http.HandleFunc("/api/webhooks", auth.RequireAuth(escrow.ListWebhooks))
+	http.HandleFunc("/api/webhooks/register", auth.RequireAuth(idempotency.Wrap(escrow.RegisterWebhook)))
+	http.HandleFunc("/api/webhooks/delete", auth.RequireAuth(idempotency.Wrap(escrow.DeleteWebhook)))
+	http.HandleFunc("/api/webhooks/dead-letters", auth.RequireAuth(escrow.ListDeadLetters))
+	http.HandleFunc("/api/webhooks/redeliver", auth.RequireAuth(idempotency.Wrap(escrow.RedeliverWebhook)))
+
+	// Mock chain endpoints: simulate deposits and confirmations when no chain backend is configured
+	http.HandleFunc("/api/admin/mock-chain/deposit", auth.RequireAdmin(idempotency.Wrap(escrow.MockDeposit)))
+	http.HandleFunc("/api/admin/mock-chain/confirm", auth.RequireAdmin(idempotency.Wrap(escrow.MockConfirm)))
+	http.HandleFunc("/api/admin/mock-chain/double-spend", auth.RequireAdmin(idempotency.Wrap(escrow.MockDoubleSpend)))
 
 	// BIP70 Payment Protocol endpoints
-	http.HandleFunc("/api/pay/request/", escrow.HandlePaymentRequest) // endpoint for getting payment requests
-	http.HandleFunc("/api/pay/", escrow.HandlePayment)                // endpoint for receiving payments
+	http.HandleFunc("/api/pay/request/", escrow.HandlePaymentRequest)    // endpoint for getting payment requests
+	http.HandleFunc("/api/pay/", idempotency.Wrap(escrow.HandlePayment)) // endpoint for receiving payments
 
 	// Health check endpoint
 	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
@@ -46,6 +100,46 @@ func setupRoutes() {
 				"/api/escrow/refund",
 				"/api/escrow/verify-payment",
 				"/api/escrow/get",
+				"/api/escrow/recovery-kit",
+				"/api/escrow/fee-quote",
+				"/api/escrow/list",
+				"/api/escrow/history",
+				"/api/escrow/events",
+				"/api/escrow/payment-uri",
+				"/api/escrow/payment-qr",
+				"/api/escrow/milestone/release",
+				// Dispute endpoints
+				"/api/escrow/dispute/open",
+				"/api/escrow/dispute/statement",
+				"/api/escrow/dispute/decide",
+				// Settlement endpoints
+				"/api/escrow/settlement/propose",
+				"/api/escrow/settlement/sign",
+				"/api/escrow/settlement/cancel",
+				// Fee bump endpoints
+				"/api/escrow/fee-bump/propose",
+				"/api/escrow/fee-bump/sign",
+				"/api/escrow/fee-bump/cpfp",
+				// Batch endpoints
+				"/api/escrow/batch",
+				"/api/escrow/batch/sign",
+				// Authentication endpoints
+				"/api/auth/challenge",
+				"/api/auth/verify",
+				// Admin endpoints
+				"/api/admin/credentials",
+				"/api/admin/credentials/revoke",
+				"/api/admin/service-fees",
+				// Webhook endpoints
+				"/api/webhooks",
+				"/api/webhooks/register",
+				"/api/webhooks/delete",
+				"/api/webhooks/dead-letters",
+				"/api/webhooks/redeliver",
+				// Mock chain endpoints
+				"/api/admin/mock-chain/deposit",
+				"/api/admin/mock-chain/confirm",
+				"/api/admin/mock-chain/double-spend",
 				// BIP70 endpoints
 				"/api/pay/request/{requestID}",
 				"/api/pay/{requestID}",
@@ -55,13 +149,37 @@ func setupRoutes() {
 	})
 }
 
+// corsAllowedOrigins returns the origins listed in CORS_ALLOWED_ORIGINS (comma-separated); "*" allows any origin
+func corsAllowedOrigins() []string {
+	var origins []string
+	for _, origin := range strings.Split(os.Getenv("CORS_ALLOWED_ORIGINS"), ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			origins = append(origins, origin)
+		}
+	}
+	return origins
+}
+
 // CORS middleware
+// Only origins listed in CORS_ALLOWED_ORIGINS are allowed
 func corsMiddleware(next http.Handler) http.Handler {
+	allowedOrigins := make(map[string]bool)
+	for _, origin := range corsAllowedOrigins() {
+		allowedOrigins[origin] = true
+	}
+
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Set CORS headers
-		w.Header().Set("Access-Control-Allow-Origin", "*")
+		origin := r.Header.Get("Origin")
+		if allowedOrigins["*"] {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		} else if allowedOrigins[origin] {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Add("Vary", "Origin")
+		}
 		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-API-Key, If-Match, Idempotency-Key, X-Escrow-Token")
+		w.Header().Set("Access-Control-Expose-Headers", "ETag")
 
 		// Handle preflight requests
 		if r.Method == "OPTIONS" {
@@ -83,11 +201,214 @@ func loggingMiddleware(next http.Handler) http.Handler {
 }
 
 func main() {
-	// Set up routes
-	setupRoutes()
+	// Keep idempotent responses for IDEMPOTENCY_WINDOW (default 24h)
+	idempotencyWindow := 24 * time.Hour
+	if window := os.Getenv("IDEMPOTENCY_WINDOW"); window != "" {
+		parsed, err := time.ParseDuration(window)
+		if err != nil {
+			log.Fatalf("Invalid IDEMPOTENCY_WINDOW: %v", err)
+		}
+		idempotencyWindow = parsed
+	}
+
+	// Set up routes, idempotency keys are scoped to the caller
+	setupRoutes(utils.NewIdempotencyStore(idempotencyWindow, auth.CallerID))
+
+	// Payment request URLs given to wallets start with PUBLIC_BASE_URL (default http://localhost:8080)
+	if baseURL := os.Getenv("PUBLIC_BASE_URL"); baseURL != "" {
+		if err := utils.SetPublicBaseURL(baseURL); err != nil {
+			log.Fatalf("Invalid PUBLIC_BASE_URL: %v", err)
+		}
+	}
+
+	// Use the remote signer daemon for the escrow service key if configured.
+	// Its public key is fetched now and cached, so requests only reach the daemon to sign
+	if signerURL := os.Getenv("ESCROW_SIGNER_URL"); signerURL != "" {
+		signer := escrow.NewRemoteSigner(signerURL, os.Getenv("ESCROW_SIGNER_TOKEN"))
+		pubKey, err := signer.PublicKey()
+		if err != nil {
+			log.Fatalf("Failed to reach the escrow signer at %s: %v", signerURL, err)
+		}
+		escrow.SetServiceSigner(signer)
+		log.Printf("Using remote escrow signer at %s with public key %s", signerURL, pubKey)
+	}
+
+	// Read fee estimates and deposits from an Esplora API at CHAIN_BACKEND_URL, or from the mock chain
+	if chainURL := os.Getenv("CHAIN_BACKEND_URL"); chainURL != "" {
+		escrow.SetChainBackend(escrow.NewEsploraChain(chainURL))
+		log.Printf("Using Esplora chain backend at %s", chainURL)
+	}
+
+	// Deposits count towards funding once they have FUNDING_CONFIRMATIONS confirmations (default 1).
+	// Payments short or over by up to FUNDING_TOLERANCE satoshis (default 1000) are accepted as is,
+	// larger overpayments follow OVERPAYMENT_POLICY: refund (default) or release
+	fundingPolicy := escrow.FundingPolicy{Confirmations: 1, Tolerance: 1000, Overpayment: escrow.OverpaymentRefund}
+	if confirmations := os.Getenv("FUNDING_CONFIRMATIONS"); confirmations != "" {
+		parsed, err := strconv.ParseInt(confirmations, 10, 64)
+		if err != nil {
+			log.Fatalf("Invalid FUNDING_CONFIRMATIONS: %v", err)
+		}
+		fundingPolicy.Confirmations = parsed
+	}
+	if tolerance := os.Getenv("FUNDING_TOLERANCE"); tolerance != "" {
+		parsed, err := strconv.ParseInt(tolerance, 10, 64)
+		if err != nil {
+			log.Fatalf("Invalid FUNDING_TOLERANCE: %v", err)
+		}
+		fundingPolicy.Tolerance = parsed
+	}
+	if policy := os.Getenv("OVERPAYMENT_POLICY"); policy != "" {
+		fundingPolicy.Overpayment = escrow.OverpaymentAction(policy)
+	}
+	if err := escrow.SetFundingPolicy(fundingPolicy); err != nil {
+		log.Fatalf("Invalid funding policy: %v", err)
+	}
+
+	// The service charges SERVICE_FEE_PERCENT of each escrow, kept between SERVICE_FEE_MIN and SERVICE_FEE_MAX,
+	// or SERVICE_FEE_FLAT satoshis, paid to SERVICE_FEE_ADDRESS at SERVICE_FEE_CHARGE_AT: release (default) or funding
+	serviceFeePolicy := escrow.ServiceFeePolicy{ChargeAt: escrow.ServiceFeeAtRelease, Address: os.Getenv("SERVICE_FEE_ADDRESS")}
+	if percent := os.Getenv("SERVICE_FEE_PERCENT"); percent != "" {
+		parsed, err := strconv.ParseFloat(percent, 64)
+		if err != nil {
+			log.Fatalf("Invalid SERVICE_FEE_PERCENT: %v", err)
+		}
+		serviceFeePolicy.Percent = parsed
+	}
+	for name, value := range map[string]*int64{
+		"SERVICE_FEE_FLAT": &serviceFeePolicy.Flat,
+		"SERVICE_FEE_MIN":  &serviceFeePolicy.Min,
+		"SERVICE_FEE_MAX":  &serviceFeePolicy.Max,
+	} {
+		if amount := os.Getenv(name); amount != "" {
+			parsed, err := strconv.ParseInt(amount, 10, 64)
+			if err != nil {
+				log.Fatalf("Invalid %s: %v", name, err)
+			}
+			*value = parsed
+		}
+	}
+	if chargeAt := os.Getenv("SERVICE_FEE_CHARGE_AT"); chargeAt != "" {
+		serviceFeePolicy.ChargeAt = escrow.ServiceFeeMode(chargeAt)
+	}
+	if err := escrow.SetServiceFeePolicy(serviceFeePolicy); err != nil {
+		log.Fatalf("Invalid service fee policy: %v", err)
+	}
+
+	// Payout fees target confirmation within FEE_CONF_TARGET blocks (default 6),
+	// with the feerate kept between FEE_RATE_MIN and FEE_RATE_MAX sat/vB (default 1 and 200)
+	feePolicy := escrow.FeePolicy{ConfTarget: 6, MinFeeRate: 1, MaxFeeRate: 200}
+	if target := os.Getenv("FEE_CONF_TARGET"); target != "" {
+		parsed, err := strconv.Atoi(target)
+		if err != nil {
+			log.Fatalf("Invalid FEE_CONF_TARGET: %v", err)
+		}
+		feePolicy.ConfTarget = parsed
+	}
+	if rate := os.Getenv("FEE_RATE_MIN"); rate != "" {
+		parsed, err := strconv.ParseFloat(rate, 64)
+		if err != nil {
+			log.Fatalf("Invalid FEE_RATE_MIN: %v", err)
+		}
+		feePolicy.MinFeeRate = parsed
+	}
+	if rate := os.Getenv("FEE_RATE_MAX"); rate != "" {
+		parsed, err := strconv.ParseFloat(rate, 64)
+		if err != nil {
+			log.Fatalf("Invalid FEE_RATE_MAX: %v", err)
+		}
+		feePolicy.MaxFeeRate = parsed
+	}
+	if err := escrow.SetFeePolicy(feePolicy); err != nil {
+		log.Fatalf("Invalid fee policy: %v", err)
+	}
+
+	// Disputes are auto-resolved or escalated after DISPUTE_RESPONSE_WINDOW (default 72h)
+	if window := os.Getenv("DISPUTE_RESPONSE_WINDOW"); window != "" {
+		parsed, err := time.ParseDuration(window)
+		if err != nil {
+			log.Fatalf("Invalid DISPUTE_RESPONSE_WINDOW: %v", err)
+		}
+		escrow.SetDisputeResponseWindow(parsed)
+	}
+
+	// Funded escrows past expiry follow EXPIRY_POLICY: refund, notify (default), or dispute
+	if policy := os.Getenv("EXPIRY_POLICY"); policy != "" {
+		if err := escrow.SetExpiryPolicy(escrow.ExpiryPolicy(policy)); err != nil {
+			log.Fatalf("Invalid EXPIRY_POLICY: %v", err)
+		}
+	}
+
+	// Scan for expired escrows, dispute deadlines and reverted funding every SCHEDULER_INTERVAL (default 1m)
+	schedulerInterval := time.Minute
+	if interval := os.Getenv("SCHEDULER_INTERVAL"); interval != "" {
+		parsed, err := time.ParseDuration(interval)
+		if err != nil || parsed <= 0 {
+			log.Fatalf("Invalid SCHEDULER_INTERVAL: %q", interval)
+		}
+		schedulerInterval = parsed
+	}
+	escrow.StartScheduler(schedulerInterval)
+
+	// Open and broadcast batched release payouts every BATCH_INTERVAL (default 10m)
+	batchInterval := 10 * time.Minute
+	if interval := os.Getenv("BATCH_INTERVAL"); interval != "" {
+		parsed, err := time.ParseDuration(interval)
+		if err != nil || parsed <= 0 {
+			log.Fatalf("Invalid BATCH_INTERVAL: %q", interval)
+		}
+		batchInterval = parsed
+	}
+	escrow.StartBatcher(batchInterval)
+
+	// Deliver webhooks as events happen. Failed deliveries are retried after WEBHOOK_RETRY_DELAY (default 30s),
+	// doubling each time up to an hour, and are dead letters after WEBHOOK_MAX_ATTEMPTS (default 8)
+	retryPolicy := escrow.WebhookRetryPolicy{BaseDelay: 30 * time.Second, MaxDelay: time.Hour, MaxAttempts: 8}
+	if delay := os.Getenv("WEBHOOK_RETRY_DELAY"); delay != "" {
+		parsed, err := time.ParseDuration(delay)
+		if err != nil {
+			log.Fatalf("Invalid WEBHOOK_RETRY_DELAY: %q", delay)
+		}
+		retryPolicy.BaseDelay = parsed
+		if parsed > retryPolicy.MaxDelay {
+			retryPolicy.MaxDelay = parsed
+		}
+	}
+	if attempts := os.Getenv("WEBHOOK_MAX_ATTEMPTS"); attempts != "" {
+		parsed, err := strconv.Atoi(attempts)
+		if err != nil {
+			log.Fatalf("Invalid WEBHOOK_MAX_ATTEMPTS: %q", attempts)
+		}
+		retryPolicy.MaxAttempts = parsed
+	}
+	if err := escrow.SetWebhookRetryPolicy(retryPolicy); err != nil {
+		log.Fatalf("Invalid webhook retry policy: %v", err)
+	}
+	// Webhooks cannot point at loopback, link-local or private addresses unless WEBHOOK_ALLOW_PRIVATE is true,
+	// for receivers on a local network during development
+	if allow := os.Getenv("WEBHOOK_ALLOW_PRIVATE"); allow != "" {
+		parsed, err := strconv.ParseBool(allow)
+		if err != nil {
+			log.Fatalf("Invalid WEBHOOK_ALLOW_PRIVATE: %q", allow)
+		}
+		escrow.SetWebhookAllowPrivate(parsed)
+	}
+	escrow.StartWebhookDispatcher(retryPolicy.BaseDelay)
+
+	// Drop expired login challenges and sessions every minute
+	auth.StartSessionJanitor(time.Minute)
+
+	// Bootstrap admin credential, used to issue merchant and participant API keys
+	if adminKey := os.Getenv("ADMIN_API_KEY"); adminKey != "" {
+		auth.RegisterAPIKey(adminKey, &auth.Identity{ID: "admin", Role: auth.RoleAdmin, Name: "bootstrap admin"})
+	} else {
+		log.Printf("ADMIN_API_KEY is not set, no credentials can be issued")
+	}
+
+	// WebSocket event streams accept the same browser origins as CORS
+	escrow.SetAllowedOrigins(corsAllowedOrigins())
 
 	// Set up middleware
-	handler := corsMiddleware(loggingMiddleware(http.DefaultServeMux))
+	handler := corsMiddleware(loggingMiddleware(auth.Middleware(http.DefaultServeMux)))
 
 	// Get port from environment variable or use default
 	port := os.Getenv("PORT")
@@ -0,0 +1,79 @@
+package utils
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// publicBaseURL is the address wallets reach this service at, used in the URLs given to them
+var publicBaseURL = "http://localhost:8080"
+
+// SetPublicBaseURL sets the address wallets reach this service at, e.g. https://escrow.example.com
+func SetPublicBaseURL(baseURL string) error {
+	parsed, err := url.Parse(baseURL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return fmt.Errorf("public base URL must be an absolute http or https URL, got %q", baseURL)
+	}
+	publicBaseURL = strings.TrimSuffix(baseURL, "/")
+	return nil
+}
+
+// PaymentRequestURL returns the URL wallets fetch a stored BIP70 payment request from
+func PaymentRequestURL(requestID string) string {
+	return publicBaseURL + "/api/pay/request/" + requestID
+}
+
+// FormatBTC formats satoshis as a decimal amount of bitcoin without trailing zeros, e.g. 0.001
+func FormatBTC(satoshis int64) string {
+	sign := ""
+	if satoshis < 0 {
+		sign, satoshis = "-", -satoshis
+	}
+	whole, fraction := satoshis/1e8, satoshis%1e8
+	if fraction == 0 {
+		return fmt.Sprintf("%s%d", sign, whole)
+	}
+	return strings.TrimRight(fmt.Sprintf("%s%d.%08d", sign, whole, fraction), "0")
+}
+
+// BIP21URI returns a bitcoin: URI (BIP21) paying amount satoshis to address
+// A non-empty requestURL is added as the r parameter (BIP72), so wallets that support it fetch the payment request
+func BIP21URI(address string, amount int64, label, message, requestURL string) string {
+	var params []string
+	if amount > 0 {
+		params = append(params, "amount="+FormatBTC(amount))
+	}
+	if label != "" {
+		params = append(params, "label="+bip21Escape(label))
+	}
+	if message != "" {
+		params = append(params, "message="+bip21Escape(message))
+	}
+	if requestURL != "" {
+		params = append(params, "r="+bip21Escape(requestURL))
+	}
+
+	uri := "bitcoin:" + address
+	if len(params) > 0 {
+		uri += "?" + strings.Join(params, "&")
+	}
+	return uri
+}
+
+// bip21Escape percent-encodes a parameter value, leaving the characters that are safe in a query value
+// and keeping ':' and '/' so URLs stay readable
+func bip21Escape(value string) string {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9',
+			c == '-', c == '.', c == '_', c == '~', c == ':', c == '/':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
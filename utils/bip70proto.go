@@ -0,0 +1,327 @@
+package utils
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Protocol buffer encodings of the BIP70 messages, as BIP71 requires for the application/bitcoin-* media types
+// Field numbers follow paymentrequest.proto in BIP70. Only the wire format is implemented, not a general protobuf library
+
+// BIP71 media types of the binary messages
+const (
+	MediaTypePaymentRequest = "application/bitcoin-paymentrequest"
+	MediaTypePayment        = "application/bitcoin-payment"
+	MediaTypePaymentACK     = "application/bitcoin-paymentack"
+)
+
+// Protobuf wire types used by BIP70 messages
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+// protoBuffer builds an encoded message field by field
+type protoBuffer struct {
+	buf []byte
+}
+
+// key writes a field's tag
+func (b *protoBuffer) key(field, wireType int) {
+	b.buf = appendVarint(b.buf, uint64(field<<3|wireType))
+}
+
+// uint writes a varint field
+func (b *protoBuffer) uint(field int, value uint64) {
+	b.key(field, wireVarint)
+	b.buf = appendVarint(b.buf, value)
+}
+
+// bytes writes a length-delimited field
+func (b *protoBuffer) bytes(field int, value []byte) {
+	b.key(field, wireBytes)
+	b.buf = appendVarint(b.buf, uint64(len(value)))
+	b.buf = append(b.buf, value...)
+}
+
+// optionalString writes a string field unless it is empty
+func (b *protoBuffer) optionalString(field int, value string) {
+	if value != "" {
+		b.bytes(field, []byte(value))
+	}
+}
+
+// optionalBytes writes a bytes field unless it is empty
+func (b *protoBuffer) optionalBytes(field int, value []byte) {
+	if len(value) > 0 {
+		b.bytes(field, value)
+	}
+}
+
+// appendVarint appends value as a base 128 varint
+func appendVarint(buf []byte, value uint64) []byte {
+	var scratch [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(scratch[:], value)
+	return append(buf, scratch[:n]...)
+}
+
+// protoField is one decoded field, holding a varint value or the bytes of a length-delimited field
+type protoField struct {
+	number   int
+	wireType int
+	varint   uint64
+	data     []byte
+}
+
+// decodeProto calls fn with each field of an encoded message, skipping fixed-width fields no BIP70 message uses
+func decodeProto(data []byte, fn func(protoField) error) error {
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errors.New("malformed field key")
+		}
+		data = data[n:]
+
+		field := protoField{number: int(key >> 3), wireType: int(key & 7)}
+		switch field.wireType {
+		case wireVarint:
+			value, n := binary.Uvarint(data)
+			if n <= 0 {
+				return fmt.Errorf("malformed varint in field %d", field.number)
+			}
+			field.varint, data = value, data[n:]
+		case wireBytes:
+			length, n := binary.Uvarint(data)
+			if n <= 0 || length > uint64(len(data)-n) {
+				return fmt.Errorf("malformed length of field %d", field.number)
+			}
+			field.data, data = data[n:n+int(length)], data[n+int(length):]
+		case wireFixed64, wireFixed32:
+			size := 8
+			if field.wireType == wireFixed32 {
+				size = 4
+			}
+			if len(data) < size {
+				return fmt.Errorf("truncated field %d", field.number)
+			}
+			data = data[size:]
+			continue
+		default:
+			return fmt.Errorf("unsupported wire type %d in field %d", field.wireType, field.number)
+		}
+
+		if field.number == 0 {
+			return errors.New("field number 0 is invalid")
+		}
+		if err := fn(field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// expectWireType returns an error unless the field has the wire type its number calls for
+func (f protoField) expectWireType(wireType int) error {
+	if f.wireType != wireType {
+		return fmt.Errorf("field %d has wire type %d, expected %d", f.number, f.wireType, wireType)
+	}
+	return nil
+}
+
+// encodeOutput encodes an Output: amount = 1, script = 2
+func encodeOutput(output *Output) []byte {
+	b := &protoBuffer{}
+	if output.Amount != 0 {
+		b.uint(1, uint64(output.Amount))
+	}
+	b.bytes(2, output.Script)
+	return b.buf
+}
+
+// decodeOutput decodes an Output, whose script is required
+func decodeOutput(data []byte) (*Output, error) {
+	output := &Output{}
+	hasScript := false
+	err := decodeProto(data, func(f protoField) error {
+		switch f.number {
+		case 1:
+			output.Amount = int64(f.varint)
+			return f.expectWireType(wireVarint)
+		case 2:
+			output.Script, hasScript = append([]byte{}, f.data...), true
+			return f.expectWireType(wireBytes)
+		}
+		return nil
+	})
+	if err == nil && !hasScript {
+		err = errors.New("output has no script")
+	}
+	return output, err
+}
+
+// EncodePaymentDetailsProto encodes PaymentDetails: network = 1, outputs = 2, time = 3, expires = 4, memo = 5,
+// payment_url = 6, merchant_data = 7
+func EncodePaymentDetailsProto(details *PaymentDetails) []byte {
+	b := &protoBuffer{}
+	b.optionalString(1, details.Network)
+	for _, output := range details.Outputs {
+		b.bytes(2, encodeOutput(output))
+	}
+	b.uint(3, uint64(details.Time))
+	if details.Expires != 0 {
+		b.uint(4, uint64(details.Expires))
+	}
+	b.optionalString(5, details.Memo)
+	b.optionalString(6, details.PaymentURL)
+	b.optionalBytes(7, details.MerchantData)
+	return b.buf
+}
+
+// DecodePaymentDetailsProto decodes PaymentDetails, the network defaulting to "main"
+func DecodePaymentDetailsProto(data []byte) (*PaymentDetails, error) {
+	details := &PaymentDetails{Network: "main"}
+	hasTime := false
+	err := decodeProto(data, func(f protoField) error {
+		switch f.number {
+		case 1:
+			details.Network = string(f.data)
+			return f.expectWireType(wireBytes)
+		case 2:
+			if err := f.expectWireType(wireBytes); err != nil {
+				return err
+			}
+			output, err := decodeOutput(f.data)
+			if err != nil {
+				return err
+			}
+			details.Outputs = append(details.Outputs, output)
+		case 3:
+			details.Time, hasTime = int64(f.varint), true
+			return f.expectWireType(wireVarint)
+		case 4:
+			details.Expires = int64(f.varint)
+			return f.expectWireType(wireVarint)
+		case 5:
+			details.Memo = string(f.data)
+			return f.expectWireType(wireBytes)
+		case 6:
+			details.PaymentURL = string(f.data)
+			return f.expectWireType(wireBytes)
+		case 7:
+			details.MerchantData = append([]byte{}, f.data...)
+			return f.expectWireType(wireBytes)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode payment details: %v", err)
+	}
+	if !hasTime {
+		return nil, errors.New("failed to decode payment details: time is required")
+	}
+	return details, nil
+}
+
+// EncodePaymentRequestProto encodes a PaymentRequest: payment_details_version = 1, pki_type = 2, pki_data = 3,
+// serialized_payment_details = 4, signature = 5
+// The stored details are JSON, so they are encoded again as PaymentDetails. The fields this service adds are dropped
+func EncodePaymentRequestProto(request *PaymentRequest) ([]byte, error) {
+	details, err := DeserializePaymentDetails(request.SerializedDetails)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &protoBuffer{}
+	if request.PaymentDetailsVersion != 0 {
+		b.uint(1, uint64(request.PaymentDetailsVersion))
+	}
+	b.optionalString(2, request.PKIType)
+	b.optionalBytes(3, request.PKIData)
+	b.bytes(4, EncodePaymentDetailsProto(details))
+	b.optionalBytes(5, request.Signature)
+	return b.buf, nil
+}
+
+// EncodePaymentProto encodes a Payment: merchant_data = 1, transactions = 2, refund_to = 3, memo = 4
+func EncodePaymentProto(payment *Payment) []byte {
+	b := &protoBuffer{}
+	b.optionalBytes(1, payment.MerchantData)
+	for _, tx := range payment.Transactions {
+		b.bytes(2, tx)
+	}
+	for _, output := range payment.RefundTo {
+		b.bytes(3, encodeOutput(output))
+	}
+	b.optionalString(4, payment.Memo)
+	return b.buf
+}
+
+// DecodePaymentProto decodes a Payment
+func DecodePaymentProto(data []byte) (*Payment, error) {
+	payment := &Payment{}
+	err := decodeProto(data, func(f protoField) error {
+		if err := f.expectWireType(wireBytes); err != nil && f.number >= 1 && f.number <= 4 {
+			return err
+		}
+		switch f.number {
+		case 1:
+			payment.MerchantData = append([]byte{}, f.data...)
+		case 2:
+			payment.Transactions = append(payment.Transactions, append([]byte{}, f.data...))
+		case 3:
+			output, err := decodeOutput(f.data)
+			if err != nil {
+				return err
+			}
+			payment.RefundTo = append(payment.RefundTo, output)
+		case 4:
+			payment.Memo = string(f.data)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode payment: %v", err)
+	}
+	return payment, nil
+}
+
+// EncodePaymentACKProto encodes a PaymentACK: payment = 1, memo = 2
+func EncodePaymentACKProto(ack *PaymentACK) []byte {
+	b := &protoBuffer{}
+	b.bytes(1, EncodePaymentProto(&ack.Payment))
+	b.optionalString(2, ack.Memo)
+	return b.buf
+}
+
+// DecodePaymentACKProto decodes a PaymentACK, whose payment is required
+func DecodePaymentACKProto(data []byte) (*PaymentACK, error) {
+	ack := &PaymentACK{}
+	hasPayment := false
+	err := decodeProto(data, func(f protoField) error {
+		switch f.number {
+		case 1:
+			if err := f.expectWireType(wireBytes); err != nil {
+				return err
+			}
+			payment, err := DecodePaymentProto(f.data)
+			if err != nil {
+				return err
+			}
+			ack.Payment, hasPayment = *payment, true
+		case 2:
+			ack.Memo = string(f.data)
+			return f.expectWireType(wireBytes)
+		}
+		return nil
+	})
+	if err == nil && !hasPayment {
+		err = errors.New("payment is required")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode payment ack: %v", err)
+	}
+	return ack, nil
+}
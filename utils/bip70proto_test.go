@@ -0,0 +1,131 @@
+package utils
+
+import (
+	"encoding/hex"
+	"reflect"
+	"testing"
+)
+
+func TestEncodeOutputWireFormat(t *testing.T) {
+	// amount = 1000 as field 1 varint, script as field 2 bytes
+	encoded := encodeOutput(&Output{Amount: 1000, Script: []byte{0x76, 0xa9}})
+	if got, want := hex.EncodeToString(encoded), "08e807120276a9"; got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+}
+
+func TestPaymentRequestProtoRoundTrip(t *testing.T) {
+	details := &PaymentDetails{
+		Network:      "test",
+		Outputs:      []*Output{{Amount: 100000, Script: []byte{0xa9, 0x14, 0x01, 0x02, 0x87}}},
+		Time:         1741624188,
+		Expires:      1741710588,
+		Memo:         "Escrow of 100000 satoshis",
+		PaymentURL:   "https://escrow.example.com/api/pay/payreq-1",
+		MerchantData: []byte("payreq-1"),
+	}
+	serialized, err := SerializePaymentDetails(details)
+	if err != nil {
+		t.Fatalf("failed to serialize details: %v", err)
+	}
+
+	encoded, err := EncodePaymentRequestProto(&PaymentRequest{
+		PaymentDetailsVersion: 1,
+		PKIType:               "none",
+		SerializedDetails:     serialized,
+	})
+	if err != nil {
+		t.Fatalf("failed to encode payment request: %v", err)
+	}
+
+	// The PaymentRequest wraps the details as serialized_payment_details, field 4
+	var version uint64
+	var pkiType string
+	var serializedDetails []byte
+	err = decodeProto(encoded, func(f protoField) error {
+		switch f.number {
+		case 1:
+			version = f.varint
+		case 2:
+			pkiType = string(f.data)
+		case 4:
+			serializedDetails = f.data
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to decode payment request: %v", err)
+	}
+	if version != 1 || pkiType != "none" {
+		t.Errorf("expected version 1 and pki_type none, got %d and %q", version, pkiType)
+	}
+
+	decoded, err := DecodePaymentDetailsProto(serializedDetails)
+	if err != nil {
+		t.Fatalf("failed to decode payment details: %v", err)
+	}
+	if !reflect.DeepEqual(decoded, details) {
+		t.Errorf("details changed in the round trip:\n got %+v\nwant %+v", decoded, details)
+	}
+}
+
+func TestPaymentDetailsProtoDefaults(t *testing.T) {
+	// Only the required time: the network defaults to main
+	decoded, err := DecodePaymentDetailsProto(EncodePaymentDetailsProto(&PaymentDetails{Time: 1}))
+	if err != nil {
+		t.Fatalf("failed to decode payment details: %v", err)
+	}
+	if decoded.Network != "main" || decoded.Time != 1 {
+		t.Errorf("expected network main and time 1, got %q and %d", decoded.Network, decoded.Time)
+	}
+
+	if _, err := DecodePaymentDetailsProto([]byte{0x0a, 0x04, 't', 'e', 's', 't'}); err == nil {
+		t.Errorf("expected details without a time to be rejected")
+	}
+}
+
+func TestPaymentACKProtoRoundTrip(t *testing.T) {
+	ack := &PaymentACK{
+		Payment: Payment{
+			MerchantData: []byte("payreq-1"),
+			Transactions: [][]byte{{0x01, 0x00, 0x00, 0x00}, {0x02, 0x00, 0x00, 0x00}},
+			RefundTo:     []*Output{{Amount: 0, Script: []byte{0x00, 0x14, 0xaa}}},
+			Memo:         "Order 42",
+		},
+		Memo: "Payment received",
+	}
+
+	decoded, err := DecodePaymentACKProto(EncodePaymentACKProto(ack))
+	if err != nil {
+		t.Fatalf("failed to decode payment ack: %v", err)
+	}
+	if !reflect.DeepEqual(decoded, ack) {
+		t.Errorf("ack changed in the round trip:\n got %+v\nwant %+v", decoded, ack)
+	}
+
+	if _, err := DecodePaymentACKProto([]byte{0x12, 0x02, 'o', 'k'}); err == nil {
+		t.Errorf("expected an ack without a payment to be rejected")
+	}
+}
+
+func TestDecodeProtoMalformed(t *testing.T) {
+	tests := map[string][]byte{
+		"truncated length": {0x12, 0x05, 0x01},
+		"truncated varint": {0x08, 0x80},
+		"field zero":       {0x00, 0x01},
+		"wrong wire type":  {0x10, 0x01}, // transactions, field 2, as a varint
+		"unsupported wire": {0x0b},
+	}
+
+	for name, data := range tests {
+		if _, err := DecodePaymentProto(data); err == nil {
+			t.Errorf("%s: expected %x to be rejected", name, data)
+		}
+	}
+
+	// Unknown fields are skipped
+	payment, err := DecodePaymentProto(append([]byte{0x78, 0x01}, EncodePaymentProto(&Payment{Memo: "ok"})...))
+	if err != nil || payment.Memo != "ok" || len(payment.MerchantData) != 0 {
+		t.Errorf("expected unknown fields to be skipped, got %+v, %v", payment, err)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/btcsuite/btcd/btcutil"
@@ -52,6 +53,7 @@ type PaymentRequest struct {
 	MerchantID            string        `json:"merchant_id,omitempty"`   // Identifier for the merchant
 	RequestID             string        `json:"request_id"`              // Unique identifier for this request
 	CallbackURL           string        `json:"callback_url,omitempty"`  // URL for callbacks
+	InvalidatedAt         *time.Time    `json:"invalidated_at,omitempty"` // Set when the request may no longer be paid
 }
 
 // Payment represents a BIP70 payment message (from customer to merchant)
@@ -70,12 +72,18 @@ type PaymentACK struct {
 
 // Transaction represents a bitcoin transaction
 type Transaction struct {
-	TxID          string `json:"txid"`
-	RawTx         string `json:"raw_tx"`
-	Fee           int64  `json:"fee"`
-	Confirmations int64  `json:"confirmations"`
+	TxID          string         `json:"txid"`
+	RawTx         string         `json:"raw_tx"`
+	Fee           int64          `json:"fee"`
+	Confirmations int64          `json:"confirmations"`
+	Inputs        []TxInput      `json:"inputs,omitempty"`
+	Outputs       []PayoutOutput `json:"outputs,omitempty"`
+	Sequence      uint32         `json:"sequence,omitempty"` // input sequence, ReplaceableSequence signals BIP125
 }
 
+// ReplaceableSequence is the input sequence that opts a transaction in to BIP125 replacement
+const ReplaceableSequence = wire.MaxTxInSequenceNum - 2
+
 // CreateMultiSig creates a 2-of-3 multisig address (buyer, seller, escrow service)
 func CreateMultiSig(buyerPubKey, sellerPubKey, escrowPubKey string) (string, error) {
 	// LIMITATIONS:
@@ -159,7 +167,10 @@ func CreateBIP70PaymentRequest(address string, amount int64) (PaymentRequest, er
 	}
 
 	// Create unique request ID
-	requestID := fmt.Sprintf("req-%d", time.Now().UnixNano())
+	requestID, err := NewID("req")
+	if err != nil {
+		return PaymentRequest{}, err
+	}
 	
 	// Set timestamps
 	now := time.Now()
@@ -178,7 +189,7 @@ func CreateBIP70PaymentRequest(address string, amount int64) (PaymentRequest, er
 		Time:       now.Unix(),
 		Expires:    expiryTime.Unix(),
 		Memo:       "Escrow payment",
-		PaymentURL: fmt.Sprintf("http://localhost:8080/api/pay/%s", requestID),
+		PaymentURL: fmt.Sprintf("%s/api/pay/%s", publicBaseURL, requestID),
 		// MerchantData could contain additional data like order ID, customer info, etc.
 		MerchantData: []byte(fmt.Sprintf(`{"order_id": "%s"}`, requestID)),
 	}
@@ -203,12 +214,41 @@ func CreateBIP70PaymentRequest(address string, amount int64) (PaymentRequest, er
 		Expires:               expiryTime,
 		MerchantID:            "EscrowService",
 		RequestID:             requestID,
-		CallbackURL:           fmt.Sprintf("http://localhost:8080/api/callback/%s", requestID),
+		CallbackURL:           fmt.Sprintf("%s/api/callback/%s", publicBaseURL, requestID),
 	}
 	
 	return request, nil
 }
 
+// AddPaymentOutput adds an output paying amount to address to the request's PaymentDetails
+// The request's Address and Amount still describe its first output
+func AddPaymentOutput(request *PaymentRequest, address string, amount int64) error {
+	addr, err := btcutil.DecodeAddress(address, netParams)
+	if err != nil {
+		return fmt.Errorf("invalid address: %v", err)
+	}
+
+	script, err := txscript.PayToAddrScript(addr)
+	if err != nil {
+		return fmt.Errorf("failed to create output script: %v", err)
+	}
+
+	details, err := DeserializePaymentDetails(request.SerializedDetails)
+	if err != nil {
+		return err
+	}
+
+	details.Outputs = append(details.Outputs, &Output{Amount: amount, Script: script})
+
+	serialized, err := SerializePaymentDetails(details)
+	if err != nil {
+		return fmt.Errorf("failed to serialize payment details: %v", err)
+	}
+
+	request.SerializedDetails = serialized
+	return nil
+}
+
 // SerializePaymentDetails serializes PaymentDetails to JSON bytes
 // In a real implementation, this would use protobuf as specified in BIP70
 func SerializePaymentDetails(details *PaymentDetails) ([]byte, error) {
@@ -255,19 +295,77 @@ func DeserializePaymentACK(data []byte) (*PaymentACK, error) {
 	return &ack, nil
 }
 
-// CreateTransaction creates and signs a new Bitcoin transaction
-func CreateTransaction(fromAddress, toAddress string, amount int64, privateKey string) (Transaction, error) {
+// ValidateAddress checks that address is a valid address on the service's network
+func ValidateAddress(address string) error {
+	if _, err := btcutil.DecodeAddress(address, netParams); err != nil {
+		return fmt.Errorf("invalid address: %v", err)
+	}
+	return nil
+}
+
+// PayoutOutput is a destination and amount in a spending transaction
+type PayoutOutput struct {
+	Address string `json:"address"`
+	Amount  int64  `json:"amount"`
+}
+
+// TxInput is an outpoint spent by a transaction, with the value it holds
+type TxInput struct {
+	TxID  string `json:"txid"`
+	Vout  uint32 `json:"vout"`
+	Value int64  `json:"value"`
+}
+
+// CreateTransaction creates a new unsigned Bitcoin transaction
+// Signing is done separately through a signer so the caller never needs the private key
+func CreateTransaction(inputs []TxInput, toAddress string, amount, fee int64) (Transaction, error) {
+	return CreatePayoutTransaction(inputs, []PayoutOutput{{Address: toAddress, Amount: amount}}, fee)
+}
+
+// CreatePayoutTransaction creates a new unsigned Bitcoin transaction spending inputs to one or more outputs
+// fee is the miner fee left over by the outputs. The inputs signal BIP125 so the fee can be bumped
+func CreatePayoutTransaction(inputs []TxInput, outputs []PayoutOutput, fee int64) (Transaction, error) {
+	if len(inputs) == 0 {
+		return Transaction{}, errors.New("at least one input is required")
+	}
+
+	if len(outputs) == 0 {
+		return Transaction{}, errors.New("at least one output is required")
+	}
+
+	var inputTotal, outputTotal int64
+	for _, input := range inputs {
+		inputTotal += input.Value
+	}
+
+	for _, output := range outputs {
+		if output.Amount <= 0 {
+			return Transaction{}, fmt.Errorf("output amount must be positive, got %d", output.Amount)
+		}
+		outputTotal += output.Amount
+	}
+
+	// Whatever the outputs and fee leave over would silently go to the miner
+	if outputTotal+fee != inputTotal {
+		return Transaction{}, fmt.Errorf("inputs of %d satoshis do not match outputs of %d plus a fee of %d",
+			inputTotal, outputTotal, fee)
+	}
+
 	// This is a simplified implementation
 	// In a real app, you would interact with a full node or service
 
 	// For demo purposes, we'll just return a mock transaction
-	txid := fmt.Sprintf("tx-%d", time.Now().UnixNano())
+	// The txid is still a well-formed hash, since outputs paying the escrow back are spent by later transactions
+	txid := chainhash.HashH([]byte(fmt.Sprintf("tx-%d", time.Now().UnixNano()))).String()
 
 	return Transaction{
 		TxID:          txid,
 		RawTx:         "01000000...", // Simplified
-		Fee:           1000,          // 1000 satoshis
-		Confirmations: 0,             // New transaction
+		Fee:           fee,
+		Confirmations: 0, // New transaction
+		Inputs:        inputs,
+		Outputs:       outputs,
+		Sequence:      ReplaceableSequence,
 	}, nil
 }
 
@@ -344,6 +442,23 @@ func SignTransaction(txHex string, privateKey string) (string, error) {
 	return "signed_" + txHex, nil
 }
 
+// SignsTransaction reports whether signedHex is txHex with signatures added, as returned by SignTransaction
+func SignsTransaction(signedHex, txHex string) bool {
+	// LIMITATION: Matches the mock signing above, a production implementation would parse
+	// both PSBTs, compare their unsigned transactions and verify the added signatures
+	return txHex != "" && strings.HasPrefix(signedHex, "signed_") && strings.HasSuffix(signedHex, txHex)
+}
+
+// PublicKeyFromWIF derives the hex-encoded compressed public key from a WIF private key
+func PublicKeyFromWIF(privateKey string) (string, error) {
+	wif, err := btcutil.DecodeWIF(privateKey)
+	if err != nil {
+		return "", fmt.Errorf("invalid WIF private key: %v", err)
+	}
+
+	return hex.EncodeToString(wif.SerializePubKey()), nil
+}
+
 // CreateRawTransaction creates a raw Bitcoin transaction
 func CreateRawTransaction(inputs []wire.TxIn, outputs []wire.TxOut) (*wire.MsgTx, error) {
 	// Create a new transaction
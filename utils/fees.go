@@ -0,0 +1,124 @@
+package utils
+
+import (
+	"math"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/txscript"
+)
+
+// SpendPath identifies how an escrow output is spent, which decides the size of its input script
+type SpendPath int
+
+const (
+	SpendMultiSig           SpendPath = iota // 2-of-3 P2SH multisig
+	SpendTimelockedMultiSig                  // multisig branch of TimelockedEscrowScript
+	SpendTimelockedRecovery                  // buyer branch of TimelockedEscrowScript after the lock time
+	SpendPubKeyHash                          // single-key output paid out of an escrow, spent by a CPFP child
+)
+
+const (
+	// multiSigScriptSize is the size of a 2-of-3 redeem script with compressed keys
+	multiSigScriptSize = 1 + 3*(1+33) + 1 + 1
+
+	// timelockedScriptSize adds OP_IF, OP_ELSE, the 4-byte lock time push, OP_CHECKLOCKTIMEVERIFY,
+	// OP_DROP, the buyer key push, OP_CHECKSIG and OP_ENDIF to the multisig script
+	timelockedScriptSize = multiSigScriptSize + 1 + 1 + 5 + 1 + 1 + 34 + 1 + 1
+
+	// signaturePushSize is a push of the largest DER signature plus its sighash type byte
+	signaturePushSize = 1 + 72 + 1
+
+	// p2pkhScriptSize is the size of a pay-to-pubkey-hash output script
+	p2pkhScriptSize = 25
+)
+
+// inputScriptSize returns the size of the input script spending an escrow output along path
+func inputScriptSize(path SpendPath, signatures int) int {
+	switch path {
+	case SpendTimelockedMultiSig:
+		// OP_0, the signatures, OP_TRUE to select the multisig branch, then the redeem script
+		return 1 + signatures*signaturePushSize + 1 + pushSize(timelockedScriptSize)
+	case SpendTimelockedRecovery:
+		// The buyer signature, OP_FALSE to select the timelocked branch, then the redeem script
+		return signaturePushSize + 1 + pushSize(timelockedScriptSize)
+	case SpendPubKeyHash:
+		// The signature, then the compressed public key
+		return signaturePushSize + pushSize(33)
+	default:
+		// OP_0 works around the off-by-one in OP_CHECKMULTISIG
+		return 1 + signatures*signaturePushSize + pushSize(multiSigScriptSize)
+	}
+}
+
+// pushSize returns the size of a data push of n bytes, including its opcode
+func pushSize(n int) int {
+	switch {
+	case n < txscript.OP_PUSHDATA1:
+		return 1 + n
+	case n <= 0xff:
+		return 2 + n
+	default:
+		return 3 + n
+	}
+}
+
+// varIntSize returns the size of n encoded as a Bitcoin compact size
+func varIntSize(n int) int {
+	switch {
+	case n < 0xfd:
+		return 1
+	case n <= 0xffff:
+		return 3
+	default:
+		return 5
+	}
+}
+
+// outputScriptSize returns the size of the output script paying address
+// Addresses that cannot be decoded are sized as P2PKH outputs
+func outputScriptSize(address string) int {
+	addr, err := btcutil.DecodeAddress(address, netParams)
+	if err != nil {
+		return p2pkhScriptSize
+	}
+
+	script, err := txscript.PayToAddrScript(addr)
+	if err != nil {
+		return p2pkhScriptSize
+	}
+
+	return len(script)
+}
+
+// EstimateVsize returns the virtual size of a transaction spending inputs outputs along path,
+// each carrying the given number of signatures, to one output per address
+// Escrow inputs are legacy P2SH, so the virtual size equals the serialized size
+func EstimateVsize(path SpendPath, signatures, inputs int, addresses []string) int64 {
+	return EstimateOverheadVsize(inputs, len(addresses)) + EstimatePartVsize(path, signatures, inputs, addresses)
+}
+
+// EstimateOverheadVsize returns the size of a transaction's version, lock time, and input and output counts
+func EstimateOverheadVsize(inputs, outputs int) int64 {
+	return int64(4 + 4 + varIntSize(inputs) + varIntSize(outputs))
+}
+
+// EstimatePartVsize returns the size that inputs spent along path and one output per address add to a
+// transaction, such as one escrow's part of a batched payout
+func EstimatePartVsize(path SpendPath, signatures, inputs int, addresses []string) int64 {
+	// Outpoint, input script and sequence for each input
+	scriptSize := inputScriptSize(path, signatures)
+	size := inputs * (36 + varIntSize(scriptSize) + scriptSize + 4)
+
+	// Value and output script for each output
+	for _, address := range addresses {
+		scriptSize := outputScriptSize(address)
+		size += 8 + varIntSize(scriptSize) + scriptSize
+	}
+
+	return int64(size)
+}
+
+// FeeForVsize returns the fee in satoshis for vsize virtual bytes at feeRate sat/vB, rounded up
+func FeeForVsize(vsize int64, feeRate float64) int64 {
+	return int64(math.Ceil(float64(vsize) * feeRate))
+}
@@ -0,0 +1,128 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/ecdsa"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// signedMultiSigTx builds a 2-of-3 P2SH spend of inputs outputs to the addresses, signed by two keys
+func signedMultiSigTx(t *testing.T, inputs int, addresses []string) *wire.MsgTx {
+	t.Helper()
+
+	var keys []*btcec.PrivateKey
+	var pubKeys []*btcutil.AddressPubKey
+	for i := 0; i < 3; i++ {
+		key, _ := newTestKey(t)
+		pubKey, err := btcutil.NewAddressPubKey(key.PubKey().SerializeCompressed(), netParams)
+		if err != nil {
+			t.Fatalf("invalid key: %v", err)
+		}
+		keys, pubKeys = append(keys, key), append(pubKeys, pubKey)
+	}
+	redeemScript, err := txscript.MultiSigScript(pubKeys, 2)
+	if err != nil {
+		t.Fatalf("failed to build the redeem script: %v", err)
+	}
+
+	tx := wire.NewMsgTx(2)
+	for i := 0; i < inputs; i++ {
+		hash, _ := chainhash.NewHashFromStr(strings.Repeat("ab", 32))
+		tx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(hash, uint32(i)), nil, nil))
+	}
+	for _, address := range addresses {
+		addr, err := btcutil.DecodeAddress(address, netParams)
+		if err != nil {
+			t.Fatalf("invalid address %s: %v", address, err)
+		}
+		pkScript, _ := txscript.PayToAddrScript(addr)
+		tx.AddTxOut(wire.NewTxOut(10000, pkScript))
+	}
+
+	for i := range tx.TxIn {
+		sigHash, err := txscript.CalcSignatureHash(redeemScript, txscript.SigHashAll, tx, i)
+		if err != nil {
+			t.Fatalf("failed to compute the sighash: %v", err)
+		}
+		builder := txscript.NewScriptBuilder().AddOp(txscript.OP_0)
+		for _, key := range keys[:2] {
+			builder.AddData(append(ecdsa.Sign(key, sigHash).Serialize(), byte(txscript.SigHashAll)))
+		}
+		script, err := builder.AddData(redeemScript).Script()
+		if err != nil {
+			t.Fatalf("failed to build the input script: %v", err)
+		}
+		tx.TxIn[i].SignatureScript = script
+	}
+	return tx
+}
+
+// checkEstimate fails unless estimate covers actual; DER signatures vary by a few bytes, so allow that much slack per signature
+func checkEstimate(t *testing.T, name string, estimate int64, actual, signatures int) {
+	t.Helper()
+
+	if estimate < int64(actual) || estimate > int64(actual+3*signatures) {
+		t.Errorf("%s: estimated %d vbytes for a %d byte transaction", name, estimate, actual)
+	}
+}
+
+func TestEstimateVsizeMatchesSignedTransactions(t *testing.T) {
+	_, pubKey := newTestKey(t)
+	p2pkh, _ := PubKeyHashAddress(pubKey)
+	_, p2sh, _ := CreateTimelockedMultiSig(pubKey, pubKey, pubKey, LockTimeThreshold+1)
+	p2shAddress, _ := btcutil.NewAddressScriptHash(p2sh, netParams)
+
+	for _, c := range []struct {
+		name      string
+		inputs    int
+		addresses []string
+	}{
+		{"one input, one output", 1, []string{p2pkh}},
+		{"two inputs, change", 2, []string{p2pkh, p2shAddress.EncodeAddress()}},
+		{"five inputs, three outputs", 5, []string{p2pkh, p2pkh, p2pkh}},
+	} {
+		tx := signedMultiSigTx(t, c.inputs, c.addresses)
+		checkEstimate(t, c.name, EstimateVsize(SpendMultiSig, 2, c.inputs, c.addresses), tx.SerializeSize(), 2*c.inputs)
+	}
+
+	// A batched payout is the overhead once plus each escrow's part
+	parts := EstimatePartVsize(SpendMultiSig, 2, 2, []string{p2pkh}) + EstimatePartVsize(SpendMultiSig, 2, 1, []string{p2pkh})
+	if got := EstimateOverheadVsize(3, 2) + parts; got != EstimateVsize(SpendMultiSig, 2, 3, []string{p2pkh, p2pkh}) {
+		t.Errorf("expected the parts of a batch to add up to the whole transaction, got %d", got)
+	}
+}
+
+func TestEstimateVsizeOfRecovery(t *testing.T) {
+	buyer, buyerPubKey := newTestKey(t)
+	_, otherPubKey := newTestKey(t)
+	lockTime := int64(LockTimeThreshold + 1000)
+	_, redeemScript, _ := CreateTimelockedMultiSig(buyerPubKey, otherPubKey, otherPubKey, lockTime)
+	recoveryAddress, _ := PubKeyHashAddress(buyerPubKey)
+
+	inputs := []TxInput{{TxID: strings.Repeat("11", 32), Value: 50000}, {TxID: strings.Repeat("22", 32), Value: 50000}}
+	recovery, err := CreateRecoveryTransaction(inputs, redeemScript, lockTime, recoveryAddress, 1000)
+	if err != nil {
+		t.Fatalf("failed to create the recovery transaction: %v", err)
+	}
+	for i := range inputs {
+		runRecoveryInput(t, recovery.Tx, i, recovery.SigHashes[i], redeemScript, buyer, inputs[i].Value)
+	}
+
+	checkEstimate(t, "recovery", EstimateVsize(SpendTimelockedRecovery, 1, 2, []string{recoveryAddress}),
+		recovery.Tx.SerializeSize(), 2)
+}
+
+func TestFeeForVsizeRoundsUp(t *testing.T) {
+	if fee := FeeForVsize(250, 1.01); fee != 253 {
+		t.Errorf("expected 253 satoshis, got %d", fee)
+	}
+	if fee := FeeForVsize(250, 4); fee != 1000 {
+		t.Errorf("expected 1000 satoshis, got %d", fee)
+	}
+}
@@ -58,12 +58,23 @@ func CreateHTTPClient() *http.Client {
 
 // MakeHTTPRequest makes an HTTP request with the given method, URL, and body
 func MakeHTTPRequest(method, url string, body io.Reader) (*http.Response, error) {
-	client := CreateHTTPClient()
+	return MakeHTTPRequestWithHeaders(nil, method, url, body, nil)
+}
+
+// MakeHTTPRequestWithHeaders makes an HTTP request with additional headers such as Authorization
+// The request is sent with client, such as the one NewWebhookClient returns, or a default client if it is nil
+func MakeHTTPRequestWithHeaders(client *http.Client, method, url string, body io.Reader, headers map[string]string) (*http.Response, error) {
+	if client == nil {
+		client = CreateHTTPClient()
+	}
 	req, err := http.NewRequest(method, url, body)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %v", err)
 	}
 
 	req.Header.Set("Content-Type", "application/json")
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
 	return client.Do(req)
 }
@@ -0,0 +1,165 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// IdempotencyKeyHeader is the request header clients use to make retries safe
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// IdempotencyStore remembers the first response to each POST request carrying an
+// Idempotency-Key header and replays it when the same caller retries the request
+type IdempotencyStore struct {
+	mu      sync.Mutex
+	window  time.Duration
+	caller  func(r *http.Request) string
+	entries map[string]*idempotencyEntry
+}
+
+// idempotencyEntry is a stored response, or a placeholder while the first request is in flight
+type idempotencyEntry struct {
+	bodyHash  [sha256.Size]byte
+	done      bool
+	status    int
+	header    http.Header
+	body      []byte
+	createdAt time.Time
+}
+
+// NewIdempotencyStore creates a store that keeps responses for the given window
+// caller returns the ID of the authenticated caller, or "" for anonymous requests; keys are only shared
+// within a caller, so a stored response is never replayed to someone else who picked the same key
+func NewIdempotencyStore(window time.Duration, caller func(r *http.Request) string) *IdempotencyStore {
+	return &IdempotencyStore{
+		window:  window,
+		caller:  caller,
+		entries: make(map[string]*idempotencyEntry),
+	}
+}
+
+// Wrap makes a handler honor the Idempotency-Key header on POST requests
+func (s *IdempotencyStore) Wrap(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(IdempotencyKeyHeader)
+		if key == "" || r.Method != http.MethodPost {
+			next(w, r)
+			return
+		}
+
+		// Read the body so it can be fingerprinted, then hand a fresh copy to the handler
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			WriteErrorResponse(w, http.StatusBadRequest, fmt.Errorf("failed to read request body: %v", err), "Invalid request payload")
+			return
+		}
+		r.Body.Close()
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		hash := sha256.Sum256(body)
+		scope := s.caller(r) + " " + r.Method + " " + r.URL.Path + " " + key
+
+		s.mu.Lock()
+		s.evictExpired(time.Now())
+		if entry, exists := s.entries[scope]; exists {
+			var replay idempotencyEntry
+			if entry.bodyHash == hash && entry.done {
+				replay = *entry
+			}
+			s.mu.Unlock()
+
+			switch {
+			case entry.bodyHash != hash:
+				WriteErrorResponse(w, http.StatusConflict, errors.New("idempotency key reused"),
+					"This idempotency key was already used with a different request body")
+			case !replay.done:
+				WriteErrorResponse(w, http.StatusConflict, errors.New("request in progress"),
+					"A request with this idempotency key is still being processed")
+			default:
+				for name, values := range replay.header {
+					w.Header()[name] = values
+				}
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.WriteHeader(replay.status)
+				w.Write(replay.body)
+			}
+			return
+		}
+
+		entry := &idempotencyEntry{bodyHash: hash, createdAt: time.Now()}
+		s.entries[scope] = entry
+		s.mu.Unlock()
+
+		// A panicking handler must not leave the key in flight, it could never be used again
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				s.mu.Lock()
+				delete(s.entries, scope)
+				s.mu.Unlock()
+				panic(recovered)
+			}
+		}()
+
+		recorder := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		next(recorder, r)
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		// Server errors and conflicts with the resource's current state are not stored so the client can retry them
+		if retryable(recorder.status) {
+			delete(s.entries, scope)
+			return
+		}
+
+		entry.done = true
+		entry.status = recorder.status
+		entry.header = recorder.Header().Clone()
+		entry.body = recorder.body.Bytes()
+	}
+}
+
+// retryable reports whether a response asks the client to retry, which replaying it would defeat
+func retryable(status int) bool {
+	return status >= http.StatusInternalServerError || status == http.StatusConflict || status == http.StatusPreconditionFailed
+}
+
+// evictExpired drops stored responses older than the window, and requests that have been in flight
+// for as long, which can only be stuck; callers must hold s.mu
+func (s *IdempotencyStore) evictExpired(now time.Time) {
+	for scope, entry := range s.entries {
+		if now.Sub(entry.createdAt) > s.window {
+			delete(s.entries, scope)
+		}
+	}
+}
+
+// responseRecorder captures the status and body written by a handler while passing them through
+type responseRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+// WriteHeader records the status code
+func (r *responseRecorder) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.status = status
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Write records the body
+func (r *responseRecorder) Write(data []byte) (int, error) {
+	r.wroteHeader = true
+	r.body.Write(data)
+	return r.ResponseWriter.Write(data)
+}
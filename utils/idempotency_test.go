@@ -0,0 +1,100 @@
+package utils
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// countingHandler answers each request with the next status and counts the calls
+func countingHandler(statuses ...int) (http.HandlerFunc, *int) {
+	calls := 0
+	return func(w http.ResponseWriter, r *http.Request) {
+		status := statuses[calls%len(statuses)]
+		calls++
+		w.WriteHeader(status)
+		w.Write([]byte(http.StatusText(status)))
+	}, &calls
+}
+
+// postWithKey sends a POST request with an idempotency key to handler
+func postWithKey(handler http.HandlerFunc, key, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/api/escrow/release", strings.NewReader(body))
+	if key != "" {
+		r.Header.Set(IdempotencyKeyHeader, key)
+	}
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+func TestIdempotencyReplaysResponse(t *testing.T) {
+	store := NewIdempotencyStore(time.Minute, func(r *http.Request) string { return "caller" })
+	next, calls := countingHandler(http.StatusOK, http.StatusCreated)
+	handler := store.Wrap(next)
+
+	first := postWithKey(handler, "key-1", `{"a":1}`)
+	replay := postWithKey(handler, "key-1", `{"a":1}`)
+	if *calls != 1 || replay.Code != first.Code || replay.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("expected the first response to be replayed, got %d after %d calls", replay.Code, *calls)
+	}
+
+	// The same key with another body is refused
+	if w := postWithKey(handler, "key-1", `{"a":2}`); w.Code != http.StatusConflict || *calls != 1 {
+		t.Errorf("expected a reused key to be refused with 409, got %d", w.Code)
+	}
+
+	// Requests without a key are not stored
+	postWithKey(handler, "", `{"a":1}`)
+	postWithKey(handler, "", `{"a":1}`)
+	if *calls != 3 {
+		t.Errorf("expected requests without a key to reach the handler, got %d calls", *calls)
+	}
+}
+
+func TestIdempotencyRetriesConflicts(t *testing.T) {
+	for _, status := range []int{http.StatusConflict, http.StatusPreconditionFailed, http.StatusBadGateway} {
+		store := NewIdempotencyStore(time.Minute, func(r *http.Request) string { return "caller" })
+		next, calls := countingHandler(status, http.StatusOK)
+		handler := store.Wrap(next)
+
+		postWithKey(handler, "key-1", `{}`)
+		if w := postWithKey(handler, "key-1", `{}`); w.Code != http.StatusOK || *calls != 2 {
+			t.Errorf("%d: expected the retry to reach the handler, got %d after %d calls", status, w.Code, *calls)
+		}
+	}
+
+	// Client errors other than conflicts are stored
+	store := NewIdempotencyStore(time.Minute, func(r *http.Request) string { return "caller" })
+	next, calls := countingHandler(http.StatusBadRequest, http.StatusOK)
+	handler := store.Wrap(next)
+	postWithKey(handler, "key-1", `{}`)
+	if w := postWithKey(handler, "key-1", `{}`); w.Code != http.StatusBadRequest || *calls != 1 {
+		t.Errorf("expected the 400 to be replayed, got %d after %d calls", w.Code, *calls)
+	}
+}
+
+func TestIdempotencyScopesAndExpiry(t *testing.T) {
+	caller := "alice"
+	store := NewIdempotencyStore(time.Minute, func(r *http.Request) string { return caller })
+	next, calls := countingHandler(http.StatusOK)
+	handler := store.Wrap(next)
+
+	postWithKey(handler, "key-1", `{}`)
+	caller = "bob"
+	if postWithKey(handler, "key-1", `{}`); *calls != 2 {
+		t.Errorf("expected a key to be scoped to its caller, got %d calls", *calls)
+	}
+
+	// Entries older than the window are dropped
+	store.mu.Lock()
+	for _, entry := range store.entries {
+		entry.createdAt = entry.createdAt.Add(-2 * time.Minute)
+	}
+	store.mu.Unlock()
+	if postWithKey(handler, "key-1", `{}`); *calls != 3 {
+		t.Errorf("expected an expired key to reach the handler again, got %d calls", *calls)
+	}
+}
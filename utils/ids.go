@@ -0,0 +1,79 @@
+package utils
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+// IDGenerator produces unique, unguessable identifiers
+type IDGenerator interface {
+	NewID() (string, error)
+}
+
+// UUIDv7Generator generates RFC 9562 version 7 UUIDs: a millisecond timestamp
+// followed by random bits, so IDs sort by creation time but cannot be guessed
+type UUIDv7Generator struct{}
+
+// NewID returns a new UUIDv7 string
+func (UUIDv7Generator) NewID() (string, error) {
+	var uuid [16]byte
+	if _, err := rand.Read(uuid[:]); err != nil {
+		return "", fmt.Errorf("failed to read random bytes: %v", err)
+	}
+
+	// 48-bit big-endian Unix timestamp in milliseconds
+	var ts [8]byte
+	binary.BigEndian.PutUint64(ts[:], uint64(time.Now().UnixNano()/int64(time.Millisecond)))
+	copy(uuid[0:6], ts[2:8])
+
+	uuid[6] = (uuid[6] & 0x0f) | 0x70 // version 7
+	uuid[8] = (uuid[8] & 0x3f) | 0x80 // RFC 4122 variant
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", uuid[0:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:16]), nil
+}
+
+// idGenerator is the generator used for escrow and payment request IDs
+var idGenerator IDGenerator = UUIDv7Generator{}
+
+// SetIDGenerator replaces the generator used for new IDs
+func SetIDGenerator(generator IDGenerator) {
+	idGenerator = generator
+}
+
+// NewID returns a new identifier with the given prefix, e.g. "escrow-<uuid>"
+func NewID(prefix string) (string, error) {
+	id, err := idGenerator.NewID()
+	if err != nil {
+		return "", fmt.Errorf("failed to generate ID: %v", err)
+	}
+
+	return prefix + "-" + id, nil
+}
+
+// NewAccessToken returns a random bearer token and the hash to store in its place
+func NewAccessToken() (token string, hash string, err error) {
+	var buf [32]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return "", "", fmt.Errorf("failed to read random bytes: %v", err)
+	}
+
+	token = base64.RawURLEncoding.EncodeToString(buf[:])
+	return token, HashToken(token), nil
+}
+
+// HashToken returns the hex-encoded SHA-256 hash of a token
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// TokenMatches compares a presented token against a stored hash in constant time
+func TokenMatches(token, hash string) bool {
+	return subtle.ConstantTimeCompare([]byte(HashToken(token)), []byte(hash)) == 1
+}
@@ -0,0 +1,71 @@
+package utils
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fixedGenerator returns the same ID every time
+type fixedGenerator string
+
+func (g fixedGenerator) NewID() (string, error) {
+	return string(g), nil
+}
+
+func TestUUIDv7(t *testing.T) {
+	format := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-7[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+	seen := make(map[string]bool)
+	previous := ""
+	for i := 0; i < 1000; i++ {
+		id, err := UUIDv7Generator{}.NewID()
+		if err != nil {
+			t.Fatalf("failed to generate an ID: %v", err)
+		}
+		if !format.MatchString(id) {
+			t.Fatalf("expected a version 7 UUID, got %s", id)
+		}
+		if seen[id] {
+			t.Fatalf("expected unique IDs, got %s twice", id)
+		}
+		seen[id] = true
+
+		// The timestamp prefix keeps IDs of different milliseconds in creation order
+		if i%100 == 0 {
+			if previous != "" && id[:13] < previous[:13] {
+				t.Errorf("expected %s to sort after %s", id, previous)
+			}
+			previous = id
+			time.Sleep(2 * time.Millisecond)
+		}
+	}
+}
+
+func TestNewIDUsesGenerator(t *testing.T) {
+	defer SetIDGenerator(idGenerator)
+	SetIDGenerator(fixedGenerator("fixed"))
+
+	if id, err := NewID("escrow"); err != nil || id != "escrow-fixed" {
+		t.Errorf("expected escrow-fixed, got %q (%v)", id, err)
+	}
+}
+
+func TestAccessToken(t *testing.T) {
+	token, hash, err := NewAccessToken()
+	if err != nil {
+		t.Fatalf("failed to create a token: %v", err)
+	}
+	if len(token) < 43 || strings.Contains(hash, token) {
+		t.Errorf("expected a 256-bit token stored only as its hash, got %q and %q", token, hash)
+	}
+
+	if !TokenMatches(token, hash) {
+		t.Errorf("expected the token to match its hash")
+	}
+	other, _, _ := NewAccessToken()
+	if TokenMatches(other, hash) || TokenMatches("", hash) {
+		t.Errorf("expected other tokens not to match")
+	}
+}
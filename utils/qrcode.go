@@ -0,0 +1,532 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"strings"
+)
+
+// QR codes (ISO/IEC 18004) in byte mode at error correction level M, which recovers about 15% damage
+// Enough for payment URIs, with no support for other modes or levels
+
+// Error correction codewords per block and number of blocks at level M, by version
+var (
+	qrECCPerBlock = [41]int{-1, 10, 16, 26, 18, 24, 16, 18, 22, 22, 26, 30, 22, 22, 24, 24, 28, 28, 26, 26, 26,
+		26, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28}
+	qrECCBlocks = [41]int{-1, 1, 1, 1, 2, 2, 4, 4, 4, 5, 5, 5, 8, 9, 9, 10, 10, 11, 13, 14, 16,
+		17, 17, 18, 20, 21, 23, 25, 26, 28, 29, 31, 33, 35, 37, 38, 40, 43, 45, 47, 49}
+)
+
+const (
+	qrMinVersion = 1
+	qrMaxVersion = 40
+	qrFormatM    = 0 // format bits of error correction level M
+)
+
+// QRCode is an encoded QR code symbol, without its quiet zone
+type QRCode struct {
+	Version  int
+	Size     int // modules per side
+	modules  [][]bool
+	function [][]bool // modules of the finder, timing, alignment, format and version patterns
+}
+
+// Dark reports whether the module at column x and row y is dark
+func (q *QRCode) Dark(x, y int) bool {
+	return x >= 0 && y >= 0 && x < q.Size && y < q.Size && q.modules[y][x]
+}
+
+// EncodeQR encodes data as a QR code of the smallest version that fits it
+func EncodeQR(data []byte) (*QRCode, error) {
+	version := qrMinVersion
+	for ; version <= qrMaxVersion; version++ {
+		if qrSegmentBits(version, len(data)) <= qrDataCodewords(version)*8 {
+			break
+		}
+	}
+	if version > qrMaxVersion {
+		return nil, fmt.Errorf("%d bytes are too many for a QR code", len(data))
+	}
+
+	// Mode indicator, character count, then the data
+	capacity := qrDataCodewords(version) * 8
+	bits := &bitBuffer{}
+	bits.append(0x4, 4) // byte mode
+	bits.append(uint32(len(data)), qrCountBits(version))
+	for _, b := range data {
+		bits.append(uint32(b), 8)
+	}
+
+	// Terminator, padding to a byte, then alternating pad bytes
+	bits.append(0, minInt(4, capacity-bits.len()))
+	bits.append(0, (8-bits.len()%8)%8)
+	for pad := uint32(0xEC); bits.len() < capacity; pad ^= 0xEC ^ 0x11 {
+		bits.append(pad, 8)
+	}
+
+	size := version*4 + 17
+	q := &QRCode{Version: version, Size: size, modules: make([][]bool, size), function: make([][]bool, size)}
+	for i := range q.modules {
+		q.modules[i] = make([]bool, size)
+		q.function[i] = make([]bool, size)
+	}
+
+	q.drawFunctionPatterns()
+	q.drawCodewords(qrAddECC(version, bits.bytes()))
+
+	// Keep the mask that leaves the fewest patterns that confuse readers
+	best, bestPenalty := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		q.applyMask(mask)
+		q.drawFormatBits(mask)
+		if penalty := q.penalty(); bestPenalty < 0 || penalty < bestPenalty {
+			best, bestPenalty = mask, penalty
+		}
+		q.applyMask(mask) // masking twice undoes it
+	}
+	q.applyMask(best)
+	q.drawFormatBits(best)
+
+	return q, nil
+}
+
+// PNG renders the code with scale pixels per module and a quiet zone of border modules
+func (q *QRCode) PNG(scale, border int) ([]byte, error) {
+	if scale < 1 || border < 0 {
+		return nil, errors.New("scale must be positive and border not negative")
+	}
+
+	side := (q.Size + 2*border) * scale
+	img := image.NewPaletted(image.Rect(0, 0, side, side), color.Palette{color.White, color.Black})
+	for y := 0; y < side; y++ {
+		for x := 0; x < side; x++ {
+			if q.Dark(x/scale-border, y/scale-border) {
+				img.SetColorIndex(x, y, 1)
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, fmt.Errorf("failed to encode PNG: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// SVG renders the code as an SVG document with a quiet zone of border modules, one unit per module
+func (q *QRCode) SVG(border int) string {
+	var path strings.Builder
+	for y := 0; y < q.Size; y++ {
+		for x := 0; x < q.Size; x++ {
+			if q.modules[y][x] {
+				fmt.Fprintf(&path, "M%d,%dh1v1h-1z", x+border, y+border)
+			}
+		}
+	}
+
+	side := q.Size + 2*border
+	return fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>`+"\n"+
+		`<svg xmlns="http://www.w3.org/2000/svg" version="1.1" viewBox="0 0 %d %d" shape-rendering="crispEdges">`+"\n"+
+		`<rect width="100%%" height="100%%" fill="#FFFFFF"/>`+"\n"+
+		`<path d="%s" fill="#000000"/>`+"\n"+
+		`</svg>`+"\n", side, side, path.String())
+}
+
+// qrCountBits returns the width of the byte mode character count
+func qrCountBits(version int) int {
+	if version <= 9 {
+		return 8
+	}
+	return 16
+}
+
+// qrSegmentBits returns the bits needed for n bytes in byte mode
+func qrSegmentBits(version, n int) int {
+	if n >= 1<<uint(qrCountBits(version)) {
+		return 1 << 30
+	}
+	return 4 + qrCountBits(version) + 8*n
+}
+
+// qrRawModules returns the modules left for data and error correction once the function patterns are drawn
+func qrRawModules(version int) int {
+	result := (16*version+128)*version + 64
+	if version >= 2 {
+		alignments := version/7 + 2
+		result -= (25*alignments-10)*alignments - 55
+		if version >= 7 {
+			result -= 36
+		}
+	}
+	return result
+}
+
+// qrDataCodewords returns the data codewords of a version at level M
+func qrDataCodewords(version int) int {
+	return qrRawModules(version)/8 - qrECCPerBlock[version]*qrECCBlocks[version]
+}
+
+// qrAddECC splits the data into blocks, appends each block's Reed-Solomon codewords, and interleaves them
+func qrAddECC(version int, data []byte) []byte {
+	numBlocks := qrECCBlocks[version]
+	eccLen := qrECCPerBlock[version]
+	rawCodewords := qrRawModules(version) / 8
+	numShort := numBlocks - rawCodewords%numBlocks
+	shortLen := rawCodewords / numBlocks
+
+	divisor := rsDivisor(eccLen)
+	blocks := make([][]byte, 0, numBlocks)
+	k := 0
+	for i := 0; i < numBlocks; i++ {
+		n := shortLen - eccLen
+		if i >= numShort {
+			n++
+		}
+		block := append([]byte{}, data[k:k+n]...)
+		k += n
+		ecc := rsRemainder(block, divisor)
+		if i < numShort {
+			block = append(block, 0) // placeholder, skipped when interleaving
+		}
+		blocks = append(blocks, append(block, ecc...))
+	}
+
+	result := make([]byte, 0, rawCodewords)
+	for i := range blocks[0] {
+		for j, block := range blocks {
+			if i != shortLen-eccLen || j >= numShort {
+				result = append(result, block[i])
+			}
+		}
+	}
+	return result
+}
+
+// rsDivisor returns the Reed-Solomon generator polynomial of the given degree, highest coefficient first,
+// without its leading 1
+func rsDivisor(degree int) []byte {
+	result := make([]byte, degree)
+	result[degree-1] = 1
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		for j := range result {
+			result[j] = gfMultiply(result[j], root)
+			if j+1 < len(result) {
+				result[j] ^= result[j+1]
+			}
+		}
+		root = gfMultiply(root, 0x02)
+	}
+	return result
+}
+
+// rsRemainder returns the Reed-Solomon error correction codewords of data
+func rsRemainder(data, divisor []byte) []byte {
+	result := make([]byte, len(divisor))
+	for _, b := range data {
+		factor := b ^ result[0]
+		copy(result, result[1:])
+		result[len(result)-1] = 0
+		for i, coefficient := range divisor {
+			result[i] ^= gfMultiply(coefficient, factor)
+		}
+	}
+	return result
+}
+
+// gfMultiply multiplies in GF(2^8) modulo x^8 + x^4 + x^3 + x^2 + 1
+func gfMultiply(x, y byte) byte {
+	z := 0
+	for i := 7; i >= 0; i-- {
+		z = (z << 1) ^ ((z >> 7) * 0x11D)
+		z ^= int((y>>uint(i))&1) * int(x)
+	}
+	return byte(z)
+}
+
+// setFunction sets a module that belongs to a function pattern
+func (q *QRCode) setFunction(x, y int, dark bool) {
+	q.modules[y][x] = dark
+	q.function[y][x] = true
+}
+
+// drawFunctionPatterns draws everything but the data, with placeholder format bits
+func (q *QRCode) drawFunctionPatterns() {
+	for i := 0; i < q.Size; i++ {
+		q.setFunction(6, i, i%2 == 0)
+		q.setFunction(i, 6, i%2 == 0)
+	}
+
+	for _, corner := range [][2]int{{3, 3}, {q.Size - 4, 3}, {3, q.Size - 4}} {
+		for dy := -4; dy <= 4; dy++ {
+			for dx := -4; dx <= 4; dx++ {
+				x, y := corner[0]+dx, corner[1]+dy
+				if x >= 0 && y >= 0 && x < q.Size && y < q.Size {
+					distance := maxInt(absInt(dx), absInt(dy))
+					q.setFunction(x, y, distance != 2 && distance != 4)
+				}
+			}
+		}
+	}
+
+	positions := q.alignmentPositions()
+	last := len(positions) - 1
+	for i, cy := range positions {
+		for j, cx := range positions {
+			// Alignment patterns are not drawn over the finders
+			if (i == 0 && j == 0) || (i == 0 && j == last) || (i == last && j == 0) {
+				continue
+			}
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					q.setFunction(cx+dx, cy+dy, maxInt(absInt(dx), absInt(dy)) != 1)
+				}
+			}
+		}
+	}
+
+	q.drawFormatBits(0)
+
+	if q.Version >= 7 {
+		rem := q.Version
+		for i := 0; i < 12; i++ {
+			rem = (rem << 1) ^ ((rem >> 11) * 0x1F25)
+		}
+		bits := q.Version<<12 | rem
+		for i := 0; i < 18; i++ {
+			dark := (bits>>uint(i))&1 != 0
+			a, b := q.Size-11+i%3, i/3
+			q.setFunction(a, b, dark)
+			q.setFunction(b, a, dark)
+		}
+	}
+}
+
+// alignmentPositions returns the row and column centers of the alignment patterns
+func (q *QRCode) alignmentPositions() []int {
+	if q.Version == 1 {
+		return nil
+	}
+
+	count := q.Version/7 + 2
+	step := (q.Version*4 + count*2 + 1) / (count*2 - 2) * 2
+	if q.Version == 32 {
+		step = 26
+	}
+
+	positions := make([]int, count)
+	positions[0] = 6
+	for i, position := count-1, q.Size-7; i >= 1; i, position = i-1, position-step {
+		positions[i] = position
+	}
+	return positions
+}
+
+// drawFormatBits draws both copies of the error correction level and mask, and the dark module
+func (q *QRCode) drawFormatBits(mask int) {
+	data := qrFormatM<<3 | mask
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = (rem << 1) ^ ((rem >> 9) * 0x537)
+	}
+	bits := (data<<10 | rem) ^ 0x5412
+	bit := func(i int) bool { return (bits>>uint(i))&1 != 0 }
+
+	for i := 0; i <= 5; i++ {
+		q.setFunction(8, i, bit(i))
+	}
+	q.setFunction(8, 7, bit(6))
+	q.setFunction(8, 8, bit(7))
+	q.setFunction(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		q.setFunction(14-i, 8, bit(i))
+	}
+
+	for i := 0; i < 8; i++ {
+		q.setFunction(q.Size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		q.setFunction(8, q.Size-15+i, bit(i))
+	}
+	q.setFunction(8, q.Size-8, true)
+}
+
+// drawCodewords places the codewords in the zigzag order, two columns at a time from the bottom right
+func (q *QRCode) drawCodewords(codewords []byte) {
+	i := 0
+	for right := q.Size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5 // skip the vertical timing pattern
+		}
+		for vertical := 0; vertical < q.Size; vertical++ {
+			for j := 0; j < 2; j++ {
+				x := right - j
+				y := vertical
+				if (right+1)&2 == 0 {
+					y = q.Size - 1 - vertical // upwards
+				}
+				if !q.function[y][x] && i < len(codewords)*8 {
+					q.modules[y][x] = (codewords[i>>3]>>uint(7-i&7))&1 != 0
+					i++
+				}
+			}
+		}
+	}
+}
+
+// applyMask flips the data modules selected by the mask pattern
+func (q *QRCode) applyMask(mask int) {
+	for y := 0; y < q.Size; y++ {
+		for x := 0; x < q.Size; x++ {
+			var flip bool
+			switch mask {
+			case 0:
+				flip = (x+y)%2 == 0
+			case 1:
+				flip = y%2 == 0
+			case 2:
+				flip = x%3 == 0
+			case 3:
+				flip = (x+y)%3 == 0
+			case 4:
+				flip = (x/3+y/2)%2 == 0
+			case 5:
+				flip = x*y%2+x*y%3 == 0
+			case 6:
+				flip = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				flip = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if flip && !q.function[y][x] {
+				q.modules[y][x] = !q.modules[y][x]
+			}
+		}
+	}
+}
+
+// penalty scores the symbol by the rules of the standard, lower is easier to read
+func (q *QRCode) penalty() int {
+	result := 0
+	finderLike := [][]bool{
+		{true, false, true, true, true, false, true, false, false, false, false},
+		{false, false, false, false, true, false, true, true, true, false, true},
+	}
+
+	for pass := 0; pass < 2; pass++ {
+		at := func(i, j int) bool {
+			if pass == 0 {
+				return q.modules[i][j] // rows
+			}
+			return q.modules[j][i] // columns
+		}
+
+		for i := 0; i < q.Size; i++ {
+			// Runs of five or more modules of the same color
+			run := 1
+			for j := 1; j <= q.Size; j++ {
+				if j < q.Size && at(i, j) == at(i, j-1) {
+					run++
+					continue
+				}
+				if run >= 5 {
+					result += run - 2
+				}
+				run = 1
+			}
+
+			// Patterns that look like a finder, with four light modules on one side
+			for j := 0; j+len(finderLike[0]) <= q.Size; j++ {
+				for _, pattern := range finderLike {
+					matched := true
+					for k, dark := range pattern {
+						if at(i, j+k) != dark {
+							matched = false
+							break
+						}
+					}
+					if matched {
+						result += 40
+					}
+				}
+			}
+		}
+	}
+
+	// 2x2 blocks of the same color
+	dark := 0
+	for y := 0; y < q.Size; y++ {
+		for x := 0; x < q.Size; x++ {
+			if q.modules[y][x] {
+				dark++
+			}
+			if x > 0 && y > 0 {
+				c := q.modules[y][x]
+				if c == q.modules[y][x-1] && c == q.modules[y-1][x] && c == q.modules[y-1][x-1] {
+					result += 3
+				}
+			}
+		}
+	}
+
+	// Balance of dark and light modules
+	total := q.Size * q.Size
+	deviation := absInt(dark*20-total*10) / total
+	result += deviation * 10
+	return result
+}
+
+// bitBuffer accumulates bits, most significant first
+type bitBuffer struct {
+	bits []bool
+}
+
+// append adds the low n bits of value
+func (b *bitBuffer) append(value uint32, n int) {
+	for i := n - 1; i >= 0; i-- {
+		b.bits = append(b.bits, (value>>uint(i))&1 != 0)
+	}
+}
+
+// len returns the number of bits
+func (b *bitBuffer) len() int {
+	return len(b.bits)
+}
+
+// bytes packs the bits, whose count is a multiple of 8, into bytes
+func (b *bitBuffer) bytes() []byte {
+	result := make([]byte, len(b.bits)/8)
+	for i, bit := range b.bits {
+		if bit {
+			result[i/8] |= 1 << uint(7-i%8)
+		}
+	}
+	return result
+}
+
+// minInt returns the smaller of a and b
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// maxInt returns the larger of a and b
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// absInt returns the absolute value of a
+func absInt(a int) int {
+	if a < 0 {
+		return -a
+	}
+	return a
+}
@@ -0,0 +1,225 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// Byte mode capacity at error correction level M, from the tables of ISO/IEC 18004
+var qrCapacityM = map[int]int{1: 14, 2: 26, 3: 42, 4: 62, 5: 84, 6: 106, 7: 122, 8: 152, 9: 180, 10: 213, 40: 2331}
+
+// Format information of level M by mask, after the 0x5412 XOR, from the tables of ISO/IEC 18004
+var qrFormatInfoM = [8]int{0x5412, 0x5125, 0x5E7C, 0x5B4B, 0x45F9, 0x40CE, 0x4F97, 0x4AA0}
+
+// Alignment pattern centers by version, from the tables of ISO/IEC 18004
+var qrAlignmentCenters = map[int][]int{
+	2: {6, 18}, 3: {6, 22}, 4: {6, 26}, 5: {6, 30}, 6: {6, 34}, 7: {6, 22, 38}, 8: {6, 24, 42},
+	9: {6, 26, 46}, 10: {6, 28, 50}, 11: {6, 30, 54}, 12: {6, 32, 58}, 13: {6, 34, 62},
+}
+
+func TestQRVersionCapacity(t *testing.T) {
+	for version, capacity := range qrCapacityM {
+		code, err := EncodeQR(bytes.Repeat([]byte{'a'}, capacity))
+		if err != nil {
+			t.Fatalf("version %d: failed to encode %d bytes: %v", version, capacity, err)
+		}
+		if code.Version != version || code.Size != 17+4*version {
+			t.Errorf("%d bytes: expected version %d of size %d, got version %d of size %d",
+				capacity, version, 17+4*version, code.Version, code.Size)
+		}
+
+		if version == qrMaxVersion {
+			if _, err := EncodeQR(bytes.Repeat([]byte{'a'}, capacity+1)); err == nil {
+				t.Errorf("expected %d bytes to be too many for a QR code", capacity+1)
+			}
+			continue
+		}
+		code, err = EncodeQR(bytes.Repeat([]byte{'a'}, capacity+1))
+		if err != nil || code.Version != version+1 {
+			t.Errorf("%d bytes: expected version %d, got %+v, %v", capacity+1, version+1, code, err)
+		}
+	}
+}
+
+func TestQRDecode(t *testing.T) {
+	payloads := []string{
+		"bitcoin:2N7DRF4Ny72Ws7p2TwQbd8J7oK4RHiFuLhX",
+		"bitcoin:2N7DRF4Ny72Ws7p2TwQbd8J7oK4RHiFuLhX?amount=0.001&label=Escrow&message=Order%2042" +
+			"&r=https%3A%2F%2Fescrow.example.com%2Fapi%2Fpay%2Frequest%2Fpayreq-01957f4e-86aa-7d3b-9a51-3c8e2f6b1d07",
+		strings.Repeat("0123456789abcdef", 19),
+	}
+
+	for _, payload := range payloads {
+		code, err := EncodeQR([]byte(payload))
+		if err != nil {
+			t.Fatalf("failed to encode %q: %v", payload, err)
+		}
+		decoded, err := decodeQRForTest(code)
+		if err != nil {
+			t.Errorf("version %d: failed to decode: %v", code.Version, err)
+			continue
+		}
+		if decoded != payload {
+			t.Errorf("version %d: decoded %q, expected %q", code.Version, decoded, payload)
+		}
+	}
+}
+
+// decodeQRForTest reads a level M byte mode symbol back, locating the data modules from the standard's
+// layout rather than the encoder's bookkeeping, and checks each block's Reed-Solomon syndromes
+func decodeQRForTest(code *QRCode) (string, error) {
+	size, version := code.Size, code.Version
+	if size != 17+4*version {
+		return "", fmt.Errorf("size %d does not match version %d", size, version)
+	}
+
+	// Format information, the first copy around the top left finder
+	format := 0
+	positions := [][2]int{{8, 0}, {8, 1}, {8, 2}, {8, 3}, {8, 4}, {8, 5}, {8, 7}, {8, 8}, {7, 8},
+		{5, 8}, {4, 8}, {3, 8}, {2, 8}, {1, 8}, {0, 8}}
+	for i, p := range positions {
+		if code.Dark(p[0], p[1]) {
+			format |= 1 << uint(i)
+		}
+	}
+	mask := -1
+	for m, info := range qrFormatInfoM {
+		if info == format {
+			mask = m
+		}
+	}
+	if mask < 0 {
+		return "", fmt.Errorf("format information %#x is not level M", format)
+	}
+	if !code.Dark(8, size-8) {
+		return "", fmt.Errorf("missing dark module")
+	}
+
+	isFunction := func(x, y int) bool {
+		switch {
+		case x == 6 || y == 6: // timing patterns
+			return true
+		case x <= 8 && y <= 8, x >= size-8 && y <= 8, x <= 8 && y >= size-8: // finders, separators, format
+			return true
+		case version >= 7 && ((x >= size-11 && y < 6) || (y >= size-11 && x < 6)): // version information
+			return true
+		}
+		centers := qrAlignmentCenters[version]
+		last := len(centers) - 1
+		for i, cy := range centers {
+			for j, cx := range centers {
+				if (i == 0 && j == 0) || (i == 0 && j == last) || (i == last && j == 0) {
+					continue
+				}
+				if absInt(x-cx) <= 2 && absInt(y-cy) <= 2 {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	if version > 1 && qrAlignmentCenters[version] == nil {
+		return "", fmt.Errorf("no alignment table for version %d", version)
+	}
+
+	// Data modules in zigzag order, unmasked
+	var bits []bool
+	for right := size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		for vertical := 0; vertical < size; vertical++ {
+			for j := 0; j < 2; j++ {
+				x, y := right-j, vertical
+				if (right+1)&2 == 0 {
+					y = size - 1 - vertical
+				}
+				if isFunction(x, y) {
+					continue
+				}
+				masks := [8]bool{(x+y)%2 == 0, y%2 == 0, x%3 == 0, (x+y)%3 == 0, (x/3+y/2)%2 == 0,
+					x*y%2+x*y%3 == 0, (x*y%2+x*y%3)%2 == 0, ((x+y)%2+x*y%3)%2 == 0}
+				bits = append(bits, code.Dark(x, y) != masks[mask])
+			}
+		}
+	}
+	codewords := make([]byte, len(bits)/8)
+	for i := range codewords {
+		for j := 0; j < 8; j++ {
+			if bits[i*8+j] {
+				codewords[i] |= 1 << uint(7-j)
+			}
+		}
+	}
+
+	// Undo the interleaving: data codewords of every block first, then their error correction codewords
+	numBlocks, eccLen := qrECCBlocks[version], qrECCPerBlock[version]
+	numShort := numBlocks - len(codewords)%numBlocks
+	shortData := len(codewords)/numBlocks - eccLen
+	blocks := make([][]byte, numBlocks)
+	next := 0
+	for i := 0; i <= shortData; i++ {
+		for b := range blocks {
+			if i < shortData || b >= numShort {
+				blocks[b] = append(blocks[b], codewords[next])
+				next++
+			}
+		}
+	}
+	for i := 0; i < eccLen; i++ {
+		for b := range blocks {
+			blocks[b] = append(blocks[b], codewords[next])
+			next++
+		}
+	}
+
+	// Every block is a codeword of the Reed-Solomon code, its polynomial vanishes at the generator's roots
+	var data []byte
+	for b, block := range blocks {
+		root := byte(1)
+		for i := 0; i < eccLen; i++ {
+			var value byte
+			for _, c := range block {
+				value = gfMultiply(value, root) ^ c
+			}
+			if value != 0 {
+				return "", fmt.Errorf("block %d has a nonzero syndrome %d", b, i)
+			}
+			root = gfMultiply(root, 2)
+		}
+		data = append(data, block[:len(block)-eccLen]...)
+	}
+
+	// Byte mode segment
+	reader := &bitReader{data: data}
+	if mode := reader.read(4); mode != 0x4 {
+		return "", fmt.Errorf("mode %#x is not byte mode", mode)
+	}
+	count := reader.read(qrCountBits(version))
+	if count*8 > len(data)*8-reader.pos {
+		return "", fmt.Errorf("character count %d overruns the data", count)
+	}
+	payload := make([]byte, count)
+	for i := range payload {
+		payload[i] = byte(reader.read(8))
+	}
+	return string(payload), nil
+}
+
+// bitReader reads big-endian bit fields from a byte slice
+type bitReader struct {
+	data []byte
+	pos  int
+}
+
+// read returns the next n bits
+func (r *bitReader) read(n int) int {
+	value := 0
+	for i := 0; i < n; i++ {
+		value = value<<1 | int(r.data[r.pos>>3]>>uint(7-r.pos&7)&1)
+		r.pos++
+	}
+	return value
+}
@@ -0,0 +1,194 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/ecdsa"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// Signed message formats accepted by VerifySignedMessage
+const (
+	SignatureTypeLegacy = "legacy" // Bitcoin Core signmessage compact signature (P2PKH)
+	SignatureTypeBIP322 = "bip322" // BIP322 simple signature (P2WPKH)
+)
+
+// messageMagic is the prefix Bitcoin Core adds before hashing a signed message
+const messageMagic = "Bitcoin Signed Message:\n"
+
+// bip322Tag is the tagged hash tag for BIP322 message hashes
+const bip322Tag = "BIP0322-signed-message"
+
+// ValidatePublicKey checks that pubKeyHex is a hex-encoded secp256k1 public key, compressed or uncompressed
+func ValidatePublicKey(pubKeyHex string) error {
+	pubKeyBytes, err := hex.DecodeString(pubKeyHex)
+	if err != nil {
+		return fmt.Errorf("invalid public key: %v", err)
+	}
+	if _, err := btcec.ParsePubKey(pubKeyBytes); err != nil {
+		return fmt.Errorf("invalid public key: %v", err)
+	}
+	return nil
+}
+
+// VerifySignedMessage verifies that signature was made over message by the key pubKeyHex
+// If signatureType is empty it is detected from the signature length
+func VerifySignedMessage(pubKeyHex, message, signature, signatureType string) error {
+	pubKeyBytes, err := hex.DecodeString(pubKeyHex)
+	if err != nil {
+		return fmt.Errorf("invalid public key: %v", err)
+	}
+
+	pubKey, err := btcec.ParsePubKey(pubKeyBytes)
+	if err != nil {
+		return fmt.Errorf("invalid public key: %v", err)
+	}
+
+	sigBytes, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return fmt.Errorf("signature is not valid base64: %v", err)
+	}
+
+	if signatureType == "" {
+		signatureType = SignatureTypeBIP322
+		if len(sigBytes) == 65 {
+			signatureType = SignatureTypeLegacy
+		}
+	}
+
+	switch signatureType {
+	case SignatureTypeLegacy:
+		return verifyLegacyMessage(pubKey, pubKeyBytes, message, sigBytes)
+	case SignatureTypeBIP322:
+		return verifyBIP322Message(pubKey, message, sigBytes)
+	default:
+		return fmt.Errorf("unsupported signature type: %s", signatureType)
+	}
+}
+
+// verifyLegacyMessage checks a 65-byte compact signature by recovering the signing key
+func verifyLegacyMessage(pubKey *btcec.PublicKey, pubKeyBytes []byte, message string, sig []byte) error {
+	var buf bytes.Buffer
+	wire.WriteVarString(&buf, 0, messageMagic)
+	wire.WriteVarString(&buf, 0, message)
+	hash := chainhash.DoubleHashB(buf.Bytes())
+
+	recovered, compressed, err := ecdsa.RecoverCompact(sig, hash)
+	if err != nil {
+		return fmt.Errorf("invalid signature: %v", err)
+	}
+
+	if !recovered.IsEqual(pubKey) {
+		return errors.New("signature was not made by this public key")
+	}
+
+	// The recovery flag commits to the key encoding, which must match the registered key
+	if compressed != (len(pubKeyBytes) == btcec.PubKeyBytesLenCompressed) {
+		return errors.New("signature key encoding does not match the public key")
+	}
+
+	return nil
+}
+
+// verifyBIP322Message checks a BIP322 "simple" signature for the P2WPKH address of pubKey
+// The signature is the serialized witness stack of the virtual to_sign transaction
+func verifyBIP322Message(pubKey *btcec.PublicKey, message string, sig []byte) error {
+	witness, err := parseWitness(sig)
+	if err != nil {
+		return fmt.Errorf("invalid BIP322 signature: %v", err)
+	}
+
+	addr, err := btcutil.NewAddressWitnessPubKeyHash(btcutil.Hash160(pubKey.SerializeCompressed()), netParams)
+	if err != nil {
+		return fmt.Errorf("failed to derive segwit address: %v", err)
+	}
+
+	pkScript, err := txscript.PayToAddrScript(addr)
+	if err != nil {
+		return fmt.Errorf("failed to create output script: %v", err)
+	}
+
+	// to_spend commits to the message hash and pays the address being proven
+	messageHash := chainhash.TaggedHash([]byte(bip322Tag), []byte(message))
+	scriptSig, err := txscript.NewScriptBuilder().AddOp(txscript.OP_0).AddData(messageHash[:]).Script()
+	if err != nil {
+		return fmt.Errorf("failed to build to_spend script: %v", err)
+	}
+
+	toSpend := wire.NewMsgTx(0)
+	toSpend.AddTxIn(&wire.TxIn{
+		PreviousOutPoint: wire.OutPoint{Index: 0xffffffff},
+		SignatureScript:  scriptSig,
+		Sequence:         0,
+	})
+	toSpend.AddTxOut(wire.NewTxOut(0, pkScript))
+
+	// to_sign spends to_spend with the provided witness
+	toSign := wire.NewMsgTx(0)
+	toSign.AddTxIn(&wire.TxIn{
+		PreviousOutPoint: wire.OutPoint{Hash: toSpend.TxHash(), Index: 0},
+		Witness:          witness,
+		Sequence:         0,
+	})
+	toSign.AddTxOut(wire.NewTxOut(0, []byte{txscript.OP_RETURN}))
+
+	prevFetcher := txscript.NewCannedPrevOutputFetcher(pkScript, 0)
+	engine, err := txscript.NewEngine(pkScript, toSign, 0, txscript.StandardVerifyFlags, nil,
+		txscript.NewTxSigHashes(toSign, prevFetcher), 0, prevFetcher)
+	if err != nil {
+		return fmt.Errorf("failed to create script engine: %v", err)
+	}
+
+	if err := engine.Execute(); err != nil {
+		return fmt.Errorf("signature verification failed: %v", err)
+	}
+
+	return nil
+}
+
+// parseWitness decodes a consensus-serialized witness stack
+func parseWitness(data []byte) (wire.TxWitness, error) {
+	r := bytes.NewReader(data)
+
+	count, err := wire.ReadVarInt(r, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	if count == 0 || count > uint64(len(data)) {
+		return nil, fmt.Errorf("invalid witness item count: %d", count)
+	}
+
+	witness := make(wire.TxWitness, 0, count)
+	for i := uint64(0); i < count; i++ {
+		item, err := wire.ReadVarBytes(r, 0, wire.MaxMessagePayload, "witness item")
+		if err != nil {
+			return nil, err
+		}
+		witness = append(witness, item)
+	}
+
+	if r.Len() != 0 {
+		return nil, errors.New("trailing data after witness stack")
+	}
+
+	return witness, nil
+}
+
+// LoginMessage returns the message a party signs to prove control of pubKey
+func LoginMessage(pubKey, nonce string) string {
+	return strings.Join([]string{
+		"Escrow service login",
+		"Public key: " + pubKey,
+		"Nonce: " + nonce,
+	}, "\n")
+}
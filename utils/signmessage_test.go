@@ -0,0 +1,122 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/ecdsa"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// BIP322 test vectors: the simple signatures of the P2WPKH address of this key
+const (
+	bip322PrivKey       = "L3VFeEujGtevx9w18HD1fhRbCH67Az2dpCymeRE1SoPK6XQtaN2k"
+	bip322HelloWorldSig = "AkcwRAIgZRfIY3p7/DoVTty6YZbWS71bc5Vct9p9Fia83eRmw2QCICK/ENGfwLtptFluMGs2KsqoNSk89pO7F29zJLUx9a/sASECx/EgAxlkQpQ9hYjgGu6EBCPMVPwVIVJqO4XCsMvViHI="
+	bip322EmptySig      = "AkcwRAIgM2gBAQqvZX15ZiysmKmQpDrG83avLIT492QBzLnQIxYCIBaTpOaD20qRlEylyxFSeEA2ba9YOixpX8z46TSDtS40ASECx/EgAxlkQpQ9hYjgGu6EBCPMVPwVIVJqO4XCsMvViHI="
+)
+
+// signLegacy signs message as Bitcoin Core's signmessage does, for the compressed or uncompressed key
+func signLegacy(t *testing.T, key *btcec.PrivateKey, message string, compressed bool) string {
+	t.Helper()
+
+	var buf bytes.Buffer
+	wire.WriteVarString(&buf, 0, messageMagic)
+	wire.WriteVarString(&buf, 0, message)
+	sig, err := ecdsa.SignCompact(key, chainhash.DoubleHashB(buf.Bytes()), compressed)
+	if err != nil {
+		t.Fatalf("failed to sign: %v", err)
+	}
+	return base64.StdEncoding.EncodeToString(sig)
+}
+
+func TestVerifyLegacyMessage(t *testing.T) {
+	key, err := btcec.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressed := hex.EncodeToString(key.PubKey().SerializeCompressed())
+	uncompressed := hex.EncodeToString(key.PubKey().SerializeUncompressed())
+	message := LoginMessage(compressed, "nonce")
+
+	signature := signLegacy(t, key, message, true)
+	if err := VerifySignedMessage(compressed, message, signature, ""); err != nil {
+		t.Errorf("expected a valid signature to verify, got %v", err)
+	}
+	if err := VerifySignedMessage(compressed, message, signature, SignatureTypeLegacy); err != nil {
+		t.Errorf("expected a valid signature to verify as legacy, got %v", err)
+	}
+
+	other, _ := btcec.NewPrivateKey()
+	for name, check := range map[string]func() error{
+		"another message": func() error { return VerifySignedMessage(compressed, message+"!", signature, "") },
+		"another key": func() error {
+			return VerifySignedMessage(hex.EncodeToString(other.PubKey().SerializeCompressed()), message, signature, "")
+		},
+		"the other key encoding": func() error { return VerifySignedMessage(uncompressed, message, signature, "") },
+		"an uncompressed signature": func() error {
+			return VerifySignedMessage(compressed, message, signLegacy(t, key, message, false), "")
+		},
+		"a bad signature": func() error { return VerifySignedMessage(compressed, message, "not base64!", "") },
+	} {
+		if check() == nil {
+			t.Errorf("expected a signature with %s to be refused", name)
+		}
+	}
+
+	// An uncompressed key verifies with an uncompressed signature
+	if err := VerifySignedMessage(uncompressed, message, signLegacy(t, key, message, false), ""); err != nil {
+		t.Errorf("expected an uncompressed key to verify, got %v", err)
+	}
+}
+
+func TestVerifyBIP322Message(t *testing.T) {
+	wif, err := btcutil.DecodeWIF(bip322PrivKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubKey := hex.EncodeToString(wif.PrivKey.PubKey().SerializeCompressed())
+
+	if err := VerifySignedMessage(pubKey, "Hello World", bip322HelloWorldSig, ""); err != nil {
+		t.Errorf("expected the Hello World vector to verify, got %v", err)
+	}
+	if err := VerifySignedMessage(pubKey, "", bip322EmptySig, SignatureTypeBIP322); err != nil {
+		t.Errorf("expected the empty message vector to verify, got %v", err)
+	}
+
+	other, _ := btcec.NewPrivateKey()
+	if err := VerifySignedMessage(pubKey, "Hello World", bip322EmptySig, ""); err == nil {
+		t.Errorf("expected a signature of another message to be refused")
+	}
+	if err := VerifySignedMessage(hex.EncodeToString(other.PubKey().SerializeCompressed()), "Hello World", bip322HelloWorldSig, ""); err == nil {
+		t.Errorf("expected a signature by another key to be refused")
+	}
+
+	// A witness with trailing bytes is not a serialized witness stack
+	raw, _ := base64.StdEncoding.DecodeString(bip322HelloWorldSig)
+	if err := VerifySignedMessage(pubKey, "Hello World", base64.StdEncoding.EncodeToString(append(raw, 0)), ""); err == nil {
+		t.Errorf("expected trailing data to be refused")
+	}
+}
+
+func TestValidatePublicKey(t *testing.T) {
+	key, _ := btcec.NewPrivateKey()
+	for _, valid := range []string{
+		hex.EncodeToString(key.PubKey().SerializeCompressed()),
+		hex.EncodeToString(key.PubKey().SerializeUncompressed()),
+	} {
+		if err := ValidatePublicKey(valid); err != nil {
+			t.Errorf("expected %s to be valid, got %v", valid, err)
+		}
+	}
+
+	for _, invalid := range []string{"", "zz", "02", "04" + hex.EncodeToString(make([]byte, 64))} {
+		if err := ValidatePublicKey(invalid); err == nil {
+			t.Errorf("expected %q to be refused", invalid)
+		}
+	}
+}
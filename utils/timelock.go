@@ -0,0 +1,178 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// LockTimeThreshold is the smallest lock time interpreted as a Unix timestamp rather than a block height
+const LockTimeThreshold = txscript.LockTimeThreshold
+
+// recoverySequence enables nLockTime on the recovery input without opting in to replacement
+const recoverySequence = wire.MaxTxInSequenceNum - 1
+
+// TimelockedEscrowScript builds the escrow redeem script with a buyer recovery path:
+//
+//	OP_IF
+//	  2 <buyer> <seller> <escrow> 3 OP_CHECKMULTISIG
+//	OP_ELSE
+//	  <lockTime> OP_CHECKLOCKTIMEVERIFY OP_DROP <buyer> OP_CHECKSIG
+//	OP_ENDIF
+//
+// The multisig branch is spent as usual; after lockTime the buyer can spend alone
+func TimelockedEscrowScript(buyerPubKey, sellerPubKey, escrowPubKey string, lockTime int64) ([]byte, error) {
+	if lockTime < LockTimeThreshold {
+		return nil, fmt.Errorf("lock time must be a Unix timestamp, got %d", lockTime)
+	}
+
+	names := []string{"buyer", "seller", "escrow"}
+	keys := make([][]byte, 0, 3)
+	for i, pubKey := range []string{buyerPubKey, sellerPubKey, escrowPubKey} {
+		key, err := parsePubKey(pubKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s public key: %v", names[i], err)
+		}
+		keys = append(keys, key)
+	}
+
+	return txscript.NewScriptBuilder().
+		AddOp(txscript.OP_IF).
+		AddOp(txscript.OP_2).
+		AddData(keys[0]).AddData(keys[1]).AddData(keys[2]).
+		AddOp(txscript.OP_3).
+		AddOp(txscript.OP_CHECKMULTISIG).
+		AddOp(txscript.OP_ELSE).
+		AddInt64(lockTime).
+		AddOp(txscript.OP_CHECKLOCKTIMEVERIFY).
+		AddOp(txscript.OP_DROP).
+		AddData(keys[0]).
+		AddOp(txscript.OP_CHECKSIG).
+		AddOp(txscript.OP_ENDIF).
+		Script()
+}
+
+// CreateTimelockedMultiSig creates the P2SH address for TimelockedEscrowScript and returns it with the redeem script
+func CreateTimelockedMultiSig(buyerPubKey, sellerPubKey, escrowPubKey string, lockTime int64) (string, []byte, error) {
+	script, err := TimelockedEscrowScript(buyerPubKey, sellerPubKey, escrowPubKey, lockTime)
+	if err != nil {
+		return "", nil, err
+	}
+
+	scriptHash, err := btcutil.NewAddressScriptHash(script, netParams)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to create script hash: %v", err)
+	}
+
+	return scriptHash.EncodeAddress(), script, nil
+}
+
+// PubKeyHashAddress returns the P2PKH address for a hex-encoded public key
+func PubKeyHashAddress(pubKey string) (string, error) {
+	key, err := parsePubKey(pubKey)
+	if err != nil {
+		return "", err
+	}
+
+	addr, err := btcutil.NewAddressPubKeyHash(btcutil.Hash160(key), netParams)
+	if err != nil {
+		return "", err
+	}
+
+	return addr.EncodeAddress(), nil
+}
+
+// RecoveryTransaction is an unsigned transaction spending the timelocked branch of an escrow script
+type RecoveryTransaction struct {
+	Tx          *wire.MsgTx
+	SigHashes   [][]byte // legacy SIGHASH_ALL digest the buyer signs, one per input
+	ScriptSig   string   // template for each input script, in script assembly
+	PayoutValue int64
+}
+
+// CreateRecoveryTransaction builds the buyer's recovery transaction spending every escrow output in inputs
+// The transaction's lock time is set so it becomes valid once the script's lock time has passed
+func CreateRecoveryTransaction(inputs []TxInput, redeemScript []byte, lockTime int64, toAddress string,
+	fee int64) (*RecoveryTransaction, error) {
+	if len(inputs) == 0 {
+		return nil, errors.New("at least one funding output is required")
+	}
+
+	tx := wire.NewMsgTx(2)
+	var amount int64
+	for _, input := range inputs {
+		hash, err := chainhash.NewHashFromStr(input.TxID)
+		if err != nil {
+			return nil, fmt.Errorf("invalid funding transaction ID: %v", err)
+		}
+
+		tx.AddTxIn(&wire.TxIn{
+			PreviousOutPoint: wire.OutPoint{Hash: *hash, Index: input.Vout},
+			Sequence:         recoverySequence,
+		})
+		amount += input.Value
+	}
+
+	if amount-fee <= 0 {
+		return nil, errors.New("amount does not cover the recovery fee")
+	}
+
+	addr, err := btcutil.DecodeAddress(toAddress, netParams)
+	if err != nil {
+		return nil, fmt.Errorf("invalid recovery address: %v", err)
+	}
+
+	pkScript, err := txscript.PayToAddrScript(addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create output script: %v", err)
+	}
+
+	tx.AddTxOut(wire.NewTxOut(amount-fee, pkScript))
+	tx.LockTime = uint32(lockTime)
+
+	// Each input signs the whole transaction with the redeem script in its place
+	sigHashes := make([][]byte, 0, len(inputs))
+	for i := range inputs {
+		sigHash, err := txscript.CalcSignatureHash(redeemScript, txscript.SigHashAll, tx, i)
+		if err != nil {
+			return nil, fmt.Errorf("failed to compute signature hash: %v", err)
+		}
+		sigHashes = append(sigHashes, sigHash)
+	}
+
+	return &RecoveryTransaction{
+		Tx:          tx,
+		SigHashes:   sigHashes,
+		ScriptSig:   "<buyer signature> OP_FALSE " + hex.EncodeToString(redeemScript),
+		PayoutValue: amount - fee,
+	}, nil
+}
+
+// SerializeTransaction returns the hex encoding of a transaction
+func SerializeTransaction(tx *wire.MsgTx) (string, error) {
+	var buf bytes.Buffer
+	if err := tx.Serialize(&buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf.Bytes()), nil
+}
+
+// parsePubKey decodes a hex-encoded public key and checks it is a valid secp256k1 point
+func parsePubKey(pubKey string) ([]byte, error) {
+	key, err := hex.DecodeString(pubKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := btcutil.NewAddressPubKey(key, netParams); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
@@ -0,0 +1,112 @@
+package utils
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/ecdsa"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// newTestKey returns a fresh private key and its compressed public key in hex
+func newTestKey(t *testing.T) (*btcec.PrivateKey, string) {
+	t.Helper()
+
+	key, err := btcec.NewPrivateKey()
+	if err != nil {
+		t.Fatalf("failed to create a key: %v", err)
+	}
+	return key, hex.EncodeToString(key.PubKey().SerializeCompressed())
+}
+
+// runRecoveryInput signs input i of tx with key as the recovery kit instructs and executes its scripts
+func runRecoveryInput(t *testing.T, tx *wire.MsgTx, i int, sigHash, redeemScript []byte, key *btcec.PrivateKey, value int64) error {
+	t.Helper()
+
+	signature := append(ecdsa.Sign(key, sigHash).Serialize(), byte(txscript.SigHashAll))
+	scriptSig, err := txscript.NewScriptBuilder().AddData(signature).AddOp(txscript.OP_FALSE).AddData(redeemScript).Script()
+	if err != nil {
+		t.Fatalf("failed to build the input script: %v", err)
+	}
+	tx.TxIn[i].SignatureScript = scriptSig
+
+	address, _ := btcutil.NewAddressScriptHash(redeemScript, netParams)
+	pkScript, _ := txscript.PayToAddrScript(address)
+	engine, err := txscript.NewEngine(pkScript, tx, i, txscript.StandardVerifyFlags, nil, nil, value,
+		txscript.NewCannedPrevOutputFetcher(pkScript, value))
+	if err != nil {
+		return err
+	}
+	return engine.Execute()
+}
+
+func TestRecoveryTransactionSpendsTimelockedBranch(t *testing.T) {
+	buyer, buyerPubKey := newTestKey(t)
+	_, sellerPubKey := newTestKey(t)
+	_, escrowPubKey := newTestKey(t)
+	lockTime := time.Now().Add(30 * 24 * time.Hour).Unix()
+
+	if _, err := TimelockedEscrowScript(buyerPubKey, sellerPubKey, escrowPubKey, 800000); err == nil {
+		t.Errorf("expected a block height lock time to be refused")
+	}
+
+	_, redeemScript, err := CreateTimelockedMultiSig(buyerPubKey, sellerPubKey, escrowPubKey, lockTime)
+	if err != nil {
+		t.Fatalf("failed to create the escrow script: %v", err)
+	}
+	recoveryAddress, _ := PubKeyHashAddress(buyerPubKey)
+	inputs := []TxInput{
+		{TxID: strings.Repeat("11", 32), Vout: 0, Value: 50000},
+		{TxID: strings.Repeat("22", 32), Vout: 3, Value: 30000},
+	}
+
+	recovery, err := CreateRecoveryTransaction(inputs, redeemScript, lockTime, recoveryAddress, 1500)
+	if err != nil {
+		t.Fatalf("failed to create the recovery transaction: %v", err)
+	}
+	tx := recovery.Tx
+	if tx.LockTime != uint32(lockTime) || recovery.PayoutValue != 78500 || len(recovery.SigHashes) != 2 {
+		t.Fatalf("expected both inputs paying 78500 after %d, got lock time %d, %d and %d sighashes",
+			lockTime, tx.LockTime, recovery.PayoutValue, len(recovery.SigHashes))
+	}
+	for i, in := range tx.TxIn {
+		if in.Sequence == wire.MaxTxInSequenceNum {
+			t.Errorf("expected input %d to enable the lock time", i)
+		}
+	}
+
+	// The buyer's signatures over the sighashes alone satisfy the script, input by input
+	for i := range inputs {
+		if err := runRecoveryInput(t, tx, i, recovery.SigHashes[i], redeemScript, buyer, inputs[i].Value); err != nil {
+			t.Errorf("expected input %d to be spendable by the buyer after the lock time: %v", i, err)
+		}
+	}
+
+	// Swapping the sighashes of the inputs breaks both signatures
+	if err := runRecoveryInput(t, tx, 0, recovery.SigHashes[1], redeemScript, buyer, inputs[0].Value); err == nil {
+		t.Errorf("expected the sighash of another input not to spend input 0")
+	}
+
+	// Before the script's lock time the checklocktimeverify fails
+	early := tx.Copy()
+	early.LockTime = uint32(lockTime - 1)
+	sigHash, _ := txscript.CalcSignatureHash(redeemScript, txscript.SigHashAll, early, 0)
+	if err := runRecoveryInput(t, early, 0, sigHash, redeemScript, buyer, inputs[0].Value); err == nil {
+		t.Errorf("expected a transaction locked before the script's lock time to be refused")
+	}
+
+	// Only the buyer can take the recovery path
+	other, _ := newTestKey(t)
+	if err := runRecoveryInput(t, tx, 0, recovery.SigHashes[0], redeemScript, other, inputs[0].Value); err == nil {
+		t.Errorf("expected another key's signature to be refused")
+	}
+
+	if _, err := CreateRecoveryTransaction(inputs, redeemScript, lockTime, recoveryAddress, 80000); err == nil {
+		t.Errorf("expected a fee above the inputs to be refused")
+	}
+}
@@ -0,0 +1,141 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// Headers sent with each webhook delivery
+const (
+	WebhookIDHeader        = "X-Webhook-Id"
+	WebhookDeliveryHeader  = "X-Webhook-Delivery"
+	WebhookEventHeader     = "X-Webhook-Event"
+	WebhookTimestampHeader = "X-Webhook-Timestamp"
+	WebhookSignatureHeader = "X-Webhook-Signature"
+)
+
+// NewWebhookSecret returns a random secret for signing a webhook's deliveries
+func NewWebhookSecret() (string, error) {
+	var buf [32]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return "", fmt.Errorf("failed to read random bytes: %v", err)
+	}
+	return "whsec_" + base64.RawURLEncoding.EncodeToString(buf[:]), nil
+}
+
+// SignWebhook returns the signature header value of a delivery: the hex HMAC-SHA256,
+// keyed by the webhook's secret, of the Unix timestamp, a period, and the body
+func SignWebhook(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyWebhook checks a delivery's signature and that its timestamp is within tolerance of now,
+// as a receiver should before trusting the body
+func VerifyWebhook(secret, timestamp, signature string, body []byte, tolerance time.Duration, now time.Time) error {
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("malformed webhook timestamp: %q", timestamp)
+	}
+
+	skew := now.Sub(time.Unix(ts, 0))
+	if skew > tolerance || skew < -tolerance {
+		return fmt.Errorf("webhook timestamp is %s away from now", skew)
+	}
+
+	if !hmac.Equal([]byte(SignWebhook(secret, ts, body)), []byte(signature)) {
+		return fmt.Errorf("webhook signature does not match")
+	}
+	return nil
+}
+
+// privateNetworks are the RFC 1918 ranges and IPv6 unique local addresses, not reachable from the internet
+var privateNetworks = func() []*net.IPNet {
+	var networks []*net.IPNet
+	for _, cidr := range []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7"} {
+		_, network, _ := net.ParseCIDR(cidr)
+		networks = append(networks, network)
+	}
+	return networks
+}()
+
+// IsPublicIP reports whether ip may be reached by outgoing webhooks: not loopback, link-local, private,
+// multicast or unspecified. Link-local covers the cloud metadata address 169.254.169.254
+func IsPublicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return false
+	}
+	for _, network := range privateNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// CheckWebhookURL checks that rawURL is an absolute http or https URL whose host resolves only to public
+// addresses, unless allowPrivate is set for local testing
+func CheckWebhookURL(rawURL string, allowPrivate bool) error {
+	parsed, err := url.Parse(rawURL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Hostname() == "" {
+		return errors.New("URL must be an absolute http or https URL")
+	}
+	if allowPrivate {
+		return nil
+	}
+
+	ips := []net.IP{net.ParseIP(parsed.Hostname())}
+	if ips[0] == nil {
+		if ips, err = net.LookupIP(parsed.Hostname()); err != nil {
+			return fmt.Errorf("failed to resolve %s: %v", parsed.Hostname(), err)
+		}
+	}
+	for _, ip := range ips {
+		if !IsPublicIP(ip) {
+			return fmt.Errorf("%s resolves to %s, which is not a public address", parsed.Hostname(), ip)
+		}
+	}
+	return nil
+}
+
+// NewWebhookClient returns an HTTP client for webhook deliveries that refuses to connect to addresses that are
+// not public, unless allowPrivate is set. The check is made on the address dialled, after resolution, so a host
+// re-pointed since registration and redirects cannot reach internal services either
+func NewWebhookClient(allowPrivate bool) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			if allowPrivate {
+				return nil
+			}
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !IsPublicIP(ip) {
+				return fmt.Errorf("refusing to connect to %s, which is not a public address", host)
+			}
+			return nil
+		},
+	}
+
+	// No proxy: it would connect on the client's behalf, past the address check
+	return &http.Client{
+		Timeout:   30 * time.Second,
+		Transport: &http.Transport{DialContext: dialer.DialContext, TLSHandshakeTimeout: 10 * time.Second},
+	}
+}
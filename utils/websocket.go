@@ -0,0 +1,212 @@
+package utils
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The server side of the WebSocket protocol (RFC 6455), enough to push messages to clients
+// Fragmented messages, extensions and subprotocols are not supported
+
+// websocketGUID is appended to the client's key to compute the handshake accept value
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WebSocket frame opcodes
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xA
+)
+
+const (
+	wsMaxPayload   = 64 * 1024 // largest frame accepted from a client
+	wsWriteTimeout = 10 * time.Second
+)
+
+// WebSocketConn is an upgraded WebSocket connection
+// Writes may come from several goroutines, reads from one
+type WebSocketConn struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	writeMu sync.Mutex
+}
+
+// IsWebSocketUpgrade reports whether the request asks to upgrade to a WebSocket
+func IsWebSocketUpgrade(r *http.Request) bool {
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		return false
+	}
+	for _, token := range strings.Split(r.Header.Get("Connection"), ",") {
+		if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+			return true
+		}
+	}
+	return false
+}
+
+// UpgradeWebSocket completes the WebSocket handshake and takes over the connection
+// On error nothing has been written, so the caller can still send an HTTP error response
+func UpgradeWebSocket(w http.ResponseWriter, r *http.Request) (*WebSocketConn, error) {
+	if r.Method != http.MethodGet || !IsWebSocketUpgrade(r) {
+		return nil, errors.New("not a WebSocket upgrade request")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		return nil, errors.New("unsupported WebSocket version, only 13 is supported")
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		return nil, errors.New("missing Sec-WebSocket-Key header")
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, errors.New("connection cannot be upgraded")
+	}
+	conn, buffered, err := hijacker.Hijack()
+	if err != nil {
+		return nil, fmt.Errorf("failed to take over connection: %v", err)
+	}
+
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	handshake := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n\r\n"
+
+	conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	if _, err := conn.Write([]byte(handshake)); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to write handshake: %v", err)
+	}
+
+	return &WebSocketConn{conn: conn, reader: buffered.Reader}, nil
+}
+
+// writeFrame sends a single unmasked frame, as servers do
+func (c *WebSocketConn) writeFrame(opcode byte, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	header := []byte{0x80 | opcode} // FIN set, every message is one frame
+	switch length := len(payload); {
+	case length < 126:
+		header = append(header, byte(length))
+	case length <= 0xFFFF:
+		header = append(header, 126, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(length))
+	default:
+		header = append(header, 127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(header[2:], uint64(length))
+	}
+
+	c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	if _, err := c.conn.Write(append(header, payload...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// WriteText sends a text message
+func (c *WebSocketConn) WriteText(payload []byte) error {
+	return c.writeFrame(wsOpText, payload)
+}
+
+// Ping sends a ping, to keep the connection open through proxies and detect dead clients
+func (c *WebSocketConn) Ping() error {
+	return c.writeFrame(wsOpPing, nil)
+}
+
+// CloseWithReason sends a close frame with a status code and reason, then closes the connection
+func (c *WebSocketConn) CloseWithReason(code uint16, reason string) error {
+	payload := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, code)
+	c.writeFrame(wsOpClose, append(payload, reason...))
+	return c.conn.Close()
+}
+
+// Close closes the connection without a close frame
+func (c *WebSocketConn) Close() error {
+	return c.conn.Close()
+}
+
+// ReadMessage returns the next text or binary message from the client
+// Pings are answered and a close frame is echoed, after which io.EOF is returned
+func (c *WebSocketConn) ReadMessage() (byte, []byte, error) {
+	for {
+		var header [2]byte
+		if _, err := io.ReadFull(c.reader, header[:]); err != nil {
+			return 0, nil, err
+		}
+		opcode := header[0] & 0x0F
+		masked := header[1]&0x80 != 0
+		length := uint64(header[1] & 0x7F)
+
+		switch length {
+		case 126:
+			var extended [2]byte
+			if _, err := io.ReadFull(c.reader, extended[:]); err != nil {
+				return 0, nil, err
+			}
+			length = uint64(binary.BigEndian.Uint16(extended[:]))
+		case 127:
+			var extended [8]byte
+			if _, err := io.ReadFull(c.reader, extended[:]); err != nil {
+				return 0, nil, err
+			}
+			length = binary.BigEndian.Uint64(extended[:])
+		}
+
+		// Clients must mask their frames
+		if !masked {
+			c.CloseWithReason(1002, "frames from the client must be masked")
+			return 0, nil, errors.New("unmasked client frame")
+		}
+		if length > wsMaxPayload {
+			c.CloseWithReason(1009, "message too big")
+			return 0, nil, errors.New("client frame too large")
+		}
+
+		var mask [4]byte
+		if _, err := io.ReadFull(c.reader, mask[:]); err != nil {
+			return 0, nil, err
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(c.reader, payload); err != nil {
+			return 0, nil, err
+		}
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+
+		switch opcode {
+		case wsOpPing:
+			if err := c.writeFrame(wsOpPong, payload); err != nil {
+				return 0, nil, err
+			}
+		case wsOpPong, wsOpContinuation:
+			// Nothing to do, fragments of unsupported fragmented messages are dropped
+		case wsOpClose:
+			c.writeFrame(wsOpClose, payload)
+			c.conn.Close()
+			return 0, nil, io.EOF
+		case wsOpText, wsOpBinary:
+			return opcode, payload, nil
+		default:
+			c.CloseWithReason(1002, "unknown opcode")
+			return 0, nil, fmt.Errorf("unknown opcode %d", opcode)
+		}
+	}
+}